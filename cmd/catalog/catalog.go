@@ -3,17 +3,26 @@ package catalog
 import (
 	"fmt"
 	"os"
-	"io"
 	"io/ioutil"
 	"strconv"
 	"bytes"
 	"strings"
 	"runtime"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
 )
 
+// CommentString returns the header of a catalog. If OutputFormat isn't
+// Text, the header contains the names returned by ColumnNames instead and is
+// only meant to be passed to RowWriter.WriteHeader.
 func CommentString(
 	intNames, floatNames []string, order, sizes []int,
 ) string {
+	if OutputFormat != Text {
+		return schemaPrefix + strings.Join(
+			ColumnNames(intNames, floatNames, order, sizes), "\t",
+		)
+	}
 
 	tokens := []string{"# Column contents:"}
 	for i := range intNames {
@@ -123,9 +132,16 @@ func formatIntCol(col []int) []string {
 }
 
 func formatFloatCol(col []float64) []string {
-	width := len(fmt.Sprintf("%.6g", col[0]))
+	// RowWriter tells int and float columns apart by whether they contain a
+	// decimal point, so it's always included in machine-readable formats.
+	verb := "%.6g"
+	if OutputFormat != Text {
+		verb = "%#.6g"
+	}
+
+	width := len(fmt.Sprintf(verb, col[0]))
 	for i := 1; i < len(col); i++ {
-		n := len(fmt.Sprintf("%.6g", col[i]))
+		n := len(fmt.Sprintf(verb, col[i]))
 		if n > width {
 			width = n
 		}
@@ -133,33 +149,50 @@ func formatFloatCol(col []float64) []string {
 
 	out := []string{}
 	for i := range col {
-		out = append(out, fmt.Sprintf("%*.6g", width, col[i]))
+		out = append(out, fmt.Sprintf("%*s", width, fmt.Sprintf(verb, col[i])))
 	}
 
 	return out
 }
 
-// Parse parses the specified columns in a byte block.
+// Parse parses the specified columns in a byte block. The block can be in
+// any of the formats that catalogs can be written in.
 func Parse(data []byte, icolIdxs, fcolIdxs []int) (
 [][]int, [][]float64, error,
 ) {
+	if bytes.HasPrefix(data, []byte("\x93NUMPY")) {
+		return parseNPY(data, icolIdxs, fcolIdxs)
+	}
+
 	lines, nComm := split(data, '\n', '#')
 	lines = uncomment(lines, '#', nComm)
-	lines = trim(lines, ' ')
+	lines = trim(lines)
+
+	if len(lines) > 0 {
+		first := bytes.TrimSpace(lines[0])
+		switch {
+		case first[0] == '{':
+			return parseJSONL(lines, icolIdxs, fcolIdxs)
+		case bytes.IndexByte(first, ',') != -1:
+			// The first batch of a CSV catalog starts with the column names.
+			fields := bytes.Split(first, []byte(","))
+			if _, err := strconv.ParseFloat(
+				string(bytes.TrimSpace(fields[0])), 64,
+			); err != nil {
+				lines = lines[1:]
+			}
+			return parse(lines, ',', icolIdxs, fcolIdxs)
+		}
+	}
+
 	return parse(lines, ' ', icolIdxs, fcolIdxs)
 }
 
 func ReadFile(fname string, icolIdxs, fcolIdxs []int) (
 	[][]int, [][]float64, error,
 ) {
-	f, err := os.Open(fname)
-	defer f.Close()
-	if err != nil { return nil, nil, err }
-	info, err := f.Stat()
-	if err != nil { return nil, nil, err }
-	
-	data := make([]byte, int(info.Size()))
-	io.ReadAtLeast(f, data, len(data))
+	// Catalogs are often archived in compressed form.
+	data, err := compress.ReadFile(fname)
 	if err != nil { return nil, nil, err }
 
 	icols, fcols, err := Parse(data, icolIdxs, fcolIdxs)
@@ -240,18 +273,15 @@ func uncomment(lines [][]byte, comm byte, nComm int) [][]byte {
 	return lines
 }
 
-// trim removes empty lines.
-func trim(lines [][]byte, sep byte) [][]byte {
+// trim removes the carriage returns left at the end of lines with CRLF line
+// endings and then removes lines which only contain whitespace.
+func trim(lines [][]byte) [][]byte {
 	j := 0
-
-	LineLoop:
-	for i, line := range lines {
-		for _, c := range line {
-			if c != sep {
-				lines[j] = lines[i]
-				j++
-				continue LineLoop
-			}
+	for _, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if len(bytes.TrimSpace(line)) > 0 {
+			lines[j] = line
+			j++
 		}
 	}
 
@@ -270,7 +300,11 @@ func parse(lines [][]byte, sep byte, icolIdxs, fcolIdxs []int) (
 	for i := range fcols { fcols[i] = make([]float64, len(lines)) }
 
 	if len(lines) == 0 { return icols, fcols, nil }
-	buf := make([][]byte, len(bytes.Fields(lines[0])))
+	nFields := len(bytes.Fields(lines[0]))
+	if sep != ' ' {
+		nFields = numFields(lines[0], sep)
+	}
+	buf := make([][]byte, nFields)
 
 	maxCol := -1
 	for _, i := range icolIdxs {
@@ -325,9 +359,8 @@ func parse(lines [][]byte, sep byte, icolIdxs, fcolIdxs []int) (
 	return icols, fcols, nil
 }
 
-// Optimized and buffered analog to the standard library's bytes.FieldsFunc()
-// function.
-func fields(data []byte, sep byte, buf [][]byte) [][]byte {
+// numFields returns the number of fields that fields will split data into.
+func numFields(data []byte, sep byte) int {
 	n := 0
 	inField := false
 	for _, c := range data {
@@ -335,6 +368,13 @@ func fields(data []byte, sep byte, buf [][]byte) [][]byte {
 		inField = sep != c
 		if inField && !wasInField { n++ }
 	}
+	return n
+}
+
+// Optimized and buffered analog to the standard library's bytes.FieldsFunc()
+// function.
+func fields(data []byte, sep byte, buf [][]byte) [][]byte {
+	n := numFields(data, sep)
 
 	na := 0
 	fieldStart := -1
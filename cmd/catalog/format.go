@@ -0,0 +1,453 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Format is the file format that catalogs are written in.
+type Format int
+
+const (
+	// Text is a whitespace-separated table with a comment header.
+	Text Format = iota
+	// CSV is a comma-separated table whose first row contains column names.
+	CSV
+	// JSONL has one JSON object per row, keyed by column names.
+	JSONL
+	// NPY is a NumPy .npy file containing a structured array with one field
+	// per column.
+	NPY
+)
+
+// OutputFormat is the format used by CommentString, FormatCols, and
+// RowWriter. It should be set before any catalogs are written.
+var OutputFormat = Text
+
+// ParseFormat returns the Format with the given name: text, csv, jsonl, or
+// npy.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return Text, nil
+	case "csv":
+		return CSV, nil
+	case "jsonl":
+		return JSONL, nil
+	case "npy":
+		return NPY, nil
+	}
+	return Text, fmt.Errorf("'%s' is not a recognized output format.", name)
+}
+
+// schemaPrefix starts the headers returned by CommentString when OutputFormat
+// isn't Text. These headers aren't written directly; RowWriter uses them to
+// name the columns of the output catalog. Column names are separated by tabs.
+const schemaPrefix = "#schema\t"
+
+// ColumnNames returns the name of every individual column in a catalog. It
+// takes the same arguments as CommentString. Multi-column values are expanded
+// into one name per column: "P_ijk" becomes "P_000", "P_100", ... and "Y_lm"
+// becomes "Y_0_0", "Y_1_-1", "Y_1_0", ..., using the same ordering as the
+// coefficients, and any other name becomes "Name_0", "Name_1", etc., with the
+// units, if any, left at the end. Species suffixes stay at the end of
+// coefficient names, so "P_ijk_dm" becomes "P_000_dm", "P_100_dm", ...
+func ColumnNames(intNames, floatNames []string, order, sizes []int) []string {
+	names := append(append([]string{}, intNames...), floatNames...)
+	out := []string{}
+	for _, idx := range order {
+		if idx >= len(names) {
+			panic("Column ordering out of range.")
+		}
+		out = append(out, expandName(names[idx], sizes[idx])...)
+	}
+	return out
+}
+
+// coeffSuffix returns true if name is the given coefficient name, possibly
+// followed by a species suffix like "_dm", along with that suffix.
+func coeffSuffix(name, coeff string) (string, bool) {
+	if !strings.HasPrefix(name, coeff) {
+		return "", false
+	}
+	suffix := name[len(coeff):]
+	return suffix, suffix == "" || suffix[0] == '_'
+}
+
+// expandName returns the names of the n columns of a single value.
+func expandName(name string, n int) []string {
+	if n == 1 {
+		return []string{name}
+	}
+
+	out := make([]string, n)
+	if suffix, ok := coeffSuffix(name, "P_ijk"); ok {
+		p := int(math.Sqrt(float64(n/2)) + 0.5)
+		for idx := range out {
+			i, j, k := idx%p, (idx/p)%p, idx/(p*p)
+			out[idx] = fmt.Sprintf("P_%d%d%d%s", i, j, k, suffix)
+		}
+		return out
+	} else if suffix, ok := coeffSuffix(name, "Y_lm"); ok {
+		for idx := range out {
+			l := int(math.Sqrt(float64(idx)))
+			out[idx] = fmt.Sprintf("Y_%d_%d%s", l, idx-l*l-l, suffix)
+		}
+		return out
+	}
+
+	base, units := name, ""
+	if start := strings.Index(name, " ["); start != -1 {
+		base, units = name[:start], name[start:]
+	}
+	for i := range out {
+		out[i] = fmt.Sprintf("%s_%d%s", base, i, units)
+	}
+	return out
+}
+
+// schemaNames returns the column names stored in a header created by
+// CommentString. ok is false if the header doesn't contain column names.
+func schemaNames(header string) (names []string, ok bool) {
+	if !strings.HasPrefix(header, schemaPrefix) {
+		return nil, false
+	}
+	return strings.Split(header[len(schemaPrefix):], "\t"), true
+}
+
+// isIntField returns true if a field written by FormatCols came from an
+// integer column. When OutputFormat isn't Text, floats always contain a
+// decimal point or are one of NaN and +/-Inf.
+func isIntField(field string) bool {
+	_, err := strconv.Atoi(field)
+	return err == nil
+}
+
+// formatRow converts a whitespace-separated row into the given format. names
+// is used by JSONL.
+func formatRow(row string, format Format, names []string) (string, error) {
+	fields := strings.Fields(row)
+	switch format {
+	case CSV:
+		return strings.Join(fields, ","), nil
+	case JSONL:
+		if len(fields) != len(names) {
+			return "", fmt.Errorf("Row has %d columns, but the header "+
+				"has %d names.", len(fields), len(names))
+		}
+		tokens := make([]string, len(fields))
+		for i := range fields {
+			key, _ := json.Marshal(names[i])
+			val := fields[i]
+			if x, err := strconv.ParseFloat(val, 64); err != nil ||
+				math.IsNaN(x) || math.IsInf(x, 0) {
+				val = "null"
+			}
+			tokens[i] = fmt.Sprintf("%s:%s", key, val)
+		}
+		return "{" + strings.Join(tokens, ",") + "}", nil
+	}
+	panic("Impossible")
+}
+
+// csvHeader returns the first line of a CSV catalog.
+func csvHeader(names []string) string {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write(names)
+	w.Flush()
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// writeNPY writes rows as a version 1.0 .npy file containing a structured
+// array. Integer columns are stored as little endian int64s and float columns
+// as little endian float64s. If there are no rows, every column is stored as
+// a float64.
+func writeNPY(w io.Writer, names []string, rows []string) error {
+	isInt := make([]bool, len(names))
+	if len(rows) > 0 {
+		fields := strings.Fields(rows[0])
+		if len(fields) != len(names) {
+			return fmt.Errorf("Row has %d columns, but the header has %d "+
+				"names.", len(fields), len(names))
+		}
+		for i := range fields {
+			isInt[i] = isIntField(fields[i])
+		}
+	}
+
+	descr := make([]string, len(names))
+	for i := range names {
+		name := strings.Replace(names[i], `\`, `\\`, -1)
+		name = strings.Replace(name, `'`, `\'`, -1)
+		if isInt[i] {
+			descr[i] = fmt.Sprintf("('%s', '<i8')", name)
+		} else {
+			descr[i] = fmt.Sprintf("('%s', '<f8')", name)
+		}
+	}
+	dict := fmt.Sprintf(
+		"{'descr': [%s], 'fortran_order': False, 'shape': (%d,), }",
+		strings.Join(descr, ", "), len(rows),
+	)
+	// The header is padded with spaces so that the data starts on a multiple
+	// of 64 bytes, then terminated with a newline.
+	pad := 64 - (10+len(dict)+1)%64
+	dict += strings.Repeat(" ", pad%64) + "\n"
+
+	hd := &bytes.Buffer{}
+	hd.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(hd, binary.LittleEndian, uint16(len(dict)))
+	hd.WriteString(dict)
+	if _, err := w.Write(hd.Bytes()); err != nil {
+		return err
+	}
+
+	data := make([]byte, 8*len(names))
+	for i, row := range rows {
+		fields := strings.Fields(row)
+		if len(fields) != len(names) {
+			return fmt.Errorf("Row %d has %d columns, but the header has %d "+
+				"names.", i, len(fields), len(names))
+		}
+		for j := range fields {
+			var bits uint64
+			if isInt[j] {
+				x, err := strconv.ParseInt(fields[j], 10, 64)
+				if err != nil {
+					return err
+				}
+				bits = uint64(x)
+			} else {
+				x, err := strconv.ParseFloat(fields[j], 64)
+				if err != nil {
+					return err
+				}
+				bits = math.Float64bits(x)
+			}
+			binary.LittleEndian.PutUint64(data[8*j:], bits)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	npyDescrField = regexp.MustCompile(
+		`\(\s*'((?:[^'\\]|\\.)*)'\s*,\s*'([<>|=]?)([if])8'\s*\)`,
+	)
+	npyDescrPlain = regexp.MustCompile(`'descr'\s*:\s*'([<>|=]?)([if])8'`)
+	npyShape      = regexp.MustCompile(`'shape'\s*:\s*\(\s*(\d+)\s*,\s*(\d*)`)
+)
+
+// parseNPY parses the specified columns of a .npy file. Both structured
+// arrays with 8-byte int and float fields and two-dimensional 8-byte int and
+// float arrays are supported.
+func parseNPY(data []byte, icolIdxs, fcolIdxs []int) (
+	[][]int, [][]float64, error,
+) {
+	if len(data) < 10 {
+		return nil, nil, fmt.Errorf("The .npy header is truncated.")
+	}
+
+	var hdLen, start int
+	switch data[6] {
+	case 1:
+		hdLen, start = int(binary.LittleEndian.Uint16(data[8:10])), 10
+	case 2, 3:
+		if len(data) < 12 {
+			return nil, nil, fmt.Errorf("The .npy header is truncated.")
+		}
+		hdLen, start = int(binary.LittleEndian.Uint32(data[8:12])), 12
+	default:
+		return nil, nil, fmt.Errorf("Unsupported .npy version %d.", data[6])
+	}
+	if len(data) < start+hdLen {
+		return nil, nil, fmt.Errorf("The .npy header is truncated.")
+	}
+	dict := string(data[start : start+hdLen])
+	body := data[start+hdLen:]
+
+	if strings.Contains(dict, "'fortran_order': True") {
+		return nil, nil, fmt.Errorf("Fortran-ordered .npy files are not " +
+			"supported.")
+	}
+
+	shape := npyShape.FindStringSubmatch(dict)
+	if shape == nil {
+		return nil, nil, fmt.Errorf("Could not find the shape of the " +
+			".npy array.")
+	}
+	n, _ := strconv.Atoi(shape[1])
+
+	var orders []binary.ByteOrder
+	var isInt []bool
+	addType := func(order, kind string) {
+		if order == ">" {
+			orders = append(orders, binary.BigEndian)
+		} else {
+			orders = append(orders, binary.LittleEndian)
+		}
+		isInt = append(isInt, kind == "i")
+	}
+
+	if fields := npyDescrField.FindAllStringSubmatch(dict, -1); fields != nil {
+		for _, f := range fields {
+			addType(f[2], f[3])
+		}
+	} else if plain := npyDescrPlain.FindStringSubmatch(dict); plain != nil {
+		m := 1
+		if shape[2] != "" {
+			m, _ = strconv.Atoi(shape[2])
+		}
+		for i := 0; i < m; i++ {
+			addType(plain[1], plain[2])
+		}
+	} else {
+		return nil, nil, fmt.Errorf("Only .npy files with 8-byte int and " +
+			"float columns are supported.")
+	}
+
+	width := 8 * len(isInt)
+	if len(body) < n*width {
+		return nil, nil, fmt.Errorf("The .npy file contains %d bytes of "+
+			"data, but %d were expected.", len(body), n*width)
+	}
+
+	for _, i := range append(append([]int{}, icolIdxs...), fcolIdxs...) {
+		if i >= len(isInt) {
+			return nil, nil, fmt.Errorf(
+				"Data has %d columns, but column %d was requested.",
+				len(isInt), i,
+			)
+		}
+	}
+
+	value := func(row, col int) uint64 {
+		return orders[col].Uint64(body[row*width+8*col:])
+	}
+
+	icols := make([][]int, len(icolIdxs))
+	fcols := make([][]float64, len(fcolIdxs))
+	for j, col := range icolIdxs {
+		icols[j] = make([]int, n)
+		for i := range icols[j] {
+			if isInt[col] {
+				icols[j][i] = int(int64(value(i, col)))
+			} else {
+				icols[j][i] = int(math.Float64frombits(value(i, col)))
+			}
+		}
+	}
+	for j, col := range fcolIdxs {
+		fcols[j] = make([]float64, n)
+		for i := range fcols[j] {
+			if isInt[col] {
+				fcols[j][i] = float64(int64(value(i, col)))
+			} else {
+				fcols[j][i] = math.Float64frombits(value(i, col))
+			}
+		}
+	}
+
+	return icols, fcols, nil
+}
+
+// parseJSONL parses the specified columns of a JSON Lines catalog. Columns
+// are numbered in the order that keys appear in each object, and null values
+// are read as NaN. Provenance lines are skipped.
+func parseJSONL(lines [][]byte, icolIdxs, fcolIdxs []int) (
+	[][]int, [][]float64, error,
+) {
+	rows := [][]byte{}
+	for _, line := range lines {
+		if _, ok := provenanceBlock(line); !ok {
+			rows = append(rows, line)
+		}
+	}
+	lines = rows
+
+	icols := make([][]int, len(icolIdxs))
+	fcols := make([][]float64, len(fcolIdxs))
+	for i := range icols { icols[i] = make([]int, len(lines)) }
+	for i := range fcols { fcols[i] = make([]float64, len(lines)) }
+
+	for i, line := range lines {
+		words, err := jsonValues(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Line %d: %s", i+1, err.Error())
+		}
+
+		for j, col := range icolIdxs {
+			if col >= len(words) {
+				return nil, nil, fmt.Errorf(
+					"Data on line %d has %d columns, but column %d was "+
+						"requested.", i+1, len(words), col,
+				)
+			}
+			icols[j][i], err = strconv.Atoi(words[col])
+			if err != nil { return nil, nil, err }
+		}
+		for j, col := range fcolIdxs {
+			if col >= len(words) {
+				return nil, nil, fmt.Errorf(
+					"Data on line %d has %d columns, but column %d was "+
+						"requested.", i+1, len(words), col,
+				)
+			}
+			if words[col] == "null" {
+				fcols[j][i] = math.NaN()
+				continue
+			}
+			fcols[j][i], err = strconv.ParseFloat(words[col], 64)
+			if err != nil { return nil, nil, err }
+		}
+	}
+
+	return icols, fcols, nil
+}
+
+// jsonValues returns the values of a flat JSON object in the order they
+// appear, with null values returned as "null".
+func jsonValues(line []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("Expected a JSON object.")
+	}
+
+	values := []string{}
+	for dec.More() {
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch v := tok.(type) {
+		case json.Number:
+			values = append(values, v.String())
+		case nil:
+			values = append(values, "null")
+		default:
+			return nil, fmt.Errorf("Only numeric values are supported.")
+		}
+	}
+
+	return values, nil
+}
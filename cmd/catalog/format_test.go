@@ -0,0 +1,150 @@
+package catalog
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestColumnNames(t *testing.T) {
+	tests := []struct {
+		intNames, floatNames []string
+		order, sizes         []int
+		out                  []string
+	}{
+		{[]string{"ID"}, []string{"R200m [cMpc/h]"}, []int{0, 1}, []int{1, 1},
+			[]string{"ID", "R200m [cMpc/h]"}},
+		{[]string{"ID"}, []string{"R [cMpc/h]"}, []int{1, 0}, []int{1, 3},
+			[]string{"R_0 [cMpc/h]", "R_1 [cMpc/h]", "R_2 [cMpc/h]", "ID"}},
+		{[]string{}, []string{"P_ijk"}, []int{0}, []int{8},
+			[]string{"P_000", "P_100", "P_010", "P_110",
+				"P_001", "P_101", "P_011", "P_111"}},
+		{[]string{}, []string{"Y_lm"}, []int{0}, []int{9},
+			[]string{"Y_0_0", "Y_1_-1", "Y_1_0", "Y_1_1", "Y_2_-2",
+				"Y_2_-1", "Y_2_0", "Y_2_1", "Y_2_2"}},
+		{[]string{}, []string{"Y_lm_gas", "R_sp_gas [cMpc/h]"},
+			[]int{0, 1}, []int{4, 1},
+			[]string{"Y_0_0_gas", "Y_1_-1_gas", "Y_1_0_gas", "Y_1_1_gas",
+				"R_sp_gas [cMpc/h]"}},
+	}
+
+	for i, test := range tests {
+		out := ColumnNames(test.intNames, test.floatNames,
+			test.order, test.sizes)
+		if strings.Join(out, "|") != strings.Join(test.out, "|") {
+			t.Errorf("%d) Expected %q, got %q.", i, test.out, out)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	defer func() { OutputFormat = Text }()
+
+	ids := []int{12, -1, 7}
+	xs := []float64{1.5, 0, 2e14}
+	ps := [][]float64{{0.25, 1, -3}, {0, 0, 0}, {math.NaN(), 4, 5}}
+
+	for _, format := range []Format{Text, CSV, JSONL, NPY} {
+		OutputFormat = format
+
+		buf := &bytes.Buffer{}
+		rw := NewRowWriter(buf)
+		rw.WriteHeader(CommentString(
+			[]string{"ID"}, []string{"X [cMpc/h]", "P_ijk"},
+			[]int{0, 1, 2}, []int{1, 1, 3},
+		))
+		order := []int{0, 1, 2, 3, 4}
+		floatCols := [][]float64{xs, ps[0], ps[1], ps[2]}
+		if err := rw.WriteRows(FormatCols(
+			[][]int{ids[:2]}, [][]float64{
+				xs[:2], ps[0][:2], ps[1][:2], ps[2][:2],
+			}, order,
+		)); err != nil {
+			t.Fatalf("%d) WriteRows returned error: %s", format, err.Error())
+		}
+		if err := rw.WriteRows(FormatCols(
+			[][]int{ids[2:]}, [][]float64{
+				xs[2:], ps[0][2:], ps[1][2:], ps[2][2:],
+			}, order,
+		)); err != nil {
+			t.Fatalf("%d) WriteRows returned error: %s", format, err.Error())
+		}
+		if err := rw.Close(); err != nil {
+			t.Fatalf("%d) Close returned error: %s", format, err.Error())
+		}
+
+		data, err := NewBatchReader(buf).ReadAll()
+		if err != nil {
+			t.Fatalf("%d) ReadAll returned error: %s", format, err.Error())
+		}
+		icols, fcols, err := Parse(data, []int{0}, []int{1, 2, 3, 4})
+		if err != nil {
+			t.Fatalf("%d) Parse returned error: %s", format, err.Error())
+		}
+
+		if len(icols[0]) != len(ids) {
+			t.Fatalf("%d) Expected %d rows, got %d.",
+				format, len(ids), len(icols[0]))
+		}
+		for i := range ids {
+			if icols[0][i] != ids[i] {
+				t.Errorf("%d) Expected ID %d, got %d.",
+					format, ids[i], icols[0][i])
+			}
+			for j := range floatCols {
+				x, y := floatCols[j][i], fcols[j][i]
+				if math.IsNaN(x) != math.IsNaN(y) ||
+					(!math.IsNaN(x) && math.Abs(x-y) > 1e-5*math.Abs(x)) {
+					t.Errorf("%d) Expected column %d, row %d to be %g, "+
+						"got %g.", format, j+1, i, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	defer func() { OutputFormat = Text }()
+	OutputFormat = CSV
+
+	buf := &bytes.Buffer{}
+	rw := NewRowWriter(buf)
+	rw.WriteHeader(CommentString(
+		[]string{"ID", "Snapshot"}, []string{"R200m [cMpc/h]"},
+		[]int{0, 1, 2}, []int{1, 1, 1},
+	))
+	rw.WriteRows(FormatCols(
+		[][]int{{1}, {100}}, [][]float64{{0.5}}, []int{0, 1, 2},
+	))
+	rw.Close()
+
+	expected := "ID,Snapshot,R200m [cMpc/h]\n1,100,0.500000\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q.", expected, buf.String())
+	}
+}
+
+func TestParseWhitespace(t *testing.T) {
+	tests := []struct {
+		data string
+	}{
+		{"  \n\t\n1 0.5\n2 1.5\n"},
+		{"# ID R\r\n1 0.5\r\n \r\n2 1.5\r\n"},
+		{"ID,R\r\n1,0.5\r\n2,1.5\r\n"},
+		{"\r\n{\"ID\": 1, \"R\": 0.5}\r\n{\"ID\": 2, \"R\": 1.5}\r\n"},
+	}
+
+	for i, test := range tests {
+		icols, fcols, err := Parse([]byte(test.data), []int{0}, []int{1})
+		if err != nil {
+			t.Errorf("%d) Parse returned error: %s", i, err.Error())
+			continue
+		}
+		if fmt.Sprint(icols, fcols) != "[[1 2]] [[0.5 1.5]]" {
+			t.Errorf("%d) Expected [[1 2]] [[0.5 1.5]], got %v %v.",
+				i, icols, fcols)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"strings"
+)
+
+// BatchSeparator is the comment line which a RowWriter places between
+// batches of rows. Because it's a comment, it's ignored by Parse and by any
+// other tool that reads Shellfish catalogs.
+const BatchSeparator = "# End of batch."
+
+// ProvenancePrefix starts each line of a catalog's provenance block. Each of
+// these lines is followed by a JSON object describing one of the runs which
+// produced the catalog. In JSONL catalogs, the block is instead made of
+// objects with a single "provenance" key.
+const ProvenancePrefix = "# Provenance: "
+
+// jsonlProvenancePrefix starts each provenance line in a JSONL catalog.
+const jsonlProvenancePrefix = `{"provenance":`
+
+// provenanceBlock returns the JSON object on a provenance line. ok is false if
+// the line isn't part of a provenance block.
+func provenanceBlock(line []byte) (block string, ok bool) {
+	line = bytes.TrimRight(line, "\n")
+	if bytes.HasPrefix(line, []byte(ProvenancePrefix)) {
+		return string(line[len(ProvenancePrefix):]), true
+	} else if bytes.HasPrefix(line, []byte(jsonlProvenancePrefix)) &&
+		bytes.HasSuffix(line, []byte("}")) {
+		return string(line[len(jsonlProvenancePrefix) : len(line)-1]), true
+	}
+	return "", false
+}
+
+// UpstreamError is returned by a BatchReader when the input stream contains
+// an error message written by an earlier Shellfish tool in a pipeline.
+type UpstreamError struct {
+	Line string
+}
+
+func (err *UpstreamError) Error() string { return err.Line }
+
+// BatchReader reads a catalog stream one batch at a time. A batch is
+// everything written by a single call to RowWriter.WriteRows, so a mode
+// reading from a BatchReader can start working on the first batch while the
+// tool that's writing the stream works on later batches. Streams which weren't
+// written by a RowWriter (e.g. files) are read as a single batch.
+//
+// Provenance blocks are removed from the stream as it's read and can be
+// retrieved with Provenance.
+type BatchReader struct {
+	r          *bufio.Reader
+	done       bool
+	hash       hash.Hash64
+	provenance []string
+}
+
+// NewBatchReader creates a BatchReader which reads from r.
+func NewBatchReader(r io.Reader) *BatchReader {
+	return &BatchReader{r: bufio.NewReader(r), hash: fnv.New64a()}
+}
+
+// Hash returns a hash of every batch which has been read so far.
+func (br *BatchReader) Hash() string {
+	return fmt.Sprintf("fnv64a:%016x", br.hash.Sum64())
+}
+
+// Provenance returns the provenance blocks which have been read so far.
+func (br *BatchReader) Provenance() []string {
+	return br.provenance
+}
+
+// Next returns the contents of the next batch. Its output can be passed
+// directly to Parse. io.EOF is returned once the stream has been exhausted.
+func (br *BatchReader) Next() ([]byte, error) {
+	if br.done {
+		return nil, io.EOF
+	}
+
+	data := []byte{}
+	for {
+		line, err := br.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if bytes.HasPrefix(line, []byte("Shellfish")) {
+			return nil, &UpstreamError{string(bytes.TrimRight(line, "\n"))}
+		} else if string(bytes.TrimRight(line, "\n")) == BatchSeparator {
+			br.hash.Write(data)
+			return data, nil
+		} else if block, ok := provenanceBlock(line); ok {
+			br.provenance = append(br.provenance, block)
+			line = nil
+		}
+		data = append(data, line...)
+
+		if err == io.EOF {
+			br.done = true
+			if len(data) == 0 {
+				return nil, io.EOF
+			}
+			br.hash.Write(data)
+			return data, nil
+		}
+	}
+}
+
+// ReadAll returns the contents of every remaining batch.
+func (br *BatchReader) ReadAll() ([]byte, error) {
+	data := []byte{}
+	for {
+		batch, err := br.Next()
+		if err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return nil, err
+		}
+		data = append(data, batch...)
+	}
+}
+
+// RowWriter writes the output catalog of a mode. Rows are written in batches,
+// and each batch is flushed as soon as it is written so that the next tool in
+// a pipeline can start working on it.
+//
+// Rows are converted to OutputFormat as they're written. JSONL catalogs don't
+// contain batch separators, so the next tool will read them as a single batch,
+// and NPY catalogs are only written once Close is called, since the number of
+// rows needs to be known before anything can be written.
+type RowWriter struct {
+	w           *bufio.Writer
+	format      Format
+	header      string
+	wroteHeader bool
+	batches     int
+	npyRows     []string
+	provenance  []string
+}
+
+// NewRowWriter creates a RowWriter which writes to w in the current
+// OutputFormat.
+func NewRowWriter(w io.Writer) *RowWriter {
+	return &RowWriter{w: bufio.NewWriter(w), format: OutputFormat}
+}
+
+// WriteHeader sets the comment line written at the top of the catalog (e.g.
+// the output of CommentString). It is written along with the first batch of
+// rows, and only the first call to WriteHeader has any effect.
+func (rw *RowWriter) WriteHeader(header string) {
+	if rw.header == "" && !rw.wroteHeader {
+		rw.header = header
+	}
+}
+
+// AddProvenance adds blocks to the provenance block which is written at the
+// end of the catalog by Close. Blocks which have already been added are
+// ignored.
+func (rw *RowWriter) AddProvenance(blocks ...string) {
+BlockLoop:
+	for _, block := range blocks {
+		for _, prev := range rw.provenance {
+			if prev == block {
+				continue BlockLoop
+			}
+		}
+		rw.provenance = append(rw.provenance, block)
+	}
+}
+
+// writeProvenance writes the provenance block.
+func (rw *RowWriter) writeProvenance() error {
+	for _, block := range rw.provenance {
+		var err error
+		if rw.format == JSONL {
+			_, err = fmt.Fprintf(rw.w, "%s%s}\n", jsonlProvenancePrefix, block)
+		} else {
+			_, err = fmt.Fprintf(rw.w, "%s%s\n", ProvenancePrefix, block)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnNames returns the names of the n columns in the catalog. If the header
+// doesn't contain names, the columns are named by their indices.
+func (rw *RowWriter) columnNames(n int) []string {
+	if names, ok := schemaNames(rw.header); ok && len(names) == n {
+		return names
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("col_%d", i)
+	}
+	return names
+}
+
+// writeFirstHeader writes the header in the format of the catalog. n is the
+// number of columns.
+func (rw *RowWriter) writeFirstHeader(n int) error {
+	rw.wroteHeader = true
+	switch rw.format {
+	case Text:
+		if rw.header == "" {
+			return nil
+		}
+		_, err := fmt.Fprintln(rw.w, rw.header)
+		return err
+	case CSV:
+		if _, ok := schemaNames(rw.header); !ok && n == 0 {
+			return nil
+		}
+		_, err := fmt.Fprintln(rw.w, csvHeader(rw.columnNames(n)))
+		return err
+	}
+	return nil
+}
+
+// WriteRows writes a batch of rows. Empty batches are ignored.
+func (rw *RowWriter) WriteRows(rows []string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if rw.format == NPY {
+		rw.npyRows = append(rw.npyRows, rows...)
+		return nil
+	}
+
+	n := len(strings.Fields(rows[0]))
+	if !rw.wroteHeader {
+		if err := rw.writeFirstHeader(n); err != nil {
+			return err
+		}
+	}
+
+	if rw.batches > 0 && rw.format != JSONL {
+		if _, err := fmt.Fprintln(rw.w, BatchSeparator); err != nil {
+			return err
+		}
+	}
+
+	names := rw.columnNames(n)
+	for _, row := range rows {
+		if rw.format != Text {
+			var err error
+			if row, err = formatRow(row, rw.format, names); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(rw.w, row); err != nil {
+			return err
+		}
+	}
+
+	rw.batches++
+	return rw.w.Flush()
+}
+
+// Close writes the provenance block and flushes any buffered output. If no
+// rows were written, the header is written by itself.
+func (rw *RowWriter) Close() error {
+	if rw.format == NPY {
+		n := 0
+		if len(rw.npyRows) > 0 {
+			n = len(strings.Fields(rw.npyRows[0]))
+		} else if names, ok := schemaNames(rw.header); ok {
+			n = len(names)
+		}
+		err := writeNPY(rw.w, rw.columnNames(n), rw.npyRows)
+		if err != nil {
+			return err
+		}
+		rw.npyRows = nil
+
+		// NumPy ignores anything after the end of the array, so the
+		// provenance block can follow it as long as it starts on a new line.
+		if len(rw.provenance) > 0 {
+			if _, err := fmt.Fprintln(rw.w); err != nil {
+				return err
+			}
+		}
+	} else if !rw.wroteHeader {
+		n := 0
+		if names, ok := schemaNames(rw.header); ok {
+			n = len(names)
+		}
+		if err := rw.writeFirstHeader(n); err != nil {
+			return err
+		}
+	}
+
+	if err := rw.writeProvenance(); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
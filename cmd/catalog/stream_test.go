@@ -0,0 +1,111 @@
+package catalog
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		batches [][]string
+	}{
+		{[][]string{{"1 2"}}},
+		{[][]string{{"1 2", "3 4"}, {"5 6"}}},
+		{[][]string{{"1 2"}, {}, {"3 4"}, {"5 6", "7 8"}}},
+	}
+
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		rw := NewRowWriter(buf)
+		rw.WriteHeader("# Column contents: A(0) B(1)")
+		expected := []string{}
+		for _, batch := range test.batches {
+			if err := rw.WriteRows(batch); err != nil {
+				t.Fatalf("%d) WriteRows returned error: %s", i, err.Error())
+			}
+			if len(batch) > 0 {
+				expected = append(expected, strings.Join(batch, "\n")+"\n")
+			}
+		}
+		if err := rw.Close(); err != nil {
+			t.Fatalf("%d) Close returned error: %s", i, err.Error())
+		}
+
+		br := NewBatchReader(buf)
+		for j := range expected {
+			data, err := br.Next()
+			if err != nil {
+				t.Fatalf("%d) Next returned error: %s", i, err.Error())
+			}
+			if j == 0 {
+				expected[j] = "# Column contents: A(0) B(1)\n" + expected[j]
+			}
+			if string(data) != expected[j] {
+				t.Errorf("%d) Expected batch %d to be %q, got %q.",
+					i, j, expected[j], string(data))
+			}
+		}
+		if _, err := br.Next(); err != io.EOF {
+			t.Errorf("%d) Expected io.EOF after %d batches.", i, len(expected))
+		}
+	}
+}
+
+func TestBatchReaderUpstreamError(t *testing.T) {
+	br := NewBatchReader(strings.NewReader("1 2\nShellfish terminating.\n"))
+	_, err := br.Next()
+	if upErr, ok := err.(*UpstreamError); !ok {
+		t.Errorf("Expected an UpstreamError, got %v.", err)
+	} else if upErr.Line != "Shellfish terminating." {
+		t.Errorf("Expected line 'Shellfish terminating.', got '%s'.",
+			upErr.Line)
+	}
+}
+
+func TestProvenanceRoundTrip(t *testing.T) {
+	defer func() { OutputFormat = Text }()
+
+	blocks := []string{`{"mode":"id"}`, `{"mode":"coord"}`}
+	for _, format := range []Format{Text, CSV, JSONL, NPY} {
+		OutputFormat = format
+
+		buf := &bytes.Buffer{}
+		rw := NewRowWriter(buf)
+		rw.WriteHeader(CommentString(
+			[]string{"ID"}, []string{"X"}, []int{0, 1}, []int{1, 1},
+		))
+		rw.WriteRows(FormatCols(
+			[][]int{{1, 2}}, [][]float64{{0.5, 1.5}}, []int{0, 1},
+		))
+		rw.AddProvenance(blocks[0])
+		rw.AddProvenance(blocks...)
+		if err := rw.Close(); err != nil {
+			t.Fatalf("%d) Close returned error: %s", format, err.Error())
+		}
+
+		raw := append([]byte{}, buf.Bytes()...)
+		br := NewBatchReader(buf)
+		data, err := br.ReadAll()
+		if err != nil {
+			t.Fatalf("%d) ReadAll returned error: %s", format, err.Error())
+		}
+
+		prov := br.Provenance()
+		if strings.Join(prov, "|") != strings.Join(blocks, "|") {
+			t.Errorf("%d) Expected provenance %q, got %q.", format, blocks, prov)
+		}
+
+		for _, in := range [][]byte{data, raw} {
+			icols, fcols, err := Parse(in, []int{0}, []int{1})
+			if err != nil {
+				t.Fatalf("%d) Parse returned error: %s", format, err.Error())
+			}
+			if len(icols[0]) != 2 || icols[0][1] != 2 || fcols[0][1] != 1.5 {
+				t.Errorf("%d) Expected IDs [1 2] and Xs [0.5 1.5], got %v "+
+					"and %v.", format, icols[0], fcols[0])
+			}
+		}
+	}
+}
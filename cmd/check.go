@@ -7,7 +7,9 @@ import (
 
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/parse"
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
 	"github.com/phil-mansfield/shellfish/los/geom"
 )
@@ -19,6 +21,8 @@ type CheckConfig struct {
 	particleMasses []float64
 	particleCount int64
 	exampleHalo []float64
+
+	configRecord
 }
 
 var _ Mode = &CheckConfig{}
@@ -60,6 +64,7 @@ func (config *CheckConfig) ExampleConfig() string {
 func (config *CheckConfig) ReadConfig(fname string, flags []string) error {
 
 	vars := parse.NewConfigVars("check.config")
+	defer config.record(vars)
 
 	vars.Float(&config.h0, "H0", -1)
 	vars.Float(&config.omegaM, "OmegaM", -1)
@@ -88,6 +93,15 @@ func (config *CheckConfig) ReadConfig(fname string, flags []string) error {
 }
 
 func (config *CheckConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	_, err := config.run(gConfig, e, nil)
+	return err
+}
+
+// run executes the mode. check doesn't read any input or write any rows.
+func (config *CheckConfig) run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 
@@ -107,6 +121,8 @@ func (config *CheckConfig) Run(
 	if err != nil { return nil, err }
 	failedTests, err = haloChecks(hd, buf, config, failedTests, e)
 	if err != nil { return nil, err }
+	failedTests, err = haloScaleFactorChecks(gConfig, buf, failedTests, e)
+	if err != nil { return nil, err }
 
 	if len(failedTests) > 0 {
 		if len(failedTests) == 1 {
@@ -281,6 +297,73 @@ func haloChecks(
 	return failedTests, nil
 }
 
+// scaleFactorTolerance is the largest relative difference between the scale
+// factors of a halo catalog and its snapshot that haloScaleFactorChecks
+// allows. AHF only writes redshifts to three decimal places.
+const scaleFactorTolerance = 1e-3
+
+// haloScaleFactorChecks checks that every file of every halo catalog has the
+// same scale factor as the particle headers of its snapshot. Closely spaced
+// snapshots can be closer together than scaleFactorTolerance, so catalogs
+// which are closer to a neighbouring snapshot also fail. Catalogs which don't
+// store their scale factors are skipped.
+func haloScaleFactorChecks(
+	gConfig *GlobalConfig, buf io.VectorBuffer, failedTests []string,
+	e *env.Environment,
+) ([]string, error) {
+	if gConfig.HaloType == "nil" { return failedTests, nil }
+
+	scales := map[int]float64{}
+	scaleFactor := func(snap int) (float64, error) {
+		if a, ok := scales[snap]; ok { return a, nil }
+		hds, _, err := memo.ReadHeaders(snap, buf, e)
+		if err != nil { return 0, err }
+		scales[snap] = 1 / (1 + hds[0].Cosmo.Z)
+		return scales[snap], nil
+	}
+
+	for snap := int(gConfig.HSnapMin); snap <= int(gConfig.HSnapMax); snap++ {
+		for _, fname := range e.HaloCatalog(snap) {
+			haloHd, err := halo.ReadHeader(gConfig.HaloType, fname)
+			if err != nil { return nil, err }
+			aHalo := haloHd.ScaleFactor
+			if aHalo < 0 { continue }
+
+			a, err := scaleFactor(snap)
+			if err != nil { return nil, err }
+			if math.Abs(aHalo/a - 1) > scaleFactorTolerance {
+				msg := fmt.Sprintf(
+					"The halo catalog %s has a scale factor of %g, but " +
+					"the particles in snapshot %d have a scale factor of %g.",
+					fname, aHalo, snap, a,
+				)
+				failedTests = append(failedTests, msg)
+				continue
+			}
+
+			for _, next := range []int{snap - 1, snap + 1} {
+				if next < int(gConfig.SnapMin) || next > int(gConfig.SnapMax) {
+					continue
+				}
+				aNext, err := scaleFactor(next)
+				if err != nil { return nil, err }
+				if math.Abs(aHalo - aNext) < math.Abs(aHalo - a) {
+					msg := fmt.Sprintf(
+						"The halo catalog %s has a scale factor of %g, " +
+						"which is closer to the scale factor of snapshot %d, " +
+						"%g, than to the scale factor of snapshot %d, %g.",
+						fname, aHalo, next, aNext, snap, a,
+					)
+					failedTests = append(failedTests, msg)
+					break
+				}
+			}
+		}
+	}
+
+	return failedTests, nil
+}
+
 func addMass(
 	s geom.Sphere, hd *io.Header, xs [][3]float32, ms []float32,
 ) float64 {
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cmd/env"
+)
+
+func TestHaloScaleFactorChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_check")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	memoDir, haloDir := path.Join(dir, "memo"), path.Join(dir, "halos")
+	for _, d := range []string{memoDir, haloDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// The snapshots are closer together than the tolerance.
+	config := strings.Replace(syntheticTestConfig,
+		"SnapMax = 0", "SnapMax = 2", 1)
+	config = strings.Replace(config, "SyntheticScaleFactors = 1.0",
+		"SyntheticScaleFactors = 0.9, 0.9005, 0.901", 1)
+	config = strings.Replace(config, "SyntheticParticles = 262144",
+		"SyntheticParticles = 4096", 1)
+	fname := path.Join(dir, "check.config")
+	err = ioutil.WriteFile(
+		fname, []byte(fmt.Sprintf(config, memoDir, "")), 0644,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	gConfig := &GlobalConfig{}
+	if err := gConfig.ReadConfig(fname, nil); err != nil {
+		t.Fatalf("Could not read the config file: %s", err.Error())
+	}
+	e := &env.Environment{MemoDir: memoDir}
+	err = e.InitSynthetic(
+		&gConfig.ParticleInfo, gConfig.SyntheticBlocks, false,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf, err := getVectorBuffer(e.ParticleCatalog(0, 0), gConfig)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		scales string
+		fails  int
+	}{
+		{"0.9 0.9005 0.901", 0},
+		{"0.9 0.9 0.901", 1},
+		{"0.9 0.901 0.901", 1},
+		{"0.9 0.9005 0.99", 1},
+	}
+
+	for i, test := range tests {
+		for snap, a := range strings.Fields(test.scales) {
+			err := ioutil.WriteFile(
+				path.Join(haloDir, fmt.Sprintf("out_%d.list", snap)),
+				[]byte("#ID X Y Z M200b\n#a = "+a+"\n"), 0644,
+			)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		gConfig.HaloType, gConfig.HaloDir = "Text", haloDir
+		gConfig.HSnapMin, gConfig.HSnapMax = 0, 2
+		if err := e.InitTextHalo(&gConfig.HaloInfo); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		failed, err := haloScaleFactorChecks(gConfig, buf, nil, e)
+		if err != nil {
+			t.Fatalf("%d) haloScaleFactorChecks returned error: %s",
+				i, err.Error())
+		}
+		if len(failed) != test.fails {
+			t.Errorf("%d) Expected %d failed checks for scale factors %s, "+
+				"got %q.", i, test.fails, test.scales, failed)
+		}
+	}
+}
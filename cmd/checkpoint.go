@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+// checkpointMagic is the first value in every checkpoint file. It's used to
+// avoid clobbering files which aren't checkpoints.
+const checkpointMagic = uint64(0x5346434b50543031) // "SFCKPT01"
+
+// checkpoint records the results of halos which have already been analyzed so
+// that a run which is killed partway through can be restarted without
+// repeating work.
+//
+// The file starts with a header of two uint64s: checkpointMagic and a hash of
+// the mode's configuration. This is followed by one record per finished halo:
+//
+// |- Input -||- Idx -||- NFloat -||- NInt -||- ...Floats... -||- ...Ints... -|
+//
+// where Input is a uint64 hash of the input batch that the halo came from,
+// Idx, NFloat, and NInt are int64s, Floats is an []float64 of length NFloat,
+// and Ints is an []int64 of length NInt. Idx is the halo's line in the input
+// batch. Records are always little endian.
+//
+// A nil *checkpoint is valid and corresponds to a run without checkpointing.
+type checkpoint struct {
+	fname  string
+	input  uint64
+	floats map[checkpointKey][]float64
+	ints   map[checkpointKey][]int64
+}
+
+// checkpointKey identifies a halo within a run.
+type checkpointKey struct {
+	input uint64
+	idx   int
+}
+
+// checkpointRecordHeader is the fixed-size part of each checkpoint record.
+type checkpointRecordHeader struct {
+	Input             uint64
+	Idx, NFloat, NInt int64
+}
+
+// openCheckpoint opens the checkpoint file fname, creating it if it doesn't
+// exist. config is the mode's config struct. If the file was created with a
+// different config, or with different global variables that change the
+// results of a halo (Seed, Species, and SpeciesTypes), an error is returned.
+// If fname is "", a nil checkpoint is returned.
+func openCheckpoint(
+	fname string, config interface{}, gConfig *GlobalConfig,
+) (*checkpoint, error) {
+	if fname == "" {
+		return nil, nil
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("%+v %d %q %q", config, gConfig.Seed,
+		gConfig.Species, gConfig.SpeciesTypes)))
+	hash := h.Sum64()
+
+	cp := &checkpoint{
+		fname:  fname,
+		floats: make(map[checkpointKey][]float64),
+		ints:   make(map[checkpointKey][]int64),
+	}
+
+	if _, err := os.Stat(fname); err != nil {
+		f, err := os.Create(fname)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		err = binary.Write(f, binary.LittleEndian, []uint64{
+			checkpointMagic, hash,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cp, f.Sync()
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	hd := make([]uint64, 2)
+	if err = binary.Read(f, binary.LittleEndian, hd); err != nil ||
+		hd[0] != checkpointMagic {
+		return nil, fmt.Errorf("The file '%s' is not a checkpoint file.",
+			fname)
+	} else if hd[1] != hash {
+		return nil, fmt.Errorf("The checkpoint file '%s' was created with "+
+			"a different config file. Delete it to start a new run.", fname)
+	}
+
+	// The last record may have been partially written if the previous run
+	// was killed. Anything after the last complete record is discarded.
+	end := int64(16)
+	for {
+		rhd := checkpointRecordHeader{}
+		if err := binary.Read(f, binary.LittleEndian, &rhd); err != nil {
+			break
+		}
+		if rhd.Idx < 0 || rhd.NFloat < 0 || rhd.NInt < 0 {
+			return nil, fmt.Errorf("The checkpoint file '%s' is corrupted: "+
+				"the record at byte %d has Idx = %d, NFloat = %d, and "+
+				"NInt = %d. Delete it to start a new run.", fname, end,
+				rhd.Idx, rhd.NFloat, rhd.NInt)
+		}
+		// Counts which are larger than the rest of the file can't be
+		// allocated, and are treated like any other partial record.
+		left := (info.Size() - end - 32) / 8
+		if rhd.NFloat > left || rhd.NInt > left-rhd.NFloat {
+			break
+		}
+		floats := make([]float64, rhd.NFloat)
+		ints := make([]int64, rhd.NInt)
+		if err := binary.Read(f, binary.LittleEndian, floats); err != nil {
+			break
+		}
+		if err := binary.Read(f, binary.LittleEndian, ints); err != nil {
+			break
+		}
+
+		key := checkpointKey{rhd.Input, int(rhd.Idx)}
+		cp.floats[key] = floats
+		cp.ints[key] = ints
+		end += 32 + 8*(rhd.NFloat+rhd.NInt)
+	}
+
+	if err = os.Truncate(fname, end); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// SetInput sets the input batch which the indices passed to the other methods
+// refer to. Halos from a different input are never considered finished.
+func (cp *checkpoint) SetInput(input []byte) {
+	if cp == nil {
+		return
+	}
+	h := fnv.New64a()
+	h.Write(input)
+	cp.input = h.Sum64()
+}
+
+// Done returns true if the halo at the given index has been analyzed.
+func (cp *checkpoint) Done(idx int) bool {
+	if cp == nil {
+		return false
+	}
+	_, ok := cp.floats[checkpointKey{cp.input, idx}]
+	return ok
+}
+
+// AllDone returns true if every halo in idxs has been analyzed.
+func (cp *checkpoint) AllDone(idxs []int) bool {
+	for _, idx := range idxs {
+		if !cp.Done(idx) {
+			return false
+		}
+	}
+	return true
+}
+
+// Record returns the values which were saved for the halo at the given index.
+func (cp *checkpoint) Record(idx int) (floats []float64, ints []int64) {
+	key := checkpointKey{cp.input, idx}
+	return cp.floats[key], cp.ints[key]
+}
+
+// Append adds the results of the halos at the given indices to the end of the
+// checkpoint file. ints may be nil if there are no integer results. The data
+// is synced to disk before Append returns.
+func (cp *checkpoint) Append(
+	idxs []int, floats [][]float64, ints [][]int64,
+) error {
+	if cp == nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(cp.fname, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i, idx := range idxs {
+		var iRow []int64
+		if ints != nil {
+			iRow = ints[i]
+		}
+		rhd := checkpointRecordHeader{
+			cp.input, int64(idx), int64(len(floats[i])), int64(len(iRow)),
+		}
+		if err = binary.Write(f, binary.LittleEndian, &rhd); err != nil {
+			return err
+		}
+		if err = binary.Write(f, binary.LittleEndian, floats[i]); err != nil {
+			return err
+		}
+		if err = binary.Write(f, binary.LittleEndian, iRow); err != nil {
+			return err
+		}
+
+		key := checkpointKey{cp.input, idx}
+		cp.floats[key] = floats[i]
+		cp.ints[key] = iRow
+	}
+
+	return f.Sync()
+}
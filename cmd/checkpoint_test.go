@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type checkpointTestConfig struct {
+	values []string
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_checkpoint")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "stats.checkpoint")
+
+	config := &checkpointTestConfig{[]string{"r_sp", "m_sp"}}
+	gConfig := &GlobalConfig{Seed: 7}
+
+	cp, err := openCheckpoint(fname, config, gConfig)
+	if err != nil {
+		t.Fatalf("openCheckpoint returned error: %s", err.Error())
+	}
+	cp.SetInput([]byte("batch 0"))
+	err = cp.Append([]int{0, 2}, [][]float64{{1, 2}, {3, 4}},
+		[][]int64{{5}, {6}})
+	if err != nil {
+		t.Fatalf("Append returned error: %s", err.Error())
+	}
+
+	// Resuming should find the finished halos of the same input.
+	cp, err = openCheckpoint(fname, config, gConfig)
+	if err != nil {
+		t.Fatalf("openCheckpoint returned error on resume: %s", err.Error())
+	}
+	cp.SetInput([]byte("batch 0"))
+	if !cp.AllDone([]int{0, 2}) || cp.Done(1) {
+		t.Errorf("Expected halos 0 and 2 to be done, but not halo 1.")
+	}
+	floats, ints := cp.Record(2)
+	if fmt.Sprint(floats, ints) != "[3 4] [6]" {
+		t.Errorf("Expected record [3 4] [6], got %v %v.", floats, ints)
+	}
+	cp.SetInput([]byte("batch 1"))
+	if cp.Done(0) {
+		t.Errorf("Halos from a different input shouldn't be done.")
+	}
+
+	// Changing either config should prevent resuming.
+	otherConfig := &checkpointTestConfig{[]string{"r_sp"}}
+	if _, err := openCheckpoint(fname, otherConfig, gConfig); err == nil {
+		t.Errorf("Expected error for a different mode config.")
+	}
+	for i, g := range []*GlobalConfig{
+		{Seed: 8}, {Seed: 7, Species: []string{"dm"}},
+		{Seed: 7, SpeciesTypes: []string{"1"}},
+	} {
+		if _, err := openCheckpoint(fname, config, g); err == nil {
+			t.Errorf("%d) Expected error for a different GlobalConfig.", i)
+		}
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_checkpoint")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "stats.checkpoint")
+
+	config, gConfig := &checkpointTestConfig{}, &GlobalConfig{}
+	cp, err := openCheckpoint(fname, config, gConfig)
+	if err != nil {
+		t.Fatalf("openCheckpoint returned error: %s", err.Error())
+	}
+	cp.SetInput([]byte("batch"))
+	if err = cp.Append([]int{0}, [][]float64{{1}}, nil); err != nil {
+		t.Fatalf("Append returned error: %s", err.Error())
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	good := info.Size()
+
+	appendRecord := func(rhd checkpointRecordHeader, body []float64) {
+		f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		binary.Write(f, binary.LittleEndian, &rhd)
+		binary.Write(f, binary.LittleEndian, body)
+		f.Close()
+	}
+
+	// Partial records and records with counts larger than the file are
+	// discarded.
+	partials := []struct {
+		rhd  checkpointRecordHeader
+		body []float64
+	}{
+		{checkpointRecordHeader{Idx: 1, NFloat: 3}, []float64{1}},
+		{checkpointRecordHeader{Idx: 1, NFloat: 1 << 60}, nil},
+		{checkpointRecordHeader{Idx: 1, NFloat: 1, NInt: 1 << 62}, nil},
+	}
+	for i, partial := range partials {
+		appendRecord(partial.rhd, partial.body)
+		cp, err := openCheckpoint(fname, config, gConfig)
+		if err != nil {
+			t.Fatalf("%d) openCheckpoint returned error: %s", i, err.Error())
+		}
+		cp.SetInput([]byte("batch"))
+		if !cp.Done(0) || cp.Done(1) {
+			t.Errorf("%d) Expected only halo 0 to be done.", i)
+		}
+		if info, _ := os.Stat(fname); info.Size() != good {
+			t.Errorf("%d) Expected the file to be truncated to %d bytes, "+
+				"but it has %d.", i, good, info.Size())
+		}
+	}
+
+	// Negative counts mean the file is corrupted.
+	appendRecord(checkpointRecordHeader{Idx: 1, NFloat: -1}, nil)
+	if _, err := openCheckpoint(fname, config, gConfig); err == nil {
+		t.Errorf("Expected error for a record with a negative count.")
+	}
+
+	// Files which aren't checkpoints aren't overwritten.
+	other := path.Join(dir, "other.txt")
+	err = ioutil.WriteFile(other, []byte("hello, world!!!!!"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := openCheckpoint(other, config, gConfig); err == nil {
+		t.Errorf("Expected error for a file which isn't a checkpoint.")
+	}
+}
@@ -9,7 +9,11 @@ import (
 	"strings"
 	"time"
 	
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/parse"
 	"github.com/phil-mansfield/shellfish/version"
 )
@@ -24,6 +28,8 @@ var ModeNames map[string]Mode = map[string]Mode{
 	"phase": &PhaseConfig{},
 	"check": &CheckConfig{},
 	"potential": &PotentialConfig{},
+	"pipeline": &PipelineConfig{},
+	"cutout": &CutoutConfig{},
 }
 
 // Mode represents the interface used by the main binary when interacting with
@@ -34,11 +40,28 @@ type Mode interface {
 	ReadConfig(fname string, flags []string) error
 	// ExampleConfig returns the text of an example config file of this mode.
 	ExampleConfig() string
-	// Run executes the mode. It takes
-	// an initialized GlobalConfig struct, and a slice of lines representing the
-	// contents of stdin. It will return a slice of lines that should be
-	// written to stdout along with an error if one occurs.
-	Run(gConfig *GlobalConfig, e *env.Environment, stdin []byte) ([]string, error)
+	// Run executes the mode. It takes an initialized GlobalConfig struct, a
+	// BatchReader wrapping stdin, and a RowWriter wrapping stdout. Rows are
+	// written to out as soon as they're finished, so the next mode in a
+	// pipeline can start working on them while this one keeps going.
+	Run(
+		gConfig *GlobalConfig, e *env.Environment,
+		in *catalog.BatchReader, out *catalog.RowWriter,
+	) error
+}
+
+// CheckGlobalConfig checks the parts of a mode's config file which depend on
+// the global config file. It should be called after both have been read.
+func CheckGlobalConfig(mode Mode, gConfig *GlobalConfig) error {
+	switch config := mode.(type) {
+	case *IDConfig:
+		return config.validateGlobal(gConfig)
+	case *PipelineConfig:
+		if config.hasStage("id") {
+			return config.id.validateGlobal(gConfig)
+		}
+	}
+	return nil
 }
 
 // GlobalConfig is a config file used by every mode. It contains information on
@@ -58,6 +81,7 @@ type GlobalConfig struct {
 	HaloValueNames    []string
 	HaloValueColumns  []int64
 	HaloValueComments []string
+	HaloValueAliases  []string
 
 	HaloPositionUnits string
 	HaloRadiusUnits   string
@@ -66,8 +90,17 @@ type GlobalConfig struct {
 	Endianness        string
 	ValidateFormats   bool
 	Threads           int64
+	Seed              int64
+	ChunkSize         int64
+	PrefetchBlocks    int64
 
 	Logging           string
+	OutputFormat      string
+
+	Species      []string
+	SpeciesTypes []string
+	// species is set from Species and SpeciesTypes by validate.
+	species []species
 
 	GadgetDMTypeIndices []int64
 	GadgetSingleMassIndices []int64
@@ -81,6 +114,53 @@ type GlobalConfig struct {
 	NilSnapH100 float64
 	NilSnapScaleFactors []float64
 	NilSnapTotalWidth float64
+
+	RawHeaderSize int64
+	RawRecordMarkers int64
+	RawHeaderNames []string
+	RawHeaderOffsets []int64
+	RawHeaderTypes []string
+	RawHeaderValues []float64
+	RawArrayNames []string
+	RawArrayOffsets []int64
+	RawArrayTypes []string
+	RawArrayStrides []int64
+	RawPositionUnits float64
+	RawVelocityUnits float64
+	RawMassUnits float64
+
+	TipsyKpcUnit float64
+	TipsyMsolUnit float64
+	TipsyOmegaM float64
+	TipsyOmegaL float64
+	TipsyH100 float64
+	TipsyFamilies []string
+
+	RamsesDMFamilies []int64
+
+	SyntheticTotalWidth float64
+	SyntheticOmegaM float64
+	SyntheticOmegaL float64
+	SyntheticH100 float64
+	SyntheticScaleFactors []float64
+	SyntheticParticles int64
+	SyntheticBlocks int64
+	SyntheticSeed int64
+	SyntheticCausticContrast float64
+	SyntheticROuterMult float64
+	SyntheticSubhaloMassRatio float64
+	SyntheticHaloX []float64
+	SyntheticHaloY []float64
+	SyntheticHaloZ []float64
+	SyntheticHaloM200m []float64
+	SyntheticHaloC200m []float64
+	SyntheticHaloRspMult []float64
+	SyntheticHaloBA []float64
+	SyntheticHaloCA []float64
+	SyntheticSubhalos []int64
+	SyntheticCatalogDir string
+
+	configRecord
 }
 
 var _ Mode = &GlobalConfig{}
@@ -89,10 +169,16 @@ var _ Mode = &GlobalConfig{}
 func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 
 	vars := parse.NewConfigVars("config")
+	defer config.record(vars)
 	vars.String(&config.Version, "Version", version.SourceVersion)
 	vars.String(&config.SnapshotFormat, "SnapshotFormat", "")
 	vars.String(&config.SnapshotType, "SnapshotType", "")
 	vars.String(&config.HaloDir, "HaloDir", "")
+	vars.String(&config.HaloFormat, "HaloFormat", "")
+	vars.Strings(&config.HaloFormatMeanings,
+		"HaloFormatMeanings", []string{})
+	vars.Ints(&config.HaloBlockMins, "HaloBlockMins", []int64{})
+	vars.Ints(&config.HaloBlockMaxes, "HaloBlockMaxes", []int64{})
 	vars.String(&config.HaloType, "HaloType", "nil")
 	vars.String(&config.TreeDir, "TreeDir", "")
 	vars.String(&config.TreeType, "TreeType", "nil")
@@ -101,6 +187,7 @@ func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 	vars.Strings(&config.HaloValueNames, "HaloValueNames", []string{})
 	vars.Ints(&config.HaloValueColumns, "HaloValueColumns", []int64{})
 	vars.Strings(&config.HaloValueComments, "HaloValueComments", []string{})
+	vars.Strings(&config.HaloValueAliases, "HaloValueAliases", []string{})
 
 	vars.String(&config.HaloPositionUnits, "HaloPositionUnits", "")
 	vars.String(&config.HaloRadiusUnits, "HaloRadiusUnits", "")
@@ -117,7 +204,14 @@ func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 	vars.Bool(&config.ValidateFormats, "ValidateFormats", false)
 
 	vars.Int(&config.Threads, "Threads", -1)
+	vars.Int(&config.Seed, "Seed", -1)
+	vars.Int(&config.ChunkSize, "ChunkSize", 0)
+	vars.Int(&config.PrefetchBlocks, "PrefetchBlocks", 0)
 	vars.String(&config.Logging, "Logging", "nil")
+	vars.String(&config.OutputFormat, "OutputFormat", "text")
+
+	vars.Strings(&config.Species, "Species", []string{})
+	vars.Strings(&config.SpeciesTypes, "SpeciesTypes", []string{})
 
 	vars.Ints(&config.GadgetDMTypeIndices,
 		"GadgetDMTypeIndices", []int64{1})
@@ -134,11 +228,61 @@ func (config *GlobalConfig) ReadConfig(fname string, flags []string) error {
 	vars.Floats(&config.NilSnapScaleFactors, "NilSnapScaleFactors", []float64{})
 	vars.Float(&config.NilSnapTotalWidth, "NilSnapTotalWidth", -1)
 
+	vars.Int(&config.RawHeaderSize, "RawHeaderSize", 0)
+	vars.Int(&config.RawRecordMarkers, "RawRecordMarkers", 0)
+	vars.Strings(&config.RawHeaderNames, "RawHeaderNames", []string{})
+	vars.Ints(&config.RawHeaderOffsets, "RawHeaderOffsets", []int64{})
+	vars.Strings(&config.RawHeaderTypes, "RawHeaderTypes", []string{})
+	vars.Floats(&config.RawHeaderValues, "RawHeaderValues", []float64{})
+	vars.Strings(&config.RawArrayNames, "RawArrayNames", []string{})
+	vars.Ints(&config.RawArrayOffsets, "RawArrayOffsets", []int64{})
+	vars.Strings(&config.RawArrayTypes, "RawArrayTypes", []string{})
+	vars.Ints(&config.RawArrayStrides, "RawArrayStrides", []int64{})
+	vars.Float(&config.RawPositionUnits, "RawPositionUnits", 1.0)
+	vars.Float(&config.RawVelocityUnits, "RawVelocityUnits", 1.0)
+	vars.Float(&config.RawMassUnits, "RawMassUnits", 1.0)
+
+	vars.Float(&config.TipsyKpcUnit, "TipsyKpcUnit", -1)
+	vars.Float(&config.TipsyMsolUnit, "TipsyMsolUnit", -1)
+	vars.Float(&config.TipsyOmegaM, "TipsyOmegaM", -1)
+	vars.Float(&config.TipsyOmegaL, "TipsyOmegaL", -1)
+	vars.Float(&config.TipsyH100, "TipsyH100", -1)
+	vars.Strings(&config.TipsyFamilies, "TipsyFamilies", []string{"dark"})
+
+	vars.Ints(&config.RamsesDMFamilies, "RamsesDMFamilies", []int64{1})
+
+	vars.Float(&config.SyntheticTotalWidth, "SyntheticTotalWidth", -1)
+	vars.Float(&config.SyntheticOmegaM, "SyntheticOmegaM", 0.27)
+	vars.Float(&config.SyntheticOmegaL, "SyntheticOmegaL", 0.73)
+	vars.Float(&config.SyntheticH100, "SyntheticH100", 0.7)
+	vars.Floats(&config.SyntheticScaleFactors,
+		"SyntheticScaleFactors", []float64{})
+	vars.Int(&config.SyntheticParticles, "SyntheticParticles", -1)
+	vars.Int(&config.SyntheticBlocks, "SyntheticBlocks", 1)
+	vars.Int(&config.SyntheticSeed, "SyntheticSeed", 0)
+	vars.Float(&config.SyntheticCausticContrast,
+		"SyntheticCausticContrast", 0.1)
+	vars.Float(&config.SyntheticROuterMult, "SyntheticROuterMult", 4)
+	vars.Float(&config.SyntheticSubhaloMassRatio,
+		"SyntheticSubhaloMassRatio", 0.01)
+	vars.Floats(&config.SyntheticHaloX, "SyntheticHaloX", []float64{})
+	vars.Floats(&config.SyntheticHaloY, "SyntheticHaloY", []float64{})
+	vars.Floats(&config.SyntheticHaloZ, "SyntheticHaloZ", []float64{})
+	vars.Floats(&config.SyntheticHaloM200m, "SyntheticHaloM200m", []float64{})
+	vars.Floats(&config.SyntheticHaloC200m, "SyntheticHaloC200m", []float64{})
+	vars.Floats(&config.SyntheticHaloRspMult,
+		"SyntheticHaloRspMult", []float64{})
+	vars.Floats(&config.SyntheticHaloBA, "SyntheticHaloBA", []float64{})
+	vars.Floats(&config.SyntheticHaloCA, "SyntheticHaloCA", []float64{})
+	vars.Ints(&config.SyntheticSubhalos, "SyntheticSubhalos", []int64{})
+	vars.String(&config.SyntheticCatalogDir, "SyntheticCatalogDir", "")
+
 	if err := parse.ReadConfig(fname, vars); err != nil {
 		return err
 	}
 	config.HSnapMax = config.SnapMax
 	config.HSnapMin = config.SnapMin
+	config.HScaleFactorFile = config.ScaleFactorFile
 	
 	return config.validate()
 }
@@ -163,7 +307,8 @@ func (config *GlobalConfig) validate() error {
 	}
 
 	switch config.SnapshotType {
-	case "gotetra", "LGadget-2", "Gadget-2", "ARTIO", "Bolshoi", "BolshoiP", "nil":
+	case "gotetra", "LGadget-2", "Gadget-2", "HDF5-Gadget", "ARTIO", "Bolshoi",
+		"BolshoiP", "raw", "TIPSY", "RAMSES", "cutout", "synthetic", "nil":
 	case "":
 		return fmt.Errorf("The 'SnapshotType variable isn't set.'")
 	default:
@@ -171,8 +316,13 @@ func (config *GlobalConfig) validate() error {
 			"which I don't recognize.", config.SnapshotType)
 	}
 
+	if _, err := catalog.ParseFormat(config.OutputFormat); err != nil {
+		return fmt.Errorf("The 'OutputFormat' variable is set to '%s', "+
+			"which I don't recognize.", config.OutputFormat)
+	}
+
 	switch config.HaloType {
-	case "Text", "nil":
+	case "Text", "Rockstar-Binary", "AHF", "Subfind", "nil":
 	case "":
 		return fmt.Errorf("The 'HaloType' variable isn't set.'")
 	default:
@@ -231,15 +381,22 @@ func (config *GlobalConfig) validate() error {
 	}
 	
 	switch config.TreeType {
-	case "consistent-trees", "nil":
+	case "consistent-trees", "SubLink", "LHaloTree", "Text", "nil":
 	case "":
 		return fmt.Errorf("The 'TreeType variable isn't set.'")
 	default:
 		return fmt.Errorf("The 'TreeType' variable is set to '%s', "+
 			"which I don't recognize.", config.TreeType)
 	}
+	if err := validateTreeHaloTypes(config); err != nil {
+		return err
+	}
 
-	if config.HaloType != "nil" {
+	if config.HaloType != "nil" && config.HaloFormat != "" {
+		if err := validateHaloFormat(config); err != nil {
+			return err
+		}
+	} else if config.HaloType != "nil" {
 		if config.HaloDir == "" {
 			return fmt.Errorf("The 'HaloDir' variable isn't set.")
 		} else if err = validateDir(config.HaloDir); err != nil {
@@ -267,7 +424,15 @@ func (config *GlobalConfig) validate() error {
 	if config.HaloType != "nil" {
 		if len(config.HaloValueNames) == 0 {
 			return fmt.Errorf("The 'HaloValueNames' variable isn't set.")
-		} else if len(config.HaloValueColumns) == 0 {
+		}
+
+		if len(config.HaloValueColumns) == 0 {
+			if err := validateHaloHeader(config); err != nil {
+				return err
+			}
+		}
+
+		if len(config.HaloValueColumns) == 0 {
 			return fmt.Errorf("The 'HaloValueColumns' variable isn't set.")
 		} else if len(config.HaloValueNames) != len(config.HaloValueColumns) {
 			return fmt.Errorf("len(HaloValueColumns) = %d, but " +
@@ -326,6 +491,14 @@ func (config *GlobalConfig) validate() error {
 	}
 
 
+	if config.ChunkSize < 0 {
+		return fmt.Errorf("The variable 'ChunkSize' was set to %d.",
+			config.ChunkSize)
+	} else if config.PrefetchBlocks < 0 {
+		return fmt.Errorf("The variable 'PrefetchBlocks' was set to %d.",
+			config.PrefetchBlocks)
+	}
+
 	switch config.Endianness {
 	case "":
 		return fmt.Errorf("The variable 'Endianness' was not set.")
@@ -354,8 +527,412 @@ func (config *GlobalConfig) validate() error {
 		)
 	}
 
-	
-	return validateFormat(config)
+	if config.SnapshotType == "raw" {
+		if err := validateRaw(config); err != nil {
+			return err
+		}
+	}
+
+	if config.SnapshotType == "TIPSY" {
+		if err := validateTipsy(config); err != nil {
+			return err
+		}
+	}
+
+	if config.SnapshotType == "RAMSES" && len(config.RamsesDMFamilies) == 0 {
+		return fmt.Errorf("The variable 'RamsesDMFamilies' is empty.")
+	}
+
+	if err := config.validateSpecies(); err != nil {
+		return err
+	}
+
+	if err := validateFormat(config); err != nil {
+		return err
+	}
+
+	if config.SnapshotType == "synthetic" {
+		// This needs SnapMin and SnapMax to have been checked already.
+		return validateSynthetic(config)
+	}
+	return nil
+}
+
+// validateSpecies returns an error if there are any problems with the
+// 'Species' and 'SpeciesTypes' variables and sets config.species otherwise.
+// validateTreeHaloTypes checks that the IDs in the merger trees can be found
+// in the halo catalogs. SubLink and LHaloTree IDs aren't used by any halo
+// finder that Shellfish reads, so they can only be used with Text catalogs
+// which have been written with those IDs.
+func validateTreeHaloTypes(config *GlobalConfig) error {
+	switch config.TreeType {
+	case "SubLink", "LHaloTree":
+		switch config.HaloType {
+		case "Text", "nil":
+		default:
+			return fmt.Errorf("The 'TreeType' variable is set to '%s', but "+
+				"the IDs in these trees don't match the IDs of '%s' halos. "+
+				"Only Text halo catalogs can be used with %s trees.",
+				config.TreeType, config.HaloType, config.TreeType)
+		}
+	}
+	return nil
+}
+
+func (config *GlobalConfig) validateSpecies() error {
+	config.species = nil
+	if len(config.Species) == 0 && len(config.SpeciesTypes) == 0 {
+		return nil
+	}
+
+	switch config.SnapshotType {
+	case "Gadget-2", "HDF5-Gadget":
+	default:
+		return fmt.Errorf("The variable 'Species' is set, but SnapshotType "+
+			"'%s' doesn't have particle types. Only Gadget-2 and "+
+			"HDF5-Gadget snapshots can be split into species.",
+			config.SnapshotType)
+	}
+
+	sps, err := parseSpecies(config.Species, config.SpeciesTypes)
+	if err != nil {
+		return err
+	}
+	config.species = sps
+	return nil
+}
+
+// validateRaw returns an error if there are any problems with the variables
+// describing the layout of raw files.
+func validateRaw(config *GlobalConfig) error {
+	switch {
+	case config.RawHeaderSize < 0:
+		return fmt.Errorf("The variable 'RawHeaderSize' was set to %d.",
+			config.RawHeaderSize)
+	case config.RawRecordMarkers != 0 && config.RawRecordMarkers != 4 &&
+		config.RawRecordMarkers != 8:
+		return fmt.Errorf("The variable 'RawRecordMarkers' was set to %d, "+
+			"but the only valid values are 0, 4, and 8.",
+			config.RawRecordMarkers)
+	case config.RawPositionUnits <= 0:
+		return fmt.Errorf("The variable 'RawPositionUnits' was set to %g.",
+			config.RawPositionUnits)
+	case config.RawVelocityUnits <= 0:
+		return fmt.Errorf("The variable 'RawVelocityUnits' was set to %g.",
+			config.RawVelocityUnits)
+	case config.RawMassUnits <= 0:
+		return fmt.Errorf("The variable 'RawMassUnits' was set to %g.",
+			config.RawMassUnits)
+	}
+
+	n := len(config.RawHeaderNames)
+	switch {
+	case len(config.RawHeaderOffsets) != n:
+		return fmt.Errorf("len(RawHeaderNames) = %d, but "+
+			"len(RawHeaderOffsets) = %d.", n, len(config.RawHeaderOffsets))
+	case len(config.RawHeaderTypes) != n:
+		return fmt.Errorf("len(RawHeaderNames) = %d, but "+
+			"len(RawHeaderTypes) = %d.", n, len(config.RawHeaderTypes))
+	case len(config.RawHeaderValues) != n:
+		return fmt.Errorf("len(RawHeaderNames) = %d, but "+
+			"len(RawHeaderValues) = %d.", n, len(config.RawHeaderValues))
+	}
+	for i, name := range config.RawHeaderNames {
+		if !inStringSlice(name, io.RawHeaderNames) {
+			return fmt.Errorf("'RawHeaderNames' contains '%s', which isn't "+
+				"one of %s.", name, io.RawHeaderNames)
+		} else if _, ok := io.RawTypeSize(config.RawHeaderTypes[i]); !ok {
+			return fmt.Errorf("'RawHeaderTypes' contains '%s', which isn't "+
+				"one of float32, float64, int32, or int64.",
+				config.RawHeaderTypes[i])
+		} else if config.RawHeaderOffsets[i] >= config.RawHeaderSize {
+			return fmt.Errorf("The offset of the header field %s is %d, "+
+				"but 'RawHeaderSize' is only %d.", name,
+				config.RawHeaderOffsets[i], config.RawHeaderSize)
+		}
+	}
+	for _, name := range []string{"BoxWidth", "OmegaM", "OmegaL", "H100"} {
+		if !inStringSlice(name, config.RawHeaderNames) {
+			return fmt.Errorf("'RawHeaderNames' does not contain '%s'.", name)
+		}
+	}
+	if !inStringSlice("Redshift", config.RawHeaderNames) &&
+		!inStringSlice("ScaleFactor", config.RawHeaderNames) {
+		return fmt.Errorf("'RawHeaderNames' contains neither 'Redshift' " +
+			"nor 'ScaleFactor'.")
+	}
+
+	n = len(config.RawArrayNames)
+	switch {
+	case len(config.RawArrayOffsets) != n:
+		return fmt.Errorf("len(RawArrayNames) = %d, but "+
+			"len(RawArrayOffsets) = %d.", n, len(config.RawArrayOffsets))
+	case len(config.RawArrayTypes) != n:
+		return fmt.Errorf("len(RawArrayNames) = %d, but "+
+			"len(RawArrayTypes) = %d.", n, len(config.RawArrayTypes))
+	case len(config.RawArrayStrides) != n:
+		return fmt.Errorf("len(RawArrayNames) = %d, but "+
+			"len(RawArrayStrides) = %d.", n, len(config.RawArrayStrides))
+	}
+	for i, name := range config.RawArrayNames {
+		size, ok := io.RawTypeSize(config.RawArrayTypes[i])
+		if name == "X" || name == "V" {
+			size *= 3
+		}
+
+		if !inStringSlice(name, io.RawArrayNames) {
+			return fmt.Errorf("'RawArrayNames' contains '%s', which isn't "+
+				"one of %s.", name, io.RawArrayNames)
+		} else if !ok {
+			return fmt.Errorf("'RawArrayTypes' contains '%s', which isn't "+
+				"one of float32, float64, int32, or int64.",
+				config.RawArrayTypes[i])
+		} else if stride := config.RawArrayStrides[i]; stride != 0 &&
+			stride < int64(size) {
+			return fmt.Errorf("The stride of the %s array is %d, but each "+
+				"element is %d bytes.", name, stride, size)
+		}
+	}
+	for _, name := range []string{"X", "V", "ID"} {
+		if !inStringSlice(name, config.RawArrayNames) {
+			return fmt.Errorf("'RawArrayNames' does not contain '%s'.", name)
+		}
+	}
+	if !inStringSlice("M", config.RawArrayNames) &&
+		!inStringSlice("TotalCount", config.RawHeaderNames) {
+		return fmt.Errorf("'RawHeaderNames' must contain 'TotalCount' if " +
+			"'RawArrayNames' doesn't contain 'M'.")
+	}
+
+	return nil
+}
+
+// validateTipsy returns an error if there are any problems with the variables
+// describing the units of TIPSY files.
+// validateSynthetic returns an error if there are any problems with the
+// variables describing synthetic snapshots.
+func validateSynthetic(config *GlobalConfig) error {
+	switch {
+	case config.SyntheticTotalWidth == -1:
+		return fmt.Errorf("'SyntheticTotalWidth' not set even though " +
+			"SnapshotType == 'synthetic'")
+	case config.SyntheticParticles == -1:
+		return fmt.Errorf("'SyntheticParticles' not set even though " +
+			"SnapshotType == 'synthetic'")
+	case config.SyntheticTotalWidth <= 0:
+		return fmt.Errorf("The variable 'SyntheticTotalWidth' was set to %g.",
+			config.SyntheticTotalWidth)
+	case config.SyntheticParticles <= 0:
+		return fmt.Errorf("The variable 'SyntheticParticles' was set to %d.",
+			config.SyntheticParticles)
+	case config.SyntheticBlocks <= 0:
+		return fmt.Errorf("The variable 'SyntheticBlocks' was set to %d.",
+			config.SyntheticBlocks)
+	case config.SyntheticOmegaM <= 0:
+		return fmt.Errorf("The variable 'SyntheticOmegaM' was set to %g.",
+			config.SyntheticOmegaM)
+	case config.SyntheticH100 <= 0:
+		return fmt.Errorf("The variable 'SyntheticH100' was set to %g.",
+			config.SyntheticH100)
+	case config.SyntheticCausticContrast < 0:
+		return fmt.Errorf("The variable 'SyntheticCausticContrast' was "+
+			"set to %g.", config.SyntheticCausticContrast)
+	case config.SyntheticSubhaloMassRatio <= 0 ||
+		config.SyntheticSubhaloMassRatio >= 1:
+		return fmt.Errorf("The variable 'SyntheticSubhaloMassRatio' was "+
+			"set to %g.", config.SyntheticSubhaloMassRatio)
+	}
+
+	snaps := int(config.SnapMax - config.SnapMin + 1)
+	if len(config.SyntheticScaleFactors) != snaps {
+		return fmt.Errorf("'SyntheticScaleFactors' has %d elements, but "+
+			"'SnapMin' = %d and 'SnapMax' = %d.",
+			len(config.SyntheticScaleFactors), config.SnapMin, config.SnapMax)
+	}
+	for _, a := range config.SyntheticScaleFactors {
+		if a <= 0 {
+			return fmt.Errorf("'SyntheticScaleFactors' contains %g.", a)
+		}
+	}
+
+	n := len(config.SyntheticHaloX)
+	lists := map[string]int{
+		"SyntheticHaloY": len(config.SyntheticHaloY),
+		"SyntheticHaloZ": len(config.SyntheticHaloZ),
+		"SyntheticHaloM200m": len(config.SyntheticHaloM200m),
+		"SyntheticHaloC200m": len(config.SyntheticHaloC200m),
+		"SyntheticHaloRspMult": len(config.SyntheticHaloRspMult),
+	}
+	optional := map[string]int{
+		"SyntheticHaloBA": len(config.SyntheticHaloBA),
+		"SyntheticHaloCA": len(config.SyntheticHaloCA),
+		"SyntheticSubhalos": len(config.SyntheticSubhalos),
+	}
+	for name, length := range optional {
+		if length != 0 {
+			lists[name] = length
+		}
+	}
+	for name, length := range lists {
+		if length != n {
+			return fmt.Errorf("len(SyntheticHaloX) = %d, but len(%s) = %d.",
+				n, name, length)
+		}
+	}
+	if (len(config.SyntheticHaloBA) == 0) !=
+		(len(config.SyntheticHaloCA) == 0) {
+		return fmt.Errorf("Only one of 'SyntheticHaloBA' and " +
+			"'SyntheticHaloCA' was set.")
+	}
+
+	for i := 0; i < n; i++ {
+		switch {
+		case config.SyntheticHaloM200m[i] <= 0:
+			return fmt.Errorf("Element %d of 'SyntheticHaloM200m' is %g.",
+				i, config.SyntheticHaloM200m[i])
+		case config.SyntheticHaloC200m[i] <= 0:
+			return fmt.Errorf("Element %d of 'SyntheticHaloC200m' is %g.",
+				i, config.SyntheticHaloC200m[i])
+		case config.SyntheticHaloRspMult[i] <= 0:
+			return fmt.Errorf("Element %d of 'SyntheticHaloRspMult' is %g.",
+				i, config.SyntheticHaloRspMult[i])
+		}
+		if len(config.SyntheticHaloBA) > 0 {
+			ba, ca := config.SyntheticHaloBA[i], config.SyntheticHaloCA[i]
+			if ca <= 0 || ca > ba || ba > 1 {
+				return fmt.Errorf("Element %d of 'SyntheticHaloBA' and "+
+					"'SyntheticHaloCA' are %g and %g, but they must satisfy "+
+					"0 < c/a <= b/a <= 1.", i, ba, ca)
+			}
+		}
+		if len(config.SyntheticSubhalos) > 0 && config.SyntheticSubhalos[i] < 0 {
+			return fmt.Errorf("Element %d of 'SyntheticSubhalos' is %d.",
+				i, config.SyntheticSubhalos[i])
+		}
+	}
+
+	if config.SyntheticCatalogDir != "" {
+		if err := validateDir(config.SyntheticCatalogDir); err != nil {
+			return fmt.Errorf("The 'SyntheticCatalogDir' variable is set "+
+				"to '%s', but %s", config.SyntheticCatalogDir, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateTipsy(config *GlobalConfig) error {
+	vals := []float64{
+		config.TipsyKpcUnit, config.TipsyMsolUnit,
+		config.TipsyOmegaM, config.TipsyOmegaL, config.TipsyH100,
+	}
+	names := []string{
+		"TipsyKpcUnit", "TipsyMsolUnit", "TipsyOmegaM", "TipsyOmegaL",
+		"TipsyH100",
+	}
+	for i := range vals {
+		if vals[i] == -1 {
+			return fmt.Errorf("'%s' not set even though SnapshotType == "+
+				"'TIPSY'", names[i])
+		} else if vals[i] < 0 || (vals[i] == 0 && names[i] != "TipsyOmegaL") {
+			return fmt.Errorf("The variable '%s' was set to %g.",
+				names[i], vals[i])
+		}
+	}
+
+	if len(config.TipsyFamilies) == 0 {
+		return fmt.Errorf("The variable 'TipsyFamilies' is empty.")
+	}
+	for _, family := range config.TipsyFamilies {
+		if !inStringSlice(family, io.TipsyFamilies) {
+			return fmt.Errorf("'TipsyFamilies' contains '%s', which isn't "+
+				"one of %s.", family, io.TipsyFamilies)
+		}
+	}
+
+	return nil
+}
+
+// validateHaloHeader sets HaloValueColumns from the names in the header of
+// the last halo catalog and checks that the units in the header
+// agree with HaloPositionUnits, HaloRadiusUnits, and HaloMassUnits. It also
+// fills in HaloValueComments if it isn't set. Binary catalogs don't have
+// headers, so the names and units of the values Shellfish can read from them
+// are used instead.
+func validateHaloHeader(config *GlobalConfig) error {
+	if len(config.HaloValueAliases) != 0 &&
+		len(config.HaloValueAliases) != len(config.HaloValueNames) {
+		return fmt.Errorf("len(HaloValueAliases) = %d, but "+
+			"len(HaloValueNames) = %d.", len(config.HaloValueAliases),
+			len(config.HaloValueNames))
+	}
+
+	files, _, err := config.HaloCatalogFiles(config.HaloType)
+	if err != nil {
+		return fmt.Errorf("The 'HaloValueColumns' variable isn't set, so "+
+			"I tried to read the header of a halo catalog, but %s",
+			err.Error())
+	}
+	fname := files[len(files)-1][0]
+
+	hd, err := halo.ReadHeader(config.HaloType, fname)
+	if err != nil {
+		return fmt.Errorf("The 'HaloValueColumns' variable isn't set, so "+
+			"I tried to read the header of a halo catalog, but %s",
+			err.Error())
+	}
+
+	units := []struct{ name, config, header string }{
+		{"HaloPositionUnits", config.HaloPositionUnits, hd.PositionUnits},
+		{"HaloRadiusUnits", config.HaloRadiusUnits, hd.RadiusUnits},
+		{"HaloMassUnits", config.HaloMassUnits, hd.MassUnits},
+	}
+	for _, u := range units {
+		if u.header != "" && u.header != u.config {
+			return fmt.Errorf("The '%s' variable is set to '%s', but the "+
+				"header of the halo catalog %s says that its units are '%s'.",
+				u.name, u.config, fname, u.header)
+		}
+	}
+
+	config.HaloValueColumns = make([]int64, len(config.HaloValueNames))
+	for i, name := range config.HaloValueNames {
+		aliases := []string{name}
+		if len(config.HaloValueAliases) > 0 {
+			aliases = strings.Split(config.HaloValueAliases[i], "|")
+			for j := range aliases {
+				aliases[j] = strings.TrimSpace(aliases[j])
+			}
+		} else if defaults, ok := halo.DefaultAliases[name]; ok {
+			aliases = append(aliases, defaults...)
+		}
+
+		col := hd.Column(aliases)
+		if col == -1 {
+			return fmt.Errorf("The 'HaloValueColumns' variable isn't set, "+
+				"so I tried to find the '%s' value in the header of the halo "+
+				"catalog %s, but it doesn't have a column named any of %q. "+
+				"Either set 'HaloValueAliases' or set 'HaloValueColumns' by "+
+				"hand.", name, fname, aliases)
+		}
+		config.HaloValueColumns[i] = int64(col)
+	}
+
+	if len(config.HaloValueComments) == 0 {
+		config.HaloValueComments = make([]string, len(config.HaloValueNames))
+		for i, name := range config.HaloValueNames {
+			switch name {
+			case "ID":
+				config.HaloValueComments[i] = "int"
+			case "X", "Y", "Z":
+				config.HaloValueComments[i] = config.HaloPositionUnits
+			case "M200m":
+				config.HaloValueComments[i] = config.HaloMassUnits
+			}
+		}
+	}
+
+	return nil
 }
 
 func inStringSlice(x string, xs []string) bool {
@@ -454,6 +1031,62 @@ func validateFormat(config *GlobalConfig) error {
 	return nil
 }
 
+// validateHaloFormat returns an error if there are any problems with the
+// HaloFormat variables. It works like validateFormat, except that the halo
+// catalogs' blocks are given by HaloBlockMins and HaloBlockMaxes.
+func validateHaloFormat(config *GlobalConfig) error {
+	specifiers := strings.Count(config.HaloFormat, "%") -
+		2*strings.Count(config.HaloFormat, "%%")
+
+	if len(config.HaloBlockMins) != len(config.HaloBlockMaxes) {
+		return fmt.Errorf("len(HaloBlockMins) = %d, but "+
+			"len(HaloBlockMaxes) = %d.", len(config.HaloBlockMins),
+			len(config.HaloBlockMaxes))
+	}
+	for i := range config.HaloBlockMins {
+		if config.HaloBlockMins[i] > config.HaloBlockMaxes[i] {
+			return fmt.Errorf("'HaloBlockMins'[%d] is larger than "+
+				"'HaloBlockMaxes'[%d].", i, i)
+		}
+	}
+
+	if specifiers != len(config.HaloFormatMeanings) {
+		return fmt.Errorf("'HaloFormat' has %d specifiers, but "+
+			"'HaloFormatMeanings' has %d elements.", specifiers,
+			len(config.HaloFormatMeanings))
+	}
+
+	snapshot := false
+	for i, meaning := range config.HaloFormatMeanings {
+		switch {
+		case meaning == "Snapshot", meaning == "ScaleFactor":
+			snapshot = true
+		case meaning == "Block":
+			if len(config.HaloBlockMins) == 0 {
+				return fmt.Errorf("'HaloFormatMeanings'[%d] is Block, but "+
+					"'HaloBlockMins' isn't set.", i)
+			}
+		case len(meaning) > 5 && meaning[:5] == "Block":
+			n, err := strconv.Atoi(meaning[5:])
+			if err != nil || n < 0 || n >= len(config.HaloBlockMins) {
+				return fmt.Errorf("'HaloFormatMeanings'[%d] specifies an "+
+					"invalid block range.", i)
+			}
+		default:
+			return fmt.Errorf("I don't understand '%s' from "+
+				"'HaloFormatMeanings'[%d].", meaning, i)
+		}
+	}
+
+	if !snapshot {
+		return fmt.Errorf("None of the elements of 'HaloFormatMeanings' " +
+			"are Snapshot or ScaleFactor, so every snapshot would use the " +
+			"same halo catalog.")
+	}
+
+	return nil
+}
+
 // ExampleConfig returns an example configuration file.
 func (config *GlobalConfig) ExampleConfig() string {
 	return fmt.Sprintf(`[config]
@@ -462,6 +1095,9 @@ func (config *GlobalConfig) ExampleConfig() string {
 # not allow previous versions to be run from earlier versions.
 Version = %s
 
+# shellfish init can write most of this file for you by looking at your
+# snapshots and halo catalogs. Type "shellfish help init" for details.
+
 # These variables describe the formats used by the files which Shellfish reads.
 # If your simulation output uses a format not included here, you can submit a
 # request for support on https://github.com/phil-mansfield/shellfish/issues.
@@ -475,9 +1111,71 @@ Version = %s
 # is nil, you don't need to fill out any of the Tree* variables.
 #
 # Supported SnapshotTypes: LGadget-2, gotetra, Gadget-2 (experimental),
-# ARTIO (experimental), Bolshoi (experimental), BolshoiP (experiemntal)
-# Supported HaloTypes: Text, nil
-# Supported TreeTypes: consistent-trees, nil
+# HDF5-Gadget (experimental), ARTIO (experimental), Bolshoi (experimental),
+# BolshoiP (experiemntal), raw, TIPSY (experimental), RAMSES (experimental),
+# cutout, synthetic
+#
+# HDF5-Gadget is the HDF5 format written by Gadget-3, Gadget-4, AREPO, and
+# SWIFT. It's read without the HDF5 library, so only the common parts of the
+# format are supported. Compressed datasets must use gzip, and groups can't
+# use the dense storage enabled by libver='latest' in h5py.
+#
+# raw is a binary format whose layout is described by the Raw* variables
+# below. Use it for simple formats which Shellfish doesn't know about.
+#
+# TIPSY is the binary format written by ChaNGa and Gasoline. RAMSES reads the
+# part_XXXXX.outYYYYY files written by RAMSES, and each CPU's file is a
+# separate Block. The info_XXXXX.txt file must be in the same directory. See
+# the TIPSY- and RAMSES-specific variables below.
+#
+# cutout reads the files written by shellfish cutout, which only contain the
+# particles around a set of halos. There is one file per snapshot, so
+# SnapshotFormatMeanings should just be Snapshot, and the original
+# simulation's config file should be used to make the cutouts.
+#
+# synthetic doesn't read any files. Instead, it generates halos with known
+# splashback radii on top of a uniform background. It's used to check that
+# Shellfish is working correctly. See the synthetic-specific variables below.
+#
+# LGadget-2 and Gadget-2 snapshots, halo catalogs, the ScaleFactorFile, and
+# merger tree files can be compressed with gzip or zstd. Compression is
+# detected automatically from the contents of each file, so compressed files
+# don't need to be renamed. Compressed snapshots are slower to read, but
+# their headers are only read once and are then cached in MemoDir.
+#
+# Text halo catalogs have one file per snapshot, like Rockstar's out_*.list
+# files or consistent-trees' hlist_*.list files. Rockstar-Binary reads
+# Rockstar's halos_<snap>.<block>.bin files, AHF reads AHF's *.AHF_halos files,
+# and Subfind reads the FoF groups in Gadget's binary subhalo_tab_<snap>.<block>
+# files, which can be inside groups_<snap> directories. For these types,
+# HaloValueColumns can be left unset and HaloValueNames will be found by name
+# (see below). AHF positions and radii are in ckpc/h, and Subfind's are in
+# whatever units Gadget used. Subfind masses are assumed to be in Gadget's
+# usual units of 10^10 Msun/h and are converted to Msun/h. Subfind group IDs
+# are their index within the snapshot.
+#
+# consistent-trees reads the tree_*.dat files in TreeDir. SubLink reads
+# IllustrisTNG-style tree.<n>.hdf5 or tree_extended.<n>.hdf5 files and
+# identifies halos by their SubhaloID. LHaloTree reads binary
+# trees_<snap>.<n> files. LHaloTree halos don't have IDs, so Shellfish gives
+# each one the ID SnapNum * 10^15 + FileNr * 10^10 + SubhaloIndex. None of the
+# supported halo finders use these IDs, so SubLink and LHaloTree trees can only
+# be used with Text halo catalogs whose ID column has been written with them.
+# Text reads every file in TreeDir as a list of halos with the columns
+#
+#     ID DescID Snap [Mass]
+#
+# where DescID is -1 for halos without descendants and lines starting with #
+# are comments. This is easy for your own halo finder to write. If Mass is
+# given, main branches follow the most massive progenitor. Otherwise they
+# follow the first progenitor in the file. SubLink, LHaloTree, and Text trees
+# use the snapshot numbers stored in the trees, so these need to be the same
+# numbers that SnapMin and SnapMax refer to. consistent-trees doesn't store
+# snapshot numbers, so its snapshots are counted from the earliest scale factor
+# in each file, with the earliest one taken to be the first halo catalog.
+#
+# Supported HaloTypes: Text, Rockstar-Binary, AHF, Subfind, nil
+# Supported TreeTypes: consistent-trees, SubLink, LHaloTree, Text, nil
 SnapshotType = LGadget-2
 HaloType = Text
 TreeType = consistent-trees
@@ -493,6 +1191,29 @@ HaloValueColumns = 0, 2, 3, 4, 20
 # catalogs. These are not analyzed by Shellfish in any way, but will be
 # propagated to output catalogs when relevant.
 HaloValueComments = "int", "cMpc/h", "cMpc/h", "cMpc/h", "Msun/h"
+#
+# If HaloValueColumns isn't set, Shellfish finds the columns by name from the
+# header line of your halo catalogs (e.g. "#ID DescID Mvir ... X Y Z"). Names
+# are compared without regard to case, and the indices that consistent-trees
+# and AHF add to their names, like "x(17)", are ignored. By default, ID also
+# matches "HaloID", X also matches "Xc", and M200m also matches "M200b". Mvir
+# is a different mass definition, so it's only used if HaloValueAliases asks
+# for it.
+#
+# Rockstar-Binary catalogs use the same names as Rockstar's text catalogs, and
+# Subfind catalogs use ID, GroupLen, GroupOffset, GroupMass, X, Y, Z, M200m,
+# R200m, M200c, R200c, MTopHat200, RTopHat200, VelDispMean200, VelDispCrit200,
+# VelDispTopHat200, ContaminationCount, ContaminationMass, GroupNsubs, and
+# GroupFirstSub. The velocity dispersions are only written by some Gadget runs.
+# If HaloValueColumns is set for one of these binary types, its values are
+# indices into these lists of names.
+#
+# HaloValueAliases changes the names that each value is matched against. It
+# has one element for each element of HaloValueNames, and each element is a
+# list of the names which that column might have, separated by "|". If the
+# header has "#Units:" lines, they're checked against the units variables
+# below. If HaloValueComments isn't set, it's filled in from those units.
+# HaloValueAliases = ID | HaloID, X, Y, Z, M200b | Mvir
 
 # HaloPositionUnits are the units which your halo catalog reports positions in.
 # Currently supported values are "cMpc/h" and "ckpc/h" (the "c" stands for
@@ -539,10 +1260,31 @@ SnapMax = 100
 #
 # If either of these isn't true, you'll still be able to use the shell finding
 # and analyzing parts of Shellfish, but won't be able to use its catalog reading
-# tools.
+# tools unless you set HaloFormat (see below).
+#
+# Binary and AHF catalogs are grouped into snapshots by the numbers and
+# redshifts in their file names instead, but missing snapshots are still a
+# problem.
 HaloDir = path/to/halos/dir/
 
-# Directory containing merger tree.
+# HaloFormat and HaloFormatMeanings work like SnapshotFormat and
+# SnapshotFormatMeanings, but give the names of your halo catalogs. If they're
+# set, HaloDir isn't used, snapshot SnapMin is assumed to be the first
+# snapshot in your merger trees, and it's an error for any of the catalogs to
+# be missing. HaloFormatMeanings can contain Snapshot, ScaleFactor (which
+# uses ScaleFactorFile), and Block or BlockN, which reference HaloBlockMins
+# and HaloBlockMaxes instead of BlockMins and BlockMaxes. Running
+# "shellfish check" will make sure that the scale factors of your halo catalogs
+# match the scale factors of your snapshots.
+# HaloFormat = path/to/halos/halos_%%d.%%d.bin
+# HaloFormatMeanings = Snapshot, Block
+# HaloBlockMins = 0
+# HaloBlockMaxes = 7
+
+# Directory containing merger tree. For consistent-trees, these are the
+# tree_*.dat files. The first time "shellfish tree" is run, it indexes these
+# files and caches the index in MemoDir, so later runs only need to read the
+# trees of the requested halos. Other TreeTypes are read in full every time.
 TreeDir = path/to/merger/tree/dir/
 
 # A directory you create the first time you run Shellfish for a particular
@@ -571,17 +1313,83 @@ Endianness = SystemOrder
 # performance.
 Threads = -1
 
+# Seed is the seed used by every random number generator. Two runs with the same
+# Seed, config files, and input catalog give bit-identical results, regardless
+# of the value of Threads. If Seed is negative (as it is by default), it will be
+# set from the current time. Either way, the seed is recorded in the provenance
+# block at the end of every output catalog, so any run can be repeated.
+Seed = -1
+
+# ChunkSize is the maximum number of particles which the shell, stats, prof,
+# phase, and potential modes load from a particle file at once. Setting it
+# lowers peak memory usage when files are large. If ChunkSize is 0 (as it is by
+# default), whole files are loaded at once. Currently only LGadget-2 files are
+# read in chunks: other SnapshotTypes load whole files and ignore it. Changing
+# ChunkSize can change the last few digits of some outputs.
+ChunkSize = 0
+
+# PrefetchBlocks is the number of particle files which the shell, stats, prof,
+# phase, and potential modes read in the background while the current file is
+# being analyzed. This hides I/O time on slow filesystems, but up to
+# PrefetchBlocks + 1 files will be held in memory at once, and files which are
+# prefetched are always read whole, regardless of ChunkSize. Prefetching
+# doesn't change any outputs. If PrefetchBlocks is 0 (as it is by default),
+# files are read one at a time. pipeline mode never prefetches, since it
+# caches files instead.
+PrefetchBlocks = 0
+
 # The logging mode to be used. There are three different logging modes:
 # nil - no logging is performed.
 # performance - runtime and memory consumption logging are written to stderr.
 # debugging - debugging information is written to stderr
 Logging = nil
 
+# OutputFormat is the format that every mode writes its output catalog in. Any
+# of these formats can be read by the other modes, so they can still be piped
+# together. The supported formats are:
+# text  - whitespace-separated columns with a comment header. (default)
+# csv   - comma-separated columns. The first row contains column names.
+# jsonl - one JSON object per row, keyed by column names.
+# npy   - a NumPy .npy file containing a structured array with one named field
+#         per column. Nothing is written until the mode has finished.
+# Column names include units where applicable (e.g. "R200m [cMpc/h]"), and
+# vector-valued columns are split up into one named column per component (e.g.
+# the shell coefficients are written as P_000, P_100, etc.).
+OutputFormat = text
+
+#############
+## Species ##
+#############
+
+# By default, the shell, stats, and prof modes use every particle read from
+# your snapshots, which are normally the dark matter particles selected by
+# GadgetDMTypeIndices. If your snapshots are from a hydrodynamic simulation, you
+# can instead split the particles into several species (e.g. dark matter, gas,
+# and stars) and analyze all of them in the same pass. Species gives the names
+# of the species, and SpeciesTypes gives the particle types in each one. A
+# species can combine several types, separated by "+", and each type can be
+# given a weight which its particles' masses are multiplied by, e.g. "0.5*4".
+#
+# When Species is set, every column which depends on the shell is written once
+# for each species, and the name of the species is added to the column name
+# (e.g. R_sp_dm and R_sp_stars). shell writes one set of shell coefficients per
+# species, and stats and prof expect to be given them. Halos are excluded, and
+# ShellParticleFile is written, using the first species.
+#
+# Species can only be used when SnapshotType is Gadget-2 or HDF5-Gadget. Every
+# particle type used by a species is read, and GadgetDMTypeIndices is ignored.
+# The particle types in Gadget snapshots are 0 (gas), 1 (dark matter), and 4
+# (stars), although some simulations use them differently. Remember to include
+# the types with individual masses in GadgetSingleMassIndices.
+#
+# Species = dm, gas, stars, baryons
+# SpeciesTypes = 1, 0, 4, 0 + 4
+
 ###############################
 ## Format-specific variables ##
 ###############################
-# If SnapshotType is set to Gadget-2, LGadget-2, or nil, extra information
-# will need to be provided to read your files.
+# If SnapshotType is set to Gadget-2, HDF5-Gadget, LGadget-2, raw, or nil,
+# extra information will need to be provided to read your files.
 
 ###############################
 ## Gadget-specific variables ##
@@ -590,13 +1398,14 @@ Logging = nil
 # GadgetDMTypeIndices indicates which particle types correspond to dark matter
 # particles. For a typical uniform mass DM-only simulation, this will be 1. For
 # simulations with particles of multiple masses, more than one index may be
-# used. This only needs to be set if SnapshßotType = Gadget-2.
+# used. This only needs to be set if SnapshßotType = Gadget-2 or HDF5-Gadget.
 # GadgetDMTypeIndices = 1
 
 # GadgetSingleMassIndices indicates which particle types don't have entries in
 # the MASS/Masses block and instead use the the Massarr/MassTable entry in the
 # header. Include non-DM particle types. This only needs to be set if
-# SnapshotType = Gadget-2.
+# SnapshotType = Gadget-2. HDF5-Gadget files use MassTable for every type
+# without a Masses dataset.
 # GadgetSingleMassIndices = 0, 1, 2, 3, 4, 5
 
 # GadgetPositionUnits indicates how positions are stored within your Gadget
@@ -604,7 +1413,7 @@ Logging = nil
 # (1 Mpc/h) * GadgetPositionUnits = (Your position units).
 # (i.e. if your position units are smaller than 1 Mpc/h, this variable should
 # be less than one). This variable only needs to be set if
-# SnapshotType = Gadget-2 and your units are not 1 Mpc/h.
+# SnapshotType = Gadget-2 or HDF5-Gadget and your units are not 1 Mpc/h.
 # GadgetPositionUnits = 1.0
 
 # GadgetMassUnits indicates how positions are stored within your Gadget
@@ -612,7 +1421,7 @@ Logging = nil
 # (1 Msun/h) * GadgetMassUnits = (Your mass units).
 # (i.e. if your mass units are smaller than 1 Msun/h, this variable should be
 # less than one). This variable only needs to be set if SnapshotType = Gadget-
-# and your units are not 1 Msun/h.
+# or HDF5-Gadget and your units are not 1 Msun/h.
 # GadgetMassUnits = 1.0
 
 ################################
@@ -629,6 +1438,177 @@ Logging = nil
 # fail and tell you to change this variable.
 # LGadgetNpartNum = 2
 
+############################
+## raw-specific variables ##
+############################
+
+# These variables describe the layout of each particle file when SnapshotType
+# is set to raw. Every file starts with a header of RawHeaderSize bytes (which
+# may be 0) followed by particle arrays. All values are read using the byte
+# order given by Endianness.
+#
+# If the file was written by Fortran, set RawRecordMarkers to the size of its
+# record markers (4 or 8). The header and every array whose offset is -1 are
+# assumed to be surrounded by markers.
+# RawHeaderSize = 256
+# RawRecordMarkers = 0
+
+# RawHeaderNames lists the fields which are read from the header. The valid
+# names are Count, TotalCount, BoxWidth, Redshift, ScaleFactor, OmegaM,
+# OmegaL, and H100. BoxWidth, OmegaM, OmegaL, H100 and one of Redshift or
+# ScaleFactor are required. Count is the number of particles in the file, and
+# if it isn't given, it is found from the file size. TotalCount is the number of
+# particles in the whole simulation, which is required if there is no M array.
+#
+# RawHeaderOffsets gives the byte offset of each field from the start of the
+# header and RawHeaderTypes gives its type: float32, float64, int32, or int64.
+# If a field isn't stored in the header, set its offset to -1 and the value
+# in RawHeaderValues will be used instead. Otherwise, RawHeaderValues is
+# ignored.
+# RawHeaderNames = Count, BoxWidth, ScaleFactor, OmegaM, OmegaL, H100
+# RawHeaderOffsets = 0, 8, 16, -1, -1, -1
+# RawHeaderTypes = int64, float64, float64, float64, float64, float64
+# RawHeaderValues = 0, 0, 0, 0.27, 0.73, 0.7
+
+# RawArrayNames lists the particle arrays in each file: X (positions), V
+# (velocities), ID, and M (masses). X, V, and ID are required. If there is no M
+# array, every particle has the same mass.
+#
+# RawArrayOffsets gives the byte offset of the first element of each array from
+# the start of the file. An offset of -1 means that the array starts directly
+# after the previous array (or after the header). RawArrayTypes gives the type
+# of each element (or each component, for X and V). RawArrayStrides gives the
+# number of bytes between consecutive particles. 0 means that the array is
+# packed.
+#
+# The example below is for files where each particle is stored as a struct
+# of three float32 positions, three float32 velocities, and an int64 ID after
+# a 256 byte header, similar to the Bolshoi format.
+# RawArrayNames = X, V, ID
+# RawArrayOffsets = 256, 268, 280
+# RawArrayTypes = float32, float32, int64
+# RawArrayStrides = 32, 32, 32
+#
+# If instead the file contained Fortran records of positions, then
+# velocities, then IDs, you would set
+# RawArrayOffsets = -1, -1, -1
+# RawArrayStrides = 0, 0, 0
+
+# These variables work the same way that GadgetPositionUnits and
+# GadgetMassUnits do: the values read from the file are multiplied by them to
+# get positions in comoving Mpc/h, velocities in km/s, and masses in Msun/h.
+# RawPositionUnits = 1.0
+# RawVelocityUnits = 1.0
+# RawMassUnits = 1.0
+
+##############################
+## TIPSY-specific variables ##
+##############################
+
+# TIPSY files don't contain units or cosmological parameters, so you need to
+# set them here. TipsyKpcUnit and TipsyMsolUnit should be the same as the
+# dKpcUnit and dMsolUnit variables in the simulation's .param file. Positions
+# are shifted by half a box so that they run from 0 to the box width, the same
+# as in Rockstar and AHF. Byte order is found from the header, so Endianness is
+# ignored.
+# TipsyKpcUnit = 50000
+# TipsyMsolUnit = 1.7e16
+# TipsyOmegaM = 0.3
+# TipsyOmegaL = 0.7
+# TipsyH100 = 0.7
+
+# TipsyFamilies lists the particle families which are read. Valid values are
+# gas, dark, and star. IDs are the index of each particle in the file.
+# TipsyFamilies = dark
+
+###############################
+## RAMSES-specific variables ##
+###############################
+
+# Units and cosmology are read from the info_XXXXX.txt file, so the only
+# setting is which particles are dark matter. If the snapshot has a
+# part_file_descriptor.txt file with a family field, particles whose family is
+# in RamsesDMFamilies are read. (In RAMSES, dark matter has family 1.) In older
+# versions without families, particles with positive IDs and no birth time are
+# read instead.
+#
+# A typical RAMSES setup with 64 CPUs would use
+# SnapshotFormat = path/to/output_%%05d/part_%%05d.out%%05d
+# SnapshotFormatMeanings = Snapshot, Snapshot, Block
+# BlockMins = 1
+# BlockMaxes = 64
+# RamsesDMFamilies = 1
+
+##################################
+## synthetic-specific variables ##
+##################################
+
+# Synthetic snapshots contain halos with NFW profiles whose density drops
+# sharply at a chosen splashback radius. The halos sit on top of a uniform
+# background at the mean matter density. The same particles are used in every
+# snapshot, and every particle has zero velocity. SnapshotFormat,
+# SnapshotFormatMeanings, BlockMins, and BlockMaxes aren't used, but SnapMin
+# and SnapMax still need to be set.
+#
+# SyntheticTotalWidth is the width of the box in cMpc/h and
+# SyntheticParticles is the number of background particles. Together they set
+# the particle mass.
+# SyntheticTotalWidth = 20
+# SyntheticParticles = 262144
+# The cosmology and one scale factor for each snapshot:
+# SyntheticOmegaM = 0.27
+# SyntheticOmegaL = 0.73
+# SyntheticH100 = 0.7
+# SyntheticScaleFactors = 1.0
+#
+# Each halo is described by one element of each of these lists. Positions are
+# in cMpc/h, masses are in Msun/h, and the splashback radius is given as a
+# multiple of R200m. The splashback surface can be made into an ellipsoid with
+# the given axis ratios. Its axes are aligned with the x, y, and z axes, and
+# its volume is the same as the volume of a sphere with the splashback radius.
+# SyntheticHaloBA, SyntheticHaloCA, and SyntheticSubhalos are optional.
+# SyntheticHaloX = 5, 15
+# SyntheticHaloY = 5, 15
+# SyntheticHaloZ = 5, 15
+# SyntheticHaloM200m = 1e14, 3e13
+# SyntheticHaloC200m = 5, 8
+# SyntheticHaloRspMult = 1.2, 1.4
+# SyntheticHaloBA = 1, 0.8
+# SyntheticHaloCA = 1, 0.6
+# SyntheticSubhalos = 0, 5
+#
+# SyntheticCausticContrast is the ratio of the density just outside the
+# splashback radius to the density just inside it. Outside the splashback
+# radius, the profile continues out to SyntheticROuterMult * R200m. Subhalos
+# are NFW halos with a mass of SyntheticSubhaloMassRatio * M200m, placed
+# randomly inside their host.
+# SyntheticCausticContrast = 0.1
+# SyntheticROuterMult = 4
+# SyntheticSubhaloMassRatio = 0.01
+#
+# Particles are split into SyntheticBlocks slabs along the x-axis, and the
+# random numbers used to generate them are set by SyntheticSeed.
+# SyntheticBlocks = 1
+# SyntheticSeed = 0
+#
+# If SyntheticCatalogDir is set, running
+#
+#     shellfish synthetic
+#
+# writes a Text halo catalog for each snapshot to this directory. Run it once
+# before the other tools, and again whenever the synthetic halos are changed.
+# Catalogs which are already up to date aren't rewritten. The columns are ID,
+# X, Y, Z, M200m, R200m, R_sp, a_sp, b_sp, and c_sp, with lengths in cMpc/h.
+# IDs are the index of each halo in the lists above. To read the catalogs, set
+# HaloType = Text, set HaloDir to the same directory, and set
+# HaloValueNames = ID, X, Y, Z, M200m
+# HaloValueColumns = 0, 1, 2, 3, 4
+# HaloPositionUnits = cMpc/h
+# HaloRadiusUnits = cMpc/h
+# HaloMassUnits = Msun/h
+# HaloDir shouldn't contain any other files.
+# SyntheticCatalogDir = path/to/catalog/dir
+
 ##########################################
 ## nil (SnapshotType)-specifc variables ##
 ##########################################
@@ -649,10 +1629,32 @@ Logging = nil
 // Run is a dummy method which allows GlobalConfig to conform to the Mode
 // interface for testing purposes.
 func (config *GlobalConfig) Run(
-	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
-) ([]string, error) {
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
 	panic("GlobalConfig.Run() should never be executed.")
 }
 
-// This needs to be global for debugging purposes.
+// randSeed is the seed of every random number generator. It's set from the
+// current time unless SetSeed is called with a config whose Seed variable is
+// set.
 var randSeed = uint64(time.Now().UnixNano())
+
+// SetSeed sets the seed of every random number generator from the Seed
+// variable of the global config file which is being run. Reading other config
+// files, like the copy in MemoDir, doesn't change the seed.
+func SetSeed(config *GlobalConfig) {
+	if config.Seed >= 0 {
+		randSeed = uint64(config.Seed)
+	}
+}
+
+// haloRand returns a random number generator for the halo with the given ID
+// and snapshot. keys can be used to get independent generators for different
+// parts of a halo's analysis. The random numbers drawn for a halo only depend
+// on randSeed, so results don't change with the number of threads or with the
+// order that halos are analyzed in.
+func haloRand(id, snap int, keys ...int) *rand.Generator {
+	keys = append([]int{id, snap}, keys...)
+	return rand.New(rand.Xorshift, rand.DeriveSeed(randSeed, keys...))
+}
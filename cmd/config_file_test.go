@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -30,10 +32,45 @@ func TestExampleFiles(t *testing.T) {
 			panic(err.Error())
 		}
 
-		err = mode.ReadConfig(f.Name())
+		err = mode.ReadConfig(f.Name(), nil)
 		if err != nil {
 			t.Errorf("%d) Got error when parsing config file:\n%s",
 				i, err.Error())
 		}
 	}
 }
+
+// readSeedConfig reads the example global config file with its Seed
+// variable set to seed.
+func readSeedConfig(t *testing.T, seed int) *GlobalConfig {
+	f, err := ioutil.TempFile("", "shellfish_seed_test")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	text := strings.Replace((&GlobalConfig{}).ExampleConfig(),
+		"Seed = -1", fmt.Sprintf("Seed = %d", seed), 1)
+	if _, err = f.Write([]byte(text)); err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+
+	config := &GlobalConfig{}
+	if err := config.ReadConfig(f.Name(), nil); err != nil {
+		t.Fatalf("ReadConfig returned error: %s", err.Error())
+	}
+	return config
+}
+
+func TestSetSeed(t *testing.T) {
+	defer func(seed uint64) { randSeed = seed }(randSeed)
+
+	SetSeed(readSeedConfig(t, 3))
+	// Reading a second config file, as checkMemoDir does, shouldn't change
+	// the seed.
+	memoConfig := readSeedConfig(t, 5)
+	if memoConfig.Seed != 5 || randSeed != 3 {
+		t.Errorf("Expected Seed = 5 and randSeed = 3, got %d and %d.",
+			memoConfig.Seed, randSeed)
+	}
+}
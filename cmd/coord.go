@@ -16,6 +16,8 @@ import (
 
 type CoordConfig struct {
 	values []string
+
+	configRecord
 }
 
 var _ Mode = &CoordConfig{}
@@ -31,6 +33,7 @@ Values = X, Y, Z, R200m
 
 func (config *CoordConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("coord.config")
+	defer config.record(vars)
 	vars.Strings(&config.values, "Values", []string{"X", "Y", "Z", "R200m"})
 
 	if fname == "" {
@@ -58,6 +61,16 @@ func (config *CoordConfig) validate(vars *halo.VarColumns) error {
 }
 
 func (config *CoordConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	return runBatches(in, out, func(stdin []byte) ([]string, error) {
+		return config.run(gConfig, e, stdin)
+	})
+}
+
+// run executes the mode on a single batch of input.
+func (config *CoordConfig) run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 
@@ -83,9 +96,30 @@ func (config *CoordConfig) Run(
 		return nil, fmt.Errorf("In input IDs.")
 	}
 
+	cols, err := config.haloCoords(gConfig, e, ids, snaps)
+	if err != nil {
+		return nil, err
+	}
+	lines := config.formatCols(gConfig, ids, snaps, cols)
+
+	cString := makeCommentString(gConfig, config)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// haloCoords reads the requested values of the given halos from the halo
+// catalogs. The returned columns are in the same order as Values.
+func (config *CoordConfig) haloCoords(
+	gConfig *GlobalConfig, e *env.Environment, ids, snaps []int,
+) ([][]float64, error) {
 	vars := halo.NewVarColumns(
 		gConfig.HaloValueNames, gConfig.HaloValueColumns,
-		gConfig.HaloRadiusUnits,
+		gConfig.HaloRadiusUnits, gConfig.HaloType,
 	)
 	if err := config.validate(vars); err != nil {
 		return nil, err
@@ -98,13 +132,16 @@ func (config *CoordConfig) Run(
 		return nil, err
 	}
 
-	cols, err := readHaloCoords(
+	return readHaloCoords(
 		ids, snaps, config.values, vars, buf, e, gConfig,
 	)
-	if err != nil {
-		return nil, err
-	}
+}
 
+// formatCols returns the lines of a coord catalog. Integer-valued variables
+// are written as ints.
+func (config *CoordConfig) formatCols(
+	gConfig *GlobalConfig, ids, snaps []int, cols [][]float64,
+) []string {
 	icols := [][]int{ids, snaps}
 	fcols := [][]float64{}
 	icolOrder := []int{0, 1}
@@ -144,16 +181,7 @@ func (config *CoordConfig) Run(
 	}
 
 	colOrder := append(icolOrder, fcolOrder...)
-	lines := catalog.FormatCols(icols, fcols, colOrder)
-
-	cString := makeCommentString(gConfig, config)
-
-	if logging.Mode == logging.Performance {
-		log.Printf("Time: %s", time.Since(t).String())
-		log.Printf("Memory:\n%s", logging.MemString())
-	}
-
-	return append([]string{cString}, lines...), nil
+	return catalog.FormatCols(icols, fcols, colOrder)
 }
 
 func isIntType(comment string) bool {
@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+type CutoutConfig struct {
+	cutoutDir string
+	rMaxMult  float64
+
+	configRecord
+}
+
+var _ Mode = &CutoutConfig{}
+
+func (config *CutoutConfig) ExampleConfig() string {
+	return `[cutout.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# CutoutDir is the directory that cutout files are written to. One file,
+# cutout_<snap>.dat, is written for every snapshot in the input catalog, and
+# any existing files with the same names are overwritten. To analyze the
+# cutouts, make a copy of your global config file with
+#
+# SnapshotType = cutout
+# SnapshotFormat = <CutoutDir>/cutout_%d.dat
+# SnapshotFormatMeanings = Snapshot
+#
+# and a different MemoDir.
+CutoutDir = path/to/cutout/dir
+
+#####################
+## Optional Fields ##
+#####################
+
+# RMaxMult is the radius of the cutout around each halo as a multiplier of
+# R200m. It needs to be at least as large as the RMaxMult used by any mode
+# which reads the cutouts, or those modes will miss particles.
+# RMaxMult = 3.0
+`
+}
+
+func (config *CutoutConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("cutout.config")
+	defer config.record(vars)
+
+	vars.String(&config.cutoutDir, "CutoutDir", "")
+	vars.Float(&config.rMaxMult, "RMaxMult", 3)
+
+	if fname == "" {
+		if len(flags) == 0 {
+			return config.validate()
+		}
+
+		err := parse.ReadFlags(flags, vars)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := parse.ReadConfig(fname, vars); err != nil {
+			return err
+		}
+		if err := parse.ReadFlags(flags, vars); err != nil {
+			return err
+		}
+	}
+
+	return config.validate()
+}
+
+func (config *CutoutConfig) validate() error {
+	if config.cutoutDir == "" {
+		return fmt.Errorf("The variable 'CutoutDir' was not set.")
+	} else if info, err := os.Stat(config.cutoutDir); err != nil ||
+		!info.IsDir() {
+		return fmt.Errorf("The variable 'CutoutDir' was set to '%s', which "+
+			"isn't a directory.", config.cutoutDir)
+	} else if config.rMaxMult <= 0 {
+		return fmt.Errorf("The variable 'RMaxMult' was set to %g.",
+			config.rMaxMult)
+	}
+	return nil
+}
+
+// Run executes the cutout mode. Every halo in a snapshot needs to be in the
+// same cutout file, so the whole input is read before anything is written.
+func (config *CutoutConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	stdin, err := in.ReadAll()
+	if err != nil {
+		return err
+	}
+	lines, err := config.run(gConfig, e, stdin)
+	if err != nil {
+		return err
+	} else if len(lines) == 0 {
+		return nil
+	}
+
+	out.WriteHeader(lines[0])
+	return out.WriteRows(lines[1:])
+}
+
+// run executes the mode on the full input.
+func (config *CutoutConfig) run(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) ([]string, error) {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+######################
+## shellfish cutout ##
+######################`,
+		)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+	}
+
+	icols, coords, err := catalog.Parse(
+		stdin, []int{0, 1}, []int{2, 3, 4, 5},
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, snaps := icols[0], icols[1]
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("No input halos.")
+	}
+
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+	pf, err := newPrefetcher(buf, e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int, len(ids))
+	_, idxBins := binBySnap(snaps, ids)
+	for _, snap := range snapOrder(snaps) {
+		if snap == -1 {
+			continue
+		}
+		idxs := idxBins[snap]
+
+		c, err := config.cutoutSnap(snap, ids, idxs, coords, pf, e, gConfig)
+		if err != nil {
+			return nil, err
+		}
+		fname := path.Join(
+			config.cutoutDir, fmt.Sprintf("cutout_%d.dat", snap),
+		)
+		if err = io.WriteCutout(fname, c); err != nil {
+			return nil, err
+		}
+		for j, idx := range idxs {
+			counts[idx] = int(c.Halos[j].N)
+		}
+
+		if logging.Mode == logging.Performance {
+			log.Printf("Wrote %d particles to %s.", len(c.Xs), fname)
+			log.Printf("Time: %s", time.Since(t).String())
+			log.Printf("Memory:\n%s", logging.MemString())
+		}
+	}
+
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps, counts}, coords, []int{0, 1, 3, 4, 5, 6, 2},
+	)
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot", "N"},
+		[]string{"X [cMpc/h]", "Y [cMpc/h]", "Z [cMpc/h]", "R200m [cMpc/h]"},
+		[]int{0, 1, 3, 4, 5, 6, 2}, []int{1, 1, 1, 1, 1, 1, 1},
+	)
+
+	return append([]string{cString}, lines...), nil
+}
+
+// cutoutSnap collects the particles within RMaxMult*R200m of the halos at the
+// indices idxs, all of which are in snapshot snap. A particle which is near
+// several halos is given to the first of them.
+func (config *CutoutConfig) cutoutSnap(
+	snap int, ids, idxs []int, coords [][]float64,
+	pf *io.Prefetcher, e *env.Environment, gConfig *GlobalConfig,
+) (*io.Cutout, error) {
+	hds, files, err := memo.ReadHeaders(snap, pf.Buffer(), e)
+	if err != nil {
+		return nil, err
+	}
+
+	spheres := make([]geom.Sphere, len(idxs))
+	for j, idx := range idxs {
+		spheres[j].C = [3]float32{
+			float32(coords[0][idx]), float32(coords[1][idx]),
+			float32(coords[2][idx]),
+		}
+		spheres[j].R = float32(coords[3][idx] * config.rMaxMult)
+	}
+	_, intrIdxs := binSphereIntersections(hds, spheres)
+	blocks, names := usedBlocks(files, func(i int) bool {
+		return len(intrIdxs[i]) > 0
+	})
+
+	// Particles are collected separately for each halo so that each halo's
+	// particles are contiguous in the file.
+	parts := make([]io.Cutout, len(idxs))
+	taken := []bool{}
+	err = pf.ReadChunks(names, io.AllFields, int(gConfig.ChunkSize),
+		func(k int, chunk *io.Chunk) error {
+			i := blocks[k]
+			tw := float32(hds[i].TotalWidth)
+
+			taken = taken[:0]
+			for range chunk.Xs {
+				taken = append(taken, false)
+			}
+
+			for _, j := range intrIdxs[i] {
+				p := &parts[j]
+				for n := range chunk.Xs {
+					if taken[n] || !inPeriodicSphere(
+						&chunk.Xs[n], &spheres[j], tw,
+					) {
+						continue
+					}
+					taken[n] = true
+					p.Xs = append(p.Xs, chunk.Xs[n])
+					p.Vs = append(p.Vs, chunk.Vs[n])
+					p.Ms = append(p.Ms, chunk.Ms[n])
+					p.IDs = append(p.IDs, chunk.IDs[n])
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &io.Cutout{
+		Cosmo:      hds[0].Cosmo,
+		TotalWidth: hds[0].TotalWidth,
+		MinMass:    pf.Buffer().MinMass(),
+		Halos:      make([]io.CutoutHalo, len(idxs)),
+	}
+	for j, idx := range idxs {
+		c.Halos[j] = io.CutoutHalo{
+			ID: int64(ids[idx]), Snap: int64(snap),
+			X: coords[0][idx], Y: coords[1][idx], Z: coords[2][idx],
+			R:     float64(spheres[j].R),
+			Start: int64(len(c.Xs)), N: int64(len(parts[j].Xs)),
+		}
+		c.Xs = append(c.Xs, parts[j].Xs...)
+		c.Vs = append(c.Vs, parts[j].Vs...)
+		c.Ms = append(c.Ms, parts[j].Ms...)
+		c.IDs = append(c.IDs, parts[j].IDs...)
+	}
+
+	return c, nil
+}
+
+// inPeriodicSphere returns true if x is inside s in a periodic box of width
+// tw. Displacements are wrapped in the same way as Halo.Transform.
+func inPeriodicSphere(x *[3]float32, s *geom.Sphere, tw float32) bool {
+	tw2 := tw / 2
+	r2 := float32(0)
+	for d := 0; d < 3; d++ {
+		dx := x[d] - s.C[d]
+		if dx > tw2 {
+			dx -= tw
+		} else if dx < -tw2 {
+			dx += tw
+		}
+		r2 += dx * dx
+	}
+	return r2 <= s.R*s.R
+}
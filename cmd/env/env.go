@@ -2,9 +2,10 @@ package env
 
 import (
 	"fmt"
-	"io/ioutil"
 	"strconv"
 	"strings"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
 )
 
 ///////////
@@ -21,12 +22,21 @@ const (
 	Gotetra CatalogType = iota
 	LGadget2
 	Gadget2
+	HDF5Gadget
 	ARTIO
 	Bolshoi
 	BolshoiP
+	Raw
+	Tipsy
+	Ramses
+	Cutout
+	Synthetic
 	Nil
 
 	Rockstar HaloType = iota
+	RockstarBinary
+	AHF
+	Subfind
 	NilHalo
 
 	ConsistentTrees TreeType = iota
@@ -55,17 +65,43 @@ type ParticleInfo struct {
 
 type HaloInfo struct {
 	HaloDir, TreeDir   string
+	HaloFormat         string
+	HaloFormatMeanings []string
+	HaloBlockMins      []int64
+	HaloBlockMaxes     []int64
+
 	HSnapMin, HSnapMax int64
+	HScaleFactorFile   string
 }
 
 func (info *ParticleInfo) GetColumn(
 	i int,
 ) (col []interface{}, snapAligned bool, err error) {
+	return formatColumn(
+		info.SnapshotFormatMeanings[i], info.SnapMin, info.SnapMax,
+		info.BlockMins, info.BlockMaxes, info.ScaleFactorFile,
+	)
+}
+
+// GetColumn is the HaloFormat version of ParticleInfo.GetColumn.
+func (info *HaloInfo) GetColumn(
+	i int,
+) (col []interface{}, snapAligned bool, err error) {
+	return formatColumn(
+		info.HaloFormatMeanings[i], info.HSnapMin, info.HSnapMax,
+		info.HaloBlockMins, info.HaloBlockMaxes, info.HScaleFactorFile,
+	)
+}
 
-	m := info.SnapshotFormatMeanings[i]
+// formatColumn returns the values taken by a format specifier with the
+// meaning m.
+func formatColumn(
+	m string, snapMin, snapMax int64, blockMins, blockMaxes []int64,
+	scaleFactorFile string,
+) (col []interface{}, snapAligned bool, err error) {
 	switch {
 	case m == "ScaleFactor":
-		bs, err := ioutil.ReadFile(info.ScaleFactorFile)
+		bs, err := compress.ReadFile(scaleFactorFile)
 		if err != nil {
 			return nil, false, err
 		}
@@ -80,19 +116,19 @@ func (info *ParticleInfo) GetColumn(
 			}
 		}
 
-		if len(out) != int(info.SnapMax-info.SnapMin)+1 {
+		if len(out) != int(snapMax-snapMin)+1 {
 			return nil, false, fmt.Errorf(
 				"%s has %d non-empty lines, but SnapMax = %d and SnapMin = %d.",
-				info.ScaleFactorFile, len(out), info.SnapMax, info.SnapMin,
+				scaleFactorFile, len(out), snapMax, snapMin,
 			)
 		}
 
 		return anonymize(out), true, nil
 
 	case m == "Snapshot":
-		out := make([]int, int(info.SnapMax-info.SnapMin)+1)
+		out := make([]int, int(snapMax-snapMin)+1)
 		for i := range out {
-			out[i] = i + int(info.SnapMin)
+			out[i] = i + int(snapMin)
 		}
 		return anonymize(out), true, nil
 
@@ -105,9 +141,9 @@ func (info *ParticleInfo) GetColumn(
 				return nil, false, err
 			}
 		}
-		out := make([]int, info.BlockMaxes[idx]-info.BlockMins[idx]+1)
+		out := make([]int, blockMaxes[idx]-blockMins[idx]+1)
 		for i := range out {
-			out[i] = i + int(info.BlockMins[idx])
+			out[i] = i + int(blockMins[idx])
 		}
 		return anonymize(out), false, nil
 	}
@@ -159,10 +195,12 @@ type Halos struct {
 	TreeType
 	snapMin    int
 	snapOffset int
-	names      []string
+	names      [][]string
 }
 
-func (h *Halos) HaloCatalog(snap int) string {
+// HaloCatalog returns the files which make up the halo catalog of the given
+// snapshot.
+func (h *Halos) HaloCatalog(snap int) []string {
 	return h.names[snap-h.snapMin]
 }
 
@@ -0,0 +1,227 @@
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+var (
+	// rockstarBinaryName matches Rockstar's halos_<snap>.<block>.bin files.
+	rockstarBinaryName = regexp.MustCompile(`^halos_(\d+)\.(\d+)\.bin$`)
+	// ahfName matches AHF's <prefix>.z<redshift>.AHF_halos files. MPI runs
+	// put a task number in the prefix.
+	ahfName = regexp.MustCompile(`\.z(\d+\.\d+)\.AHF_halos$`)
+	// subfindName matches Subfind's subhalo_tab_<snap>.<block> files. Runs
+	// with a single task leave off the block.
+	subfindName = regexp.MustCompile(`^subhalo_tab_(\d+)(?:\.(\d+))?$`)
+)
+
+// haloFile is a halo catalog file along with the values used to group it
+// into snapshots and to order it.
+type haloFile struct {
+	name  string
+	snap  float64
+	block int
+}
+
+type haloFiles []haloFile
+
+func (fs haloFiles) Len() int      { return len(fs) }
+func (fs haloFiles) Swap(i, j int) { fs[i], fs[j] = fs[j], fs[i] }
+func (fs haloFiles) Less(i, j int) bool {
+	if fs[i].snap != fs[j].snap {
+		return fs[i].snap < fs[j].snap
+	}
+	return fs[i].block < fs[j].block
+}
+
+func (h *Halos) InitRockstarBinaryHalo(info *HaloInfo) error {
+	return h.initHaloFiles(info, RockstarBinary, "Rockstar-Binary")
+}
+
+func (h *Halos) InitAHFHalo(info *HaloInfo) error {
+	return h.initHaloFiles(info, AHF, "AHF")
+}
+
+func (h *Halos) InitSubfindHalo(info *HaloInfo) error {
+	return h.initHaloFiles(info, Subfind, "Subfind")
+}
+
+// initHaloFiles finds the files of each snapshot's halo catalog.
+func (h *Halos) initHaloFiles(
+	info *HaloInfo, haloType HaloType, typeName string,
+) error {
+	h.HaloType = haloType
+	h.TreeType = ConsistentTrees
+
+	names, snapOffset, err := info.HaloCatalogFiles(typeName)
+	if err != nil {
+		return err
+	}
+
+	h.names = names
+	h.snapOffset = snapOffset
+	h.snapMin = int(info.HSnapMin)
+
+	return nil
+}
+
+// HaloCatalogFiles returns the files which make up the halo catalogs of the
+// snapshots from HSnapMin to HSnapMax, along with the snapshot offset of the
+// merger trees (see Halos.SnapOffset).
+//
+// If HaloFormat is set, the files are given by HaloFormat and
+// HaloFormatMeanings and an error is returned if any of them don't exist. The
+// merger trees are assumed to start at HSnapMin. Otherwise, the last
+// HSnapMax - HSnapMin + 1 snapshots in HaloDir are used.
+func (info *HaloInfo) HaloCatalogFiles(
+	haloType string,
+) (names [][]string, snapOffset int, err error) {
+	if info.HaloFormat == "" {
+		names, err = HaloFiles(haloType, info.HaloDir)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		snapOffset = int(info.HSnapMax) - len(names)
+		if len(names) < int(info.HSnapMax-info.HSnapMin)+1 {
+			return nil, 0, fmt.Errorf(
+				"There are %d snapshots in the 'HaloDir' directory, %s, but "+
+					"'SnapMin' = %d and 'SnapMax' = %d.",
+				len(names), info.HaloDir, info.HSnapMin, info.HSnapMax,
+			)
+		}
+		return names[len(names)-int(info.HSnapMax-info.HSnapMin+1):],
+			snapOffset, nil
+	}
+
+	cols := make([][]interface{}, len(info.HaloFormatMeanings))
+	snapAligned := make([]bool, len(info.HaloFormatMeanings))
+	for i := range cols {
+		cols[i], snapAligned[i], err = info.GetColumn(i)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	formatArgs := interleave(cols, snapAligned)
+	names = [][]string{}
+	for snap := range formatArgs {
+		snapNames := []string{}
+		for block := range formatArgs[snap] {
+			name := fmt.Sprintf(info.HaloFormat, formatArgs[snap][block]...)
+			if _, err := os.Stat(name); err != nil {
+				return nil, 0, fmt.Errorf("'HaloFormat' gives %s as a "+
+					"halo catalog of snapshot %d, but it doesn't exist.",
+					name, snap+int(info.HSnapMin))
+			}
+			snapNames = append(snapNames, name)
+		}
+		names = append(names, snapNames)
+	}
+
+	return names, int(info.HSnapMin) - 1, nil
+}
+
+// HaloFiles returns the halo catalog files of the given HaloType in dir.
+// Each element contains the files of a single snapshot, and the snapshots are
+// in temporal order. Text catalogs are assumed to have one file per snapshot
+// and to be in temporal order when sorted by name.
+func HaloFiles(haloType, dir string) ([][]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := haloFiles{}
+	for i, info := range infos {
+		name := compress.TrimExt(info.Name())
+		file := haloFile{name: path.Join(dir, info.Name())}
+
+		switch haloType {
+		case "Text":
+			file.snap = float64(i)
+		case "Rockstar-Binary":
+			m := rockstarBinaryName.FindStringSubmatch(name)
+			if m == nil {
+				continue
+			}
+			file.snap, _ = strconv.ParseFloat(m[1], 64)
+			file.block, _ = strconv.Atoi(m[2])
+		case "AHF":
+			m := ahfName.FindStringSubmatch(name)
+			if m == nil {
+				continue
+			}
+			// Later snapshots have smaller redshifts.
+			z, _ := strconv.ParseFloat(m[1], 64)
+			file.snap = -z
+		case "Subfind":
+			subFiles, err := subfindFiles(dir, info.Name(), info.IsDir())
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, subFiles...)
+			continue
+		default:
+			panic(fmt.Sprintf("Unknown HaloType '%s'", haloType))
+		}
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("There aren't any %s halo catalogs in the "+
+			"'HaloDir' directory, %s.", haloType, dir)
+	}
+
+	sort.Stable(files)
+	out := [][]string{}
+	for i := range files {
+		if i == 0 || files[i].snap != files[i-1].snap {
+			out = append(out, []string{})
+		}
+		out[len(out)-1] = append(out[len(out)-1], files[i].name)
+	}
+
+	return out, nil
+}
+
+// subfindFiles returns the Subfind files called name in dir. Subfind usually
+// writes each snapshot's files to their own groups_<snap> directory, so if name
+// is a directory, the files inside it are returned instead.
+func subfindFiles(dir, name string, isDir bool) (haloFiles, error) {
+	if !isDir {
+		m := subfindName.FindStringSubmatch(compress.TrimExt(name))
+		if m == nil {
+			return nil, nil
+		}
+		snap, _ := strconv.ParseFloat(m[1], 64)
+		block, _ := strconv.Atoi(m[2])
+		return haloFiles{{path.Join(dir, name), snap, block}}, nil
+	}
+
+	subDir := path.Join(dir, name)
+	infos, err := ioutil.ReadDir(subDir)
+	if err != nil {
+		return nil, err
+	}
+	files := haloFiles{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		subFiles, err := subfindFiles(subDir, info.Name(), false)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, subFiles...)
+	}
+	return files, nil
+}
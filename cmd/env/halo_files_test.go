@@ -0,0 +1,120 @@
+package env
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHaloFiles(t *testing.T) {
+	tests := []struct {
+		haloType string
+		files    []string
+		snaps    [][]string
+	}{
+		{"Text", []string{"out_8.list", "out_9.list"},
+			[][]string{{"out_8.list"}, {"out_9.list"}}},
+		{"Rockstar-Binary", []string{
+			"halos_10.0.bin", "halos_9.1.bin", "halos_9.0.bin",
+			"halos_10.10.bin", "halos_10.2.bin", "README",
+		}, [][]string{
+			{"halos_9.0.bin", "halos_9.1.bin"},
+			{"halos_10.0.bin", "halos_10.2.bin", "halos_10.10.bin"},
+		}},
+		{"AHF", []string{
+			"snap_001.0000.z0.000.AHF_halos", "snap_001.0001.z0.000.AHF_halos",
+			"snap_000.0000.z1.500.AHF_halos.gz", "snap_000.z1.500.AHF_profiles",
+		}, [][]string{
+			{"snap_000.0000.z1.500.AHF_halos.gz"},
+			{"snap_001.0000.z0.000.AHF_halos",
+				"snap_001.0001.z0.000.AHF_halos"},
+		}},
+		{"Subfind", []string{
+			"groups_003/subhalo_tab_003.1", "groups_003/subhalo_tab_003.0",
+			"groups_003/group_tab_003.0", "subhalo_tab_002",
+		}, [][]string{
+			{"subhalo_tab_002"},
+			{"groups_003/subhalo_tab_003.0", "groups_003/subhalo_tab_003.1"},
+		}},
+	}
+
+	for i, test := range tests {
+		dir, err := ioutil.TempDir("", "shellfish_halo_files")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(dir)
+
+		for _, file := range test.files {
+			fname := path.Join(dir, file)
+			if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := ioutil.WriteFile(fname, []byte{}, 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+
+		snaps, err := HaloFiles(test.haloType, dir)
+		if err != nil {
+			t.Errorf("%d) HaloFiles returned error: %s", i, err.Error())
+			continue
+		}
+		for j := range test.snaps {
+			for k := range test.snaps[j] {
+				test.snaps[j][k] = path.Join(dir, test.snaps[j][k])
+			}
+		}
+		if fmt.Sprint(snaps) != fmt.Sprint(test.snaps) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.snaps, snaps)
+		}
+	}
+}
+
+func TestHaloCatalogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_halo_format")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for snap := 4; snap <= 5; snap++ {
+		for block := 0; block < 2; block++ {
+			fname := path.Join(dir, fmt.Sprintf("halos_%d.%d.bin", snap, block))
+			if err := ioutil.WriteFile(fname, []byte{}, 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	info := &HaloInfo{
+		HaloFormat:         path.Join(dir, "halos_%d.%d.bin"),
+		HaloFormatMeanings: []string{"Snapshot", "Block"},
+		HaloBlockMins:      []int64{0},
+		HaloBlockMaxes:     []int64{1},
+		HSnapMin:           4,
+		HSnapMax:           5,
+	}
+
+	names, snapOffset, err := info.HaloCatalogFiles("Rockstar-Binary")
+	if err != nil {
+		t.Fatalf("HaloCatalogFiles returned error: %s", err.Error())
+	}
+	expected := [][]string{
+		{path.Join(dir, "halos_4.0.bin"), path.Join(dir, "halos_4.1.bin")},
+		{path.Join(dir, "halos_5.0.bin"), path.Join(dir, "halos_5.1.bin")},
+	}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v.", expected, names)
+	}
+	if snapOffset != 3 {
+		t.Errorf("Expected snapshot offset 3, got %d.", snapOffset)
+	}
+
+	info.HSnapMax = 6
+	if _, _, err := info.HaloCatalogFiles("Rockstar-Binary"); err == nil {
+		t.Errorf("Expected error for missing halo catalog files.")
+	}
+}
@@ -0,0 +1,28 @@
+package env
+
+import (
+	"fmt"
+)
+
+// InitSynthetic sets up the names of synthetic snapshots. These don't
+// correspond to files on disk: they're parsed by io.SyntheticBuffer, so they
+// must follow io.SyntheticFileFormat.
+func (cat *Catalogs) InitSynthetic(
+	info *ParticleInfo, blocks int64, validate bool,
+) error {
+	cat.CatalogType = Synthetic
+	cat.snapMin = int(info.SnapMin)
+	cat.names = make([][]string, info.SnapMax-info.SnapMin+1)
+
+	for i := range cat.names {
+		cat.names[i] = make([]string, blocks)
+		for b := range cat.names[i] {
+			cat.names[i][b] = fmt.Sprintf("synthetic_%d_%d", i, b)
+		}
+	}
+
+	if validate {
+		panic("File validation not yet implemented.")
+	}
+	return nil
+}
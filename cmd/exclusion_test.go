@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/los/analyze"
+)
+
+// sphereCoeffs returns the l = 0 harmonic coefficients of a sphere with
+// radius r.
+func sphereCoeffs(r float64) []float64 {
+	return []float64{r * math.Sqrt(4*math.Pi)}
+}
+
+func sphere(r float64) analyze.Shell {
+	return func(phi, theta float64) float64 { return r }
+}
+
+// elongated is a shell which has radius long along the x-axis and radius 1
+// everywhere else.
+func elongated(long float64) analyze.Shell {
+	return func(phi, theta float64) float64 {
+		x := math.Abs(math.Sin(theta) * math.Cos(phi))
+		return 1 + (long-1)*math.Pow(x, 8)
+	}
+}
+
+func TestShellContains(t *testing.T) {
+	tests := []struct {
+		shell    analyze.Shell
+		x, y, z  float64
+		contains bool
+	}{
+		{sphere(1), 0, 0, 0, true},
+		{sphere(1), 0.5, 0.5, 0.5, true},
+		{sphere(1), 0.6, 0.6, 0.6, false},
+		{sphere(1), 0, 0, -1.1, false},
+		{elongated(3), 2.5, 0, 0, true},
+		{elongated(3), 0, 2.5, 0, false},
+	}
+
+	for i, test := range tests {
+		contains := shellContains(test.shell, test.x, test.y, test.z)
+		if contains != test.contains {
+			t.Errorf("%d) Expected shellContains(%g, %g, %g) = %v.",
+				i, test.x, test.y, test.z, test.contains)
+		}
+	}
+}
+
+func TestShellsOverlap(t *testing.T) {
+	tests := []struct {
+		s1, s2     analyze.Shell
+		dx, dy, dz float64
+		overlap    bool
+	}{
+		{sphere(1), sphere(1), 1.5, 0, 0, true},
+		{sphere(1), sphere(1), 0, -1.9, 0, true},
+		{sphere(1), sphere(1), 2.1, 0, 0, false},
+		// Neither center is inside the other shell.
+		{sphere(1), sphere(0.5), 0, 0, 1.3, true},
+		{sphere(1), sphere(0.2), 0, 0, 1.3, false},
+		// Only the elongated direction reaches the other shell.
+		{elongated(3), sphere(0.5), 3.2, 0, 0, true},
+		{elongated(3), sphere(0.5), 0, 3.2, 0, false},
+		{sphere(0.5), elongated(3), -3.2, 0, 0, true},
+	}
+
+	for i, test := range tests {
+		rmax1, rmax2 := shellGridRMax(test.s1), shellGridRMax(test.s2)
+		overlap := shellsOverlap(
+			test.s1, test.s2, rmax1, rmax2, test.dx, test.dy, test.dz,
+		)
+		if overlap != test.overlap {
+			t.Errorf("%d) Expected shellsOverlap(%g, %g, %g) = %v.",
+				i, test.dx, test.dy, test.dz, test.overlap)
+		}
+	}
+}
+
+func TestFindExcludedHalos(t *testing.T) {
+	width := 100.0
+	// Halo 1 is across the periodic boundary from halo 0 and halo 2 is
+	// across the boundary from halo 3. Halo 4 is far from everything, and
+	// halo 5 touches halo 4 but has the same R200m.
+	coords := [][]float64{
+		{99.5, 0.7, 50, 50, 20, 20},
+		{50, 50, 0.2, 99.4, 50, 50},
+		{50, 50, 50, 50, 50, 51.5},
+		{2, 1, 1, 3, 1, 1},
+	}
+	coeffs := [][]float64{
+		sphereCoeffs(1.5), sphereCoeffs(0.5), sphereCoeffs(0.3),
+		sphereCoeffs(0.6), sphereCoeffs(1), sphereCoeffs(1),
+	}
+
+	tests := []struct {
+		strategy string
+		exclude  []bool
+	}{
+		// Halo 1 is 1.2 from halo 0, so its center is inside halo 0. Halo 2
+		// is 0.8 from halo 3, so it's outside, but the shells overlap.
+		{"contain", []bool{false, true, false, false, false, false}},
+		{"overlap", []bool{false, true, true, false, false, false}},
+	}
+
+	for i, test := range tests {
+		exclude := findExcludedHalos(coords, coeffs, width, test.strategy)
+		if fmt.Sprint(exclude) != fmt.Sprint(test.exclude) {
+			t.Errorf("%d) Expected %s exclusion %v, got %v.",
+				i, test.strategy, test.exclude, exclude)
+		}
+	}
+}
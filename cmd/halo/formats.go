@@ -0,0 +1,442 @@
+package halo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+// rockstarMagic is the first eight bytes of Rockstar's binary halo files.
+const rockstarMagic = 0xfadedacec0c0d0d0
+
+// ahfRedshift matches the redshift in the name of an AHF file.
+var ahfRedshift = regexp.MustCompile(`\.z(\d+\.\d+)\.AHF_halos$`)
+
+// subfindMassUnits converts Subfind's masses, which are in Gadget's usual
+// units of 10^10 Msun/h, to Msun/h.
+const subfindMassUnits = 1e10
+
+// rockstarBinaryHeader is the header of a Rockstar halos_*.bin file.
+type rockstarBinaryHeader struct {
+	Magic                  uint64
+	Snap, Chunk            int64
+	Scale, Om, Ol, H0      float32
+	Bounds                 [6]float32
+	NumHalos, NumParticles int64
+	BoxSize, ParticleMass  float32
+	ParticleType           int64
+	FormatRevision         int32
+	RockstarVersion        [32]byte
+	Unused                 [124]byte
+}
+
+// rockstarBinaryHalo is a halo in a Rockstar halos_*.bin file. It has the
+// layout of Rockstar's struct halo, including its trailing padding.
+type rockstarBinaryHalo struct {
+	ID                                    int64
+	Pos                                   [6]float32
+	CoreVel, BulkVel                      [3]float32
+	M, R, ChildR, VmaxR, MGrav, Vmax      float32
+	RVmax, Rs, KlypinRs, Vrms             float32
+	J                                     [3]float32
+	Energy, Spin                          float32
+	AltM                                  [4]float32
+	Xoff, Voff, BToA, CToA                float32
+	A                                     [3]float32
+	BToA2, CToA2                          float32
+	A2                                    [3]float32
+	BullockSpin, KinToPot, MPeB, MPeD     float32
+	HalfmassRadius                        float32
+	NumP, NumChildParticles, PStart, Desc int64
+	Flags, NCore                          int64
+	MinPosErr, MinVelErr, MinBulkVelErr   float32
+	_                                     [4]byte
+}
+
+// rockstarBinaryNames are the names of the values in rockstarBinaryHalo, in
+// the order returned by row. They're the same as the names in the headers of
+// Rockstar's text catalogs. The alternate masses assume Rockstar's default
+// mass definitions.
+var rockstarBinaryNames = []string{
+	"ID", "X", "Y", "Z", "VX", "VY", "VZ",
+	"CoreVX", "CoreVY", "CoreVZ", "BulkVX", "BulkVY", "BulkVZ",
+	"Mvir", "Rvir", "Child_r", "Vmax_r", "Mvir_all", "Vmax", "Rvmax", "Rs",
+	"rs_klypin", "Vrms", "JX", "JY", "JZ", "Energy", "Spin",
+	"M200b", "M200c", "M500c", "M2500c", "Xoff", "Voff", "b_to_a", "c_to_a",
+	"A[x]", "A[y]", "A[z]", "b_to_a(500c)", "c_to_a(500c)",
+	"A[x](500c)", "A[y](500c)", "A[z](500c)", "Spin_Bullock", "T/|U|",
+	"M_pe_Behroozi", "M_pe_Diemer", "Halfmass_Radius",
+	"Np", "Num_Child_Particles", "P_Start", "DescID", "Flags", "N_Core",
+	"Min_Pos_Err", "Min_Vel_Err", "Min_BulkVel_Err",
+}
+
+// row appends the values of h to buf in the order of rockstarBinaryNames.
+func (h *rockstarBinaryHalo) row(buf []float64) []float64 {
+	buf = append(buf[:0], float64(h.ID))
+	for _, vec := range [][]float32{h.Pos[:], h.CoreVel[:], h.BulkVel[:]} {
+		for _, x := range vec {
+			buf = append(buf, float64(x))
+		}
+	}
+	for _, x := range []float32{
+		h.M, h.R, h.ChildR, h.VmaxR, h.MGrav, h.Vmax, h.RVmax, h.Rs,
+		h.KlypinRs, h.Vrms, h.J[0], h.J[1], h.J[2], h.Energy, h.Spin,
+		h.AltM[0], h.AltM[1], h.AltM[2], h.AltM[3], h.Xoff, h.Voff,
+		h.BToA, h.CToA, h.A[0], h.A[1], h.A[2], h.BToA2, h.CToA2,
+		h.A2[0], h.A2[1], h.A2[2], h.BullockSpin, h.KinToPot, h.MPeB,
+		h.MPeD, h.HalfmassRadius,
+	} {
+		buf = append(buf, float64(x))
+	}
+	for _, x := range []int64{
+		h.NumP, h.NumChildParticles, h.PStart, h.Desc, h.Flags, h.NCore,
+	} {
+		buf = append(buf, float64(x))
+	}
+	for _, x := range []float32{
+		h.MinPosErr, h.MinVelErr, h.MinBulkVelErr,
+	} {
+		buf = append(buf, float64(x))
+	}
+	return buf
+}
+
+// subfindHeader is the header of a Subfind subhalo_tab_* file.
+type subfindHeader struct {
+	NGroups, TotNGroups, NIDs        int32
+	TotNIDs                          int64
+	NTask, NSubgroups, TotNSubgroups int32
+}
+
+// subfindNames are the names of the FoF group values that are read from
+// Subfind files. ID is the index of the group within its snapshot.
+var subfindNames = []string{
+	"ID", "GroupLen", "GroupOffset", "GroupMass", "X", "Y", "Z",
+	"M200m", "R200m", "M200c", "R200c", "MTopHat200", "RTopHat200",
+	"VelDispMean200", "VelDispCrit200", "VelDispTopHat200",
+	"ContaminationCount", "ContaminationMass", "GroupNsubs", "GroupFirstSub",
+}
+
+// subfindFields are the arrays that Subfind writes for its FoF groups, in the
+// order that they're written. Each has width elements per group, which are
+// given names. The velocity dispersions are only written by some runs.
+var subfindFields = []struct {
+	names                  []string
+	width                  int
+	isInt, isMass, velDisp bool
+}{
+	{[]string{"GroupLen"}, 1, true, false, false},
+	{[]string{"GroupOffset"}, 1, true, false, false},
+	{[]string{"GroupMass"}, 1, false, true, false},
+	{[]string{"X", "Y", "Z"}, 3, false, false, false},
+	{[]string{"M200m"}, 1, false, true, false},
+	{[]string{"R200m"}, 1, false, false, false},
+	{[]string{"M200c"}, 1, false, true, false},
+	{[]string{"R200c"}, 1, false, false, false},
+	{[]string{"MTopHat200"}, 1, false, true, false},
+	{[]string{"RTopHat200"}, 1, false, false, false},
+	{[]string{"VelDispMean200"}, 1, false, false, true},
+	{[]string{"VelDispCrit200"}, 1, false, false, true},
+	{[]string{"VelDispTopHat200"}, 1, false, false, true},
+	{[]string{"ContaminationCount"}, 1, true, false, false},
+	{[]string{"ContaminationMass"}, 1, false, true, false},
+	{[]string{"GroupNsubs"}, 1, true, false, false},
+	{[]string{"GroupFirstSub"}, 1, true, false, false},
+}
+
+// ReadHeader returns the names and units of the columns in the halo catalog
+// fname, which has the given HaloType. For binary catalogs, the names are the
+// values that Shellfish knows how to read, and HaloValueColumns index into
+// this list.
+func ReadHeader(haloType, fname string) (*Header, error) {
+	switch haloType {
+	case "Text":
+		return ReadTextHeader(fname)
+	case "AHF":
+		hd, err := ReadTextHeader(fname)
+		if err != nil {
+			return nil, err
+		}
+		hd.PositionUnits, hd.RadiusUnits = "ckpc/h", "ckpc/h"
+		hd.MassUnits = "Msun/h"
+		m := ahfRedshift.FindStringSubmatch(compress.TrimExt(fname))
+		if m != nil {
+			z, _ := strconv.ParseFloat(m[1], 64)
+			hd.ScaleFactor = 1 / (1 + z)
+		}
+		return hd, nil
+	case "Rockstar-Binary":
+		rhd, _, err := readRockstarBinary(fname, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &Header{
+			Names:         rockstarBinaryNames,
+			PositionUnits: "cMpc/h",
+			RadiusUnits:   "ckpc/h",
+			MassUnits:     "Msun/h",
+			ScaleFactor:   float64(rhd.Scale),
+		}, nil
+	case "Subfind":
+		if _, err := readSubfind(fname, nil, 0); err != nil {
+			return nil, err
+		}
+		return &Header{
+			Names: subfindNames, MassUnits: "Msun/h", ScaleFactor: -1,
+		}, nil
+	}
+	panic(fmt.Sprintf("Unknown HaloType '%s'", haloType))
+}
+
+// readCatalog reads the columns colIdxs from the files which make up a halo
+// catalog of the given HaloType.
+func readCatalog(
+	haloType string, files []string, colIdxs []int,
+) ([][]float64, error) {
+	cols := make([][]float64, len(colIdxs))
+	groups := 0
+	for _, file := range files {
+		var (
+			fileCols [][]float64
+			err      error
+		)
+		switch haloType {
+		case "Text", "AHF":
+			fileCols, err = readTable(file, colIdxs)
+		case "Rockstar-Binary":
+			_, fileCols, err = readRockstarBinary(file, colIdxs)
+		case "Subfind":
+			fileCols, err = readSubfind(file, colIdxs, groups)
+		default:
+			panic(fmt.Sprintf("Unknown HaloType '%s'", haloType))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range cols {
+			cols[i] = append(cols[i], fileCols[i]...)
+		}
+		if len(fileCols) > 0 {
+			groups += len(fileCols[0])
+		}
+	}
+	return cols, nil
+}
+
+// readRockstarBinary reads the header and the columns colIdxs of
+// rockstarBinaryNames from a Rockstar halos_*.bin file. Only the parts of the
+// file that are needed are read, so the particle IDs at the end of the file
+// are always skipped.
+func readRockstarBinary(
+	fname string, colIdxs []int,
+) (*rockstarBinaryHeader, [][]float64, error) {
+	f, err := compress.Open(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+
+	hd := &rockstarBinaryHeader{}
+	hdSize, haloSize := binary.Size(hd), binary.Size(&rockstarBinaryHalo{})
+	data := make([]byte, hdSize)
+	if _, err := io.ReadFull(rd, data); err != nil {
+		return nil, nil, fmt.Errorf("%s is too small to be a Rockstar "+
+			"binary halo file.", fname)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case binary.LittleEndian.Uint64(data) == rockstarMagic:
+		order = binary.LittleEndian
+	case binary.BigEndian.Uint64(data) == rockstarMagic:
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("%s doesn't start with Rockstar's "+
+			"magic number, so it isn't a Rockstar binary halo file.", fname)
+	}
+	binary.Read(bytes.NewReader(data), order, hd)
+
+	// The size of a compressed file isn't known without decompressing all of
+	// it, so those are only checked for having enough halos.
+	compressed, err := compress.IsCompressed(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := int64(hdSize) + hd.NumHalos*int64(haloSize) + hd.NumParticles*8
+	fileSize := int64(-1)
+	if !compressed {
+		info, err := os.Stat(fname)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileSize = info.Size()
+	}
+	if hd.NumHalos < 0 || hd.NumParticles < 0 ||
+		(!compressed && size != fileSize) {
+		return nil, nil, fmt.Errorf("The header of the Rockstar binary halo "+
+			"file %s says that it has %d halos and %d particles, which "+
+			"doesn't match its size of %d bytes. Only format revision 2 "+
+			"files can be read, and this file has revision %d.", fname,
+			hd.NumHalos, hd.NumParticles, fileSize, hd.FormatRevision)
+	}
+
+	cols := make([][]float64, len(colIdxs))
+	if len(colIdxs) == 0 {
+		return hd, cols, nil
+	}
+	for i := range cols {
+		cols[i] = make([]float64, hd.NumHalos)
+	}
+
+	h, row := &rockstarBinaryHalo{}, []float64{}
+	for j := int64(0); j < hd.NumHalos; j++ {
+		if err := binary.Read(rd, order, h); err != nil {
+			return nil, nil, fmt.Errorf("The header of the Rockstar binary "+
+				"halo file %s says that it has %d halos, but only %d could "+
+				"be read.", fname, hd.NumHalos, j)
+		}
+		row = h.row(row)
+		for i, idx := range colIdxs {
+			cols[i][j] = row[idx]
+		}
+	}
+
+	return hd, cols, nil
+}
+
+// subfindLayout describes the optional parts of a Subfind file, which depend
+// on the compile-time options of the Gadget run that wrote it.
+type subfindLayout struct {
+	velDisp bool
+	idSize  int64
+}
+
+// size returns the size of a file with this layout.
+func (l subfindLayout) size(hd *subfindHeader) int64 {
+	groupSize, subSize := int64(64), int64(84)+l.idSize
+	if l.velDisp {
+		groupSize += 12
+	}
+	return int64(binary.Size(hd)) +
+		int64(hd.NGroups)*groupSize + int64(hd.NSubgroups)*subSize
+}
+
+// readSubfind reads the columns colIdxs of subfindNames from a Subfind
+// subhalo_tab_* file. The IDs of its groups start at idStart.
+func readSubfind(
+	fname string, colIdxs []int, idStart int,
+) ([][]float64, error) {
+	data, err := compress.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subfind files don't say which byte order or options they were written
+	// with, so every combination is checked against the size of the file.
+	type match struct {
+		order  binary.ByteOrder
+		hd     subfindHeader
+		layout subfindLayout
+	}
+	matches := []match{}
+	for _, o := range []binary.ByteOrder{
+		binary.LittleEndian, binary.BigEndian,
+	} {
+		hd := subfindHeader{}
+		err := binary.Read(bytes.NewReader(data), o, &hd)
+		if err != nil {
+			return nil, fmt.Errorf("%s is too small to be a Subfind file.",
+				fname)
+		} else if hd.NGroups < 0 || hd.NSubgroups < 0 {
+			continue
+		}
+
+		for _, l := range []subfindLayout{
+			{false, 4}, {false, 8}, {true, 4}, {true, 8},
+		} {
+			if l.size(&hd) == int64(len(data)) {
+				matches = append(matches, match{o, hd, l})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("The size of %s doesn't match the size of "+
+			"any Subfind file layout that I know how to read.", fname)
+	}
+
+	// The ID size only changes the subhalos, which aren't read, but the
+	// other differences change how the groups are read.
+	m := matches[0]
+	for _, other := range matches[1:] {
+		sameGroups := other.order == m.order &&
+			other.layout.velDisp == m.layout.velDisp
+		if other.hd != m.hd || (m.hd.NGroups > 0 && !sameGroups) {
+			return nil, fmt.Errorf("The size of %s matches more than one "+
+				"Subfind file layout, so I can't tell whether it has "+
+				"velocity dispersions or which byte order it uses.", fname)
+		}
+	}
+	order, hd, layout := m.order, &m.hd, m.layout
+
+	if len(colIdxs) == 0 {
+		return [][]float64{}, nil
+	}
+
+	n := int(hd.NGroups)
+	vals := map[string][]float64{"ID": make([]float64, n)}
+	for j := range vals["ID"] {
+		vals["ID"][j] = float64(idStart + j)
+	}
+
+	rd := bytes.NewReader(data[binary.Size(hd):])
+	for _, field := range subfindFields {
+		if field.velDisp && !layout.velDisp {
+			continue
+		}
+
+		var raw interface{}
+		if field.isInt {
+			raw = make([]int32, field.width*n)
+		} else {
+			raw = make([]float32, field.width*n)
+		}
+		if err := binary.Read(rd, order, raw); err != nil {
+			return nil, err
+		}
+
+		for k, name := range field.names {
+			col := make([]float64, n)
+			for j := range col {
+				if field.isInt {
+					col[j] = float64(raw.([]int32)[field.width*j+k])
+				} else {
+					col[j] = float64(raw.([]float32)[field.width*j+k])
+				}
+				if field.isMass {
+					col[j] *= subfindMassUnits
+				}
+			}
+			vals[name] = col
+		}
+	}
+
+	cols := make([][]float64, len(colIdxs))
+	for i, idx := range colIdxs {
+		col, ok := vals[subfindNames[idx]]
+		if !ok {
+			return nil, fmt.Errorf("The Subfind file %s doesn't contain "+
+				"%s values.", fname, subfindNames[idx])
+		}
+		cols[i] = col
+	}
+	return cols, nil
+}
@@ -0,0 +1,226 @@
+package halo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeFormatFile(t *testing.T, fname string, xs ...interface{}) {
+	b := &bytes.Buffer{}
+	for _, x := range xs {
+		if err := binary.Write(b, binary.LittleEndian, x); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func writeGzip(t *testing.T, fname string, data []byte) {
+	b := &bytes.Buffer{}
+	gz := gzip.NewWriter(b)
+	gz.Write(data)
+	gz.Close()
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRockstarBinarySize(t *testing.T) {
+	if size := binary.Size(&rockstarBinaryHeader{}); size != 256 {
+		t.Errorf("Expected a 256 byte header, got %d bytes.", size)
+	}
+	if size := binary.Size(&rockstarBinaryHalo{}); size != 264 {
+		t.Errorf("Expected 264 byte halos, got %d bytes.", size)
+	}
+	n := len((&rockstarBinaryHalo{}).row(nil))
+	if n != len(rockstarBinaryNames) {
+		t.Errorf("Rockstar halos have %d values, but %d names.",
+			n, len(rockstarBinaryNames))
+	}
+}
+
+func TestReadRockstarBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_rockstar_binary")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{}
+	for block := 0; block < 2; block++ {
+		hs := make([]rockstarBinaryHalo, 2)
+		for i := range hs {
+			hs[i].ID = int64(10*block + i)
+			hs[i].Pos = [6]float32{1, 2, float32(block), 0, 0, 0}
+			hs[i].AltM[0] = float32(1024 * (i + 1))
+		}
+		hd := rockstarBinaryHeader{
+			Magic: rockstarMagic, Chunk: int64(block), NumHalos: 2,
+			NumParticles: 3, FormatRevision: 2, Scale: 0.5,
+		}
+
+		fname := path.Join(dir, fmt.Sprintf("halos_0.%d.bin", block))
+		writeFormatFile(t, fname, hd, hs, make([]int64, 3))
+		files = append(files, fname)
+	}
+
+	hd, err := ReadHeader("Rockstar-Binary", files[0])
+	if err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	if hd.ScaleFactor != 0.5 {
+		t.Errorf("Expected scale factor 0.5, got %g.", hd.ScaleFactor)
+	}
+	idxs := []int{
+		hd.Column(DefaultAliases["ID"]), hd.Column(DefaultAliases["Z"]),
+		hd.Column(DefaultAliases["M200m"]),
+	}
+
+	cols, err := readCatalog("Rockstar-Binary", files, idxs)
+	if err != nil {
+		t.Fatalf("readCatalog returned error: %s", err.Error())
+	}
+	expected := "[[0 1 10 11] [0 0 1 1] [1024 2048 1024 2048]]"
+	if fmt.Sprint(cols) != expected {
+		t.Errorf("Expected columns %s, got %v.", expected, cols)
+	}
+
+	// Compressed files can be read, but their halos need to all be there.
+	raw, err := ioutil.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	gzFile := path.Join(dir, "halos_0.1.bin.gz")
+	writeGzip(t, gzFile, raw)
+	cols, err = readCatalog("Rockstar-Binary", []string{gzFile}, idxs)
+	if err != nil {
+		t.Fatalf("readCatalog returned error: %s", err.Error())
+	}
+	if fmt.Sprint(cols) != "[[10 11] [1 1] [1024 2048]]" {
+		t.Errorf("Expected columns [[10 11] [1 1] [1024 2048]], got %v.",
+			cols)
+	}
+	writeGzip(t, gzFile, raw[:300])
+	if _, err := ReadHeader("Rockstar-Binary", gzFile); err != nil {
+		t.Errorf("ReadHeader returned error: %s", err.Error())
+	}
+	_, err = readCatalog("Rockstar-Binary", []string{gzFile}, idxs)
+	if err == nil {
+		t.Errorf("Expected error for a truncated compressed file.")
+	}
+
+	// Files with a different halo layout shouldn't be read.
+	writeFormatFile(t, files[0], rockstarBinaryHeader{
+		Magic: rockstarMagic, NumHalos: 1,
+	}, make([]byte, 200))
+	if _, err := ReadHeader("Rockstar-Binary", files[0]); err == nil {
+		t.Errorf("Expected error for a Rockstar file with the wrong size.")
+	}
+}
+
+// writeSubfind writes a Subfind file with n groups and nSub subhalos. Group
+// values are their index plus one, except for positions, which are x, and
+// velocity dispersions, which are 100, 200, or 300 plus their index.
+func writeSubfind(
+	t *testing.T, fname string, n, nSub int, x float32,
+	velDisp bool, idSize int,
+) {
+	arrays := []interface{}{subfindHeader{
+		NGroups: int32(n), TotNGroups: 3, NTask: 2, NSubgroups: int32(nSub),
+	}}
+	velDisps := 0
+	for _, field := range subfindFields {
+		if field.velDisp && !velDisp {
+			continue
+		} else if field.velDisp {
+			velDisps++
+		}
+		for k := 0; k < field.width*n; k++ {
+			switch {
+			case field.velDisp:
+				arrays = append(arrays, float32(100*velDisps+k))
+			case field.isInt:
+				arrays = append(arrays, int32(k))
+			case field.names[0] == "X":
+				arrays = append(arrays, float32(x))
+			default:
+				arrays = append(arrays, float32(k+1))
+			}
+		}
+	}
+	arrays = append(arrays, make([]byte, nSub*(84+idSize)))
+	writeFormatFile(t, fname, arrays...)
+}
+
+func TestReadSubfind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_subfind")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{}
+	for block, n := range []int{2, 1} {
+		// A single subhalo with 64-bit IDs.
+		fname := path.Join(dir, fmt.Sprintf("subhalo_tab_005.%d", block))
+		writeSubfind(t, fname, n, 1, float32(block), false, 8)
+		files = append(files, fname)
+	}
+
+	hd, err := ReadHeader("Subfind", files[0])
+	if err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	idxs := []int{
+		hd.Column(DefaultAliases["ID"]), hd.Column(DefaultAliases["Y"]),
+		hd.Column(DefaultAliases["M200m"]), hd.Column([]string{"GroupLen"}),
+	}
+
+	cols, err := readCatalog("Subfind", files, idxs)
+	if err != nil {
+		t.Fatalf("readCatalog returned error: %s", err.Error())
+	}
+	expected := "[[0 1 2] [0 0 1] [1e+10 2e+10 1e+10] [0 1 0]]"
+	if fmt.Sprint(cols) != expected {
+		t.Errorf("Expected columns %s, got %v.", expected, cols)
+	}
+
+	velDisps := []int{
+		hd.Column([]string{"VelDispMean200"}),
+		hd.Column([]string{"VelDispCrit200"}),
+		hd.Column([]string{"VelDispTopHat200"}),
+		hd.Column([]string{"ContaminationCount"}),
+	}
+	if _, err := readCatalog("Subfind", files, velDisps); err == nil {
+		t.Errorf("Expected error for velocity dispersions which weren't " +
+			"written.")
+	}
+
+	// Each velocity dispersion is written as its own array.
+	velFile := path.Join(dir, "subhalo_tab_006.0")
+	writeSubfind(t, velFile, 2, 1, 0, true, 4)
+	cols, err = readCatalog("Subfind", []string{velFile}, velDisps)
+	if err != nil {
+		t.Fatalf("readCatalog returned error: %s", err.Error())
+	}
+	expected = "[[100 101] [200 201] [300 301] [0 1]]"
+	if fmt.Sprint(cols) != expected {
+		t.Errorf("Expected velocity dispersions %s, got %v.", expected, cols)
+	}
+
+	// With three times as many subhalos as groups, 64-bit IDs without
+	// velocity dispersions are the same size as 32-bit IDs with them.
+	ambiguous := path.Join(dir, "subhalo_tab_007.0")
+	writeSubfind(t, ambiguous, 1, 3, 0, false, 8)
+	if _, err := ReadHeader("Subfind", ambiguous); err == nil {
+		t.Errorf("Expected error for an ambiguous Subfind layout.")
+	}
+}
@@ -0,0 +1,139 @@
+package halo
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+var (
+	// headerIndex matches the column indices which consistent-trees adds to
+	// the names in its headers, e.g. "x(17)".
+	headerIndex = regexp.MustCompile(`\(\d+\)$`)
+	// scaleFactorLine matches the line which Rockstar and consistent-trees
+	// use to give the scale factor of a catalog, e.g. "a = 0.500000".
+	scaleFactorLine = regexp.MustCompile(`^\s*a\s*=\s*(\S+)\s*$`)
+)
+
+// RequiredNames are the values which every halo catalog needs to supply.
+var RequiredNames = []string{"ID", "X", "Y", "Z", "M200m"}
+
+// DefaultAliases lists the names that halo finders commonly give to the values
+// in RequiredNames, in order of preference. Other mass definitions, like Mvir,
+// aren't included, since shells would be sized from the wrong radius.
+var DefaultAliases = map[string][]string{
+	"ID":    {"id", "haloid", "halo_id"},
+	"X":     {"x", "xc"},
+	"Y":     {"y", "yc"},
+	"Z":     {"z", "zc"},
+	"M200m": {"m200m", "m200b"},
+}
+
+// Header contains the names and units of the columns in a halo catalog.
+type Header struct {
+	// Names are the names of the catalog's columns with any consistent-trees
+	// indices removed.
+	Names []string
+	// PositionUnits, RadiusUnits, and MassUnits are the units given in the
+	// header's "#Units:" lines, written the way the HaloPositionUnits,
+	// HaloRadiusUnits, and HaloMassUnits config variables are. They're empty
+	// if the header doesn't give them.
+	PositionUnits, RadiusUnits, MassUnits string
+	// ScaleFactor is the scale factor of the catalog, or -1 if it isn't
+	// known.
+	ScaleFactor float64
+}
+
+// ReadTextHeader reads the header of a Rockstar or consistent-trees style text
+// halo catalog: the column names in its first line and any "#a = " and
+// "#Units:" lines in the comments which follow it. The catalog may be
+// compressed.
+func ReadTextHeader(fname string) (*Header, error) {
+	f, err := compress.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<16), 1<<20)
+
+	hd := &Header{ScaleFactor: -1}
+	for line := 0; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if !strings.HasPrefix(text, "#") {
+			break
+		}
+		text = strings.TrimLeft(text, "#")
+
+		if line == 0 {
+			hd.Names = strings.Fields(text)
+			for i := range hd.Names {
+				hd.Names[i] = headerIndex.ReplaceAllString(hd.Names[i], "")
+			}
+		} else if m := scaleFactorLine.FindStringSubmatch(text); m != nil {
+			hd.ScaleFactor, _ = strconv.ParseFloat(m[1], 64)
+		} else {
+			hd.readUnits(text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(hd.Names) == 0 {
+		return nil, fmt.Errorf("The halo catalog %s doesn't start with a "+
+			"header line which names its columns.", fname)
+	}
+	return hd, nil
+}
+
+// readUnits reads a line like "Units: Positions in Mpc / h (comoving)".
+func (hd *Header) readUnits(line string) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(strings.ToLower(line), "units:") {
+		return
+	}
+	line = line[len("units:"):]
+
+	i := strings.LastIndex(line, " in ")
+	if i == -1 {
+		return
+	}
+	quantity := strings.ToLower(line[:i])
+	units := strings.Join(strings.Fields(line[i+len(" in "):]), "")
+
+	switch {
+	case strings.HasSuffix(units, "(comoving)"):
+		units = "c" + strings.TrimSuffix(units, "(comoving)")
+	case strings.HasSuffix(units, "(physical)"):
+		units = "p" + strings.TrimSuffix(units, "(physical)")
+	}
+
+	switch {
+	case strings.Contains(quantity, "position"):
+		hd.PositionUnits = units
+	case strings.Contains(quantity, "radii"):
+		hd.RadiusUnits = units
+	case strings.Contains(quantity, "mass"):
+		hd.MassUnits = units
+	}
+}
+
+// Column returns the index of the first column whose name matches one of
+// aliases, or -1 if there isn't one. Names are compared without regard to
+// case.
+func (hd *Header) Column(aliases []string) int {
+	for _, alias := range aliases {
+		for i := range hd.Names {
+			if strings.EqualFold(hd.Names[i], alias) {
+				return i
+			}
+		}
+	}
+	return -1
+}
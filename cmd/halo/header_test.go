@@ -0,0 +1,90 @@
+package halo
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadTextHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_header")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	rockstar := path.Join(dir, "out_10.list")
+	if err := ioutil.WriteFile(rockstar, []byte(
+		"#ID DescID Mvir Vmax Vrms Rvir Rs Np X Y Z M200b\n"+
+			"#a = 1.000000\n"+
+			"#Units: Masses in Msun / h\n"+
+			"#Units: Positions in Mpc / h (comoving)\n"+
+			"#Units: Velocities in km / s (physical, peculiar)\n"+
+			"#Units: Halo Distances, Lengths, and Radii in kpc / h (comoving)\n"+
+			"1 -1 1e12 100 100 100 10 100 1 2 3 1e12\n",
+	), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hd, err := ReadTextHeader(rockstar)
+	if err != nil {
+		t.Fatalf("ReadTextHeader returned error: %s", err.Error())
+	}
+	if len(hd.Names) != 12 || hd.PositionUnits != "cMpc/h" ||
+		hd.RadiusUnits != "ckpc/h" || hd.MassUnits != "Msun/h" {
+		t.Errorf("Expected 12 columns with units cMpc/h, ckpc/h, and "+
+			"Msun/h, got %d columns with units %s, %s, and %s.",
+			len(hd.Names), hd.PositionUnits, hd.RadiusUnits, hd.MassUnits)
+	}
+	if hd.ScaleFactor != 1 {
+		t.Errorf("Expected scale factor 1, got %g.", hd.ScaleFactor)
+	}
+
+	tests := []struct {
+		aliases []string
+		col     int
+	}{
+		{[]string{"id"}, 0},
+		{[]string{"x"}, 8},
+		{DefaultAliases["M200m"], 11},
+		{[]string{"mvir", "m200b"}, 2},
+		{[]string{"vpeak"}, -1},
+	}
+	for i, test := range tests {
+		if col := hd.Column(test.aliases); col != test.col {
+			t.Errorf("%d) Expected column %d for %q, got %d.",
+				i, test.col, test.aliases, col)
+		}
+	}
+
+	hlist := path.Join(dir, "hlist_1.00000.list")
+	if err := ioutil.WriteFile(hlist, []byte(
+		"#scale(0) id(1) desc_scale(2) x(3) y(4) z(5) mvir(6)\n"+
+			"1 2 1 1 2 3 1e12\n",
+	), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	hd, err = ReadTextHeader(hlist)
+	if err != nil {
+		t.Fatalf("ReadTextHeader returned error: %s", err.Error())
+	}
+	if col := hd.Column([]string{"Z"}); col != 5 || hd.PositionUnits != "" {
+		t.Errorf("Expected Z in column 5 with no units, got column %d "+
+			"with units %q.", col, hd.PositionUnits)
+	}
+	// Mvir is a different mass definition than M200m.
+	if col := hd.Column(DefaultAliases["M200m"]); col != -1 {
+		t.Errorf("Expected no M200m column, got column %d.", col)
+	}
+
+	noHeader := path.Join(dir, "halos.txt")
+	if err := ioutil.WriteFile(
+		noHeader, []byte("1 2 1 1 2 3\n"), 0644,
+	); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ReadTextHeader(noHeader); err == nil {
+		t.Errorf("Expected error for a catalog without a header.")
+	}
+}
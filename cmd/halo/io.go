@@ -23,10 +23,11 @@ type VarColumns struct {
 	Generator []string
 	NBinary int
 	RadiusUnits string
+	HaloType string
 }
 
 func NewVarColumns(
-	names []string, columns []int64, radiusUnits string,
+	names []string, columns []int64, radiusUnits, haloType string,
 ) *VarColumns {
 	vc :=&VarColumns{}
 	vc.ColumnLookup = make(map[string]int)
@@ -52,6 +53,7 @@ func NewVarColumns(
 		}
 	}
 	vc.RadiusUnits = radiusUnits
+	vc.HaloType = haloType
 
 	return vc
 }
@@ -98,7 +100,8 @@ func (hs *halos) Swap(i, j int) {
 }
 
 func RockstarConvert(
-	inFile, outFile string, vars *VarColumns, cosmo *io.CosmologyHeader,
+	inFiles []string, outFile string, vars *VarColumns,
+	cosmo *io.CosmologyHeader,
 ) error {
 	valIdxs := vars.Columns
 	for i := range valIdxs {
@@ -108,7 +111,7 @@ func RockstarConvert(
 		}
 	}
 
-	cols, err := readTable(inFile, valIdxs)
+	cols, err := readCatalog(vars.HaloType, inFiles, valIdxs)
 	if err != nil {
 		return err
 	}
@@ -161,7 +164,8 @@ func idxSort(xs []float64) []int {
 }
 
 func RockstarConvertTopN(
-	inFile, outFile string, n int, vars *VarColumns, cosmo *io.CosmologyHeader,
+	inFiles []string, outFile string, n int, vars *VarColumns,
+	cosmo *io.CosmologyHeader,
 ) error {
 	valIdxs := vars.Columns
 	for i := range valIdxs {
@@ -171,7 +175,7 @@ func RockstarConvertTopN(
 		}
 	}
 
-	cols, err := readTable(inFile, valIdxs)
+	cols, err := readCatalog(vars.HaloType, inFiles, valIdxs)
 	if err != nil {
 		return err
 	}
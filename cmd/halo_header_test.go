@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValidateHaloHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_halo_header")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	header := "#ID DescID Mvir Vmax Vrms Rvir Rs Np X Y Z M200b\n" +
+		"#Units: Masses in Msun / h\n" +
+		"#Units: Positions in Mpc / h (comoving)\n" +
+		"#Units: Halo Distances, Lengths, and Radii in kpc / h (comoving)\n"
+	for snap := 8; snap <= 10; snap++ {
+		if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf(
+			"out_%d.list", snap,
+		)), []byte(header), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	newConfig := func() *GlobalConfig {
+		config := &GlobalConfig{
+			HaloType:          "Text",
+			HaloValueNames:    []string{"ID", "X", "Y", "Z", "M200m", "Vmax"},
+			HaloPositionUnits: "cMpc/h",
+			HaloRadiusUnits:   "ckpc/h",
+			HaloMassUnits:     "Msun/h",
+		}
+		config.HaloDir = dir
+		return config
+	}
+
+	config := newConfig()
+	if err := validateHaloHeader(config); err != nil {
+		t.Fatalf("validateHaloHeader returned error: %s", err.Error())
+	}
+	if fmt.Sprint(config.HaloValueColumns) != "[0 8 9 10 11 3]" {
+		t.Errorf("Expected columns [0 8 9 10 11 3], got %v.",
+			config.HaloValueColumns)
+	}
+	if fmt.Sprintf("%q", config.HaloValueComments) !=
+		`["int" "cMpc/h" "cMpc/h" "cMpc/h" "Msun/h" ""]` {
+		t.Errorf("Unexpected HaloValueComments, %q.",
+			config.HaloValueComments)
+	}
+
+	config = newConfig()
+	config.HaloValueAliases = []string{"ID", "X", "Y", "Z", "Mvir", "Vrms"}
+	if err := validateHaloHeader(config); err != nil {
+		t.Fatalf("validateHaloHeader returned error: %s", err.Error())
+	}
+	if fmt.Sprint(config.HaloValueColumns) != "[0 8 9 10 2 4]" {
+		t.Errorf("Expected columns [0 8 9 10 2 4] with aliases, got %v.",
+			config.HaloValueColumns)
+	}
+
+	bad := []func(*GlobalConfig){
+		func(c *GlobalConfig) { c.HaloValueNames[5] = "Vpeak" },
+		func(c *GlobalConfig) { c.HaloValueAliases = []string{"ID"} },
+		func(c *GlobalConfig) { c.HaloPositionUnits = "ckpc/h" },
+		func(c *GlobalConfig) { c.HaloRadiusUnits = "cMpc/h" },
+	}
+	for i := range bad {
+		config = newConfig()
+		bad[i](config)
+		if err := validateHaloHeader(config); err == nil {
+			t.Errorf("%d) Expected error from validateHaloHeader.", i)
+		}
+	}
+}
+
+func TestValidateHaloFormat(t *testing.T) {
+	newConfig := func() *GlobalConfig {
+		config := &GlobalConfig{}
+		config.HaloFormat = "halos_%d.%d.bin"
+		config.HaloFormatMeanings = []string{"Snapshot", "Block"}
+		config.HaloBlockMins = []int64{0}
+		config.HaloBlockMaxes = []int64{7}
+		return config
+	}
+
+	if err := validateHaloFormat(newConfig()); err != nil {
+		t.Errorf("validateHaloFormat returned error: %s", err.Error())
+	}
+
+	bad := []func(*GlobalConfig){
+		func(c *GlobalConfig) { c.HaloFormat = "halos_%d.bin" },
+		func(c *GlobalConfig) { c.HaloFormatMeanings[0] = "Block0" },
+		func(c *GlobalConfig) { c.HaloFormatMeanings[1] = "Block1" },
+		func(c *GlobalConfig) { c.HaloFormatMeanings[1] = "Redshift" },
+		func(c *GlobalConfig) { c.HaloBlockMaxes = []int64{} },
+		func(c *GlobalConfig) { c.HaloBlockMins[0] = 8 },
+	}
+	for i := range bad {
+		config := newConfig()
+		bad[i](config)
+		if err := validateHaloFormat(config); err == nil {
+			t.Errorf("%d) Expected error from validateHaloFormat.", i)
+		}
+	}
+}
@@ -26,6 +26,9 @@ type IDConfig struct {
 
 	exclusionStrategy          string
 	exclusionRadiusMult        float64
+	hostIDName, subhaloHosts   string
+
+	configRecord
 }
 
 var _ Mode = &IDConfig{}
@@ -72,8 +75,8 @@ IDs = 10, 11, 12, 13, 14
 # useful because splashback shells are not particularly meaningful for
 # subhalos. It can be set to the following modes:
 # none      - No halos are removed
-# subhalo   - Halos flagged as subhalos in the catalog are removed (not yet
-#             implemented)
+# subhalo   - Halos flagged as subhalos in the catalog are removed. This uses
+#             the host ID column named by HostIDName (see below).
 # overlap   - Halos which have an R200m shell that overlaps with a larger halo's
 #             R200m shell are removed
 # neighbor  - Instead of removing halos, all neighboring halos within
@@ -88,6 +91,31 @@ IDs = 10, 11, 12, 13, 14
 #
 # ExclusionRadiusMult = 0.8
 
+# HostIDName is the name of the halo catalog column which contains the ID of
+# each halo's host. Halos which aren't subhalos must have a host ID of -1. This
+# is used by the subhalo ExclusionStrategy and the name must be one of the
+# names given by HaloValueNames in the global config file. For Rockstar
+# catalogs this is usually either PID (the immediate host) or UPID (the most
+# massive host). HostIDName defaults to UPID if not set.
+#
+# HostIDName = UPID
+
+# SubhaloHosts determines what happens to subhalos when ExclusionStrategy is
+# set to subhalo. It can be set to the following modes:
+# none     - Subhalos are removed.
+# host     - Subhalos are replaced by their host.
+# ultimate - Subhalos are replaced by their ultimate host, which is found by
+#            following host IDs until a halo without a host is reached.
+#
+# Hosts which aren't in the halo catalog are never used: a subhalo whose host
+# is missing is kept, and the ultimate host is the last halo in the chain
+# which is in the catalog.
+#
+# A halo will only appear once in the output list, even if it is the host of
+# several of the input halos. SubhaloHosts defaults to none if not set.
+#
+# SubhaloHosts = none
+
 # Mult is the number of times a given ID should be repeated. This is most useful
 # if you want to estimate the scatter in shell measurements for halos with a
 # given set of shell parameters.
@@ -101,6 +129,7 @@ IDs = 10, 11, 12, 13, 14
 func (config *IDConfig) ReadConfig(fname string, flags []string) error {
 
 	vars := parse.NewConfigVars("id.config")
+	defer config.record(vars)
 	vars.String(&config.idType, "IDType", "m200m")
 	vars.Ints(&config.ids, "IDs", []int64{})
 	vars.Int(&config.idStart, "IDStart", -1)
@@ -111,6 +140,8 @@ func (config *IDConfig) ReadConfig(fname string, flags []string) error {
 	vars.Float(&config.exclusionRadiusMult, "ExclusionRadiusMult", 1)
 	vars.Float(&config.m200mMax, "M200mMax", 0)
 	vars.Float(&config.m200mMin, "M200mMin", 0)
+	vars.String(&config.hostIDName, "HostIDName", "UPID")
+	vars.String(&config.subhaloHosts, "SubhaloHosts", "none")
 
 	if fname == "" {
 		if len(flags) == 0 {
@@ -153,6 +184,13 @@ func (config *IDConfig) validate() error {
 			"which I don't recognize.", config.exclusionStrategy)
 	}
 
+	switch config.subhaloHosts {
+	case "none", "host", "ultimate":
+	default:
+		return fmt.Errorf("The 'SubhaloHosts' variable is set to '%s', "+
+			"which I don't recognize.", config.subhaloHosts)
+	}
+
 	switch {
 	case config.snap == -1:
 		return fmt.Errorf("'Snap' variable not set.")
@@ -164,6 +202,11 @@ func (config *IDConfig) validate() error {
 		return fmt.Errorf("'Mult' variable set to %d", config.mult)
 	}
 
+	if config.exclusionStrategy == "subhalo" && config.hostIDName == "" {
+		return fmt.Errorf("The 'ExclusionStrategy' variable is set to " +
+			"subhalo, but 'HostIDName' isn't set.")
+	}
+
 	switch {
 	case config.m200mMax < 0:
 		return fmt.Errorf("M200mStart set to %g", config.m200mMax)
@@ -174,8 +217,40 @@ func (config *IDConfig) validate() error {
 	return nil
 }
 
+// validateGlobal checks the fields of config which depend on the global
+// config file.
+func (config *IDConfig) validateGlobal(gConfig *GlobalConfig) error {
+	if config.exclusionStrategy == "subhalo" && gConfig.HaloType != "nil" &&
+		!inStringSlice(config.hostIDName, gConfig.HaloValueNames) {
+		return fmt.Errorf("The variable 'HostIDName' is set to "+
+			"'%s', but that isn't one of the names in 'HaloValueNames'.",
+			config.hostIDName)
+	}
+	return nil
+}
+
 // Run executes the ID mode of shellfish tool.
 func (config *IDConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	stdin, err := in.ReadAll()
+	if err != nil {
+		return err
+	}
+	lines, err := config.run(gConfig, e, stdin)
+	if err != nil {
+		return err
+	} else if len(lines) == 0 {
+		return nil
+	}
+
+	out.WriteHeader(lines[0])
+	return out.WriteRows(lines[1:])
+}
+
+// run executes the mode on the full input.
+func (config *IDConfig) run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 	
@@ -190,19 +265,53 @@ func (config *IDConfig) Run(
 	if logging.Mode == logging.Performance {
 		t = time.Now()
 	}
+
+	ids, snaps, err := config.haloIDs(gConfig, e, stdin)
+	if err != nil {
+		return nil, err
+	} else if ids == nil {
+		return nil, nil
+	}
+
+	// Generate lines
+	intCols := [][]int{ids, snaps}
+	floatCols := [][]float64{}
+	colOrder := []int{0, 1}
+	lines := catalog.FormatCols(intCols, floatCols, colOrder)
+
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot"}, []string{}, []int{0, 1}, []int{1, 1},
+	)
+	lines = append([]string{cString}, lines...)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return lines, nil
+}
+
+// haloIDs returns the IDs and snapshots of the halos selected by the config
+// file, after subhalos have been removed and every halo has been repeated
+// Mult times. If there are no halos in the requested ID range, nil slices
+// are returned.
+func (config *IDConfig) haloIDs(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+) (ids, snaps []int, err error) {
 	if config.snap == -1 {
-		return nil, fmt.Errorf("Either no id.config file was provided or " +
+		return nil, nil, fmt.Errorf("Either no id.config file was provided or " +
 			"the 'Snap' variable wasn't set.")
 	}
 	if config.snap < gConfig.SnapMin || config.snap > gConfig.SnapMax {
-		return nil, fmt.Errorf("'Snap' = %d, but 'SnapMin' = %d and "+
+		return nil, nil, fmt.Errorf("'Snap' = %d, but 'SnapMin' = %d and "+
 			"'SnapMax = %d'", config.snap, gConfig.SnapMin, gConfig.SnapMax)
 	}
 	// Get IDs and snapshots
 
 	vars := halo.NewVarColumns(
 		gConfig.HaloValueNames, gConfig.HaloValueColumns,
-		gConfig.HaloRadiusUnits,
+		gConfig.HaloRadiusUnits, gConfig.HaloType,
 	)
 
 	if config.m200mMax > 0 {
@@ -211,23 +320,17 @@ func (config *IDConfig) Run(
 
 	// This is kind of a hack to deal with the case where there are no IDs in
 	// the specified mass range.
-	var (
-		rawIds []int
-		err error
-	)
+	var rawIds []int
 	if config.idStart <= config.idEnd {
 		rawIds, err = getIDs(config.idStart, config.idEnd, config.ids, stdin)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		} else if len(rawIds) == 0 {
-			return nil, nil
+			return nil, nil, nil
 		}
 	}
 
-	var (
-		ids, snaps []int
-		buf        io.VectorBuffer
-	)
+	var buf io.VectorBuffer
 	switch config.idType {
 	case "halo-id":
 		snaps = make([]int, len(rawIds))
@@ -236,12 +339,11 @@ func (config *IDConfig) Run(
 		}
 		ids = rawIds
 
-		var err error
 		buf, err = getVectorBuffer(
 			e.ParticleCatalog(snaps[0], 0), gConfig,
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	case "m200m":
 		snaps = make([]int, len(rawIds))
@@ -249,17 +351,16 @@ func (config *IDConfig) Run(
 			snaps[i] = int(config.snap)
 		}
 
-		var err error
 		buf, err = getVectorBuffer(
 			e.ParticleCatalog(snaps[0], 0), gConfig,
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		ids, err = convertSortedIDs(rawIds, int(config.snap), vars, buf, e)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	default:
 		panic("Impossible")
@@ -270,59 +371,46 @@ func (config *IDConfig) Run(
 	switch config.exclusionStrategy {
 	case "none":
 	case "subhalo":
-		panic("subhalo is not implemented")
+		ids, snaps, err = removeCatalogSubs(
+			ids, snaps, vars, buf, e, config, gConfig,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		exclude = make([]bool, len(ids))
 	case "neighbor":
 		ids, snaps, err = readSubIDs(
 			ids, snaps, vars, buf, e, config, gConfig,
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		exclude = make([]bool, len(ids))
 	case "overlap":
-		var err error
 		exclude, err = findOverlapSubs(
 			ids, snaps, vars, buf, e, config, gConfig,
 		)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 	
-	// Generate lines
-	intCols := [][]int{ids, snaps}
-	floatCols := [][]float64{}
-	colOrder := []int{0, 1}
-	lines := catalog.FormatCols(intCols, floatCols, colOrder)
-
-	// Filter
-	fLines := []string{}
-	for i := range lines {
-		if !exclude[i] {
-			fLines = append(fLines, lines[i])
+	// Filter and multiply. These slices are never nil, even if every halo
+	// is filtered out.
+	fIDs, fSnaps := []int{}, []int{}
+	for i := range ids {
+		if exclude[i] {
+			continue
 		}
-	}
-
-	// Multiply
-	mLines := []string{}
-	for i := range fLines {
 		for j := 0; j < int(config.mult); j++ {
-			mLines = append(mLines, fLines[i])
+			fIDs = append(fIDs, ids[i])
+			fSnaps = append(fSnaps, snaps[i])
 		}
 	}
 
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot"}, []string{}, []int{0, 1}, []int{1, 1},
-	)
-	mLines = append([]string{cString}, mLines...)
-
-	if logging.Mode == logging.Performance {
-		log.Printf("Time: %s", time.Since(t).String())
-		log.Printf("Memory:\n%s", logging.MemString())
-	}
-
-	return mLines, nil
+	return fIDs, fSnaps, nil
 }
 
 // getMassRange updates config so that it points to an ID range that
@@ -557,6 +645,110 @@ func readSubIDs(
 	return sIDs, sSnaps, nil
 }
 
+// removeCatalogSubs uses the host ID column of the halo catalog to remove
+// subhalos from the given list of halos or to replace them with their hosts,
+// depending on the value of the SubhaloHosts variable.
+func removeCatalogSubs(
+	ids, snaps []int, vars *halo.VarColumns,
+	buf io.VectorBuffer, e *env.Environment,
+	config *IDConfig, gConfig *GlobalConfig,
+) (
+	sIDs, sSnaps []int, err error,
+) {
+	if err := config.validateGlobal(gConfig); err != nil {
+		return nil, nil, err
+	}
+
+	snapHosts := make(map[int]map[int]int)
+	for _, snap := range snaps {
+		if _, ok := snapHosts[snap]; ok {
+			continue
+		}
+
+		rids, err := memo.ReadSortedRockstarIDs(
+			snap, -1, "M200m", vars, buf, e,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, vals, err := memo.ReadRockstar(
+			snap, []string{config.hostIDName}, rids, vars, buf, e,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hosts := make(map[int]int, len(rids))
+		for i, rid := range rids {
+			hosts[rid] = int(vals[0][i])
+		}
+		snapHosts[snap] = hosts
+	}
+
+	return replaceCatalogSubs(ids, snaps, snapHosts, config.subhaloHosts)
+}
+
+// replaceCatalogSubs removes the subhalos in a list of halos or replaces them
+// with their hosts. snapHosts maps each snapshot to the host IDs of its halos
+// and subhaloHosts is the SubhaloHosts variable. Hosts are only followed to
+// halos which are in the catalog, so a subhalo whose host is missing is kept.
+func replaceCatalogSubs(
+	ids, snaps []int, snapHosts map[int]map[int]int, subhaloHosts string,
+) (sIDs, sSnaps []int, err error) {
+	type snapID struct{ id, snap int }
+	seen := make(map[snapID]bool)
+
+	sIDs, sSnaps = []int{}, []int{}
+	for i, id := range ids {
+		hosts := snapHosts[snaps[i]]
+		host, ok := hosts[id]
+		if !ok {
+			return nil, nil, fmt.Errorf("Could not find ID %d.", id)
+		}
+
+		if host >= 0 {
+			switch subhaloHosts {
+			case "none":
+				continue
+			case "host":
+				if _, ok := hosts[host]; ok {
+					id = host
+				}
+			case "ultimate":
+				if id, err = ultimateHost(id, hosts); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		key := snapID{id, snaps[i]}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		sIDs = append(sIDs, id)
+		sSnaps = append(sSnaps, snaps[i])
+	}
+
+	return sIDs, sSnaps, nil
+}
+
+// ultimateHost follows the host IDs of a halo, which must be in hosts, until
+// it reaches a halo which doesn't have a host or whose host isn't in the
+// catalog, and returns that halo's ID. An error is returned if the host IDs
+// form a cycle.
+func ultimateHost(id int, hosts map[int]int) (int, error) {
+	start := id
+	for steps := 0; steps <= len(hosts); steps++ {
+		host := hosts[id]
+		if _, ok := hosts[host]; !ok || host < 0 {
+			return id, nil
+		}
+		id = host
+	}
+	return 0, fmt.Errorf("The host IDs of halo %d form a cycle.", start)
+}
+
 // A quick generic wrapper for doing those one-to-one mappings I need to do so
 // often. Written like this so the backend can be swapped out easily.
 type intFinder struct {
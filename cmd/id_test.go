@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplaceCatalogSubs(t *testing.T) {
+	// 3 -> 2 -> 1, 4's host isn't in the catalog, and 5 and 6 are each
+	// other's hosts. In snapshot 1, 3 isn't a subhalo.
+	snapHosts := map[int]map[int]int{
+		0: {1: -1, 2: 1, 3: 2, 4: 99, 5: 6, 6: 5, 7: -1},
+		1: {3: -1},
+	}
+
+	tests := []struct {
+		subhaloHosts string
+		ids, snaps   []int
+		expIDs       string
+		expSnaps     string
+		valid        bool
+	}{
+		{"none", []int{1, 2, 3, 4, 7, 3}, []int{0, 0, 0, 0, 0, 1},
+			"[1 7 3]", "[0 0 1]", true},
+		{"host", []int{2, 3, 4, 1, 3}, []int{0, 0, 0, 0, 1},
+			"[1 2 4 3]", "[0 0 0 1]", true},
+		{"ultimate", []int{3, 4, 7, 2, 3}, []int{0, 0, 0, 0, 1},
+			"[1 4 7 3]", "[0 0 0 1]", true},
+		{"host", []int{5, 6}, []int{0, 0}, "[6 5]", "[0 0]", true},
+		{"ultimate", []int{5}, []int{0}, "", "", false},
+		{"none", []int{8}, []int{0}, "", "", false},
+		{"host", []int{1}, []int{1}, "", "", false},
+	}
+
+	for i, test := range tests {
+		ids, snaps, err := replaceCatalogSubs(
+			test.ids, test.snaps, snapHosts, test.subhaloHosts,
+		)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%d) Expected error from replaceCatalogSubs.", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d) replaceCatalogSubs returned error: %s",
+				i, err.Error())
+		} else if fmt.Sprint(ids) != test.expIDs ||
+			fmt.Sprint(snaps) != test.expSnaps {
+			t.Errorf("%d) Expected IDs %s and snapshots %s, got %v and %v.",
+				i, test.expIDs, test.expSnaps, ids, snaps)
+		}
+	}
+}
+
+func TestUltimateHost(t *testing.T) {
+	hosts := map[int]int{1: -1, 2: 1, 3: 2, 4: 99, 5: 4, 6: 7, 7: 8, 8: 6}
+
+	tests := []struct {
+		id, host int
+		valid    bool
+	}{
+		{1, 1, true}, {2, 1, true}, {3, 1, true},
+		{4, 4, true}, {5, 4, true},
+		{6, 0, false}, {8, 0, false},
+	}
+
+	for i, test := range tests {
+		host, err := ultimateHost(test.id, hosts)
+		if test.valid && (err != nil || host != test.host) {
+			t.Errorf("%d) Expected ultimateHost(%d) = %d, got %d, %v.",
+				i, test.id, test.host, host, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%d) Expected error for the cycle containing %d.",
+				i, test.id)
+		}
+	}
+}
+
+func TestIDValidateGlobal(t *testing.T) {
+	gConfig := &GlobalConfig{}
+	gConfig.HaloType = "Text"
+	gConfig.HaloValueNames = []string{"ID", "X", "Y", "Z", "M200m", "PID"}
+
+	tests := []struct {
+		strategy, hostIDName string
+		valid                bool
+	}{
+		{"subhalo", "PID", true},
+		{"subhalo", "UPID", false},
+		{"overlap", "UPID", true},
+	}
+
+	for i, test := range tests {
+		config := &IDConfig{}
+		config.exclusionStrategy, config.hostIDName =
+			test.strategy, test.hostIDName
+		err := CheckGlobalConfig(config, gConfig)
+		if test.valid && err != nil {
+			t.Errorf("%d) CheckGlobalConfig returned error: %s",
+				i, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("%d) Expected error for HostIDName = %s.",
+				i, test.hostIDName)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/cmd/halo"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/version"
+)
+
+// initMaxDepth is the number of directory levels below the snapshot directory
+// which are searched for particle files.
+const initMaxDepth = 3
+
+// InitMemoDir is the name of the MemoDir used by config files written by
+// InitConfig.
+const InitMemoDir = "shellfish_memo"
+
+var digitRuns = regexp.MustCompile(`\d+`)
+
+// initHaloColumns lists the values that init finds in halo catalogs and
+// the comments they're given. The names each value might have in the header
+// are in halo.DefaultAliases.
+var initHaloColumns = []struct {
+	name, comment string
+}{
+	{"ID", "int"},
+	{"X", "cMpc/h"},
+	{"Y", "cMpc/h"},
+	{"Z", "cMpc/h"},
+	{"M200m", "Msun/h"},
+}
+
+// templateName is the name of a file split up into the runs of digits which
+// might be replaced by format verbs and the text between them.
+type templateName struct {
+	fname  string
+	text   []string
+	fields []string
+}
+
+// splitTemplateName splits the name of a file at its runs of digits.
+func splitTemplateName(fname string) *templateName {
+	name := &templateName{fname: fname}
+	prev := 0
+	for _, loc := range digitRuns.FindAllStringIndex(fname, -1) {
+		name.text = append(name.text, fname[prev:loc[0]])
+		name.fields = append(name.fields, fname[loc[0]:loc[1]])
+		prev = loc[1]
+	}
+	name.text = append(name.text, fname[prev:])
+	return name
+}
+
+// skeleton returns the parts of the name which aren't digits. Files with the
+// same skeleton can be described by the same template.
+func (name *templateName) skeleton() string {
+	return strings.Join(name.text, "#")
+}
+
+// field returns the integer value of the i-th run of digits.
+func (name *templateName) field(i int) int64 {
+	x, _ := strconv.ParseInt(name.fields[i], 10, 64)
+	return x
+}
+
+// snapshotTemplate is a file name template and its meanings, along with the
+// ranges of its snapshots and blocks.
+type snapshotTemplate struct {
+	format                string
+	meanings              []string
+	snapMin, snapMax      int64
+	blockMins, blockMaxes []int64
+}
+
+// InitConfig returns the text of a global config file for the particle files
+// in snapDir and the halo catalogs in haloDir. The SnapshotType, Endianness,
+// and format variables are found by inspecting the files. If haloDir is "",
+// HaloType is set to nil. The config file is checked with the same validation
+// used by every other mode, so MemoDir will be created if it doesn't exist.
+func InitConfig(snapDir, haloDir, memoDir string) (string, error) {
+	snapDir, err := filepath.Abs(snapDir)
+	if err != nil {
+		return "", err
+	}
+	if memoDir, err = filepath.Abs(memoDir); err != nil {
+		return "", err
+	}
+
+	files, err := listFiles(snapDir, initMaxDepth)
+	if err != nil {
+		return "", err
+	} else if len(files) == 0 {
+		return "", fmt.Errorf("There aren't any files in %s.", snapDir)
+	}
+
+	names, guess, err := findSnapshotFiles(snapDir, files)
+	if err != nil {
+		return "", err
+	}
+	switch guess.SnapshotType {
+	case "TIPSY":
+		return "", fmt.Errorf("The files in %s are TIPSY files. TIPSY files "+
+			"don't store their units or cosmology, so you'll need to set "+
+			"the Tipsy* variables by hand. Type 'shellfish help config' "+
+			"for an example config file.", snapDir)
+	case "ARTIO":
+		return "", fmt.Errorf("The files in %s are ARTIO files. Each ARTIO "+
+			"fileset needs to be described by hand. Type 'shellfish help "+
+			"config' for an example config file.", snapDir)
+	}
+
+	tmpl, err := findTemplate(snapDir, names, func(
+		name *templateName,
+	) (float64, error) {
+		guess, err := io.DetectSnapshot(filepath.Join(snapDir, name.fname))
+		if err != nil {
+			return 0, err
+		}
+		return guess.ScaleFactor, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `[config]
+# This file was written by shellfish init. Type "shellfish help config" for
+# descriptions of these variables and of the variables which aren't set here.
+Version = %s
+
+SnapshotType = %s
+`, version.SourceVersion, guess.SnapshotType)
+
+	if haloDir == "" {
+		fmt.Fprintf(b, "HaloType = nil\nTreeType = nil\n\n")
+	} else {
+		haloDir, err = filepath.Abs(haloDir)
+		if err != nil {
+			return "", err
+		}
+		if err = writeHaloInit(b, haloDir, tmpl); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Fprintf(b, "SnapshotFormat = %s\n",
+		filepath.Join(snapDir, tmpl.format))
+	if len(tmpl.meanings) > 0 {
+		fmt.Fprintf(b, "SnapshotFormatMeanings = %s\n",
+			strings.Join(tmpl.meanings, ", "))
+	}
+	if len(tmpl.blockMins) > 0 {
+		fmt.Fprintf(b, "BlockMins = %s\nBlockMaxes = %s\n",
+			joinInts(tmpl.blockMins), joinInts(tmpl.blockMaxes))
+	}
+	fmt.Fprintf(b, `SnapMin = %d
+SnapMax = %d
+Endianness = %s
+
+MemoDir = %s
+`, tmpl.snapMin, tmpl.snapMax, guess.Endianness, memoDir)
+
+	switch guess.SnapshotType {
+	case "LGadget-2":
+		fmt.Fprintf(b, "\nLGadgetNpartNum = %d\n", guess.LGadgetNPartNum)
+	case "Gadget-2", "HDF5-Gadget":
+		fmt.Fprintf(b, `
+# These were found by comparing the particle mass to the mean density of the
+# universe. Check them if your simulation doesn't use Mpc/h or kpc/h and
+# Msun/h or 10^10 Msun/h.
+GadgetPositionUnits = %g
+GadgetMassUnits = %g
+`, guess.GadgetPositionUnits, guess.GadgetMassUnits)
+	}
+
+	// Make sure that the config file can actually be used.
+	f, err := ioutil.TempFile("", "shellfish_init")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(b.String())
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if err = (&GlobalConfig{}).ReadConfig(f.Name(), nil); err != nil {
+		return "", fmt.Errorf("I wrote a config file, but it doesn't work: "+
+			"%s", err.Error())
+	}
+
+	return b.String(), nil
+}
+
+// listFiles returns the names of the non-hidden files in dir and in its
+// subdirectories, up to depth levels down, relative to dir. The names are
+// sorted.
+func listFiles(dir string, depth int) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		} else if !info.IsDir() {
+			out = append(out, name)
+			continue
+		} else if depth == 0 {
+			continue
+		}
+
+		sub, err := listFiles(filepath.Join(dir, name), depth-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sub {
+			out = append(out, filepath.Join(name, s))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// findSnapshotFiles groups files by their skeletons and returns the largest
+// group whose files are particle files, along with the format of those files.
+func findSnapshotFiles(
+	dir string, files []string,
+) ([]*templateName, *io.SnapshotGuess, error) {
+	groups := map[string][]*templateName{}
+	skeletons := []string{}
+	for _, file := range files {
+		name := splitTemplateName(file)
+		sk := name.skeleton()
+		if _, ok := groups[sk]; !ok {
+			skeletons = append(skeletons, sk)
+		}
+		groups[sk] = append(groups[sk], name)
+	}
+
+	sort.SliceStable(skeletons, func(i, j int) bool {
+		return len(groups[skeletons[i]]) > len(groups[skeletons[j]])
+	})
+
+	for _, sk := range skeletons {
+		names := groups[sk]
+		guess, err := io.DetectSnapshot(filepath.Join(dir, names[0].fname))
+		if err == nil {
+			return names, guess, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("None of the files in %s are in a format "+
+		"that I can recognize. Bolshoi, BolshoiP, and raw files can't be "+
+		"recognized automatically, so you'll need to write a config file "+
+		"by hand. Type 'shellfish help config' for an example.", dir)
+}
+
+// findTemplate finds the SnapshotFormat template that produces names. Runs
+// of digits which are the same in every name are left alone. The remaining
+// runs are split up into snapshots and blocks by checking whether the scale
+// factor, as returned by scaleFactor, changes along with them. scaleFactor
+// returns -1 if a file doesn't store its scale factor.
+func findTemplate(
+	dir string, names []*templateName,
+	scaleFactor func(name *templateName) (float64, error),
+) (*snapshotTemplate, error) {
+	// Runs of digits which always have the same value are grouped together,
+	// e.g. the two numbers in snapdir_005/snapshot_005.0.
+	groups := [][]int{}
+	for i := range names[0].fields {
+		if isConstantField(names, i) {
+			continue
+		}
+		found := false
+		for g := range groups {
+			if equalFields(names, groups[g][0], i) {
+				groups[g] = append(groups[g], i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []int{i})
+		}
+	}
+
+	snapGroups, blockGroups := [][]int{}, [][]int{}
+	for g := range groups {
+		isSnap, err := isSnapshotField(names, groups, g, scaleFactor)
+		if err != nil {
+			return nil, err
+		}
+		if isSnap {
+			snapGroups = append(snapGroups, groups[g])
+		} else {
+			blockGroups = append(blockGroups, groups[g])
+		}
+	}
+
+	if len(snapGroups) > 1 {
+		return nil, fmt.Errorf("The names of the files in %s, like %s, seem "+
+			"to contain more than one snapshot number.", dir, names[0].fname)
+	}
+	for _, g := range blockGroups {
+		if len(g) > 1 {
+			return nil, fmt.Errorf("The names of the files in %s, like %s, "+
+				"repeat the same block number, which SnapshotFormat can't "+
+				"describe.", dir, names[0].fname)
+		}
+	}
+
+	tmpl := &snapshotTemplate{}
+	meanings := make([]string, len(names[0].fields))
+	expected := int64(1)
+	if len(snapGroups) == 1 {
+		tmpl.snapMin, tmpl.snapMax = fieldRange(names, snapGroups[0][0])
+		expected *= tmpl.snapMax - tmpl.snapMin + 1
+		for _, i := range snapGroups[0] {
+			meanings[i] = "Snapshot"
+		}
+	}
+	for b, g := range blockGroups {
+		lo, hi := fieldRange(names, g[0])
+		tmpl.blockMins = append(tmpl.blockMins, lo)
+		tmpl.blockMaxes = append(tmpl.blockMaxes, hi)
+		expected *= hi - lo + 1
+		if len(blockGroups) == 1 {
+			meanings[g[0]] = "Block"
+		} else {
+			meanings[g[0]] = fmt.Sprintf("Block%d", b)
+		}
+	}
+
+	if expected != int64(len(names)) {
+		return nil, fmt.Errorf("There are %d files with names like %s in "+
+			"%s, but their snapshot and block numbers imply that there "+
+			"should be %d. Some files might be missing.",
+			len(names), names[0].fname, dir, expected)
+	}
+
+	format := &strings.Builder{}
+	for i, text := range names[0].text {
+		if strings.Contains(text, "%") {
+			return nil, fmt.Errorf("The file %s contains a '%%', so it "+
+				"can't be described by SnapshotFormat.", names[0].fname)
+		}
+		format.WriteString(text)
+		if i == len(names[0].fields) {
+			break
+		}
+
+		if meanings[i] == "" {
+			format.WriteString(names[0].fields[i])
+		} else {
+			format.WriteString(fieldVerb(names, i))
+			tmpl.meanings = append(tmpl.meanings, meanings[i])
+		}
+	}
+	tmpl.format = format.String()
+
+	return tmpl, nil
+}
+
+// isConstantField returns true if the i-th run of digits is the same in
+// every name.
+func isConstantField(names []*templateName, i int) bool {
+	for _, name := range names {
+		if name.fields[i] != names[0].fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// equalFields returns true if the i-th and j-th runs of digits have the same
+// value in every name.
+func equalFields(names []*templateName, i, j int) bool {
+	for _, name := range names {
+		if name.field(i) != name.field(j) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldRange returns the smallest and largest values of the i-th run of
+// digits.
+func fieldRange(names []*templateName, i int) (lo, hi int64) {
+	lo, hi = names[0].field(i), names[0].field(i)
+	for _, name := range names {
+		if x := name.field(i); x < lo {
+			lo = x
+		} else if x > hi {
+			hi = x
+		}
+	}
+	return lo, hi
+}
+
+// fieldVerb returns the format verb which prints the i-th run of digits,
+// including any zero-padding.
+func fieldVerb(names []*templateName, i int) string {
+	width := len(names[0].fields[i])
+	padded := false
+	for _, name := range names {
+		s := name.fields[i]
+		if len(s) != width {
+			return "%d"
+		}
+		padded = padded || (len(s) > 1 && s[0] == '0')
+	}
+	if padded {
+		return fmt.Sprintf("%%0%dd", width)
+	}
+	return "%d"
+}
+
+// isSnapshotField returns true if the g-th group of fields gives the
+// snapshot of a file. This is true if two files which only differ in that
+// group have different scale factors. If the scale factors can't be compared,
+// the last number in the name is assumed to be the block and any other number
+// is assumed to be the snapshot.
+func isSnapshotField(
+	names []*templateName, groups [][]int, g int,
+	scaleFactor func(name *templateName) (float64, error),
+) (bool, error) {
+	ref := names[0]
+	for _, name := range names[1:] {
+		differs := true
+		for h := range groups {
+			same := name.fields[groups[h][0]] == ref.fields[groups[h][0]]
+			if (h == g) == same {
+				differs = false
+				break
+			}
+		}
+		if !differs {
+			continue
+		}
+
+		a0, err := scaleFactor(ref)
+		if err != nil {
+			return false, err
+		}
+		a1, err := scaleFactor(name)
+		if err != nil {
+			return false, err
+		}
+		if a0 < 0 || a1 < 0 {
+			break
+		}
+		return math.Abs(a0-a1) > 1e-6*math.Abs(a0), nil
+	}
+
+	last := groups[g][len(groups[g])-1] == len(ref.fields)-1
+	return !last || len(groups) == 1, nil
+}
+
+// writeHaloInit writes the Halo* and Tree* variables for the text halo
+// catalogs in haloDir to b.
+func writeHaloInit(
+	b *strings.Builder, haloDir string, tmpl *snapshotTemplate,
+) error {
+	infos, err := ioutil.ReadDir(haloDir)
+	if err != nil {
+		return err
+	} else if len(infos) == 0 {
+		return fmt.Errorf("There aren't any files in %s.", haloDir)
+	} else if snaps := tmpl.snapMax - tmpl.snapMin + 1; int64(
+		len(infos)) < snaps {
+		return fmt.Errorf("There are %d snapshots, but only %d files in %s. "+
+			"Each snapshot needs a halo catalog.", snaps, len(infos), haloDir)
+	}
+
+	// The last file is used because HaloDir sometimes starts with files that
+	// aren't catalogs, and the last snapshot is the one most likely to have
+	// halos.
+	fname := filepath.Join(haloDir, infos[len(infos)-1].Name())
+	cols, err := guessHaloColumns(fname)
+	if err != nil {
+		return err
+	}
+
+	names, comments := []string{}, []string{}
+	for _, alias := range initHaloColumns {
+		names = append(names, alias.name)
+		comments = append(comments, alias.comment)
+	}
+
+	fmt.Fprintf(b, `HaloType = Text
+# TreeType is nil, but TreeDir still needs to be set to a directory.
+TreeType = nil
+HaloDir = %s
+TreeDir = %s
+
+# These columns were found from the header of %s.
+HaloValueNames = %s
+HaloValueColumns = %s
+HaloValueComments = %s
+HaloPositionUnits = cMpc/h
+HaloRadiusUnits = ckpc/h
+HaloMassUnits = Msun/h
+
+`, haloDir, haloDir, fname, strings.Join(names, ", "), joinInts(cols),
+		strings.Join(comments, ", "))
+	return nil
+}
+
+// guessHaloColumns finds the columns of the values in initHaloColumns from
+// the header of a text halo catalog.
+func guessHaloColumns(fname string) ([]int64, error) {
+	hd, err := halo.ReadTextHeader(fname)
+	if err != nil {
+		return nil, fmt.Errorf("%s HaloValueColumns will need to be set by "+
+			"hand.", err.Error())
+	}
+
+	cols := []int64{}
+	for _, alias := range initHaloColumns {
+		col := hd.Column(halo.DefaultAliases[alias.name])
+		if col == -1 {
+			return nil, fmt.Errorf("The header of the halo catalog %s "+
+				"doesn't have a column for %s, so HaloValueColumns will need "+
+				"to be set by hand.", fname, alias.name)
+		}
+		cols = append(cols, int64(col))
+	}
+
+	return cols, nil
+}
+
+// joinInts returns xs as a comma-separated list.
+func joinInts(xs []int64) string {
+	tok := make([]string, len(xs))
+	for i := range xs {
+		tok[i] = strconv.FormatInt(xs[i], 10)
+	}
+	return strings.Join(tok, ", ")
+}
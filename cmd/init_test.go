@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeInitLGadget2 writes an LGadget-2 file with n particles at the scale
+// factor a.
+func writeInitLGadget2(t *testing.T, fname string, n int, a float64) {
+	order := binary.LittleEndian
+	hd := make([]byte, 256)
+	order.PutUint32(hd[4:], uint32(n))
+	order.PutUint64(hd[72:], math.Float64bits(a))
+	order.PutUint64(hd[80:], math.Float64bits(1/a-1))
+	order.PutUint64(hd[128:], math.Float64bits(100))
+	order.PutUint64(hd[136:], math.Float64bits(0.3))
+	order.PutUint64(hd[144:], math.Float64bits(0.7))
+	order.PutUint64(hd[152:], math.Float64bits(0.7))
+
+	b := &bytes.Buffer{}
+	for _, rec := range [][]byte{
+		hd, make([]byte, 12*n), make([]byte, 12*n), make([]byte, 8*n),
+	} {
+		binary.Write(b, order, uint32(len(rec)))
+		b.Write(rec)
+		binary.Write(b, order, uint32(len(rec)))
+	}
+
+	if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_init")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	snapDir, haloDir := path.Join(dir, "snaps"), path.Join(dir, "halos")
+	for snap := 8; snap <= 10; snap++ {
+		for block := 0; block < 4; block++ {
+			writeInitLGadget2(t, path.Join(snapDir, fmt.Sprintf(
+				"snapdir_%03d/snapshot_%03d.%d", snap, snap, block,
+			)), 2, float64(snap)/10)
+		}
+	}
+	// Files which aren't particle files shouldn't confuse anything.
+	if err := ioutil.WriteFile(
+		path.Join(snapDir, "README"), []byte("Snapshots."), 0644,
+	); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := os.MkdirAll(haloDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for snap := 8; snap <= 10; snap++ {
+		if err := ioutil.WriteFile(path.Join(haloDir, fmt.Sprintf(
+			"out_%d.list", snap,
+		)), []byte("#ID DescID Mvir Vmax Vrms Rvir Rs Np X Y Z M200b\n"),
+			0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	text, err := InitConfig(snapDir, haloDir, path.Join(dir, "memo"))
+	if err != nil {
+		t.Fatalf("InitConfig returned error: %s", err.Error())
+	}
+
+	fname := path.Join(dir, "init.config")
+	if err := ioutil.WriteFile(fname, []byte(text), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	config := &GlobalConfig{}
+	if err := config.ReadConfig(fname, nil); err != nil {
+		t.Fatalf("ReadConfig returned error: %s", err.Error())
+	}
+
+	format := path.Join(snapDir, "snapdir_%03d/snapshot_%03d.%d")
+	if config.SnapshotType != "LGadget-2" ||
+		config.Endianness != "LittleEndian" || config.LGadgetNpartNum != 2 {
+		t.Errorf("Expected a little endian LGadget-2 snapshot with "+
+			"LGadgetNpartNum = 2, got SnapshotType = %s, Endianness = %s, "+
+			"LGadgetNpartNum = %d.", config.SnapshotType, config.Endianness,
+			config.LGadgetNpartNum)
+	}
+	if config.SnapshotFormat != format ||
+		strings.Join(config.SnapshotFormatMeanings, ",") !=
+			"Snapshot,Snapshot,Block" {
+		t.Errorf("Expected SnapshotFormat = %s with meanings "+
+			"Snapshot, Snapshot, Block, got %s with meanings %s.", format,
+			config.SnapshotFormat, config.SnapshotFormatMeanings)
+	}
+	if config.SnapMin != 8 || config.SnapMax != 10 ||
+		len(config.BlockMins) != 1 || config.BlockMins[0] != 0 ||
+		config.BlockMaxes[0] != 3 {
+		t.Errorf("Expected snapshots 8-10 and blocks 0-3, got snapshots "+
+			"%d-%d and blocks %v-%v.", config.SnapMin, config.SnapMax,
+			config.BlockMins, config.BlockMaxes)
+	}
+	if config.HaloType != "Text" || fmt.Sprint(config.HaloValueColumns) !=
+		fmt.Sprint([]int64{0, 8, 9, 10, 11}) {
+		t.Errorf("Expected text halos with columns [0 8 9 10 11], got "+
+			"HaloType = %s with columns %v.", config.HaloType,
+			config.HaloValueColumns)
+	}
+
+	// A missing block should be noticed.
+	os.Remove(path.Join(snapDir, "snapdir_009/snapshot_009.2"))
+	if _, err := InitConfig(snapDir, "", path.Join(dir, "memo")); err == nil {
+		t.Errorf("Expected error for a missing block.")
+	}
+}
+
+func TestFindTemplate(t *testing.T) {
+	tests := []struct {
+		files    []string
+		as       []float64
+		format   string
+		meanings []string
+	}{
+		{[]string{"snap_0.dat", "snap_1.dat", "snap_2.dat"},
+			[]float64{0.5, 0.5, 0.5}, "snap_%d.dat", []string{"Block"}},
+		{[]string{"snap_10.dat", "snap_8.dat", "snap_9.dat"},
+			[]float64{1, 0.8, 0.9}, "snap_%d.dat", []string{"Snapshot"}},
+		{[]string{"hdf5/snap_003.0.hdf5", "hdf5/snap_003.1.hdf5"},
+			[]float64{0.5, 0.5}, "hdf5/snap_003.%d.hdf5", []string{"Block"}},
+		{[]string{"out_01/part_01.out00001", "out_01/part_01.out00002",
+			"out_02/part_02.out00001", "out_02/part_02.out00002"},
+			[]float64{0.5, 0.5, 1, 1}, "out_%02d/part_%02d.out%05d",
+			[]string{"Snapshot", "Snapshot", "Block"}},
+		// Without scale factors, the last number is the block.
+		{[]string{"a0/b0", "a0/b1", "a1/b0", "a1/b1"},
+			[]float64{-1, -1, -1, -1}, "a%d/b%d",
+			[]string{"Snapshot", "Block"}},
+	}
+
+	for i, test := range tests {
+		names := make([]*templateName, len(test.files))
+		as := map[string]float64{}
+		for j := range names {
+			names[j] = splitTemplateName(test.files[j])
+			as[test.files[j]] = test.as[j]
+		}
+
+		tmpl, err := findTemplate("", names, func(
+			name *templateName,
+		) (float64, error) {
+			return as[name.fname], nil
+		})
+		if err != nil {
+			t.Errorf("%d) findTemplate returned error: %s", i, err.Error())
+			continue
+		}
+		if tmpl.format != test.format ||
+			strings.Join(tmpl.meanings, ",") !=
+				strings.Join(test.meanings, ",") {
+			t.Errorf("%d) Expected %s with meanings %s, got %s with "+
+				"meanings %s.", i, test.format, test.meanings,
+				tmpl.format, tmpl.meanings)
+		}
+	}
+}
@@ -272,13 +272,26 @@ func ReadHeaders(
 			return nil, nil, err
 		}
 
-		f, err := os.Create(memoFile)
+		// Reading headers can be slow, particularly for compressed files, so
+		// the memo file is written to a temporary file first. Otherwise a
+		// run which is killed part of the way through would leave behind a
+		// truncated memo file that would be trusted by every later run.
+		tmpFile := memoFile + ".tmp"
+		f, err := os.Create(tmpFile)
 		if err != nil {
 			return nil, nil, err
 		}
-		defer f.Close()
-
-		binary.Write(f, binary.LittleEndian, hds)
+		err = binary.Write(f, binary.LittleEndian, hds)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmpFile, memoFile)
+		}
+		if err != nil {
+			os.Remove(tmpFile)
+			return nil, nil, err
+		}
 
 		return hds, files, nil
 	} else {
@@ -291,7 +304,11 @@ func ReadHeaders(
 		defer f.Close()
 
 		hds := make([]io.Header, e.Blocks())
-		binary.Read(f, binary.LittleEndian, hds)
+		if err = binary.Read(f, binary.LittleEndian, hds); err != nil {
+			return nil, nil, fmt.Errorf("The header memo file %s could "+
+				"not be read. Try deleting it. Error: %s",
+				memoFile, err.Error())
+		}
 		files := make([]string, e.Blocks())
 		for i := range files {
 			files[i] = e.ParticleCatalog(snap, i)
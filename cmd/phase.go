@@ -21,6 +21,8 @@ type PhaseConfig struct {
 	rMaxMult, vMaxMult float64
 	pType phaseProfileType
 	subHub bool
+
+	configRecord
 }
 
 type phaseProfileType int
@@ -57,6 +59,7 @@ ProfileType = radial
 
 func (config *PhaseConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("prof.config")
+	defer config.record(vars)
 
 	vars.Int(&config.rbins, "RBins", 100)
 	vars.Int(&config.vbins, "VBins", 100)
@@ -111,6 +114,16 @@ func (config *PhaseConfig) validate() error {
 }
 
 func (config *PhaseConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	return runBatches(in, out, func(stdin []byte) ([]string, error) {
+		return config.run(gConfig, e, stdin)
+	})
+}
+
+// run executes the mode on a single batch of input.
+func (config *PhaseConfig) run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 	if logging.Mode != logging.Nil {
@@ -167,6 +180,10 @@ func (config *PhaseConfig) Run(
 	if err != nil {
 		return nil, err
 	}
+	pf, err := newPrefetcher(buf, e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, snap := range sortedSnaps {
 		if snap == -1 {
@@ -205,29 +222,29 @@ func (config *PhaseConfig) Run(
 		}
 		_, intrIdxs := binSphereIntersections(hds, hxBounds)
 
-		for i := range hds {
-			if len(intrIdxs[i]) == 0 {
-				continue
-			}
-
-			xs, vs, ms, _, err := buf.Read(files[i])
-			if err != nil {
-				return nil, err
-			}
-
-			// Waarrrgggble
-			for _, j := range intrIdxs[i] {
-				rhos := rhoSets[idxs[j]]
-
-				insertPhasePoints(
-					rhos,
-					hxBounds[j], hvBounds[j],
-					xs, vs, ms,
-					config, &hds[i],
-				)
-			}
-
-			buf.Close()
+		blocks, names := usedBlocks(files, func(i int) bool {
+			return len(intrIdxs[i]) > 0
+		})
+
+		err = pf.ReadChunks(names,
+			io.Positions|io.Velocities|io.Masses, int(gConfig.ChunkSize),
+			func(k int, chunk *io.Chunk) error {
+				i := blocks[k]
+				// Waarrrgggble
+				for _, j := range intrIdxs[i] {
+					rhos := rhoSets[idxs[j]]
+
+					insertPhasePoints(
+						rhos,
+						hxBounds[j], hvBounds[j],
+						chunk.Xs, chunk.Vs, chunk.Ms,
+						config, &hds[i],
+					)
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
 		}
 	}
 	
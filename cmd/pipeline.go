@@ -0,0 +1,438 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/io"
+	"github.com/phil-mansfield/shellfish/logging"
+	"github.com/phil-mansfield/shellfish/parse"
+)
+
+// pipelineStages lists the modes which can be run by the pipeline mode in the
+// order that they must be run.
+var pipelineStages = []string{"id", "tree", "coord", "shell", "stats"}
+
+type PipelineConfig struct {
+	stages []string
+
+	idConfig    string
+	treeConfig  string
+	coordConfig string
+	shellConfig string
+	statsConfig string
+
+	id    *IDConfig
+	tree  *TreeConfig
+	coord *CoordConfig
+	shell *ShellConfig
+	stats *StatsConfig
+
+	configRecord
+}
+
+var _ Mode = &PipelineConfig{}
+
+func (config *PipelineConfig) ExampleConfig() string {
+	return `[pipeline.config]
+
+#####################
+## Required Fields ##
+#####################
+
+# Stages lists the modes which will be run, in order. The output of each stage
+# is passed directly to the next stage without being written to disk, and
+# only the catalog of the final stage is printed. This must be the start of
+# the list id, tree, coord, shell, stats, except that tree may be left out.
+# The default is equivalent to running:
+#
+#     shellfish id | shellfish tree | shellfish coord | shellfish shell |
+#     shellfish stats
+Stages = id, tree, coord, shell, stats
+
+#####################
+## Optional Fields ##
+#####################
+
+# Each stage is configured by the same config file that the corresponding
+# mode would use. Stages whose config files aren't set use the default values
+# of every variable. Checkpoint files are ignored by the pipeline mode.
+#
+# IDConfig = example.id.config
+# TreeConfig = example.tree.config
+# CoordConfig = example.coord.config
+# ShellConfig = example.shell.config
+# StatsConfig = example.stats.config`
+}
+
+func (config *PipelineConfig) ReadConfig(fname string, flags []string) error {
+	vars := parse.NewConfigVars("pipeline.config")
+	defer config.record(vars)
+
+	vars.Strings(&config.stages, "Stages", pipelineStages)
+	vars.String(&config.idConfig, "IDConfig", "")
+	vars.String(&config.treeConfig, "TreeConfig", "")
+	vars.String(&config.coordConfig, "CoordConfig", "")
+	vars.String(&config.shellConfig, "ShellConfig", "")
+	vars.String(&config.statsConfig, "StatsConfig", "")
+
+	if fname != "" {
+		if err := parse.ReadConfig(fname, vars); err != nil {
+			return err
+		}
+	}
+	if err := parse.ReadFlags(flags, vars); err != nil {
+		return err
+	}
+
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	config.id, config.tree = &IDConfig{}, &TreeConfig{}
+	config.coord, config.shell = &CoordConfig{}, &ShellConfig{}
+	config.stats = &StatsConfig{}
+
+	stageConfigs := []struct {
+		mode  Mode
+		fname string
+	}{
+		{config.id, config.idConfig}, {config.tree, config.treeConfig},
+		{config.coord, config.coordConfig}, {config.shell, config.shellConfig},
+		{config.stats, config.statsConfig},
+	}
+	for _, sc := range stageConfigs {
+		if err := sc.mode.ReadConfig(sc.fname, nil); err != nil {
+			return err
+		}
+	}
+
+	if config.hasStage("shell") {
+		values := config.coord.values
+		if len(values) < 4 || values[0] != "X" || values[1] != "Y" ||
+			values[2] != "Z" || values[3] != "R200m" {
+			return fmt.Errorf("The shell stage requires that the coord " +
+				"stage's 'Values' variable starts with X, Y, Z, R200m.")
+		}
+	}
+
+	if config.hasStage("shell") && config.hasStage("stats") {
+		shell, stats := config.shell, config.stats
+		if shell.shellType != stats.shellType ||
+			shellCoeffNum(shell.shellType, shell.order, shell.lMax) !=
+				shellCoeffNum(stats.shellType, stats.order, stats.lMax) {
+			return fmt.Errorf("The 'ShellType', 'Order', and 'LMax' " +
+				"variables of the shell and stats stages don't match.")
+		}
+	}
+
+	return nil
+}
+
+func (config *PipelineConfig) validate() error {
+	if len(config.stages) == 0 {
+		return fmt.Errorf("The variable 'Stages' must be set.")
+	}
+
+	j := 0
+	for _, stage := range config.stages {
+		for j < len(pipelineStages) && pipelineStages[j] != stage {
+			if pipelineStages[j] != "tree" {
+				return fmt.Errorf("The variable 'Stages' was set to %s. "+
+					"It must be the start of the list %s, optionally "+
+					"without tree.", config.stages, pipelineStages)
+			}
+			j++
+		}
+		if j == len(pipelineStages) {
+			return fmt.Errorf("The variable 'Stages' contains '%s', which "+
+				"is either out of order or not a stage I recognize.", stage)
+		}
+		j++
+	}
+
+	return nil
+}
+
+// configs returns the recorded config files of the pipeline and of each of
+// the stages it runs.
+func (config *PipelineConfig) configs() map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{})
+	stages := map[string]recorder{
+		"id": config.id, "tree": config.tree, "coord": config.coord,
+		"shell": config.shell, "stats": config.stats,
+	}
+	for stage, rec := range stages {
+		if !config.hasStage(stage) {
+			continue
+		}
+		for name, values := range rec.configs() {
+			out[name] = values
+		}
+	}
+	for name, values := range config.resolved {
+		out[name] = values
+	}
+	return out
+}
+
+// hasStage returns true if the given stage is run by the pipeline.
+func (config *PipelineConfig) hasStage(stage string) bool {
+	for _, s := range config.stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Run executes each stage of the pipeline. Halos are passed between stages as
+// typed columns rather than text catalogs, and if both shell and stats are
+// run, every particle file is read once per snapshot.
+func (config *PipelineConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	if logging.Mode != logging.Nil {
+		log.Println(`
+########################
+## shellfish pipeline ##
+########################`,
+		)
+		log.Println("RNG Seed is", randSeed)
+	}
+	var t time.Time
+	if logging.Mode == logging.Performance {
+		t = time.Now()
+		tStart = t
+	}
+
+	last := config.stages[len(config.stages)-1]
+	idCString := catalog.CommentString(
+		[]string{"ID", "Snapshot"}, []string{}, []int{0, 1}, []int{1, 1},
+	)
+
+	ids, snaps, err := config.id.haloIDs(gConfig, e, nil)
+	if err != nil {
+		return err
+	} else if ids == nil {
+		return nil
+	}
+
+	if config.hasStage("tree") {
+		ids, snaps, err = config.tree.histories(gConfig, e, ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	if last == "id" || last == "tree" {
+		out.WriteHeader(idCString)
+		return out.WriteRows(catalog.FormatCols(
+			[][]int{ids, snaps}, [][]float64{}, []int{0, 1},
+		))
+	}
+
+	if len(ids) == 0 {
+		return fmt.Errorf("No input IDs.")
+	}
+	cols, err := config.coord.haloCoords(gConfig, e, ids, snaps)
+	if err != nil {
+		return err
+	}
+
+	switch last {
+	case "coord":
+		out.WriteHeader(makeCommentString(gConfig, config.coord))
+		return out.WriteRows(
+			config.coord.formatCols(gConfig, ids, snaps, cols),
+		)
+	case "shell":
+		return config.shell.runHalos(
+			gConfig, e, ids, snaps, cols[:4], nil, out,
+		)
+	}
+
+	err = config.runShellStats(gConfig, e, ids, snaps, cols[:4], out)
+	if err != nil {
+		return err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return nil
+}
+
+// runShellStats runs the shell and stats stages one snapshot at a time. The
+// particle files which stats needs are kept in memory after shell reads them
+// and are dropped once the snapshot is finished.
+func (config *PipelineConfig) runShellStats(
+	gConfig *GlobalConfig, e *env.Environment, ids, snaps []int,
+	coords [][]float64, out *catalog.RowWriter,
+) error {
+	buf, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return err
+	}
+	cache := newBlockCache(buf)
+	bufs := []io.VectorBuffer{cache}
+	for i := int64(0); i < gConfig.PrefetchBlocks; i++ {
+		b, err := getVectorBuffer(e.ParticleCatalog(snaps[0], 0), gConfig)
+		if err != nil {
+			return err
+		}
+		bufs = append(bufs, cache.share(b))
+	}
+
+	shells := make([][]float64, len(ids))
+	var state *shellState
+	prepare := func(snap int, idxs []int) error {
+		var err error
+		if state == nil {
+			state, err = newShellState(
+				config.shell, gConfig.speciesList(),
+				io.NewPrefetcher(bufs),
+				e, snap,
+				gConfig.Threads, gConfig.ChunkSize,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		keep, err := config.stats.particleFiles(snap, idxs, coords, cache, e)
+		if err != nil {
+			return err
+		}
+		cache.Reset(keep)
+
+		return state.analyzeSnap(snap, ids, idxs, coords, shells)
+	}
+
+	sp := &statsShellParticles{}
+	err = config.stats.runHalos(
+		gConfig, e, ids, snaps, coords, shells, cache, prepare, nil, sp, out,
+	)
+	if err != nil {
+		return err
+	}
+	cache.Reset(nil)
+
+	if config.stats.shellFilter && !config.stats.skipMass {
+		return writeShellParticles(sp.snaps, sp.ids, sp.particles,
+			gConfig, config.stats)
+	}
+	return nil
+}
+
+// blockCache is a VectorBuffer which keeps copies of some of the particle
+// files it reads so that they only need to be read from disk once. The slices
+// returned for a cached file must not be modified.
+type blockCache struct {
+	io.VectorBuffer
+	store *blockStore
+	// types are the particle types of the last file which was read.
+	types []uint8
+}
+
+// blockStore holds the files cached by a blockCache. It's shared by every
+// blockCache created with share, which may be read from concurrently while
+// prefetching.
+type blockStore struct {
+	mu     sync.Mutex
+	keep   map[string]bool
+	blocks map[string]*cachedBlock
+}
+
+// cachedBlock is the contents of a single particle file.
+type cachedBlock struct {
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+	types  []uint8
+}
+
+// newBlockCache creates a blockCache which reads files through buf.
+func newBlockCache(buf io.VectorBuffer) *blockCache {
+	return &blockCache{
+		VectorBuffer: buf,
+		store: &blockStore{
+			keep:   map[string]bool{},
+			blocks: map[string]*cachedBlock{},
+		},
+	}
+}
+
+// share creates a blockCache which reads files through buf and shares its
+// cached files with bc.
+func (bc *blockCache) share(buf io.VectorBuffer) *blockCache {
+	return &blockCache{VectorBuffer: buf, store: bc.store}
+}
+
+// Reset drops every cached file. Afterwards, only the files in keep will be
+// cached.
+func (bc *blockCache) Reset(keep map[string]bool) {
+	bc.store.mu.Lock()
+	defer bc.store.mu.Unlock()
+	bc.store.keep = keep
+	bc.store.blocks = map[string]*cachedBlock{}
+}
+
+func (bc *blockCache) Read(
+	fname string,
+) (xs, vs [][3]float32, ms []float32, ids []int64, err error) {
+	bc.store.mu.Lock()
+	b, ok := bc.store.blocks[fname]
+	keep := bc.store.keep[fname]
+	bc.store.mu.Unlock()
+	if ok {
+		bc.types = b.types
+		return b.xs, b.vs, b.ms, b.ids, nil
+	}
+
+	xs, vs, ms, ids, err = bc.VectorBuffer.Read(fname)
+	bc.types = nil
+	if tbuf, ok := bc.VectorBuffer.(io.TypedBuffer); ok && err == nil {
+		bc.types = tbuf.Types()
+	}
+	if err != nil || !keep {
+		return xs, vs, ms, ids, err
+	}
+
+	// shell moves particles across the periodic boundaries in place, so the
+	// cache needs its own copy.
+	b = &cachedBlock{
+		xs:  append([][3]float32{}, xs...),
+		vs:  append([][3]float32{}, vs...),
+		ms:  append([]float32{}, ms...),
+		ids: append([]int64{}, ids...),
+	}
+	if bc.types != nil {
+		b.types = append([]uint8{}, bc.types...)
+		bc.types = b.types
+	}
+	bc.store.mu.Lock()
+	bc.store.blocks[fname] = b
+	bc.store.mu.Unlock()
+
+	return xs, vs, ms, ids, nil
+}
+
+// Types returns the particle types of the last file which was read. They're
+// nil if the underlying VectorBuffer isn't an io.TypedBuffer.
+func (bc *blockCache) Types() []uint8 { return bc.types }
+
+// Close closes the underlying VectorBuffer if it's open. Reading a cached file
+// doesn't open it, so there may be nothing to close.
+func (bc *blockCache) Close() {
+	if bc.VectorBuffer.IsOpen() {
+		bc.VectorBuffer.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// countingBuffer is a VectorBuffer which counts how many times each file is
+// read.
+type countingBuffer struct {
+	reads map[string]int
+}
+
+func (buf *countingBuffer) Read(
+	fname string,
+) (xs, vs [][3]float32, ms []float32, ids []int64, err error) {
+	buf.reads[fname]++
+	return [][3]float32{{1, 2, 3}}, [][3]float32{{0, 0, 0}},
+		[]float32{1}, []int64{int64(len(fname))}, nil
+}
+
+func (buf *countingBuffer) Close()                              {}
+func (buf *countingBuffer) IsOpen() bool                        { return false }
+func (buf *countingBuffer) ReadHeader(string, *io.Header) error { return nil }
+func (buf *countingBuffer) MinMass() float32                    { return 1 }
+func (buf *countingBuffer) TotalParticles(string) (int, error)  { return 1, nil }
+
+func TestBlockCacheShare(t *testing.T) {
+	buf0 := &countingBuffer{map[string]int{}}
+	buf1 := &countingBuffer{map[string]int{}}
+	cache := newBlockCache(buf0)
+	shared := cache.share(buf1)
+	cache.Reset(map[string]bool{"a": true})
+
+	// Files read through either buffer are cached for both.
+	for _, bc := range []*blockCache{shared, cache, shared} {
+		bc.Read("a")
+		bc.Read("b")
+	}
+	if buf0.reads["a"] != 0 || buf1.reads["a"] != 1 {
+		t.Errorf("Expected the kept file to be read once, got %d and %d "+
+			"reads.", buf0.reads["a"], buf1.reads["a"])
+	}
+	if buf0.reads["b"] != 1 || buf1.reads["b"] != 2 {
+		t.Errorf("Expected the other file to be read every time, got %d "+
+			"and %d reads.", buf0.reads["b"], buf1.reads["b"])
+	}
+
+	shared.Reset(nil)
+	cache.Read("a")
+	if buf0.reads["a"] != 1 {
+		t.Errorf("Expected Reset to drop files cached by the other buffer.")
+	}
+}
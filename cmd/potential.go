@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"math/rand"
 	"sort"
 	"time"
 	"runtime"
@@ -16,6 +15,7 @@ import (
 	"github.com/phil-mansfield/shellfish/parse"
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/cmd/memo"
+	"github.com/phil-mansfield/shellfish/math/rand"
 )
 
 type PotentialConfig struct {
@@ -23,6 +23,8 @@ type PotentialConfig struct {
 	rGridMult float64
 	rMinMult, rMaxMult float64
 	frac float64
+
+	configRecord
 }
 
 var _ Mode = &PotentialConfig{}
@@ -45,6 +47,7 @@ ParticleFraction = 0.01
 
 func (config *PotentialConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("prof.config")
+	defer config.record(vars)
 
 	vars.Int(&config.ncells, "RBins", 64)
 	vars.Float(&config.rGridMult, "GridRMult", 8)
@@ -70,13 +73,13 @@ func (config *PotentialConfig) validate() error {
 		return fmt.Errorf("The variable '%s' was set to %d.",
 			"NCells", config.ncells)
 	} else if config.rGridMult < 0 {
-		return fmt.Errorf("The variable '%s' was set to %d.",
+		return fmt.Errorf("The variable '%s' was set to %g.",
 			"RGridMult", config.rGridMult)
 	} else if config.rMaxMult < 0 {
-		return fmt.Errorf("The variable '%s' was set to %d.",
+		return fmt.Errorf("The variable '%s' was set to %g.",
 			"RMaxMult", config.rMaxMult)
 	} else if config.rMinMult < 0 {
-		return fmt.Errorf("The variable '%s' was set to %d.",
+		return fmt.Errorf("The variable '%s' was set to %g.",
 			"RMinMult", config.rMinMult)
 	}
 
@@ -84,6 +87,16 @@ func (config *PotentialConfig) validate() error {
 }
 
 func (config *PotentialConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	return runBatches(in, out, func(stdin []byte) ([]string, error) {
+		return config.run(gConfig, e, stdin)
+	})
+}
+
+// run executes the mode on a single batch of input.
+func (config *PotentialConfig) run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 	if logging.Mode != logging.Nil {
@@ -139,6 +152,10 @@ func (config *PotentialConfig) Run(
 	if err != nil {
 		return nil, err
 	}
+	pf, err := newPrefetcher(buf, e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	// Count number of workers
 
@@ -172,39 +189,58 @@ func (config *PotentialConfig) Run(
 
 		for i := range hxBounds { hxBounds[i].R /= float32(config.rMaxMult) }
 		
-		for i := range hds {
-			if len(intrIdxs[i]) == 0 { continue }
-
-			xs, _, ms, _, err := buf.Read(files[i])
-			if err != nil {
-				return nil, err
-			}
-
-			table := make([]bool, len(xs))
-
-			// Waarrrgggble
-			for _, j := range intrIdxs[i] {
-				phisXY := phiSets[0][idxs[j]]
-				phisYZ := phiSets[1][idxs[j]]
-				phisXZ := phiSets[2][idxs[j]]
-
-				lg := NewLockGroup(workers)
-				for i := range table { table[i] = rand.Float64() <= config.frac }
-				
-				for k := 0; k < workers; k++ {
-					go insertPotentialPoints(
-						phisXY, phisYZ, phisXZ,
-						hxBounds[j],
-						xs, ms, table,
-						config, &hds[i],
-						lg.Lock(k),
-					)
+		blocks, names := usedBlocks(files, func(i int) bool {
+			return len(intrIdxs[i]) > 0
+		})
+
+		// Each halo's generator is shared by all the chunks of the file so
+		// that the same particles are used regardless of the chunk size or
+		// prefetching.
+		gens := []*rand.Generator{}
+		table := []bool{}
+
+		err = pf.ReadChunks(names, io.Positions|io.Masses,
+			int(gConfig.ChunkSize), func(k int, chunk *io.Chunk) error {
+				i := blocks[k]
+				if chunk.Start == 0 {
+					gens = gens[:0]
+					for _, j := range intrIdxs[i] {
+						gens = append(gens, haloRand(ids[idxs[j]], snap, i))
+					}
 				}
-				
-				lg.Synchronize()
-			}
 
-			buf.Close()
+				xs, ms := chunk.Xs, chunk.Ms
+				if cap(table) < len(xs) {
+					table = make([]bool, len(xs))
+				}
+				table = table[:len(xs)]
+
+				// Waarrrgggble
+				for jj, j := range intrIdxs[i] {
+					phisXY := phiSets[0][idxs[j]]
+					phisYZ := phiSets[1][idxs[j]]
+					phisXZ := phiSets[2][idxs[j]]
+
+					lg := NewLockGroup(workers)
+					gen := gens[jj]
+					for k := range table { table[k] = gen.Uniform(0, 1) <= config.frac }
+			
+					for k := 0; k < workers; k++ {
+						go insertPotentialPoints(
+							phisXY, phisYZ, phisXZ,
+							hxBounds[j],
+							xs, ms, table,
+							config, &hds[i],
+							lg.Lock(k),
+						)
+					}
+			
+					lg.Synchronize()
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
 		}
 	}
 	
@@ -4,12 +4,11 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"sort"
 	"time"
-	"math/rand"
 	"runtime"
 
 	msort "github.com/phil-mansfield/shellfish/math/sort"
+	"github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/los/geom"
 	"github.com/phil-mansfield/shellfish/los/analyze"
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
@@ -22,12 +21,17 @@ import (
 
 type ProfConfig struct {
 	bins, order, samples int64
+	shellType string
+	lMax int64
 	rMaxMult, rMinMult float64
 	medianPixelLevel int64
 	percentile float64
 
 	pType profileType
 
+	checkpointFile string
+
+	configRecord
 }
 
 type profileType int
@@ -63,10 +67,14 @@ func (config *ProfConfig) ExampleConfig() string {
 # bound-density -     The density of bound matter, assuming an NFW profile.
 ProfileType = median-density
 
-# Order is the order of the Penna-Dines shell fit that Shellfish uses. This
-# variable only needs to be set if ProfileType is set to contained-density
-# or angular-fraction.
+# ShellType is the type of shell in the input catalog, either penna or
+# harmonic, and must match the ShellType used by the shell.config file. Order
+# is the order of Penna-Dines shells and LMax is the maximum degree of harmonic
+# shells. These variables only need to be set if ProfileType is set to
+# contained-density or angular-fraction.
+# ShellType = penna
 # Order = 3
+# LMax = 4
 
 # Samples is the number of Monte Carlo samples used when calculating angular
 # fraction profiles. It does not need to be set when other profiles are
@@ -96,20 +104,33 @@ ProfileType = median-density
 
 # RMinMult is the minimum radius of the profile as a function of R_200m.
 # RMinMult = 0.03
+
+# CheckpointFile is a file that the profiles of finished halos are appended to
+# after each snapshot is analyzed. If a run is killed and then restarted with
+# the same input and config file, halos in the checkpoint file will not be
+# analyzed again. The checkpoint file can be deleted after the run finishes.
+# Checkpointing is not done for angular-fraction profiles.
+#
+# If CheckpointFile is not set, no checkpointing is done.
+# CheckpointFile = prof.checkpoint
 `
 }
 
 
 func (config *ProfConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("prof.config")
+	defer config.record(vars)
 
 	vars.Int(&config.bins, "Bins", 150)
+	vars.String(&config.shellType, "ShellType", "penna")
 	vars.Int(&config.order, "Order", 3)
+	vars.Int(&config.lMax, "LMax", 4)
 	vars.Int(&config.samples, "Samples", 50 * 1000)
 	vars.Float(&config.rMaxMult, "RMaxMult", 3.0)
 	vars.Float(&config.rMinMult, "RMinMult", 0.03)
 	vars.Int(&config.medianPixelLevel, "MedianPixelLevel", 3)
 	vars.Float(&config.percentile, "Percentile", 50)
+	vars.String(&config.checkpointFile, "CheckpointFile", "")
 	var pType string
 	vars.String(&pType, "ProfileType", "")
 
@@ -165,16 +186,17 @@ func (config *ProfConfig) validate() error {
 		return fmt.Errorf("The variable '%s' was set to %g.",
 			"RMinMult", config.rMinMult)
 	} else if config.medianPixelLevel < 0 {
-		return fmt.Errorf("The variable '%s' was set to %g.",
+		return fmt.Errorf("The variable '%s' was set to %d.",
 			"MedianPixelLevel", config.medianPixelLevel)
 	}
 
-	return nil
+	return validateShellType(config.shellType, config.lMax)
 }
 
 func (config *ProfConfig) Run(
-	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
-) ([]string, error) {
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
 	if logging.Mode != logging.Nil {
 		log.Println(`
 ####################
@@ -188,16 +210,46 @@ func (config *ProfConfig) Run(
 		t = time.Now()
 	}
 
+	cp, err := openCheckpoint(config.checkpointFile, config, gConfig)
+	if err != nil {
+		return err
+	}
+
+	err = eachBatch(in, func(stdin []byte) error {
+		return config.runBatch(gConfig, e, stdin, cp, out)
+	})
+	if err != nil {
+		return err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return nil
+}
+
+// runBatch computes the profiles of the halos in a single batch of input and
+// writes them to out as each snapshot is finished.
+func (config *ProfConfig) runBatch(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+	cp *checkpoint, out *catalog.RowWriter,
+) error {
 	var (
 		intCols [][]int
 		coords  [][]float64
 		vCoords [][]float64
 		scaleRs []float64
 		masses  []float64
-		shells []analyze.Shell
+		shells [][]analyze.Shell
 		err error
 	)
 
+	// shells[k][i] is the shell of species k around halo i.
+	sps := gConfig.speciesList()
+	shells = make([][]analyze.Shell, len(sps))
+
 	switch config.pType {
 	case densityProfile, medianDensityProfile, medianErrorProfile:
 		intColIdxs := []int{0, 1}
@@ -208,10 +260,12 @@ func (config *ProfConfig) Run(
 		)
 		
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		shells = make([]analyze.Shell, len(coords[0]))
+		for k := range shells {
+			shells[k] = make([]analyze.Shell, len(coords[0]))
+		}
 		vCoords = make([][]float64, 3)
 		masses = make([]float64, len(coords[0]))
 		scaleRs = make([]float64, len(coords[0]))
@@ -220,7 +274,8 @@ func (config *ProfConfig) Run(
 		}
 	case containedDensityProfile, angularFractionProfile:
 		intColIdxs := []int{0, 1}
-		floatColIdxs := make([]int, 4 + config.order*config.order*2)
+		n := shellCoeffNum(config.shellType, config.order, config.lMax)
+		floatColIdxs := make([]int, 4 + n*len(sps))
 		for i := range floatColIdxs {
 			floatColIdxs[i] += i + 2
 		}
@@ -231,19 +286,20 @@ func (config *ProfConfig) Run(
 		)
 
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		coords = floatCols[:4]
-		coeffs := floatCols[4:]
-		shells = make([]analyze.Shell, len(coords[0]))
-		for i := range shells {
-			coeffVec := make([]float64, len(coeffs))
-			for j := range coeffVec {
-				coeffVec[j] = coeffs[j][i]
+		for k := range shells {
+			coeffs := floatCols[4+k*n : 4+(k+1)*n]
+			shells[k] = make([]analyze.Shell, len(coords[0]))
+			for i := range shells[k] {
+				coeffVec := make([]float64, len(coeffs))
+				for j := range coeffVec {
+					coeffVec[j] = coeffs[j][i]
+				}
+				shells[k][i] = shellFunc(coeffVec)
 			}
-			order := int(config.order)
-			shells[i] = analyze.PennaFunc(coeffVec, order, order, 2)
 		}
 
 		scaleRs = make([]float64, len(coords[0]))
@@ -260,69 +316,154 @@ func (config *ProfConfig) Run(
 		intCols, fCols, err = catalog.Parse(
 			stdin, intColIdxs, floatColIdxs,
 		)
-		if err != nil { return nil, err }
+		if err != nil { return err }
 
 		coords, masses, scaleRs, vCoords =
 			fCols[:4], fCols[4], fCols[5], fCols[6:9]
 		
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		shells = make([]analyze.Shell, len(coords[0]))
+		for k := range shells {
+			shells[k] = make([]analyze.Shell, len(coords[0]))
+		}
 	}
 
 	if len(intCols) == 0 {
-		return nil, fmt.Errorf("No input IDs.")
+		return fmt.Errorf("No input IDs.")
 	}
 
 	ids, snaps := intCols[0], intCols[1]
-	snapBins, idxBins := binBySnap(snaps, ids)
+	_, idxBins := binBySnap(snaps, ids)
 
 	if config.pType == angularFractionProfile {
-		return angularFractionMain(ids, snaps, shells, coords[3], config)
+		lines, err := angularFractionMain(
+			ids, snaps, sps, shells, coords[3], config,
+		)
+		if err != nil {
+			return err
+		}
+		out.WriteHeader(lines[0])
+		return out.WriteRows(lines[1:])
 	}
 
-	// Profiles for everyone
+	// Profiles for everyone. rhoSets[k][i] is the profile of species k
+	// around halo i.
 	rSets := make([][]float64, len(ids))
-	rhoSets := make([][]float64, len(ids))
 	for i := range rSets {
 		rSets[i] = make([]float64, config.bins)
-		rhoSets[i] = make([]float64, config.bins)
+	}
+	rhoSets := make([][][]float64, len(sps))
+	for k := range rhoSets {
+		rhoSets[k] = make([][]float64, len(ids))
+		for i := range rhoSets[k] {
+			rhoSets[k][i] = make([]float64, config.bins)
+		}
 	}
 
 	// Workspace buffers just for the median-density mode.
 	var (
-		medRhoSets [][][]float64
+		medRhoSets [][][][]float64
 		medScratchBuffer []float64
 	)
 	if config.pType == medianDensityProfile ||
 		config.pType == medianErrorProfile {
 
-		medRhoSets = make([][][]float64, len(ids))
+		medRhoSets = make([][][][]float64, len(sps))
 		n := geom.SpherePixelNum(int(config.medianPixelLevel))
 		medScratchBuffer = make([]float64, n)
-		for i := range medRhoSets {
-			medRhoSets[i] = make([][]float64, config.bins)
-			for j := range medRhoSets[i] {
-				medRhoSets[i][j] = make([]float64, n)
+		for k := range medRhoSets {
+			medRhoSets[k] = make([][][]float64, len(ids))
+			for i := range medRhoSets[k] {
+				medRhoSets[k][i] = make([][]float64, config.bins)
+				for j := range medRhoSets[k][i] {
+					medRhoSets[k][i][j] = make([]float64, n)
+				}
 			}
 		}
 
 	}
 
 
-	sortedSnaps := []int{}
-	for snap := range snapBins {
-		sortedSnaps = append(sortedSnaps, snap)
+	cp.SetInput(stdin)
+	for i := range rSets {
+		if !cp.Done(i) {
+			continue
+		}
+		row, _ := cp.Record(i)
+		for k := range rhoSets {
+			copy(rhoSets[k][i], row[:len(rhoSets[k][i])])
+			row = row[len(rhoSets[k][i]):]
+			if medRhoSets != nil {
+				for j := range medRhoSets[k][i] {
+					n := len(medRhoSets[k][i][j])
+					copy(medRhoSets[k][i][j], row[:n])
+					row = row[n:]
+				}
+			}
+		}
+	}
+
+	names := []string{"ID", "Snapshot", "R [cMpc/h]"}
+	sizes := []int{1, 1, int(config.bins)}
+	for k := range sps {
+		names = append(names, sps[k].columnName("Rho [h^2 Msun/cMpc^3]"))
+		sizes = append(sizes, int(config.bins))
 	}
-	sort.Ints(sortedSnaps)
+	headerOrder := make([]int, len(names))
+	for i := range headerOrder { headerOrder[i] = i }
+	out.WriteHeader(catalog.CommentString(
+		names, []string{}, headerOrder, sizes,
+	))
+
+	em := newRowEmitter(out, len(ids), func(start, end int) []string {
+		for k := range rhoSets {
+			for i := start; i < end; i++ {
+				rMax := coords[3][i]*config.rMaxMult
+				rMin := coords[3][i]*config.rMinMult
+				if config.pType == medianDensityProfile {
+					processMedianProfile(rSets[i], rhoSets[k][i],
+						medRhoSets[k][i], medScratchBuffer, rMin, rMax,
+						config.percentile,
+					)
+				} else if config.pType == medianErrorProfile {
+					processMedianErrorProfile(rSets[i], rhoSets[k][i],
+						medRhoSets[k][i], medScratchBuffer, rMin, rMax,
+						config.percentile, config.samples,
+						haloRand(ids[i], snaps[i]),
+					)
+				} else {
+					processProfile(rSets[i], rhoSets[k][i], rMin, rMax)
+				}
+			}
+		}
+
+		cols := transpose(rSets[start:end])
+		for k := range rhoSets {
+			cols = append(cols, transpose(rhoSets[k][start:end])...)
+		}
+
+		order := make([]int, len(cols) + 2)
+		for i := range order { order[i] = i }
+		return catalog.FormatCols(
+			[][]int{ids[start:end], snaps[start:end]}, cols, order,
+		)
+	})
+
+	// Snapshots are analyzed in the order they first appear so that rows can
+	// be written as soon as possible.
+	sortedSnaps := snapOrder(snaps)
 	
 	buf, err := getVectorBuffer(
 		e.ParticleCatalog(snaps[0], 0), gConfig,
 	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	pf, err := newPrefetcher(buf, e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return err
 	}
 
 	// Count number of workers
@@ -331,12 +472,17 @@ func (config *ProfConfig) Run(
 	if gConfig.Threads > 0 { workers = int(gConfig.Threads) }
 	runtime.GOMAXPROCS(workers)
 
+	var spMs []float32
+
 	for _, snap := range sortedSnaps {
-		if snap == -1 {
+		idxs := idxBins[snap]
+		if snap == -1 || cp.AllDone(idxs) {
+			if err = em.Finish(idxs); err != nil {
+				return err
+			}
 			continue
 		}
 
-		idxs := idxBins[snap]
 		snapCoords := [][]float64{
 			// radii and positions
 			make([]float64, len(idxs)), make([]float64, len(idxs)),
@@ -362,101 +508,90 @@ func (config *ProfConfig) Run(
 		}
 		hds, files, err := memo.ReadHeaders(snap, buf, e)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		hBounds, err := extendedBoundingSpheres(snapCoords, &hds[0], e)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		for i := range hBounds { hBounds[i].S.R *= float32(config.rMaxMult) }
 		_, intrIdxs := binExtendedSphereIntersections(hds, hBounds)
 		for i := range hBounds { hBounds[i].S.R /= float32(config.rMaxMult) }
 		
-		for i := range hds {
-			if len(intrIdxs[i]) == 0 {
-				continue
-			}
+		blocks, blockNames := usedBlocks(files, func(i int) bool {
+			return len(intrIdxs[i]) > 0
+		})
 
-			xs, vs, ms, _, err := buf.Read(files[i])
-			if err != nil { return nil, err }
-			
-			lg := NewLockGroup(workers)
+		fields := io.Positions|io.Velocities|io.Masses
+		if needsTypes(sps) {
+			fields |= io.Types
+		}
+		err = pf.ReadChunks(blockNames, fields, int(gConfig.ChunkSize),
+			func(b int, chunk *io.Chunk) error {
+				i := blocks[b]
+				xs, vs := chunk.Xs, chunk.Vs
+
+				for k := range sps {
+					ms := sps[k].weighMasses(chunk.Ms, chunk.Types, spMs)
+					if sps[k].weights != nil {
+						spMs = ms
+					}
+					lg := NewLockGroup(workers)
 
-			for w := 0; w < workers; w++ {
-				go func(w int, lock *Lock) {
-					// Waarrrgggble
-					for jj := lock.Idx; jj < len(intrIdxs[i]); jj += workers {
-						j := intrIdxs[i][jj]
+					for w := 0; w < workers; w++ {
+						go func(w int, lock *Lock) {
+							// Waarrrgggble
+							for jj := lock.Idx; jj < len(intrIdxs[i]); jj += workers {
+								j := intrIdxs[i][jj]
 						
-						rhos := rhoSets[idxs[j]]
-						s := hBounds[j]
+								rhos := rhoSets[k][idxs[j]]
+								s := hBounds[j]
 						
-						if config.pType == medianDensityProfile ||
-							config.pType == medianErrorProfile {
-							medRhos := medRhoSets[idxs[j]]
-							insertMedianPoints(
-								medRhos, s, xs, ms, config, &hds[i],
-							)
-						} else {
-							insertPoints(
-								rhos, s, xs, vs, ms,
-								shells[idxs[j]], config, &hds[i],
-							)
-						}
+								if config.pType == medianDensityProfile ||
+									config.pType == medianErrorProfile {
+									medRhos := medRhoSets[k][idxs[j]]
+									insertMedianPoints(
+										medRhos, s, xs, ms, config, &hds[i],
+									)
+								} else {
+									insertPoints(
+										rhos, s, xs, vs, ms,
+										shells[k][idxs[j]], config, &hds[i],
+									)
+								}
+							}
+
+							lock.Unlock()
+						}(w, lg.Lock(w))
 					}
-
-					lock.Unlock()
-				}(w, lg.Lock(w))
-			}
-			
-			lg.Synchronize()
 			
-			buf.Close()
-
-			return nil, nil
+					lg.Synchronize()
+				}
+				return nil
+			})
+		if err != nil { return err }
+
+		rows := make([][]float64, len(idxs))
+		for j, idx := range idxs {
+			for k := range rhoSets {
+				rows[j] = append(rows[j], rhoSets[k][idx]...)
+				if medRhoSets != nil {
+					for jj := range medRhoSets[k][idx] {
+						rows[j] = append(rows[j], medRhoSets[k][idx][jj]...)
+					}
+				}
+			}
 		}
-	}
-	
-	for i := range rSets {
-		rMax := coords[3][i]*config.rMaxMult
-		rMin := coords[3][i]*config.rMinMult
-		if config.pType == medianDensityProfile {
-			processMedianProfile(rSets[i], rhoSets[i],
-				medRhoSets[i], medScratchBuffer, rMin, rMax,
-				config.percentile,
-			)
-		} else if config.pType == medianErrorProfile {
-			processMedianErrorProfile(rSets[i], rhoSets[i],
-				medRhoSets[i], medScratchBuffer, rMin, rMax,
-				config.percentile, config.samples,
-			)
-		} else {
-			processProfile(rSets[i], rhoSets[i], rMin, rMax)
+		if err = cp.Append(idxs, rows, nil); err != nil {
+			return err
+		}
+		if err = em.Finish(idxs); err != nil {
+			return err
 		}
 	}
 
-	rSets = transpose(rSets)
-	rhoSets = transpose(rhoSets)
-
-	order := make([]int, len(rSets) + len(rhoSets) + 2)
-	for i := range order { order[i] = i }
-	lines := catalog.FormatCols(
-			[][]int{ids, snaps}, append(rSets, rhoSets...), order,
-	)
-	
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot", "R [cMpc/h]", "Rho [h^2 Msun/cMpc^3]"},
-		[]string{}, []int{0, 1, 2, 3},
-		[]int{1, 1, int(config.bins), int(config.bins)},
-	)
-
-	if logging.Mode == logging.Performance {
-		log.Printf("Time: %s", time.Since(t).String())
-		log.Printf("Memory:\n%s", logging.MemString())
-	}
-
-	return append([]string{cString}, lines...), nil
+	return nil
 }
 
 // rhos is a buffer and will be cleared before use
@@ -606,7 +741,7 @@ func processMedianProfile(rs, rhos []float64, medRhos [][]float64,
 
 func processMedianErrorProfile(rs, rhos []float64, medRhos [][]float64,
 	medScratchBuffer []float64, rMin, rMax float64,
-	percentile float64, samples int64,
+	percentile float64, samples int64, gen *rand.Generator,
 ) {
 	n := len(rs)
 
@@ -621,13 +756,14 @@ func processMedianErrorProfile(rs, rhos []float64, medRhos [][]float64,
 		dV := (rHi*rHi*rHi - rLo*rLo*rLo) * 4 * math.Pi / 3
 
 		rhos[j] = bootstrapErrorPercentile(
-			medRhos[j], percentile, medScratchBuffer, samples,
+			medRhos[j], percentile, medScratchBuffer, samples, gen,
 		) / dV
 	}
 }
 
 func bootstrapErrorPercentile(
 	x []float64, percentile float64, scratchBuffer []float64, samples int64,
+	gen *rand.Generator,
 ) float64 {
 	sampleBuffer := make([]float64, len(x))
 
@@ -636,7 +772,7 @@ func bootstrapErrorPercentile(
 
 	for i := int64(0); i < samples; i++ {
 		for j := range x {
-			sampleBuffer[j] = x[rand.Intn(len(x))]
+			sampleBuffer[j] = x[gen.UniformInt(0, len(x))]
 		}
 		p := msort.Percentile(sampleBuffer, percentile/100, scratchBuffer)
 		sum += p
@@ -650,37 +786,47 @@ func bootstrapErrorPercentile(
 }
 
 func angularFractionMain(
-	ids, snaps []int, shells []analyze.Shell, rs []float64, config *ProfConfig,
+	ids, snaps []int, sps []species, shells [][]analyze.Shell, rs []float64,
+	config *ProfConfig,
 ) ([]string, error) {
 	rCols := make([][]float64, config.bins)
-	fCols := make([][]float64, config.bins)
 	for i := range rCols {
 		rCols[i] = make([]float64, len(ids))
-		fCols[i] = make([]float64, len(ids))
 	}
+	cols := rCols
+	names := []string{"ID", "Snapshot", "R [cMpc/h]"}
+	sizes := []int{1, 1, int(config.bins)}
+
+	for k := range sps {
+		fCols := make([][]float64, config.bins)
+		for i := range fCols {
+			fCols[i] = make([]float64, len(ids))
+		}
 
-	for i := range shells {
-		rs, fs := shells[i].AngularFractionProfile(
-			int(config.samples), int(config.bins),
-			rs[i] * config.rMinMult, rs[i] * config.rMaxMult,
-		)
+		for i := range shells[k] {
+			rBins, fs := shells[k][i].AngularFractionProfile(
+				int(config.samples), int(config.bins),
+				rs[i] * config.rMinMult, rs[i] * config.rMaxMult,
+				haloRand(ids[i], snaps[i]),
+			)
 
-		for j := range rs {
-			rCols[j][i], fCols[j][i] = rs[j], fs[j]
+			for j := range rBins {
+				rCols[j][i], fCols[j][i] = rBins[j], fs[j]
+			}
 		}
+
+		cols = append(cols, fCols...)
+		names = append(names, sps[k].columnName("Volume Fraction Contained"))
+		sizes = append(sizes, int(config.bins))
 	}
 
-	order := make([]int, len(rCols) + len(fCols) + 2)
+	order := make([]int, len(cols) + 2)
 	for i := range order { order[i] = i }
-	lines := catalog.FormatCols(
-		[][]int{ids, snaps}, append(rCols, fCols...), order,
-	)
+	lines := catalog.FormatCols([][]int{ids, snaps}, cols, order)
 
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot", "R [cMpc/h]", "Volume Fraction Contained"},
-		[]string{}, []int{0, 1, 2, 3},
-		[]int{1, 1, int(config.bins), int(config.bins)},
-	)
+	headerOrder := make([]int, len(names))
+	for i := range headerOrder { headerOrder[i] = i }
+	cString := catalog.CommentString(names, []string{}, headerOrder, sizes)
 
 	return append([]string{cString}, lines...), nil
 }
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/parse"
+	"github.com/phil-mansfield/shellfish/version"
+)
+
+// provenance is a single block in the provenance record at the end of every
+// catalog. It describes one run of one mode. Blocks from earlier modes in a
+// pipeline are carried forward, so the full record describes every step that
+// went into a catalog.
+type provenance struct {
+	Mode      string `json:"mode"`
+	Version   string `json:"version"`
+	Seed      uint64 `json:"seed"`
+	InputHash string `json:"input_hash"`
+	Timestamp string `json:"timestamp"`
+	// Configs contains the value of every variable in the global config and
+	// the mode's config files, including defaults and flags, keyed by config
+	// file title.
+	Configs map[string]map[string]interface{} `json:"configs"`
+}
+
+// configRecord stores the value of every variable in the config files that a
+// config struct was read from, keyed by config file title. It's embedded in
+// each config struct so that provenance blocks describe the configs which
+// were actually run and not other files read along the way, like the copy of
+// the global config in MemoDir.
+type configRecord struct {
+	resolved map[string]map[string]interface{}
+}
+
+// record stores the current values of the variables in vars.
+func (r *configRecord) record(vars *parse.ConfigVars) {
+	if r.resolved == nil {
+		r.resolved = make(map[string]map[string]interface{})
+	}
+	r.resolved[vars.Name()] = vars.Values()
+}
+
+// configs returns the recorded config files.
+func (r *configRecord) configs() map[string]map[string]interface{} {
+	return r.resolved
+}
+
+// recorder is a config struct which records the files it was read from.
+type recorder interface {
+	configs() map[string]map[string]interface{}
+}
+
+// Provenance returns the provenance block for a run of the mode modeName
+// which started at the time start and whose input had the hash inputHash.
+// mode and gConfig are the configs being run and must already have been read.
+func Provenance(
+	modeName string, mode Mode, gConfig *GlobalConfig,
+	inputHash string, start time.Time,
+) (string, error) {
+	p := provenance{
+		Mode:      modeName,
+		Version:   version.SourceVersion,
+		Seed:      randSeed,
+		InputHash: inputHash,
+		Timestamp: start.UTC().Format(time.RFC3339),
+		Configs:   make(map[string]map[string]interface{}),
+	}
+	for _, rec := range []interface{}{gConfig, mode} {
+		if rec, ok := rec.(recorder); ok {
+			for name, values := range rec.configs() {
+				p.Configs[name] = values
+			}
+		}
+	}
+
+	data, err := json.Marshal(&p)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	defer func(seed uint64) { randSeed = seed }(randSeed)
+
+	// Both config files have the title "config", but only the one being run
+	// should be recorded.
+	gConfig := readSeedConfig(t, 3)
+	SetSeed(gConfig)
+	readSeedConfig(t, 5)
+
+	stats := &StatsConfig{}
+	if err := stats.ReadConfig("", []string{"--Values", "id,r_sp"}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	block, err := Provenance("stats", stats, gConfig, "abc", time.Now())
+	if err != nil {
+		t.Fatalf("Provenance returned error: %s", err.Error())
+	}
+	p := provenance{}
+	if err := json.Unmarshal([]byte(block), &p); err != nil {
+		t.Fatalf("Could not parse the provenance block %s.", block)
+	}
+
+	if p.Mode != "stats" || p.Seed != 3 || p.InputHash != "abc" {
+		t.Errorf("Expected mode stats, seed 3, and hash abc, got %s.", block)
+	}
+	if seed, ok := p.Configs["config"]["Seed"].(float64); !ok || seed != 3 {
+		t.Errorf("Expected the config Seed to be 3, got %v.",
+			p.Configs["config"]["Seed"])
+	}
+	values, ok := p.Configs["stats.config"]["Values"].([]interface{})
+	if !ok || len(values) != 2 || values[1] != "r_sp" {
+		t.Errorf("Expected stats.config Values [id r_sp], got %v.",
+			p.Configs["stats.config"]["Values"])
+	}
+	if len(p.Configs) != 2 {
+		t.Errorf("Expected two config files, got %d.", len(p.Configs))
+	}
+}
+
+func TestPipelineProvenance(t *testing.T) {
+	config := &PipelineConfig{}
+	err := config.ReadConfig("", []string{"--Stages", "id,tree,coord"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	block, err := Provenance(
+		"pipeline", config, readSeedConfig(t, 3), "", time.Now(),
+	)
+	if err != nil {
+		t.Fatalf("Provenance returned error: %s", err.Error())
+	}
+	p := provenance{}
+	if err := json.Unmarshal([]byte(block), &p); err != nil {
+		t.Fatalf("Could not parse the provenance block %s.", block)
+	}
+
+	// Only the stages which are run are recorded.
+	for _, name := range []string{
+		"config", "pipeline.config", "id.config", "tree.config",
+		"coord.config",
+	} {
+		if _, ok := p.Configs[name]; !ok {
+			t.Errorf("%s isn't in the provenance block %s.", name, block)
+		}
+	}
+	if len(p.Configs) != 5 {
+		t.Errorf("Expected five config files, got %d.", len(p.Configs))
+	}
+}
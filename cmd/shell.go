@@ -5,7 +5,6 @@ import (
 	"log"
 	"math"
 	"runtime"
-	"sort"
 	"time"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
@@ -31,7 +30,13 @@ type ShellConfig struct {
 
 	eta                                             float64
 	order, smoothingWindow, levels, subsampleFactor int64
+	shellType                                       string
+	lMax                                            int64
 	losSlopeCutoff, backgroundRhoMult               float64
+
+	checkpointFile string
+
+	configRecord
 }
 
 var _ Mode = &ShellConfig{}
@@ -76,10 +81,27 @@ RKernelMult = 0.2
 # complicated to be described here and can be found in the Shellfish paper.
 Eta = 10.0
 
+# ShellType is the function used to represent the splashback shell. The
+# supported types are:
+# penna    - A Penna-Dines function of order Order, which has 2*Order^2
+#            coefficients. (default)
+# harmonic - A real spherical harmonic expansion up to degree LMax, which has
+#            (LMax + 1)^2 coefficients. Unlike Penna-Dines functions, these fits
+#            stay well-conditioned at high degrees.
+# The coefficient columns of the output catalog are named P_ijk for penna
+# shells and Y_lm for harmonic shells. In harmonic catalogs, the coefficients
+# are ordered by l and then by m, from -l to l. The stats and prof modes must be
+# given the same ShellType as this file.
+ShellType = penna
+
 # Order indicates the order of the Penna function used to represent the
-# splashback shell.
+# splashback shell. Only used if ShellType = penna.
 Order = 3
 
+# LMax is the maximum degree of the spherical harmonic expansion used to
+# represent the splashback shell. Only used if ShellType = harmonic.
+LMax = 4
+
 # Levels is the number of recursive angular splittings that should be done when
 # filtering points.
 Levels = 3
@@ -96,11 +118,20 @@ LOSSlopeCutoff = 0.0
 
 # BackgroundRhoMult is the density assigned to points which do not intersect
 # with any kernels as a multiple of the kernel density.
-BackgroundRhoMult = 0.5`
+BackgroundRhoMult = 0.5
+
+# CheckpointFile is a file that the shells of finished halos are appended to
+# after each snapshot is analyzed. If a run is killed and then restarted with
+# the same input and config file, halos in the checkpoint file will not be
+# analyzed again. The checkpoint file can be deleted after the run finishes.
+#
+# If CheckpointFile is not set, no checkpointing is done.
+# CheckpointFile = shell.checkpoint`
 }
 
 func (config *ShellConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("shell.config")
+	defer config.record(vars)
 
 	vars.Int(&config.subsampleFactor, "SubsampleFactor", 1)
 	vars.Int(&config.radialBins, "RadialBins", 256)
@@ -110,13 +141,16 @@ func (config *ShellConfig) ReadConfig(fname string, flags []string) error {
 	vars.Float(&config.rMinMult, "RMinMult", 0.3)
 	vars.Float(&config.rKernelMult, "RKernelMult", 0.2)
 	vars.Float(&config.eta, "Eta", 10)
+	vars.String(&config.shellType, "ShellType", "penna")
 	vars.Int(&config.order, "Order", 3)
+	vars.Int(&config.lMax, "LMax", 4)
 	vars.Int(&config.levels, "Levels", 3)
 	vars.Int(&config.smoothingWindow, "SmoothingWindow", 121)
 	vars.Float(&config.losSlopeCutoff, "LOSSlopeCutoff", 0.0)
 	vars.Float(&config.backgroundRhoMult, "BackgroundRhoMult", 0.5)
 	vars.Bool(&config.percentileProfile, "PercentileProfile", false)
 	vars.Float(&config.percentile, "Percentile", 50.0)
+	vars.String(&config.checkpointFile, "CheckpointFile", "")
 
 	if fname == "" {
 		if len(flags) == 0 {
@@ -183,15 +217,16 @@ func (config *ShellConfig) validate() error {
 			"RMaxMult", config.rMaxMult)
 	}
 
-	return nil
+	return validateShellType(config.shellType, config.lMax)
 }
 
 // I know, I know. This makes the benchmarking code _much_ cleaner, though.
 var tStart time.Time
 
 func (config *ShellConfig) Run(
-	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
-) ([]string, error) {
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
 	if logging.Mode != logging.Nil {
 		log.Println(`
 #####################
@@ -205,68 +240,117 @@ func (config *ShellConfig) Run(
 		tStart = time.Now()
 	}
 
+	cp, err := openCheckpoint(config.checkpointFile, config, gConfig)
+	if err != nil {
+		return err
+	}
+
+	err = eachBatch(in, func(stdin []byte) error {
+		return config.runBatch(gConfig, e, stdin, cp, out)
+	})
+	if err != nil {
+		return err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory: %s", logging.MemString())
+	}
+
+	return nil
+}
+
+// runBatch finds the shells of the halos in a single batch of input and
+// writes them to out as each snapshot is finished.
+func (config *ShellConfig) runBatch(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+	cp *checkpoint, out *catalog.RowWriter,
+) error {
 	// Parse.
 	intCols, coords, err := catalog.Parse(
 		stdin, []int{0, 1}, []int{2, 3, 4, 5},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	ids, snaps := intCols[0], intCols[1]
 
 	if len(ids) == 0 {
-		return nil, fmt.Errorf("No input IDs.")
+		return fmt.Errorf("No input IDs.")
 	}
 
-	// Compute coefficients.
-	out := make([][]float64, len(ids))
-	rowLength := config.order * config.order * 2
+	cp.SetInput(stdin)
+	return config.runHalos(gConfig, e, ids, snaps, coords, cp, out)
+}
 
-	for i := range out {
-		if config.percentileProfile {
-			out[i] = make([]float64, config.radialBins)
-		} else {
-			out[i] = make([]float64, rowLength)
-		}
-	}
-	
-	buf, err := getVectorBuffer(
-		e.ParticleCatalog(snaps[0], 0), gConfig,
-	)
-	
-	if err != nil {
-		return nil, err
+// runHalos finds the shells of the given halos and writes them to out as
+// each snapshot is finished. coords contains the X, Y, Z, and R200m columns.
+func (config *ShellConfig) runHalos(
+	gConfig *GlobalConfig, e *env.Environment, ids, snaps []int,
+	coords [][]float64, cp *checkpoint, out *catalog.RowWriter,
+) error {
+	// Compute coefficients. Each row contains the coefficients of every
+	// species, one after another.
+	sps := gConfig.speciesList()
+	shells := make([][]float64, len(ids))
+	rowLength := config.rowLength()
+
+	for i := range shells {
+		shells[i] = make([]float64, rowLength*len(sps))
 	}
 
-	err = loop(ids, snaps, coords, config, buf, e, out, gConfig.Threads)
-	if err != nil {
-		return nil, err
+	for i := range shells {
+		if cp.Done(i) {
+			shells[i], _ = cp.Record(i)
+		}
 	}
 
 	intNames := []string{"ID", "Snapshot"}
 	floatNames := []string{"X [cMpc/h]", "Y [cMpc/h]", "Z [cMpc/h]",
-		"R200m [cMpc/h]", "P_ijk"}
+		"R200m [cMpc/h]"}
+	order := []int{0, 1, 2, 3, 4, 5}
+	sizes := []int{1, 1, 1, 1, 1, 1}
+	for k := range sps {
+		floatNames = append(floatNames,
+			sps[k].columnName(shellColumnName(config.shellType)))
+		order = append(order, len(order))
+		sizes = append(sizes, rowLength)
+	}
 
-	colOrder := make([]int, 2+4+len(out[0]))
+	colOrder := make([]int, 2+4+len(shells[0]))
 	for i := range colOrder {
 		colOrder[i] = i
 	}
 
-	lines := catalog.FormatCols(
-		[][]int{ids, snaps}, append(coords, transpose(out)...), colOrder,
-	)
+	out.WriteHeader(catalog.CommentString(intNames, floatNames, order, sizes))
 
-	cString := catalog.CommentString(
-		intNames, floatNames, []int{0, 1, 2, 3, 4, 5, 6},
-		[]int{1, 1, 1, 1, 1, 1, len(out[0])},
-	)
+	em := newRowEmitter(out, len(ids), func(start, end int) []string {
+		floatCols := [][]float64{}
+		for i := range coords {
+			floatCols = append(floatCols, coords[i][start:end])
+		}
+		floatCols = append(floatCols, transpose(shells[start:end])...)
+		return catalog.FormatCols(
+			[][]int{ids[start:end], snaps[start:end]}, floatCols, colOrder,
+		)
+	})
 
-	if logging.Mode == logging.Performance {
-		log.Printf("Time: %s", time.Since(t).String())
-		log.Printf("Memory: %s", logging.MemString())
+	buf, err := getVectorBuffer(
+		e.ParticleCatalog(snaps[0], 0), gConfig,
+	)
+	
+	if err != nil {
+		return err
+	}
+	pf, err := newPrefetcher(buf, e.ParticleCatalog(snaps[0], 0), gConfig)
+	if err != nil {
+		return err
 	}
 
-	return append([]string{cString}, lines...), nil
+	return loop(
+		ids, snaps, coords, config, sps, pf, e, shells,
+		gConfig.Threads, gConfig.ChunkSize, cp, em,
+	)
 }
 
 func transpose(in [][]float64) [][]float64 {
@@ -286,86 +370,162 @@ func transpose(in [][]float64) [][]float64 {
 }
 
 func loop(
-	ids, snaps []int, coords [][]float64, c *ShellConfig,
-	buf io.VectorBuffer, e *env.Environment, out [][]float64,
-	threads int64,
+	ids, snaps []int, coords [][]float64, c *ShellConfig, sps []species,
+	pf *io.Prefetcher, e *env.Environment, out [][]float64,
+	threads, chunkSize int64, cp *checkpoint, em *rowEmitter,
 ) error {
-	snapBins, idxBins := binBySnap(snaps, ids)
-	ringBuf := make([]analyze.RingBuffer, c.rings)
-	for i := range ringBuf {
-		ringBuf[i].Init(int(c.spokes), int(c.radialBins))
-	}
+	_, idxBins := binBySnap(snaps, ids)
 
-	sortedSnaps := []int{}
-	for snap := range snapBins {
-		sortedSnaps = append(sortedSnaps, snap)
+	// Snapshots are analyzed in the order they first appear so that rows can
+	// be written as soon as possible.
+	sortedSnaps := snapOrder(snaps)
+	hdSnap := sortedSnaps[0]
+	for _, snap := range sortedSnaps {
+		if snap != -1 {
+			hdSnap = snap
+			break
+		}
 	}
-	sort.Ints(sortedSnaps)
 
-	hds, _, err := memo.ReadHeaders(sortedSnaps[0], buf, e)
+	state, err := newShellState(c, sps, pf, e, hdSnap, threads, chunkSize)
 	if err != nil {
 		return err
 	}
-	minMass := buf.MinMass()
-
-	workers := runtime.NumCPU()
-	if threads > 0 {
-		workers = int(threads)
-	}
-	sphBuf := &sphBuffers{
-		intr:       make([]bool, hds[0].N),
-		xs:         [][3]float32{},
-		ms:         []float32{},
-		sphWorkers: make([]los.Halo, workers-1),
-	}
 
 	for _, snap := range sortedSnaps {
-		if snap == -1 {
+		idxs := idxBins[snap]
+		if snap == -1 || cp.AllDone(idxs) {
+			if err = em.Finish(idxs); err != nil {
+				return err
+			}
 			continue
 		}
-		idxs := idxBins[snap]
-		snapCoords := [][]float64{
-			make([]float64, len(idxs)), make([]float64, len(idxs)),
-			make([]float64, len(idxs)), make([]float64, len(idxs)),
+
+		if err = state.analyzeSnap(snap, ids, idxs, coords, out); err != nil {
+			return err
 		}
+
+		snapOut := make([][]float64, len(idxs))
 		for i, idx := range idxs {
-			snapCoords[0][i] = coords[0][idx]
-			snapCoords[1][i] = coords[1][idx]
-			snapCoords[2][i] = coords[2][idx]
-			snapCoords[3][i] = coords[3][idx]
+			snapOut[i] = out[idx]
 		}
-
-		// Create Halos
-		runtime.GC()
-		halos, err := createHalos(snapCoords, &hds[0], c, e, minMass)
-		if err != nil {
+		if err = cp.Append(idxs, snapOut, nil); err != nil {
 			return err
 		}
+		if err = em.Finish(idxs); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+}
+
+// shellState holds the buffers which are reused when finding the shells of
+// halos in different snapshots.
+type shellState struct {
+	c       *ShellConfig
+	sps     []species
+	pf      *io.Prefetcher
+	e       *env.Environment
+	hd      io.Header
+	minMass float32
+	sphBuf  *sphBuffers
+	ringBuf []analyze.RingBuffer
+	threads int64
+}
+
+// newShellState creates a shellState. The header of snapshot hdSnap is used
+// to set up the halos of every snapshot.
+func newShellState(
+	c *ShellConfig, sps []species, pf *io.Prefetcher, e *env.Environment,
+	hdSnap int, threads, chunkSize int64,
+) (*shellState, error) {
+	ringBuf := make([]analyze.RingBuffer, c.rings)
+	for i := range ringBuf {
+		ringBuf[i].Init(int(c.spokes), int(c.radialBins))
+	}
 
-		// I'm so sorry about having ten arguments to this function.
-		if err = sphereLoop(snap, ids, idxs, halos, c,
-			buf, e, sphBuf, threads, out); err != nil {
+	hds, _, err := memo.ReadHeaders(hdSnap, pf.Buffer(), e)
+	if err != nil {
+		return nil, err
+	}
+	minMass := pf.Buffer().MinMass()
 
+	sphBuf := &sphBuffers{
+		intr:      make([]bool, hds[0].N),
+		xs:        [][3]float32{},
+		ms:        []float32{},
+		chunkSize: int(chunkSize),
+	}
+
+	return &shellState{
+		c: c, sps: sps, pf: pf, e: e, hd: hds[0], minMass: minMass,
+		sphBuf: sphBuf, ringBuf: ringBuf, threads: threads,
+	}, nil
+}
+
+// analyzeSnap finds the shells of the halos at the indices idxs, all of which
+// are in snapshot snap, and stores them in out.
+func (s *shellState) analyzeSnap(
+	snap int, ids, idxs []int, coords, out [][]float64,
+) error {
+	snapCoords := [][]float64{
+		make([]float64, len(idxs)), make([]float64, len(idxs)),
+		make([]float64, len(idxs)), make([]float64, len(idxs)),
+	}
+	for i, idx := range idxs {
+		snapCoords[0][i] = coords[0][idx]
+		snapCoords[1][i] = coords[1][idx]
+		snapCoords[2][i] = coords[2][idx]
+		snapCoords[3][i] = coords[3][idx]
+	}
+
+	// Create Halos. Each species gets its own set.
+	runtime.GC()
+	halos := make([][]*los.Halo, len(s.sps))
+	for k := range halos {
+		var err error
+		halos[k], err = createHalos(snapCoords, &s.hd, s.c, s.e, s.minMass)
+		if err != nil {
 			return err
 		}
+	}
 
-		if logging.Mode == logging.Performance {
-			log.Printf("Snap %d, sphereLoop ended", snap)
-			log.Printf("Time: %s", time.Since(tStart).String())
-			log.Printf("Memory: %s", logging.MemString())
-		}
-		
-		// Analysis
-		if err = haloAnalysis(halos, idxs, c, ringBuf, out); err != nil {
+	// I'm so sorry about having eleven arguments to this function.
+	if err := sphereLoop(snap, ids, idxs, halos, s.c, s.sps,
+		s.pf, s.e, s.sphBuf, s.threads, out); err != nil {
+
+		return err
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Snap %d, sphereLoop ended", snap)
+		log.Printf("Time: %s", time.Since(tStart).String())
+		log.Printf("Memory: %s", logging.MemString())
+	}
+
+	// Analysis. The coefficients of each species are appended to the rows
+	// in order.
+	spOut := make([][]float64, len(out))
+	rows := make([][]float64, len(idxs))
+	for k := range halos {
+		err := haloAnalysis(halos[k], idxs, s.c, s.ringBuf, spOut)
+		if err != nil {
 			return err
 		}
-
-		if logging.Mode == logging.Performance {
-			log.Printf("Snap %d, haloAnalysis ended", snap)
-			log.Printf("Time: %s", time.Since(tStart).String())
-			log.Printf("Memory: %s", logging.MemString())
+		for i, idx := range idxs {
+			rows[i] = appendSpeciesRow(rows[i], spOut[idx], s.c.rowLength())
 		}
+	}
+	for i, idx := range idxs {
+		out[idx] = rows[i]
+	}
 
+	if logging.Mode == logging.Performance {
+		log.Printf("Snap %d, haloAnalysis ended", snap)
+		log.Printf("Time: %s", time.Since(tStart).String())
+		log.Printf("Memory: %s", logging.MemString())
 	}
 
 	return nil
@@ -374,50 +534,70 @@ func loop(
 // TODO: Refactor this monstrosity of a call signature.
 
 func sphereLoop(
-	snap int, IDs, ids []int, halos []*los.Halo, c *ShellConfig,
-	buf io.VectorBuffer, e *env.Environment, sphBuf *sphBuffers,
-	threads int64, out [][]float64,
+	snap int, IDs, ids []int, halos [][]*los.Halo, c *ShellConfig,
+	sps []species, pf *io.Prefetcher, e *env.Environment,
+	sphBuf *sphBuffers, threads int64, out [][]float64,
 ) error {
-	hds, files, err := memo.ReadHeaders(snap, buf, e)
+	hds, files, err := memo.ReadHeaders(snap, pf.Buffer(), e)
 	if err != nil {
 		return err
 	}
-	intrBins := binIntersections(hds, halos)
-	
-	for i := range hds {
-		runtime.GC()
-		if len(intrBins[i]) == 0 {
-			continue
-		}
-
-		if logging.Mode == logging.Performance {
-			log.Printf("Snap %d, HD %d", snap, i)
-			log.Printf("Time: %s", time.Since(tStart).String())
-			log.Printf("Memory: %s", logging.MemString())
-		}
-		
-		sphBuf.xs, _, sphBuf.ms, _, err = buf.Read(files[i])
-		
-		if err != nil {
-			return err
-		}
-
-		binHs := intrBins[i]
-		for j := range binHs {
-			loadSphereVecs(binHs[j], sphBuf, &hds[i], c, threads)
-		}
+	// halos[k] is the set of halos for species k. Every species has halos
+	// in the same places, so they all intersect the same files.
+	intrBins := make([][][]*los.Halo, len(halos))
+	for k := range halos {
+		intrBins[k] = binIntersections(hds, halos[k])
+	}
+	blocks, names := usedBlocks(files, func(i int) bool {
+		return len(intrBins[0][i]) > 0
+	})
+
+	fields := io.Positions | io.Masses
+	if needsTypes(sps) {
+		fields |= io.Types
+	}
+
+	// Each halo's rings are built up from the chunks in file order, so
+	// neither the chunk size nor prefetching changes the shells.
+	return pf.ReadChunks(names, fields, sphBuf.chunkSize,
+		func(k int, chunk *io.Chunk) error {
+			i := blocks[k]
+			if chunk.Start == 0 {
+				runtime.GC()
+				if logging.Mode == logging.Performance {
+					log.Printf("Snap %d, HD %d", snap, i)
+					log.Printf("Time: %s", time.Since(tStart).String())
+					log.Printf("Memory: %s", logging.MemString())
+				}
+			}
 
-		buf.Close()
-	}
+			sphBuf.xs, sphBuf.start = chunk.Xs, chunk.Start
+			for k := range sps {
+				sphBuf.ms = sps[k].weighMasses(
+					chunk.Ms, chunk.Types, sphBuf.spMs,
+				)
+				if sps[k].weights != nil {
+					sphBuf.spMs = sphBuf.ms
+				}
 
-	return nil
+				binHs := intrBins[k][i]
+				for j := range binHs {
+					loadSphereVecs(binHs[j], sphBuf, &hds[i], c, threads)
+				}
+			}
+			return nil
+		})
 }
 
 type sphBuffers struct {
-	sphWorkers []los.Halo
-	xs         [][3]float32
-	ms         []float32
-	intr       []bool
+	xs   [][3]float32
+	ms   []float32
+	intr []bool
+	// spMs is a buffer for the masses of a single species.
+	spMs []float32
+	// chunkSize is the maximum number of particles loaded at once. 0 means
+	// that whole files are loaded. start is the index of xs[0] in its file.
+	chunkSize, start int
 }
 
 func loadSphereVecs(
@@ -429,12 +609,9 @@ func loadSphereVecs(
 		workers = int(threads)
 	}
 	runtime.GOMAXPROCS(workers)
-	sphWorkers, xs := sphBuf.sphWorkers, sphBuf.xs
+	xs := sphBuf.xs
 	sphBuf.intr = expandBools(sphBuf.intr[:0], len(xs))
 	ms, intr := sphBuf.ms, sphBuf.intr
-	if len(sphWorkers)+1 != workers {
-		panic("impossible")
-	}
 
 	sync := make(chan bool, workers)
 
@@ -449,19 +626,19 @@ func loadSphereVecs(
 		}
 	}
 	
-	h.Split(sphWorkers)
-
-	for i := range sphWorkers {
-		wh := &sphBuf.sphWorkers[i]
-		go chanLoadSphereVec(wh, xs, ms, intr, i, workers, hd, c, sync)
+	// Each worker inserts every particle into a different set of rings, so
+	// each profile is built up in the same order regardless of the number of
+	// workers.
+	for i := 0; i < workers-1; i++ {
+		go chanLoadSphereVec(h, xs, ms, intr, sphBuf.start,
+			i, workers, hd, c, sync)
 	}
-	chanLoadSphereVec(h, xs, ms, intr, workers-1, workers, hd, c, sync)
+	chanLoadSphereVec(h, xs, ms, intr, sphBuf.start,
+		workers-1, workers, hd, c, sync)
 
 	for i := 0; i < workers; i++ {
 		<-sync
 	}
-
-	h.Join(sphWorkers)
 }
 
 func expandBools(scalars []bool, n int) []bool {
@@ -478,7 +655,7 @@ func expandBools(scalars []bool, n int) []bool {
 
 func chanLoadSphereVec(
 	h *los.Halo, xs [][3]float32, ms []float32,
-	intr []bool, offset, workers int,
+	intr []bool, start, offset, workers int,
 	hd *io.Header, c *ShellConfig, sync chan bool,
 ) {
 	rad := h.RMax() * c.rKernelMult / c.rMaxMult
@@ -488,11 +665,13 @@ func chanLoadSphereVec(
 		hd.Cosmo.OmegaM, hd.Cosmo.OmegaL, hd.Cosmo.Z)
 	
 	sf := c.subsampleFactor
-	skip := workers * int(sf*sf*sf)
-	for i := offset * int(sf*sf*sf); i < len(xs); i += skip {
-		if intr[i] {
-			h.Insert(xs[i], rad, (float64(ms[i])*float64(sf*sf*sf)/
-				sphVol)/rhoM)
+	skip := int(sf*sf*sf)
+	// Subsampling is relative to the start of the file, not of the chunk.
+	for i := (skip - start%skip) % skip; i < len(xs); i += skip {
+		// Particles from other species have no mass.
+		if intr[i] && ms[i] > 0 {
+			h.InsertRings(xs[i], rad, (float64(ms[i])*float64(sf*sf*sf)/
+				sphVol)/rhoM, offset, workers)
 		}
 	}
 
@@ -517,10 +696,12 @@ func haloAnalysis(
 		} else {
 			var ok bool
 			out[idxs[i]], ok = calcCoeffs(halos[i], ringBuf, c)
-			if !ok {
-				fmt.Errorf("Shell coefficients undetermined. The most likely " +
-				"explanation is that there is corruption in your particle " +
-				"snapshots.")
+			if !ok && logging.Mode != logging.Nil {
+				log.Printf("Shell coefficients of the halo in row %d of the "+
+					"input are undetermined, so they were set to NaN. The "+
+					"most likely explanation is that there are too few "+
+					"particles around the halo or that there is corruption "+
+					"in your particle snapshots.", idxs[i])
 			}
 		}
 	}
@@ -610,6 +791,10 @@ func binIntersections(
 	return bins
 }
 
+// calcCoeffs fits a shell to a halo's splashback points and returns its
+// coefficients. If there are too few points for a fit, a row of NaNs of the
+// same length is returned along with false, so the halo still gets a row in
+// the output catalog.
 func calcCoeffs(
 	halo *los.Halo, buf []analyze.RingBuffer, c *ShellConfig,
 ) ([]float64, bool) {
@@ -620,12 +805,96 @@ func calcCoeffs(
 	pxs, pys, ok := analyze.FilterPoints(buf, int(c.levels), halo.RMax()/c.eta)
 
 	if !ok {
-		return nil, false
+		return nanRow(c.rowLength()), false
 	}
+
+	if c.shellType == "harmonic" {
+		n := 0
+		for i := range pxs {
+			n += len(pxs[i])
+		}
+		if n < analyze.HarmonicCoeffNum(int(c.lMax)) {
+			return nanRow(c.rowLength()), false
+		}
+		cs, _ := analyze.HarmonicVolumeFit(pxs, pys, halo, int(c.lMax))
+		return cs, true
+	}
+
 	cs, _ := analyze.PennaVolumeFit(pxs, pys, halo, int(c.order), int(c.order))
 	return cs, true
 }
 
+// appendSpeciesRow appends the row of one species to the row of a halo. Missing
+// rows are replaced with width NaNs so later species stay in their own columns.
+func appendSpeciesRow(row, spRow []float64, width int) []float64 {
+	if len(spRow) == 0 {
+		spRow = nanRow(width)
+	}
+	return append(row, spRow...)
+}
+
+// rowLength returns the number of columns written for each species.
+func (c *ShellConfig) rowLength() int {
+	if c.percentileProfile {
+		return int(2 * c.radialBins)
+	}
+	return shellCoeffNum(c.shellType, c.order, c.lMax)
+}
+
+// nanRow returns a row of n NaNs for a halo which couldn't be analyzed.
+func nanRow(n int) []float64 {
+	row := make([]float64, n)
+	for i := range row {
+		row[i] = math.NaN()
+	}
+	return row
+}
+
+// validateShellType checks that the 'ShellType' and 'LMax' variables, which
+// are shared by several modes, are set correctly.
+func validateShellType(shellType string, lMax int64) error {
+	switch shellType {
+	case "penna", "harmonic":
+	default:
+		return fmt.Errorf("The variable 'ShellType' was set to '%s', which "+
+			"I don't recognize.", shellType)
+	}
+	if lMax < 0 {
+		return fmt.Errorf("The variable '%s' was set to %d.", "LMax", lMax)
+	}
+	return nil
+}
+
+// shellCoeffNum returns the number of coefficients in a shell of the given
+// type.
+func shellCoeffNum(shellType string, order, lMax int64) int {
+	if shellType == "harmonic" {
+		return analyze.HarmonicCoeffNum(int(lMax))
+	}
+	return int(2 * order * order)
+}
+
+// shellColumnName returns the name of the coefficient column written by the
+// shell mode for the given type of shell.
+func shellColumnName(shellType string) string {
+	if shellType == "harmonic" {
+		return "Y_lm"
+	}
+	return "P_ijk"
+}
+
+// shellFunc returns the shell described by a set of coefficients, which can
+// come from either type of shell. Penna-Dines shells have 2*Order^2
+// coefficients and harmonic shells have (LMax + 1)^2. Twice a square number is
+// never a square number, so the type can always be told from the length.
+func shellFunc(coeffs []float64) analyze.Shell {
+	if lMax, ok := analyze.HarmonicLMax(len(coeffs)); ok {
+		return analyze.HarmonicFunc(coeffs, lMax)
+	}
+	order := findOrder(coeffs)
+	return analyze.PennaFunc(coeffs, order, order, 2)
+}
+
 func calcPercentile(
 	halo *los.Halo, c *ShellConfig,
 ) []float64 {
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxParticleType is the largest particle type which can be used in
+// 'SpeciesTypes'. Gadget snapshots have six particle types.
+const maxParticleType = 5
+
+// species is a weighted combination of particle types whose masses are used
+// together to find a splashback shell.
+type species struct {
+	name string
+	// weights[t] is the weight given to the masses of particles of type t.
+	// If weights is nil, every particle is used with its own mass.
+	weights []float64
+}
+
+// parseSpecies parses the 'Species' and 'SpeciesTypes' variables. Each
+// element of types is a list of particle types joined by "+", each of which
+// may be preceded by a weight and "*", e.g. "1" or "0 + 4" or "1 + 0.5*0".
+func parseSpecies(names, types []string) ([]species, error) {
+	if len(names) != len(types) {
+		return nil, fmt.Errorf("len(Species) = %d, but len(SpeciesTypes) "+
+			"= %d.", len(names), len(types))
+	}
+
+	out := make([]species, len(names))
+	for i := range names {
+		if names[i] == "" || strings.ContainsAny(names[i], " \t[]()") {
+			return nil, fmt.Errorf("The species name '%s' can't be used. "+
+				"Names can't be empty or contain spaces or brackets.",
+				names[i])
+		}
+		for j := 0; j < i; j++ {
+			if names[j] == names[i] {
+				return nil, fmt.Errorf("The species '%s' appears twice in "+
+					"'Species'.", names[i])
+			}
+		}
+
+		out[i].name = names[i]
+		out[i].weights = make([]float64, maxParticleType+1)
+		for _, term := range strings.Split(types[i], "+") {
+			t, w, err := parseSpeciesTerm(strings.TrimSpace(term))
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse '%s', element %d of "+
+					"'SpeciesTypes': %s", types[i], i, err.Error())
+			}
+			out[i].weights[t] += w
+		}
+	}
+
+	return out, nil
+}
+
+// parseSpeciesTerm parses a single particle type with an optional weight.
+func parseSpeciesTerm(term string) (t int, w float64, err error) {
+	w = 1
+	if star := strings.Index(term, "*"); star != -1 {
+		w, err = strconv.ParseFloat(strings.TrimSpace(term[:star]), 64)
+		if err != nil || w <= 0 {
+			return 0, 0, fmt.Errorf("'%s' doesn't have a positive weight.",
+				term)
+		}
+		term = strings.TrimSpace(term[star+1:])
+	}
+
+	t, err = strconv.Atoi(term)
+	if err != nil || t < 0 || t > maxParticleType {
+		return 0, 0, fmt.Errorf("'%s' isn't a particle type between 0 and "+
+			"%d.", term, maxParticleType)
+	}
+	return t, w, nil
+}
+
+// speciesList returns the species analyzed by the shell, stats, and prof
+// modes. If 'Species' isn't set, there's a single unnamed species which
+// contains every particle.
+func (config *GlobalConfig) speciesList() []species {
+	if len(config.species) == 0 {
+		return []species{{}}
+	}
+	return config.species
+}
+
+// speciesTypeIndices returns every particle type used by at least one
+// species, in increasing order.
+func speciesTypeIndices(sps []species) []int64 {
+	used := map[int64]bool{}
+	for _, sp := range sps {
+		for t, w := range sp.weights {
+			if w > 0 {
+				used[int64(t)] = true
+			}
+		}
+	}
+
+	out := []int64{}
+	for t := range used {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// needsTypes returns true if the particle types need to be read in order to
+// separate the given species.
+func needsTypes(sps []species) bool {
+	for _, sp := range sps {
+		if sp.weights != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// weighMasses returns the masses of the particles in the species. Particles
+// which aren't in the species have zero mass. out is used as a buffer. If the
+// species contains every particle, ms is returned unchanged.
+func (sp *species) weighMasses(
+	ms []float32, types []uint8, out []float32,
+) []float32 {
+	if sp.weights == nil {
+		return ms
+	}
+
+	if cap(out) < len(ms) {
+		out = make([]float32, len(ms))
+	}
+	out = out[:len(ms)]
+	for i := range ms {
+		out[i] = ms[i] * float32(sp.weights[types[i]])
+	}
+	return out
+}
+
+// columnName adds the name of the species to a column name, so "R_sp
+// [cMpc/h]" becomes "R_sp_dm [cMpc/h]". Names are unchanged for the unnamed
+// species.
+func (sp *species) columnName(name string) string {
+	if sp.name == "" {
+		return name
+	}
+	if start := strings.Index(name, " ["); start != -1 {
+		return name[:start] + "_" + sp.name + name[start:]
+	}
+	return name + "_" + sp.name
+}
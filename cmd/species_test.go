@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseSpecies(t *testing.T) {
+	sps, err := parseSpecies(
+		[]string{"dm", "baryons", "mixed"},
+		[]string{"1", "0 + 4", "1 + 0.5*0"},
+	)
+	if err != nil {
+		t.Fatalf("parseSpecies returned error: %s", err.Error())
+	}
+
+	weights := [][]float64{
+		{0, 1, 0, 0, 0, 0},
+		{1, 0, 0, 0, 1, 0},
+		{0.5, 1, 0, 0, 0, 0},
+	}
+	for i := range sps {
+		for t0 := range weights[i] {
+			if sps[i].weights[t0] != weights[i][t0] {
+				t.Errorf("%d) Expected weights %v, got %v.",
+					i, weights[i], sps[i].weights)
+				break
+			}
+		}
+	}
+
+	idxs := speciesTypeIndices(sps)
+	if len(idxs) != 3 || idxs[0] != 0 || idxs[1] != 1 || idxs[2] != 4 {
+		t.Errorf("Expected type indices [0 1 4], got %v.", idxs)
+	}
+
+	bad := []struct{ names, types []string }{
+		{[]string{"dm"}, []string{}},
+		{[]string{"dm", "dm"}, []string{"1", "1"}},
+		{[]string{"dark matter"}, []string{"1"}},
+		{[]string{"dm"}, []string{"6"}},
+		{[]string{"dm"}, []string{"-1*1"}},
+		{[]string{"dm"}, []string{"1 +"}},
+	}
+	for i := range bad {
+		if _, err := parseSpecies(bad[i].names, bad[i].types); err == nil {
+			t.Errorf("%d) Expected error for Species = %q, "+
+				"SpeciesTypes = %q.", i, bad[i].names, bad[i].types)
+		}
+	}
+}
+
+func TestWeighMasses(t *testing.T) {
+	ms := []float32{1, 2, 3, 4}
+	types := []uint8{0, 1, 4, 1}
+
+	all := &species{}
+	if out := all.weighMasses(ms, nil, nil); &out[0] != &ms[0] {
+		t.Errorf("Expected the masses of every particle to be unchanged.")
+	}
+
+	sps, err := parseSpecies([]string{"mixed"}, []string{"1 + 0.5*4"})
+	if err != nil {
+		t.Fatalf("parseSpecies returned error: %s", err.Error())
+	}
+	out := sps[0].weighMasses(ms, types, nil)
+	expected := []float32{0, 2, 1.5, 4}
+	for i := range expected {
+		if out[i] != expected[i] {
+			t.Errorf("Expected masses %v, got %v.", expected, out)
+			break
+		}
+	}
+}
+
+func TestSpeciesColumnName(t *testing.T) {
+	tests := []struct {
+		sp        species
+		name, out string
+	}{
+		{species{}, "R_sp [cMpc/h]", "R_sp [cMpc/h]"},
+		{species{name: "dm"}, "R_sp [cMpc/h]", "R_sp_dm [cMpc/h]"},
+		{species{name: "gas"}, "P_ijk", "P_ijk_gas"},
+	}
+
+	for i := range tests {
+		if out := tests[i].sp.columnName(tests[i].name); out != tests[i].out {
+			t.Errorf("%d) Expected %q, got %q.", i, tests[i].out, out)
+		}
+	}
+}
+
+func TestAppendSpeciesRow(t *testing.T) {
+	var row []float64
+	for _, spRow := range [][]float64{{1, 2}, nil, {3, 4}} {
+		row = appendSpeciesRow(row, spRow, 2)
+	}
+	if fmt.Sprint(row) != "[1 2 NaN NaN 3 4]" {
+		t.Errorf("Expected [1 2 NaN NaN 3 4], got %v.", row)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/phil-mansfield/shellfish/io"
 	"github.com/phil-mansfield/shellfish/los/analyze"
 	"github.com/phil-mansfield/shellfish/los/geom"
+	"github.com/phil-mansfield/shellfish/math/rand"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
@@ -25,16 +26,31 @@ type StatsConfig struct {
 	monteCarloSamples int64
 	exclusionStrategy string
 	order             int64
+	shellType         string
+	lMax              int64
 
 	skipMass          bool
 	
 	shellFilter       bool
 	shellParticleFile string
 	shellWidth        float64
+
+	checkpointFile    string
+
+	configRecord
 }
 
 var _ Mode = &StatsConfig{}
 
+// Keys passed to haloRand so that every Monte Carlo quantity gets its own
+// random numbers and doesn't change when other Values are requested.
+const (
+	volumeRandKey = iota
+	areaRandKey
+	axesRandKey
+	rangeRandKey
+)
+
 func (config *StatsConfig) ExampleConfig() string {
 	return `[stats.config]
 
@@ -42,6 +58,37 @@ func (config *StatsConfig) ExampleConfig() string {
 ## Optional Fields ##
 #####################
 
+# Values is the list of columns which will be written to the output catalog,
+# in the order that they will appear. Shellfish will skip any calculation which
+# isn't needed by one of the requested columns (e.g. no axis fitting is done
+# unless one of a_sp, b_sp, c_sp, or A_sp is requested).
+#
+# The supported values are:
+# id         - The halo's catalog ID.
+# snap       - Index of the halo's snapshot.
+# m_sp       - The mass contained within the splashback shell in Msun/h.
+# r_sp       - The volume-equivalent splashback radius in comoving Mpc/h.
+# V_sp       - The volume of the splashback shell in comoving (Mpc/h)^3.
+# SA_sp      - The surface area of the splashback shell in comoving (Mpc/h)^2.
+# a_sp       - The length of the major axis of the shell in comoving Mpc/h.
+# b_sp       - The length of the intermediate axis of the shell in comoving
+#              Mpc/h.
+# c_sp       - The length of the minor axis of the shell in comoving Mpc/h.
+# A_sp       - The x, y, and z components of the major axis of the shell
+#              (three columns).
+# r_min      - The minimum radius of the shell in comoving Mpc/h.
+# r_max      - The maximum radius of the shell in comoving Mpc/h.
+# SA_sp/V_sp - The ratio of the shell's surface area to its volume in
+#              comoving h/Mpc.
+# power_sp   - The power in each degree, l, of the shell's spherical harmonic
+#              expansion, the sum of Y_lm^2 over m, in comoving (Mpc/h)^2
+#              (LMax + 1 columns, starting at l = 0). The total power is the
+#              integral of r^2 over solid angle, and the power above l = 0
+#              measures asphericity. Only supported if ShellType = harmonic.
+#
+# If Values is not set, every column is output in the order given above.
+# Values = id, snap, m_sp, r_sp, V_sp, SA_sp, a_sp, b_sp, c_sp, A_sp, r_min, r_max
+
 # MonteCarloSamplings The number of Monte Carlo samplings done when calculating
 # properties of shells.
 MonteCarloSamples = 50000
@@ -56,13 +103,30 @@ MonteCarloSamples = 50000
 # overlap - Halos which have a splashback shell that overlaps the splashback
 #           shell of a larger halo are excluded.
 #
+# Halo size is measured by R200m and distances are computed using periodic
+# boundary conditions. Excluded halos are not written to the output catalog
+# or to ShellParticleFile. Every halo in a snapshot needs to be compared, so
+# unless this is none, stats waits until it has read its entire input before
+# writing any rows.
+#
 # The default value is none.
 ExclusionStrategy = none
 
+# ShellType is the type of shell constructed around the halos, either penna or
+# harmonic. It must be the same value used by the shell.config file. By default
+# both are set to penna.
+ShellType = penna
+
 # Order is the order of the Penna shell constructed around the halos. It must be
 # the same value used by the shell.config file. By default both are set to 3.
+# Only used if ShellType = penna.
 Order = 3
 
+# LMax is the maximum degree of the spherical harmonic shell constructed around
+# the halos. It must be the same value used by the shell.config file. By
+# default both are set to 4. Only used if ShellType = harmonic.
+LMax = 4
+
 # SkipMass indicates whether splashback masses should be calculated. This is the
 # most expensive part of calculating the stats catalog by several order of
 # magnitude.
@@ -101,19 +165,31 @@ Order = 3
 # If ShellParticleFile = "" or if ShellWidth = 0, no such file will be
 # created.
 # ShellParticleFile = shell-particles.dat
-# ShellWidth = 0.05`
+# ShellWidth = 0.05
+
+# CheckpointFile is a file that the properties of finished halos are appended
+# to after each snapshot is analyzed. If a run is killed and then restarted with
+# the same input and config file, halos in the checkpoint file will not be
+# analyzed again. The checkpoint file can be deleted after the run finishes.
+#
+# If CheckpointFile is not set, no checkpointing is done.
+# CheckpointFile = stats.checkpoint`
 }
 
 func (config *StatsConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("stats.config")
+	defer config.record(vars)
 
 	vars.Strings(&config.values, "Values", []string{})
 	vars.Int(&config.monteCarloSamples, "MonteCarloSamples", 50*1000)
 	vars.String(&config.exclusionStrategy, "ExclusionStrategy", "none")
+	vars.String(&config.shellType, "ShellType", "penna")
 	vars.Int(&config.order, "Order", 3)
+	vars.Int(&config.lMax, "LMax", 4)
 	vars.String(&config.shellParticleFile, "ShellParticleFile", "")
 	vars.Float(&config.shellWidth, "ShellWidth", 0)
 	vars.Bool(&config.skipMass, "SkipMass", false)
+	vars.String(&config.checkpointFile, "CheckpointFile", "")
 
 	
 	if fname == "" {
@@ -146,10 +222,7 @@ func (config *StatsConfig) ReadConfig(fname string, flags []string) error {
 
 func (config *StatsConfig) validate() error {
 	for i, val := range config.values {
-		switch val {
-		case "snap", "id", "m_sp", "r_sp", "a_sp", "b_sp", "c_sp",
-			"SA_sp/V_sp":
-		default:
+		if _, ok := statsValueNames[val]; !ok {
 			return fmt.Errorf("Item %d of variable 'Values' is set to '%s', "+
 				"which I don't recognize.", i, val)
 		}
@@ -162,9 +235,19 @@ func (config *StatsConfig) validate() error {
 			"I don't recognize.", config.exclusionStrategy)
 	}
 
+	if err := validateShellType(config.shellType, config.lMax); err != nil {
+		return err
+	}
+	for _, val := range config.values {
+		if val == "power_sp" && config.shellType != "harmonic" {
+			return fmt.Errorf("The variable 'Values' contains 'power_sp', " +
+				"but 'ShellType' isn't set to harmonic.")
+		}
+	}
+
 	switch {
 	case config.monteCarloSamples <= 0:
-		return fmt.Errorf("The variable '%s' was set to %g",
+		return fmt.Errorf("The variable '%s' was set to %d",
 			"MonteCarloSamples", config.monteCarloSamples)
 	}
 
@@ -172,8 +255,9 @@ func (config *StatsConfig) validate() error {
 }
 
 func (config *StatsConfig) Run(
-	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
-) ([]string, error) {
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
 
 	if logging.Mode != logging.Nil {
 		log.Println(`
@@ -187,8 +271,65 @@ func (config *StatsConfig) Run(
 		t = time.Now()
 	}
 
+	cp, err := openCheckpoint(config.checkpointFile, config, gConfig)
+	if err != nil {
+		return err
+	}
+
+	sp := &statsShellParticles{}
+	if config.exclusionStrategy != "none" {
+		// Exclusion compares every pair of halos in a snapshot, and a
+		// snapshot's halos can be spread across any number of batches, so
+		// the whole input needs to be read before any halo can be analyzed.
+		stdin, err := in.ReadAll()
+		if err == nil && len(stdin) > 0 {
+			err = config.runBatch(gConfig, e, stdin, cp, sp, out)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		err = eachBatch(in, func(stdin []byte) error {
+			return config.runBatch(gConfig, e, stdin, cp, sp, out)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if config.shellFilter && !config.skipMass {
+		err = writeShellParticles(sp.snaps, sp.ids, sp.particles,
+			gConfig, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return nil
+}
+
+// statsShellParticles collects the particles near the shells of each
+// non-excluded halo across every input batch.
+type statsShellParticles struct {
+	snaps, ids []int
+	particles  [][]int64
+}
+
+// runBatch computes the statistics of the halos in a single batch of input
+// and writes them to out as each snapshot is finished.
+func (config *StatsConfig) runBatch(
+	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
+	cp *checkpoint, sp *statsShellParticles, out *catalog.RowWriter,
+) error {
 	intColIdxs := []int{0, 1}
-	floatColIdxs := make([]int, 4+2*config.order*config.order)
+	floatColIdxs := make([]int, 4+len(gConfig.speciesList())*shellCoeffNum(
+		config.shellType, config.order, config.lMax,
+	))
 	for i := range floatColIdxs {
 		floatColIdxs[i] = i + len(intColIdxs)
 	}
@@ -197,57 +338,312 @@ func (config *StatsConfig) Run(
 	)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(intCols) == 0 {
-		return nil, fmt.Errorf("No input IDs.")
+	if len(intCols) == 0 || len(intCols[0]) == 0 {
+		return fmt.Errorf("No input IDs.")
 	}
 	ids, snaps := intCols[0], intCols[1]
 	coords, coeffs := floatCols[:4], transpose(floatCols[4:])
-	snapBins, coeffBins, idxBins := binCoeffsBySnap(snaps, ids, coeffs)
-
-	masses := make([]float64, len(ids))
-
-	rads := make([]float64, len(ids))
-	rmins := make([]float64, len(ids))
-	rmaxes := make([]float64, len(ids))
-	vols := make([]float64, len(ids))
-	sas := make([]float64, len(ids))
-	as := make([]float64, len(ids))
-	bs := make([]float64, len(ids))
-	cs := make([]float64, len(ids))
-	aVecs := make([][3]float64, len(ids))
-	shellParticles := make([][]int64, len(ids))
 
-	sortedSnaps := []int{}
-	for snap := range snapBins {
-		sortedSnaps = append(sortedSnaps, snap)
+	cp.SetInput(stdin)
+	return config.runHalos(
+		gConfig, e, ids, snaps, coords, coeffs, nil, nil, cp, sp, out,
+	)
+}
+
+// statsResults contains the values computed for every halo using the shells
+// of a single species.
+type statsResults struct {
+	masses, rads, rmins, rmaxes []float64
+	vols, sas, as, bs, cs       []float64
+	aVecs                       [][3]float64
+}
+
+func newStatsResults(n int) *statsResults {
+	return &statsResults{
+		masses: make([]float64, n), rads: make([]float64, n),
+		rmins: make([]float64, n), rmaxes: make([]float64, n),
+		vols: make([]float64, n), sas: make([]float64, n),
+		as: make([]float64, n), bs: make([]float64, n),
+		cs: make([]float64, n), aVecs: make([][3]float64, n),
+	}
+}
+
+// statsCheckpointValues is the number of values each species adds to a row of
+// the checkpoint file.
+const statsCheckpointValues = 12
+
+// row returns the values of halo i which are saved to checkpoint files.
+func (res *statsResults) row(i int) []float64 {
+	return []float64{
+		res.masses[i], res.rads[i], res.vols[i], res.sas[i],
+		res.as[i], res.bs[i], res.cs[i],
+		res.aVecs[i][0], res.aVecs[i][1], res.aVecs[i][2],
+		res.rmins[i], res.rmaxes[i],
+	}
+}
+
+// setRow sets the values of halo i from a row written by row.
+func (res *statsResults) setRow(i int, row []float64) {
+	res.masses[i], res.rads[i], res.vols[i], res.sas[i] =
+		row[0], row[1], row[2], row[3]
+	res.as[i], res.bs[i], res.cs[i] = row[4], row[5], row[6]
+	res.aVecs[i] = [3]float64{row[7], row[8], row[9]}
+	res.rmins[i], res.rmaxes[i] = row[10], row[11]
+}
+
+// speciesCoeffs returns the shell coefficients of species k from a row
+// containing the coefficients of every species.
+func speciesCoeffs(coeffs []float64, k, species int) []float64 {
+	n := len(coeffs) / species
+	return coeffs[k*n : (k+1)*n]
+}
+
+// runHalos computes the statistics of the given halos and writes them to out
+// as each snapshot is finished. coords contains the X, Y, Z, and R200m
+// columns and coeffs contains the shell coefficients of each halo. If there
+// are several species, each halo's coefficients are given one species after
+// another.
+//
+// If buf is nil, a new VectorBuffer is created when particles need to be
+// read. If prepare is non-nil, it's called before each snapshot is analyzed
+// and may fill in the coefficients of that snapshot's halos.
+func (config *StatsConfig) runHalos(
+	gConfig *GlobalConfig, e *env.Environment, ids, snaps []int,
+	coords, coeffs [][]float64, buf io.VectorBuffer,
+	prepare func(snap int, idxs []int) error,
+	cp *checkpoint, sp *statsShellParticles, out *catalog.RowWriter,
+) error {
+	_, idxBins := binBySnap(snaps, ids)
+
+	values := config.values
+	if len(values) == 0 {
+		values = defaultStatsValues
 	}
-	sort.Ints(sortedSnaps)
+	needs := findStatsNeeds(values)
+
+	sps := gConfig.speciesList()
+	res := make([]*statsResults, len(sps))
+	for k := range res {
+		res[k] = newStatsResults(len(ids))
+	}
+	shellParticles := make([][]int64, len(ids))
+
+	// Snapshots are analyzed in the order they first appear so that rows can
+	// be written as soon as possible.
+	sortedSnaps := snapOrder(snaps)
 
 	if logging.Mode == logging.Performance {
 		log.Println("Finished initial allocations")
 		log.Println(logging.MemString())
 	}
-	
-	buf, err := getVectorBuffer(
-		e.ParticleCatalog(snaps[0], 0), gConfig,
-	)
-	if err != nil {
-		return nil, err
+
+	readParticles := config.readsParticles()
+	excluding := config.exclusionStrategy != "none"
+	exclude := make([]bool, len(ids))
+
+	for i := range ids {
+		if cp.Done(i) {
+			row, pIDs := cp.Record(i)
+			for k := range res {
+				res[k].setRow(i, row[k*statsCheckpointValues:])
+			}
+			exclude[i] = row[len(res)*statsCheckpointValues] != 0
+			shellParticles[i] = pIDs
+		}
 	}
 
-	if logging.Mode == logging.Performance {
-		log.Println("Initialized VectorBuffer")
-		log.Println(logging.MemString())
+	// formatRows returns the comment string and the formatted lines of the
+	// halos in [start, end) which haven't been excluded.
+	formatRows := func(start, end int) (string, []string) {
+		rows := []int{}
+		for i := start; i < end; i++ {
+			if !exclude[i] {
+				rows = append(rows, i)
+			}
+		}
+
+		// FormatCols and CommentString index int columns before float
+		// columns, so float column positions are stored as negative
+		// placeholders until the number of int columns is known.
+		intCols, floatCols := [][]int{}, [][]float64{}
+		intNames, floatNames := []string{}, []string{}
+		order := []int{}
+		addInt := func(col []int, name string) {
+			sub := make([]int, len(rows))
+			for j, i := range rows {
+				sub[j] = col[i]
+			}
+			order = append(order, len(intCols))
+			intCols, intNames = append(intCols, sub), append(intNames, name)
+		}
+		addFloat := func(f func(i int) float64, name string) {
+			sub := make([]float64, len(rows))
+			for j, i := range rows {
+				sub[j] = f(i)
+			}
+			order = append(order, -1-len(floatCols))
+			floatCols = append(floatCols, sub)
+			floatNames = append(floatNames, name)
+		}
+
+		for _, val := range values {
+			switch val {
+			case "id":
+				addInt(ids, "ID")
+				continue
+			case "snap":
+				addInt(snaps, "Snapshot")
+				continue
+			}
+
+			// Every other value is written once for each species.
+			for k := range sps {
+				sp, r, k := &sps[k], res[k], k
+				switch val {
+				case "m_sp":
+					addFloat(func(i int) float64 { return r.masses[i] },
+						sp.columnName("M_sp [M_sun/h]"))
+				case "r_sp":
+					addFloat(func(i int) float64 { return r.rads[i] },
+						sp.columnName("R_sp [cMpc/h]"))
+				case "V_sp":
+					addFloat(func(i int) float64 { return r.vols[i] },
+						sp.columnName("Volume [cMpc^3/h^3]"))
+				case "SA_sp":
+					addFloat(func(i int) float64 { return r.sas[i] },
+						sp.columnName("Surface Area [cMpc^2/h^2]"))
+				case "a_sp":
+					addFloat(func(i int) float64 { return r.as[i] },
+						sp.columnName("Major Axis [cMpc/h]"))
+				case "b_sp":
+					addFloat(func(i int) float64 { return r.bs[i] },
+						sp.columnName("Intermediate Axis [cMpc/h]"))
+				case "c_sp":
+					addFloat(func(i int) float64 { return r.cs[i] },
+						sp.columnName("Minor Axis [cMpc/h]"))
+				case "A_sp":
+					for d, name := range []string{"Ax", "Ay", "Az"} {
+						d := d
+						addFloat(func(i int) float64 { return r.aVecs[i][d] },
+							sp.columnName(name))
+					}
+				case "r_min":
+					addFloat(func(i int) float64 { return r.rmins[i] },
+						sp.columnName("RMin [cMpc/h]"))
+				case "r_max":
+					addFloat(func(i int) float64 { return r.rmaxes[i] },
+						sp.columnName("RMax [cMpc/h]"))
+				case "SA_sp/V_sp":
+					addFloat(func(i int) float64 {
+						return r.sas[i] / r.vols[i]
+					}, sp.columnName("SA_sp/V_sp [h/cMpc]"))
+				case "power_sp":
+					// Power is cheap to compute, so it isn't checkpointed.
+					for l := 0; l <= int(config.lMax); l++ {
+						l := l
+						addFloat(func(i int) float64 {
+							return analyze.HarmonicPower(
+								speciesCoeffs(coeffs[i], k, len(sps)),
+							)[l]
+						}, sp.columnName(fmt.Sprintf("Power_%d [cMpc^2/h^2]", l)))
+					}
+				}
+			}
+		}
+
+		sizes := make([]int, len(order))
+		for i := range order {
+			if order[i] < 0 {
+				order[i] = len(intCols) - 1 - order[i]
+			}
+			sizes[i] = 1
+		}
+
+		return catalog.CommentString(intNames, floatNames, order, sizes),
+			catalog.FormatCols(intCols, floatCols, order)
 	}
-	
+
+	cString, _ := formatRows(0, 0)
+	out.WriteHeader(cString)
+	em := newRowEmitter(out, len(ids), func(start, end int) []string {
+		_, lines := formatRows(start, end)
+		return lines
+	})
+
+	// saveSnap appends the halos in a finished snapshot to the checkpoint
+	// and writes them to out.
+	saveSnap := func(idxs []int) error {
+		rows := make([][]float64, len(idxs))
+		for j, i := range idxs {
+			excluded := 0.0
+			if exclude[i] {
+				excluded = 1
+			}
+			for k := range res {
+				rows[j] = append(rows[j], res[k].row(i)...)
+			}
+			rows[j] = append(rows[j], excluded)
+		}
+		pIDs := make([][]int64, len(idxs))
+		for j, i := range idxs {
+			pIDs[j] = shellParticles[i]
+		}
+		if err := cp.Append(idxs, rows, pIDs); err != nil {
+			return err
+		}
+		return em.Finish(idxs)
+	}
+
+	// Buffers passed in by the caller (e.g. pipeline mode's cache) are used
+	// on their own, without prefetching.
+	var pf *io.Prefetcher
+	if (readParticles || excluding) && buf == nil {
+		var err error
+		buf, err = getVectorBuffer(
+			e.ParticleCatalog(snaps[0], 0), gConfig,
+		)
+		if err != nil {
+			return err
+		}
+		pf, err = newPrefetcher(buf, e.ParticleCatalog(snaps[0], 0), gConfig)
+		if err != nil {
+			return err
+		}
+
+		if logging.Mode == logging.Performance {
+			log.Println("Initialized VectorBuffer")
+			log.Println(logging.MemString())
+		}
+	} else if buf != nil {
+		pf = io.NewPrefetcher([]io.VectorBuffer{buf})
+	}
+
 	for _, snap := range sortedSnaps {
-		if snap == -1 {
+		idxs := idxBins[snap]
+		if snap == -1 || cp.AllDone(idxs) {
+			if err := em.Finish(idxs); err != nil {
+				return err
+			}
 			continue
 		}
-		snapCoeffs := coeffBins[snap]
-		idxs := idxBins[snap]
+
+		if prepare != nil {
+			if err := prepare(snap, idxs); err != nil {
+				return err
+			}
+		}
+
+		// snapCoeffs[k][j] are the coefficients of species k for the j-th
+		// halo in the snapshot.
+		snapCoeffs := make([][][]float64, len(sps))
+		for k := range snapCoeffs {
+			snapCoeffs[k] = make([][]float64, len(idxs))
+			for j, idx := range idxs {
+				snapCoeffs[k][j] = speciesCoeffs(coeffs[idx], k, len(sps))
+			}
+		}
 
 		snapCoords := [][]float64{
 			make([]float64, len(idxs)), make([]float64, len(idxs)),
@@ -261,123 +657,382 @@ func (config *StatsConfig) Run(
 		}
 
 		samples := int(config.monteCarloSamples)
-		for j := range idxs {
-			order := findOrder(coeffs[idxs[j]])
-			shell := analyze.PennaFunc(coeffs[idxs[j]], order, order, 2)
-
-			vol := shell.Volume(samples)
-			r := math.Pow(vol/(math.Pi*4/3), 0.33333)
-
-			vols[idxs[j]] = vol
-			rads[idxs[j]] = r
-			sas[idxs[j]] = shell.SurfaceArea(samples)
-			as[idxs[j]], bs[idxs[j]], cs[idxs[j]], aVecs[idxs[j]] =
-				shell.Axes(samples)
+		for k, r := range res {
+			for j, i := range idxs {
+				shell := shellFunc(snapCoeffs[k][j])
+				gen := func(key int) *rand.Generator {
+					return haloRand(ids[i], snap, key)
+				}
 
-			rmins[idxs[j]], rmaxes[idxs[j]] = rangeSp(snapCoeffs[j], config)
+				if needs.volume {
+					vol := shell.Volume(samples, gen(volumeRandKey))
+					r.vols[i] = vol
+					r.rads[i] = math.Pow(vol/(math.Pi*4/3), 0.33333)
+				}
+				if needs.area {
+					r.sas[i] = shell.SurfaceArea(samples, gen(areaRandKey))
+				}
+				if needs.axes {
+					r.as[i], r.bs[i], r.cs[i], r.aVecs[i] =
+						shell.Axes(samples, gen(axesRandKey))
+				}
+				if needs.radialRange || readParticles {
+					r.rmins[i], r.rmaxes[i] =
+						rangeSp(snapCoeffs[k][j], config, gen(rangeRandKey))
+				}
+			}
 		}
 
 		if logging.Mode == logging.Performance {
 			log.Println("Shell calculations.")
 			log.Println(logging.MemString())
 		}
-		
+
+		if !readParticles && !excluding {
+			if err := saveSnap(idxs); err != nil {
+				return err
+			}
+			continue
+		}
+
 		hds, files, err := memo.ReadHeaders(snap, buf, e)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		// Exclusion only uses the shells of the first species.
+		if excluding {
+			snapExclude := findExcludedHalos(
+				snapCoords, snapCoeffs[0], float64(hds[0].TotalWidth),
+				config.exclusionStrategy,
+			)
+			for j := range idxs {
+				exclude[idxs[j]] = snapExclude[j]
+			}
+
+			if logging.Mode == logging.Performance {
+				log.Println("Found excluded halos.")
+				log.Println(logging.MemString())
+			}
+		}
+
+		if !readParticles {
+			if err = saveSnap(idxs); err != nil {
+				return err
+			}
+			continue
 		}
 		hBounds, err := boundingSpheres(snapCoords, &hds[0], e)
-		
+
 		if err != nil {
-			return nil, err
+			return err
 		}
 		intrBins, _ := binSphereIntersections(hds, hBounds)
-
-		
-		rLows := make([]float64, len(snapCoeffs))
-		rHighs := make([]float64, len(snapCoeffs))
-		for i := range snapCoeffs {
-			// TODO: Figure out what's going on here and refactor.
-			rLows[i], rHighs[i] = rangeSp(snapCoeffs[i], config)
+		blocks, names := usedBlocks(files, func(i int) bool {
+			return len(intrBins[i]) > 0
+		})
+
+		fields := io.Positions
+		if needs.mass {
+			fields |= io.Masses
+			if needsTypes(sps) {
+				fields |= io.Types
+			}
+		}
+		if config.shellFilter {
+			fields |= io.IDs
 		}
+		var spMs []float32
+
+		err = pf.ReadChunks(names, fields, int(gConfig.ChunkSize),
+			func(k int, chunk *io.Chunk) error {
+				i := blocks[k]
+				if chunk.Start == 0 && logging.Mode == logging.Performance {
+					log.Printf("Reading segment %d.", i)
+					log.Println(logging.MemString())
+				}
 
-		for i := range hds {
-			if config.skipMass { break }
-			if len(intrBins[i]) == 0 { continue }
+				xs, pIDs := chunk.Xs, chunk.IDs
+				for k, r := range res {
+					if !needs.mass {
+						break
+					}
+					ms := sps[k].weighMasses(chunk.Ms, chunk.Types, spMs)
+					if sps[k].weights != nil {
+						spMs = ms
+					}
+
+					for j := range idxs {
+						if exclude[idxs[j]] { continue }
+						rLow, rHigh := r.rmins[idxs[j]], r.rmaxes[idxs[j]]
+						r.masses[idxs[j]] += massContained(
+							&hds[i], xs, ms, snapCoeffs[k][j],
+							hBounds[j], rLow, rHigh,
+							gConfig.Threads,
+						)
+					}
+				}
 
-			xs, _, ms, pIDs, err := buf.Read(files[i])
+				// Shell particles only use the shells of the first species.
+				if config.shellFilter {
+					for j := range idxs {
+						if exclude[idxs[j]] { continue }
+						rLow, rHigh := res[0].rmins[idxs[j]], res[0].rmaxes[idxs[j]]
+						// This isn't the correct way to handle this for
+						// performance, but massContained is already gross
+						// enough as it is.
+						shellParticles[idxs[j]] = appendShellParticles(
+							&hds[i], xs, pIDs, snapCoeffs[0][j],
+							hBounds[j], rLow, rHigh,
+							config.shellWidth,
+							gConfig.Threads,
+							shellParticles[idxs[j]],
+						)
+					}
+				}
+				return nil
+			})
+		if err != nil {
+			return err
+		}
 
-			if logging.Mode == logging.Performance {
-				log.Printf("Read segment %d.", i)
-				log.Println(logging.MemString())
+		if err = saveSnap(idxs); err != nil {
+			return err
+		}
+	}
+
+	if config.shellFilter && !config.skipMass {
+		for i := range ids {
+			if !exclude[i] {
+				sp.snaps = append(sp.snaps, snaps[i])
+				sp.ids = append(sp.ids, ids[i])
+				sp.particles = append(sp.particles, shellParticles[i])
 			}
-			
-			if err != nil {
-				return nil, err
+		}
+	}
+
+	return nil
+}
+
+// statsValueNames is the set of values which can be requested by the
+// stats.config variable 'Values'.
+var statsValueNames = map[string]bool{
+	"id": true, "snap": true, "m_sp": true, "r_sp": true, "V_sp": true,
+	"SA_sp": true, "a_sp": true, "b_sp": true, "c_sp": true, "A_sp": true,
+	"r_min": true, "r_max": true, "SA_sp/V_sp": true, "power_sp": true,
+}
+
+// defaultStatsValues reproduces the columns written by older versions of
+// Shellfish which didn't support the 'Values' variable.
+var defaultStatsValues = []string{
+	"id", "snap", "m_sp", "r_sp", "V_sp", "SA_sp", "a_sp", "b_sp", "c_sp",
+	"A_sp", "r_min", "r_max",
+}
+
+// readsParticles returns true if the particles around each halo need to be
+// read from the snapshot files.
+func (config *StatsConfig) readsParticles() bool {
+	values := config.values
+	if len(values) == 0 {
+		values = defaultStatsValues
+	}
+	needs := findStatsNeeds(values)
+	return (needs.mass || config.shellFilter) && !config.skipMass
+}
+
+// particleFiles returns the names of the particle files which need to be read
+// to analyze the halos at the indices idxs, all of which are in snapshot
+// snap.
+func (config *StatsConfig) particleFiles(
+	snap int, idxs []int, coords [][]float64,
+	buf io.VectorBuffer, e *env.Environment,
+) (map[string]bool, error) {
+	files := make(map[string]bool)
+	if !config.readsParticles() {
+		return files, nil
+	}
+
+	hds, names, err := memo.ReadHeaders(snap, buf, e)
+	if err != nil {
+		return nil, err
+	}
+
+	snapCoords := make([][]float64, 4)
+	for k := range snapCoords {
+		snapCoords[k] = make([]float64, len(idxs))
+		for i, idx := range idxs {
+			snapCoords[k][i] = coords[k][idx]
+		}
+	}
+	hBounds, err := boundingSpheres(snapCoords, &hds[0], e)
+	if err != nil {
+		return nil, err
+	}
+
+	intrBins, _ := binSphereIntersections(hds, hBounds)
+	for i := range hds {
+		if len(intrBins[i]) > 0 {
+			files[names[i]] = true
+		}
+	}
+	return files, nil
+}
+
+// statsNeeds records which of the expensive shell calculations need to be
+// done for a given list of values.
+type statsNeeds struct {
+	mass, volume, area, axes, radialRange bool
+}
+
+func findStatsNeeds(values []string) statsNeeds {
+	needs := statsNeeds{}
+	for _, val := range values {
+		switch val {
+		case "m_sp":
+			needs.mass = true
+		case "r_sp", "V_sp":
+			needs.volume = true
+		case "SA_sp":
+			needs.area = true
+		case "SA_sp/V_sp":
+			needs.area, needs.volume = true, true
+		case "a_sp", "b_sp", "c_sp", "A_sp":
+			needs.axes = true
+		case "r_min", "r_max":
+			needs.radialRange = true
+		}
+	}
+	return needs
+}
+
+// exclusionRings is the number of rings of constant polar angle used to
+// sample the surfaces of shells when checking for overlaps. Each ring contains
+// 2*exclusionRings points.
+const exclusionRings = 32
+
+// findExcludedHalos returns a flag for each of the halos in a snapshot
+// indicating whether it is removed by the given exclusion strategy. coords are
+// the X, Y, Z, and R200m columns of the halos and width is the width of the
+// simulation box.
+func findExcludedHalos(
+	coords, coeffs [][]float64, width float64, strategy string,
+) []bool {
+	n := len(coeffs)
+	exclude := make([]bool, n)
+	if n == 0 {
+		return exclude
+	}
+
+	shells := make([]analyze.Shell, n)
+	rmaxes := make([]float64, n)
+	for i := range shells {
+		shells[i] = shellFunc(coeffs[i])
+		rmaxes[i] = shellGridRMax(shells[i])
+	}
+
+	// Larger halos come first. Ties are broken by input order so that the
+	// result doesn't depend on the sorting algorithm.
+	sorted := make([]int, n)
+	for i := range sorted {
+		sorted[i] = i
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return coords[3][sorted[i]] > coords[3][sorted[j]]
+	})
+
+	for jj := 1; jj < n; jj++ {
+		j := sorted[jj]
+		for ii := 0; ii < jj; ii++ {
+			i := sorted[ii]
+			if coords[3][i] == coords[3][j] {
+				break
 			}
 
-			for j := range idxs {
-				masses[idxs[j]] += massContained(
-					&hds[i], xs, ms, snapCoeffs[j],
-					hBounds[j], rLows[j], rHighs[j],
-					gConfig.Threads,
+			dx := wrapDist(coords[0][j], coords[0][i], width)
+			dy := wrapDist(coords[1][j], coords[1][i], width)
+			dz := wrapDist(coords[2][j], coords[2][i], width)
+
+			var excluded bool
+			switch strategy {
+			case "contain":
+				excluded = shellContains(shells[i], dx, dy, dz)
+			case "overlap":
+				excluded = shellsOverlap(
+					shells[i], shells[j], rmaxes[i], rmaxes[j], dx, dy, dz,
 				)
+			default:
+				panic("Impossible")
+			}
 
-				if config.shellFilter {
-					// This isn't the correct way to handle this for
-					// performance, but massContained is already gross enough as
-					// it is.
-					shellParticles[idxs[j]] = appendShellParticles(
-						&hds[i], xs, pIDs, snapCoeffs[j],
-						hBounds[j], rLows[j], rHighs[j],
-						config.shellWidth,
-						gConfig.Threads,
-						shellParticles[idxs[j]],
-					)
-				}
-
+			if excluded {
+				exclude[j] = true
+				break
 			}
-			buf.Close()
 		}
 	}
 
-	if config.shellFilter && !config.skipMass {
-		writeShellParticles(snaps, ids, shellParticles, gConfig, config)
-	}
+	return exclude
+}
 
-	axs := make([]float64, len(ids))
-	ays := make([]float64, len(ids))
-	azs := make([]float64, len(ids))
-	for i := range axs {
-		axs[i], ays[i], azs[i] = aVecs[i][0], aVecs[i][1], aVecs[i][2]
+// shellContains returns true if the point (x, y, z), given relative to the
+// center of the shell, is inside the shell.
+func shellContains(shell analyze.Shell, x, y, z float64) bool {
+	if x == 0 && y == 0 && z == 0 {
+		return true
 	}
+	return shell.Contains(x, y, z)
+}
 
-	lines := catalog.FormatCols(
-		[][]int{ids, snaps},
-		[][]float64{masses, rads, vols, sas,
-			as, bs, cs, axs, ays, azs, rmins, rmaxes},
-		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
-	)
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot"},
-		[]string{"M_sp [M_sun/h]", "R_sp [cMpc/h]",
-			"Volume [cMpc^3/h^3]", "Surface Area [cMpc^2/h^2]",
-			"Major Axis [cMpc/h]",
-			"Intermediate Axis [cMpc/h]",
-			"Minor Axis [cMpc/h]",
-			"Ax", "Ay", "Az",
-			"RMin [cMpc/h]", "RMax [cMpc/h]",
-		},
-		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13},
-		[]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
-	)
+// shellsOverlap returns true if the shells s1 and s2 intersect, where
+// (dx, dy, dz) is the displacement from the center of s1 to the center of s2.
+// Because shells are star-shaped, this is true if and only if
+// some part of either surface is inside the other shell.
+func shellsOverlap(
+	s1, s2 analyze.Shell, rmax1, rmax2, dx, dy, dz float64,
+) bool {
+	if dx*dx+dy*dy+dz*dz > (rmax1+rmax2)*(rmax1+rmax2) {
+		return false
+	}
+	if shellContains(s1, dx, dy, dz) || shellContains(s2, -dx, -dy, -dz) {
+		return true
+	}
 
-	if logging.Mode == logging.Performance {
-		log.Printf("Time: %s", time.Since(t).String())
-		log.Printf("Memory:\n%s", logging.MemString())
+	for i := 0; i < exclusionRings; i++ {
+		theta := math.Acos(1 - 2*(float64(i)+0.5)/exclusionRings)
+		for j := 0; j < 2*exclusionRings; j++ {
+			phi := 2 * math.Pi * (float64(j) + 0.5) / (2 * exclusionRings)
+			ux := math.Sin(theta) * math.Cos(phi)
+			uy := math.Sin(theta) * math.Sin(phi)
+			uz := math.Cos(theta)
+
+			r2 := s2(phi, theta)
+			if s1.Contains(dx+r2*ux, dy+r2*uy, dz+r2*uz) {
+				return true
+			}
+			r1 := s1(phi, theta)
+			if s2.Contains(r1*ux-dx, r1*uy-dy, r1*uz-dz) {
+				return true
+			}
+		}
 	}
 
-	return append([]string{cString}, lines...), nil
+	return false
+}
+
+// shellGridRMax returns the maximum radius of the shell over the grid of
+// angles used by shellsOverlap.
+func shellGridRMax(shell analyze.Shell) float64 {
+	rmax := 0.0
+	for i := 0; i < exclusionRings; i++ {
+		theta := math.Acos(1 - 2*(float64(i)+0.5)/exclusionRings)
+		for j := 0; j < 2*exclusionRings; j++ {
+			phi := 2 * math.Pi * (float64(j) + 0.5) / (2 * exclusionRings)
+			if r := shell(phi, theta); r > rmax {
+				rmax = r
+			}
+		}
+	}
+	return rmax
 }
 
 func wrapDist(x1, x2, width float64) float64 {
@@ -391,20 +1046,6 @@ func wrapDist(x1, x2, width float64) float64 {
 	}
 }
 
-func binCoeffsBySnap(
-	snaps, ids []int, coeffs [][]float64,
-) (snapBins map[int][]int, coeffBins map[int][][]float64, idxBins map[int][]int) {
-	snapBins = make(map[int][]int)
-	coeffBins = make(map[int][][]float64)
-	idxBins = make(map[int][]int)
-	for i, snap := range snaps {
-		snapBins[snap] = append(snapBins[snap], ids[i])
-		coeffBins[snap] = append(coeffBins[snap], coeffs[i])
-		idxBins[snap] = append(idxBins[snap], i)
-	}
-	return snapBins, coeffBins, idxBins
-}
-
 func boundingSpheres(
 	coords [][]float64, hd *io.Header, e *env.Environment,
 ) ([]geom.Sphere, error) {
@@ -442,10 +1083,25 @@ func wrap(x, tw2 float32) float32 {
 	return x
 }
 
-func rangeSp(coeffs []float64, c *StatsConfig) (rmin, rmax float64) {
-	order := findOrder(coeffs)
-	shell := analyze.PennaFunc(coeffs, order, order, 2)
-	return shell.RadialRange(int(c.monteCarloSamples))
+func rangeSp(
+	coeffs []float64, c *StatsConfig, gen *rand.Generator,
+) (rmin, rmax float64) {
+	shell := shellFunc(coeffs)
+	return shell.RadialRange(int(c.monteCarloSamples), gen)
+}
+
+// particleChunk is the number of particles in each of the chunks that
+// massContained and appendShellParticles split their work into. Chunks are
+// combined in order, so results don't depend on the number of threads.
+const particleChunk = 1 << 14
+
+// chunkRange returns the range of particle indices in the given chunk.
+func chunkRange(chunk int64, n int) (start, end int64) {
+	start, end = chunk*particleChunk, (chunk+1)*particleChunk
+	if end > int64(n) {
+		end = int64(n)
+	}
+	return start, end
 }
 
 func massContained(
@@ -457,21 +1113,26 @@ func massContained(
 		cpu = int(threads)
 	}
 	workers := int64(runtime.GOMAXPROCS(cpu))
-	outChan := make(chan float64, workers)
+	sums := make([]float64, (len(xs)+particleChunk-1)/particleChunk)
+	done := make(chan bool, workers)
 	for i := int64(0); i < workers-1; i++ {
 		go massContainedChan(
-			hd, xs, ms, coeffs, sphere, rLow, rHigh, i, workers, outChan,
+			hd, xs, ms, coeffs, sphere, rLow, rHigh, i, workers, sums, done,
 		)
 	}
 
 	massContainedChan(
 		hd, xs, ms, coeffs, sphere, rLow, rHigh,
-		workers-1, workers, outChan,
+		workers-1, workers, sums, done,
 	)
 
-	sum := 0.0
 	for i := int64(0); i < workers; i++ {
-		sum += <-outChan
+		<-done
+	}
+
+	sum := 0.0
+	for i := range sums {
+		sum += sums[i]
 	}
 
 	return sum
@@ -489,22 +1150,27 @@ func appendShellParticles(
 		cpu = int(threads)
 	}
 	workers := int64(runtime.GOMAXPROCS(cpu))
-	outChan := make(chan []int64, workers)
+	bufs := make([][]int64, (len(xs)+particleChunk-1)/particleChunk)
+	done := make(chan bool, workers)
 
 	for i := int64(0); i < workers-1; i++ {
 		go appendShellParticlesChan(
 			hd, xs, pIDs, coeffs, sphere, rLow, rHigh,
-			shellWidth, i, workers, outChan,
+			shellWidth, i, workers, bufs, done,
 		)
 	}
 
 	appendShellParticlesChan(
 		hd, xs, pIDs, coeffs, sphere, rLow, rHigh,
-		shellWidth, workers-1, workers, outChan,
+		shellWidth, workers-1, workers, bufs, done,
 	)
 
 	for i := int64(0); i < workers; i++ {
-		out = append(out, <-outChan...)
+		<-done
+	}
+
+	for i := range bufs {
+		out = append(out, bufs[i]...)
 	}
 
 	return out
@@ -513,87 +1179,94 @@ func appendShellParticles(
 func massContainedChan(
 	hd *io.Header, xs [][3]float32, ms []float32, coeffs []float64,
 	sphere geom.Sphere, rLow, rHigh float64,
-	offset, workers int64, out chan float64,
+	offset, workers int64, sums []float64, done chan bool,
 ) {
 	tw2 := float32(hd.TotalWidth) / 2
 
-	order := findOrder(coeffs)
-	shell := analyze.PennaFunc(coeffs, order, order, 2)
+	shell := shellFunc(coeffs)
 	low2, high2 := float32(rLow*rLow), float32(rHigh*rHigh)
 
-	
-	sum := 0.0
-	
-	for i := offset; i < int64(len(xs)); i += workers {
-		x, y, z := xs[i][0], xs[i][1], xs[i][2]
-		x, y, z = x - sphere.C[0], y - sphere.C[1], z - sphere.C[2]
-		x = wrap(x, tw2)
-		y = wrap(y, tw2)
-		z = wrap(z, tw2)
+	for chunk := offset; chunk < int64(len(sums)); chunk += workers {
+		start, end := chunkRange(chunk, len(xs))
+		sum := 0.0
+
+		for i := start; i < end; i++ {
+			x, y, z := xs[i][0], xs[i][1], xs[i][2]
+			x, y, z = x - sphere.C[0], y - sphere.C[1], z - sphere.C[2]
+			x = wrap(x, tw2)
+			y = wrap(y, tw2)
+			z = wrap(z, tw2)
 
-		r2 := x*x + y*y + z*z
+			r2 := x*x + y*y + z*z
 
-		if r2 < low2 || (r2 < high2 &&
-		shell.Contains(float64(x), float64(y), float64(z))) {
-			sum += float64(ms[i])
+			if r2 < low2 || (r2 < high2 &&
+			shell.Contains(float64(x), float64(y), float64(z))) {
+				sum += float64(ms[i])
+			}
 		}
+
+		sums[chunk] = sum
 	}
 
-	out <- sum
+	done <- true
 }
 
 func appendShellParticlesChan(
 	hd *io.Header, xs [][3]float32, pIDs []int64, coeffs []float64,
 	sphere geom.Sphere, rLow, rHigh float64, shellWidth float64,
-	offset, workers int64, outChan chan []int64,
-) {	
-	buf := []int64{}
-
+	offset, workers int64, bufs [][]int64, done chan bool,
+) {
 	tw2 := float32(hd.TotalWidth) / 2
 
-	order := findOrder(coeffs)
-	shell := analyze.PennaFunc(coeffs, order, order, 2)
+	shell := shellFunc(coeffs)
 	delta := float64(sphere.R) * shellWidth
 	if shellWidth < 0 { delta = 0 }
 	rLow -= delta
 	rHigh += delta
 	low2, high2 := float32(rLow*rLow), float32(rHigh*rHigh)
-		
-	for i := offset; i < int64(len(xs)); i += workers {
-		x, y, z := xs[i][0], xs[i][1], xs[i][2]
-		x, y, z = x-sphere.C[0], y-sphere.C[1], z-sphere.C[2]
-		x = wrap(x, tw2)
-		y = wrap(y, tw2)
-		z = wrap(z, tw2)
 
-		r2 := x*x + y*y + z*z
+	for chunk := offset; chunk < int64(len(bufs)); chunk += workers {
+		start, end := chunkRange(chunk, len(xs))
+		buf := []int64{}
+
+		for i := start; i < end; i++ {
+			x, y, z := xs[i][0], xs[i][1], xs[i][2]
+			x, y, z = x-sphere.C[0], y-sphere.C[1], z-sphere.C[2]
+			x = wrap(x, tw2)
+			y = wrap(y, tw2)
+			z = wrap(z, tw2)
+
+			r2 := x*x + y*y + z*z
+
+			if shellWidth < 0 {
+				if r2 < high2 {
+					r := math.Sqrt(float64(r2))
+					phi := math.Atan2(float64(y), float64(x))
+					theta := math.Acos(float64(z) / r)
+					rs := shell(phi, theta)
+
+					if rs > r {
+						buf = append(buf, pIDs[i])
+					}
 
-		if shellWidth < 0 {
-			if r2 < high2 {
+				}
+			} else if r2 > low2 && r2 < high2 {
 				r := math.Sqrt(float64(r2))
 				phi := math.Atan2(float64(y), float64(x))
 				theta := math.Acos(float64(z) / r)
+
 				rs := shell(phi, theta)
 
-				if rs > r {
+				if rs+delta > r && rs-delta < r {
 					buf = append(buf, pIDs[i])
 				}
-
-			}
-		} else if r2 > low2 && r2 < high2 {
-			r := math.Sqrt(float64(r2))
-			phi := math.Atan2(float64(y), float64(x))
-			theta := math.Acos(float64(z) / r)
-
-			rs := shell(phi, theta)
-
-			if rs+delta > r && rs-delta < r {
-				buf = append(buf, pIDs[i])
 			}
 		}
+
+		bufs[chunk] = buf
 	}
-	
-	outChan <- buf
+
+	done <- true
 }
 
 func writeShellParticles(
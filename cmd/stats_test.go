@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStatsValues(t *testing.T) {
+	dir, gConfig, e, shellOut := runSyntheticShell(t, syntheticTestConfig, nil)
+	defer os.RemoveAll(dir)
+
+	stats := &StatsConfig{}
+	if err := stats.ReadConfig("", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Without Values, every column is written with M_sp before R_sp.
+	def := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+	expHeader := "# Column contents: ID(0) Snapshot(1) M_sp [M_sun/h](2) " +
+		"R_sp [cMpc/h](3) Volume [cMpc^3/h^3](4) " +
+		"Surface Area [cMpc^2/h^2](5) Major Axis [cMpc/h](6) " +
+		"Intermediate Axis [cMpc/h](7) Minor Axis [cMpc/h](8) Ax(9) " +
+		"Ay(10) Az(11) RMin [cMpc/h](12) RMax [cMpc/h](13)"
+	if header := strings.Split(def, "\n")[0]; header != expHeader {
+		t.Errorf("Expected the default header\n%s\ngot\n%s",
+			expHeader, header)
+	}
+
+	// Custom Values are written in the order they're given.
+	stats.values = []string{"r_sp", "id", "m_sp"}
+	custom := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+	expHeader = "# Column contents: R_sp [cMpc/h](0) ID(1) M_sp [M_sun/h](2)"
+	if header := strings.Split(custom, "\n")[0]; header != expHeader {
+		t.Errorf("Expected the header\n%s\ngot\n%s", expHeader, header)
+	}
+	if statsColumns(def, 3, 0, 2) != statsColumns(custom, 0, 1, 2) {
+		t.Errorf("Expected the columns R_sp, ID, and M_sp of\n%s\ngot\n%s",
+			def, custom)
+	}
+
+	stats.values = []string{"id", "R_sp"}
+	if err := stats.validate(); err == nil {
+		t.Errorf("Expected error for an unknown value.")
+	}
+}
+
+func TestFindStatsNeeds(t *testing.T) {
+	tests := []struct {
+		values []string
+		needs  statsNeeds
+	}{
+		{[]string{"id", "snap"}, statsNeeds{}},
+		{[]string{"m_sp"}, statsNeeds{mass: true}},
+		{[]string{"r_sp"}, statsNeeds{volume: true}},
+		{[]string{"SA_sp/V_sp"}, statsNeeds{volume: true, area: true}},
+		{[]string{"c_sp", "r_max"}, statsNeeds{axes: true, radialRange: true}},
+		{defaultStatsValues, statsNeeds{true, true, true, true, true}},
+	}
+
+	for i, test := range tests {
+		needs := findStatsNeeds(test.values)
+		if needs != test.needs {
+			t.Errorf("%d) Expected %+v for %v, got %+v.",
+				i, test.needs, test.values, needs)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"io"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+)
+
+// runBatches calls run on each batch of the input stream and writes the
+// resulting lines to out. The first line returned by run must be the catalog's
+// comment string. This is how modes which don't need to stream within a batch
+// implement Mode.Run.
+func runBatches(
+	in *catalog.BatchReader, out *catalog.RowWriter,
+	run func(stdin []byte) ([]string, error),
+) error {
+	for {
+		stdin, err := in.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		lines, err := run(stdin)
+		if err != nil {
+			return err
+		} else if len(lines) == 0 {
+			continue
+		}
+
+		out.WriteHeader(lines[0])
+		if err = out.WriteRows(lines[1:]); err != nil {
+			return err
+		}
+	}
+}
+
+// eachBatch calls run on each batch of the input stream.
+func eachBatch(in *catalog.BatchReader, run func(stdin []byte) error) error {
+	for {
+		stdin, err := in.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err = run(stdin); err != nil {
+			return err
+		}
+	}
+}
+
+// rowEmitter writes the rows of an output catalog as soon as they're
+// finished. Rows are always written in input order, so a row will only be
+// written once every row before it has also been finished. If a mode analyzes
+// snapshots in the order they first appear in its input, this means that rows
+// are written as each snapshot is finished whenever the input is grouped by
+// snapshot.
+type rowEmitter struct {
+	out  *catalog.RowWriter
+	done []bool
+	next int
+	// format returns the formatted lines for the rows in [start, end).
+	format func(start, end int) []string
+}
+
+// newRowEmitter creates a rowEmitter for a catalog with n rows.
+func newRowEmitter(
+	out *catalog.RowWriter, n int, format func(start, end int) []string,
+) *rowEmitter {
+	return &rowEmitter{out: out, done: make([]bool, n), format: format}
+}
+
+// Finish marks the rows at the given indices as finished and writes every row
+// which is now ready.
+func (em *rowEmitter) Finish(idxs []int) error {
+	for _, idx := range idxs {
+		em.done[idx] = true
+	}
+
+	start := em.next
+	for em.next < len(em.done) && em.done[em.next] {
+		em.next++
+	}
+	if start == em.next {
+		return nil
+	}
+
+	return em.out.WriteRows(em.format(start, em.next))
+}
+
+// snapOrder returns the unique snapshots in snaps in the order that they first
+// appear.
+func snapOrder(snaps []int) []int {
+	order := []int{}
+	seen := make(map[int]bool)
+	for _, snap := range snaps {
+		if !seen[snap] {
+			seen[snap] = true
+			order = append(order, snap)
+		}
+	}
+	return order
+}
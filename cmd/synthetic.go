@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// SyntheticCatalogFormat is the format of the names of the halo catalogs
+// written by WriteSyntheticCatalogs. Snapshot numbers are zero-padded so that
+// the catalogs are listed in order.
+const SyntheticCatalogFormat = "synthetic_halos_%04d.txt"
+
+// WriteSyntheticCatalogs writes a Text halo catalog for every snapshot to
+// SyntheticCatalogDir which lists the halos of the synthetic snapshots along
+// with their true splashback radii. It does nothing if SyntheticCatalogDir
+// isn't set. Catalogs which are already up to date aren't rewritten, so other
+// runs can read them while this is called.
+func WriteSyntheticCatalogs(config *GlobalConfig) error {
+	if config.SyntheticCatalogDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.SyntheticCatalogDir, 0755); err != nil {
+		return err
+	}
+
+	halos, err := io.SyntheticHalos(ioContext(config))
+	if err != nil {
+		return err
+	}
+
+	for snap := config.SnapMin; snap <= config.SnapMax; snap++ {
+		fname := path.Join(
+			config.SyntheticCatalogDir,
+			fmt.Sprintf(SyntheticCatalogFormat, snap),
+		)
+		if err := writeSyntheticCatalog(fname, halos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSyntheticCatalog(fname string, halos []io.SyntheticHalo) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "# Column contents: ID(0) X(1) Y(2) Z(3) M200m(4) "+
+		"R200m(5) R_sp(6) a_sp(7) b_sp(8) c_sp(9)")
+	fmt.Fprintln(buf, "# Lengths are in cMpc/h and masses are in Msun/h.")
+	for _, h := range halos {
+		fmt.Fprintf(buf, "%d %.6g %.6g %.6g %.6g %.6g %.6g %.6g %.6g %.6g\n",
+			h.ID, h.X, h.Y, h.Z, h.M200m, h.R200m, h.Rsp, h.A, h.B, h.C)
+	}
+
+	if old, err := ioutil.ReadFile(fname); err == nil &&
+		bytes.Equal(old, buf.Bytes()) {
+		return nil
+	}
+
+	// The catalog is written to a temporary file first so that nothing
+	// reading the catalog ever sees it half-written.
+	tmpFile := fname + ".tmp"
+	err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, fname)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
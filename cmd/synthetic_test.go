@@ -0,0 +1,332 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
+	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+const syntheticTestConfig = `[config]
+Version = 1.0.0
+SnapshotType = synthetic
+HaloType = nil
+TreeType = nil
+MemoDir = %s
+SnapMin = 0
+SnapMax = 0
+Endianness = LittleEndian
+SyntheticTotalWidth = 20
+SyntheticParticles = 262144
+SyntheticScaleFactors = 1.0
+SyntheticSeed = 7
+SyntheticHaloX = 5, 14
+SyntheticHaloY = 5, 14
+SyntheticHaloZ = 5, 14
+SyntheticHaloM200m = 1e14, 1e14
+SyntheticHaloC200m = 5, 5
+SyntheticHaloRspMult = 1.3, 1.5
+SyntheticCatalogDir = %s
+`
+
+// runSyntheticShell writes synthetic halos and particles using the given
+// config file, runs shell on every halo, and returns the environment and the
+// output of shell. If shell is nil, the default ShellConfig is used with fewer
+// rings. The returned directory should be removed by the caller.
+func runSyntheticShell(
+	t *testing.T, config string, shell *ShellConfig,
+) (string, *GlobalConfig, *env.Environment, *bytes.Buffer) {
+	dir, err := ioutil.TempDir("", "shellfish_synthetic")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	memoDir, catDir := path.Join(dir, "memo"), path.Join(dir, "halos")
+	if err := os.Mkdir(memoDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	fname := path.Join(dir, "synthetic.config")
+	err = ioutil.WriteFile(
+		fname, []byte(fmt.Sprintf(config, memoDir, catDir)), 0644,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	gConfig := &GlobalConfig{}
+	if err := gConfig.ReadConfig(fname, nil); err != nil {
+		t.Fatalf("Could not read the config file: %s", err.Error())
+	}
+	if err := WriteSyntheticCatalogs(gConfig); err != nil {
+		t.Fatalf("Could not write the halo catalogs: %s", err.Error())
+	}
+	e := &env.Environment{MemoDir: memoDir}
+	err = e.InitSynthetic(
+		&gConfig.ParticleInfo, gConfig.SyntheticBlocks, false,
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Build the input to shell from the halo catalog, as id would.
+	cat, err := ioutil.ReadFile(
+		path.Join(catDir, fmt.Sprintf(SyntheticCatalogFormat, 0)),
+	)
+	if err != nil {
+		t.Fatalf("Could not read the halo catalog: %s", err.Error())
+	}
+	input := &bytes.Buffer{}
+	for _, line := range strings.Split(string(cat), "\n") {
+		tok := strings.Fields(line)
+		if len(tok) == 0 || tok[0] == "#" {
+			continue
+		}
+		fmt.Fprintf(input, "%s 0 %s %s %s %s\n",
+			tok[0], tok[1], tok[2], tok[3], tok[5])
+	}
+
+	if shell == nil {
+		shell = &ShellConfig{}
+		if err := shell.ReadConfig("", nil); err != nil {
+			t.Fatal(err.Error())
+		}
+		// Fewer rings than the default keep the test fast.
+		shell.rings = 20
+	}
+	shellOut := &bytes.Buffer{}
+	wr := catalog.NewRowWriter(shellOut)
+	err = shell.Run(gConfig, e, catalog.NewBatchReader(input), wr)
+	if err == nil {
+		err = wr.Close()
+	}
+	if err != nil {
+		t.Fatalf("shell returned error: %s", err.Error())
+	}
+
+	return dir, gConfig, e, shellOut
+}
+
+// runSyntheticStats runs stats on the output of shell and returns its output.
+func runSyntheticStats(
+	t *testing.T, stats *StatsConfig, gConfig *GlobalConfig,
+	e *env.Environment, shellOut []byte,
+) string {
+	statsOut := &bytes.Buffer{}
+	wr := catalog.NewRowWriter(statsOut)
+	err := stats.Run(
+		gConfig, e, catalog.NewBatchReader(bytes.NewReader(shellOut)), wr,
+	)
+	if err == nil {
+		err = wr.Close()
+	}
+	if err != nil {
+		t.Fatalf("stats returned error: %s", err.Error())
+	}
+	return statsOut.String()
+}
+
+// TestSyntheticPipeline runs shell and stats on synthetic halos and checks
+// that the splashback radii match the ones the halos were generated with.
+func TestSyntheticPipeline(t *testing.T) {
+	dir, gConfig, e, shellOut := runSyntheticShell(t, syntheticTestConfig, nil)
+	defer os.RemoveAll(dir)
+	halos, err := io.SyntheticHalos(ioContext(gConfig))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	stats := &StatsConfig{}
+	if err := stats.ReadConfig("", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	stats.values = []string{"id", "r_sp"}
+	out := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		tok := strings.Fields(line)
+		if len(tok) != 2 || strings.HasPrefix(tok[0], "#") {
+			continue
+		}
+		id, err1 := strconv.Atoi(tok[0])
+		rsp, err2 := strconv.ParseFloat(tok[1], 64)
+		if err1 != nil || err2 != nil || id < 0 || id >= len(halos) {
+			t.Fatalf("Could not parse the stats line %q.", line)
+		}
+
+		if math.Abs(rsp/halos[id].Rsp-1) > 0.1 {
+			t.Errorf("Halo %d has R_sp = %.3f, but was generated with "+
+				"R_sp = %.3f.", id, rsp, halos[id].Rsp)
+		}
+		n++
+	}
+	if n != len(halos) {
+		t.Errorf("stats returned %d halos instead of %d:\n%s",
+			n, len(halos), out)
+	}
+
+	// Requesting more values shouldn't change the ones already requested.
+	stats.values = []string{"id", "a_sp", "r_min"}
+	few := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+	stats.values = []string{"id", "V_sp", "SA_sp", "a_sp", "r_min"}
+	more := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+	if statsColumns(few, 0, 1, 2) != statsColumns(more, 0, 3, 4) {
+		t.Errorf("a_sp and r_min changed when more values were "+
+			"requested:\n%s\nvs.\n%s", few, more)
+	}
+}
+
+// statsColumns returns the given columns of every row in a stats catalog.
+func statsColumns(out string, cols ...int) string {
+	rows := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		tok := strings.Fields(line)
+		if len(tok) == 0 || strings.HasPrefix(tok[0], "#") {
+			continue
+		}
+		row := []string{}
+		for _, i := range cols {
+			row = append(row, tok[i])
+		}
+		rows = append(rows, strings.Join(row, " "))
+	}
+	return strings.Join(rows, "\n")
+}
+
+// TestStatsExclusionBatches checks that exclusion doesn't depend on how the
+// halos of a snapshot are split into batches.
+func TestStatsExclusionBatches(t *testing.T) {
+	// Halo 1 is small and inside halo 0.
+	config := strings.Replace(syntheticTestConfig, `SyntheticHaloX = 5, 14
+SyntheticHaloY = 5, 14
+SyntheticHaloZ = 5, 14
+SyntheticHaloM200m = 1e14, 1e14
+SyntheticHaloC200m = 5, 5
+SyntheticHaloRspMult = 1.3, 1.5`, `SyntheticHaloX = 5, 5.8, 14
+SyntheticHaloY = 5, 5, 14
+SyntheticHaloZ = 5, 5, 14
+SyntheticHaloM200m = 1e14, 1e12, 1e14
+SyntheticHaloC200m = 5, 5, 5
+SyntheticHaloRspMult = 1.3, 1.3, 1.5`, 1)
+	dir, gConfig, e, shellOut := runSyntheticShell(t, config, nil)
+	defer os.RemoveAll(dir)
+
+	// Every halo gets its own batch.
+	split := &bytes.Buffer{}
+	for _, line := range strings.Split(shellOut.String(), "\n") {
+		if line == catalog.BatchSeparator || line == "" {
+			continue
+		}
+		fmt.Fprintln(split, line)
+		if !strings.HasPrefix(line, "#") {
+			fmt.Fprintln(split, catalog.BatchSeparator)
+		}
+	}
+
+	stats := &StatsConfig{}
+	if err := stats.ReadConfig("", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	stats.values = []string{"id", "r_sp"}
+	stats.exclusionStrategy = "contain"
+	whole := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+	batched := runSyntheticStats(t, stats, gConfig, e, split.Bytes())
+
+	ids := []string{}
+	for _, line := range strings.Split(whole, "\n") {
+		if tok := strings.Fields(line); len(tok) > 0 && tok[0][0] != '#' {
+			ids = append(ids, tok[0])
+		}
+	}
+	if fmt.Sprint(ids) != "[0 2]" {
+		t.Errorf("Expected halos [0 2] to be left after exclusion, got %v.",
+			ids)
+	}
+	if whole != batched {
+		t.Errorf("Output changed when the input was split into batches:\n"+
+			"%s\nvs.\n%s", whole, batched)
+	}
+}
+
+// TestSyntheticShellFailure checks that halos which shells can't be fit to
+// get rows of NaNs instead of breaking shell and stats.
+func TestSyntheticShellFailure(t *testing.T) {
+	shell := &ShellConfig{}
+	if err := shell.ReadConfig("", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	// There are fewer lines of sight than harmonic coefficients.
+	shell.rings, shell.spokes = 10, 16
+	shell.shellType, shell.lMax = "harmonic", 20
+	dir, gConfig, e, shellOut := runSyntheticShell(
+		t, syntheticTestConfig, shell,
+	)
+	defer os.RemoveAll(dir)
+
+	stats := &StatsConfig{}
+	if err := stats.ReadConfig("", nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	stats.values = []string{"id", "r_sp"}
+	stats.shellType, stats.lMax = "harmonic", 20
+	out := runSyntheticStats(t, stats, gConfig, e, shellOut.Bytes())
+
+	rsps := statsColumns(out, 1)
+	if rsps != "NaN\nNaN" {
+		t.Errorf("Expected NaN R_sp for both halos, got:\n%s", out)
+	}
+}
+
+func TestWriteSyntheticCatalogs(t *testing.T) {
+	dir, gConfig, _, _ := runSyntheticShell(t, syntheticTestConfig, nil)
+	defer os.RemoveAll(dir)
+	fname := path.Join(
+		gConfig.SyntheticCatalogDir, fmt.Sprintf(SyntheticCatalogFormat, 0),
+	)
+	cat, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Catalogs which are up to date aren't rewritten.
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(fname, past, past); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := WriteSyntheticCatalogs(gConfig); err != nil {
+		t.Fatalf("WriteSyntheticCatalogs returned error: %s", err.Error())
+	}
+	if info, err := os.Stat(fname); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("An up to date catalog was rewritten.")
+	}
+
+	// Catalogs which are out of date are, and no temporary files are left.
+	if err := ioutil.WriteFile(fname, cat[:len(cat)/2], 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := WriteSyntheticCatalogs(gConfig); err != nil {
+		t.Fatalf("WriteSyntheticCatalogs returned error: %s", err.Error())
+	}
+	if newCat, err := ioutil.ReadFile(fname); err != nil ||
+		!bytes.Equal(cat, newCat) {
+		t.Errorf("An out of date catalog wasn't rewritten.")
+	}
+	infos, err := ioutil.ReadDir(gConfig.SyntheticCatalogDir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(infos) != 1 {
+		t.Errorf("Expected one file in SyntheticCatalogDir, got %d.",
+			len(infos))
+	}
+}
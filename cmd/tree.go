@@ -1,13 +1,17 @@
 package cmd
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
+	"github.com/phil-mansfield/shellfish/io/compress"
 	"github.com/phil-mansfield/shellfish/logging"
 	"github.com/phil-mansfield/shellfish/los/tree"
 	"github.com/phil-mansfield/shellfish/parse"
@@ -15,6 +19,8 @@ import (
 
 type TreeConfig struct {
 	selectSnaps []int64
+
+	configRecord
 }
 
 var _ Mode = &TreeConfig{}
@@ -34,6 +40,7 @@ func (config *TreeConfig) ExampleConfig() string {
 
 func (config *TreeConfig) ReadConfig(fname string, flags []string) error {
 	vars := parse.NewConfigVars("tree.config")
+	defer config.record(vars)
 	vars.Ints(&config.selectSnaps, "SelectSnaps", []int64{})
 
 	if fname == "" {
@@ -60,6 +67,16 @@ func (config *TreeConfig) ReadConfig(fname string, flags []string) error {
 func (config *TreeConfig) validate() error { return nil }
 
 func (config *TreeConfig) Run(
+	gConfig *GlobalConfig, e *env.Environment,
+	in *catalog.BatchReader, out *catalog.RowWriter,
+) error {
+	return runBatches(in, out, func(stdin []byte) ([]string, error) {
+		return config.run(gConfig, e, stdin)
+	})
+}
+
+// run executes the mode on a single batch of input.
+func (config *TreeConfig) run(
 	gConfig *GlobalConfig, e *env.Environment, stdin []byte,
 ) ([]string, error) {
 	if logging.Mode != logging.Nil {
@@ -78,63 +95,89 @@ func (config *TreeConfig) Run(
 	if err != nil {
 		return nil, err
 	}
-	inputIDs := intCols[0]
 
-	trees, err := treeFiles(gConfig)
+	ids, snaps, err := config.histories(gConfig, e, intCols[0])
 	if err != nil {
 		return nil, err
 	}
 
+	lines := catalog.FormatCols(
+		[][]int{ids, snaps}, [][]float64{}, []int{0, 1},
+	)
+
+	cString := catalog.CommentString(
+		[]string{"ID", "Snapshot"}, []string{}, []int{0, 1}, []int{1, 1},
+	)
+
+	if logging.Mode == logging.Performance {
+		log.Printf("Time: %s", time.Since(t).String())
+		log.Printf("Memory:\n%s", logging.MemString())
+	}
+
+	return append([]string{cString}, lines...), nil
+}
+
+// histories returns the IDs and snapshots of every halo along the main
+// progenitor branches of the given halos which are within the requested
+// snapshot range.
+func (config *TreeConfig) histories(
+	gConfig *GlobalConfig, e *env.Environment, inputIDs []int,
+) (ids, snaps []int, err error) {
+	trees, err := treeFiles(gConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	idSets, snapSets, err := tree.HaloHistories(
-		trees, inputIDs, e.SnapOffset(),
+		gConfig.TreeType, trees, inputIDs, e.SnapOffset(), gConfig.MemoDir,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	ids, snaps := []int{}, []int{}
+	allIDs, allSnaps := []int{}, []int{}
 	for i := range idSets {
-		ids = append(ids, idSets[i]...)
-		snaps = append(snaps, snapSets[i]...)
+		allIDs = append(allIDs, idSets[i]...)
+		allSnaps = append(allSnaps, snapSets[i]...)
 		// Sentinels:
 		if i != len(idSets)-1 {
-			ids = append(ids, -1)
-			snaps = append(snaps, -1)
+			allIDs = append(allIDs, -1)
+			allSnaps = append(allSnaps, -1)
 		}
 	}
 
-	lines := catalog.FormatCols(
-		[][]int{ids, snaps}, [][]float64{}, []int{0, 1},
-	)
-	fLines := []string{}
-	for i := range lines {
-		if snaps[i] >= int(gConfig.SnapMin) &&
-			snaps[i] <= int(gConfig.SnapMax) {
+	ids, snaps = []int{}, []int{}
+	for i := range allIDs {
+		if allSnaps[i] >= int(gConfig.SnapMin) &&
+			allSnaps[i] <= int(gConfig.SnapMax) {
 
 			if len(config.selectSnaps) > 0 {
 				for j := range config.selectSnaps {
-					if int(config.selectSnaps[j]) == snaps[i] {
-						fLines = append(fLines, lines[i])
+					if int(config.selectSnaps[j]) == allSnaps[i] {
+						ids = append(ids, allIDs[i])
+						snaps = append(snaps, allSnaps[i])
 					}
 				}
 			} else {
-				fLines = append(fLines, lines[i])
+				ids = append(ids, allIDs[i])
+				snaps = append(snaps, allSnaps[i])
 			}
 		}
 	}
 
-	cString := catalog.CommentString(
-		[]string{"ID", "Snapshot"}, []string{}, []int{0, 1}, []int{1, 1},
-	)
-
-	if logging.Mode == logging.Performance {
-		log.Printf("Time: %s", time.Since(t).String())
-		log.Printf("Memory:\n%s", logging.MemString())
-	}
-
-	return append([]string{cString}, fLines...), nil
+	return ids, snaps, nil
 }
 
+var (
+	// subLinkName matches SubLink's tree.<n>.hdf5 and tree_extended.<n>.hdf5
+	// files.
+	subLinkName = regexp.MustCompile(`^tree(_extended)?\.\d+\.hdf5$`)
+	// lHaloTreeName matches LHaloTree's trees_<snap>.<n> files.
+	lHaloTreeName = regexp.MustCompile(`^trees_\d+\.\d+$`)
+)
+
+// treeFiles returns the merger tree files in TreeDir. Which files are used
+// depends on TreeType, and for the Text TreeType every file is used.
 func treeFiles(gConfig *GlobalConfig) ([]string, error) {
 	infos, err := ioutil.ReadDir(gConfig.TreeDir)
 	if err != nil {
@@ -143,12 +186,33 @@ func treeFiles(gConfig *GlobalConfig) ([]string, error) {
 
 	names := []string{}
 	for _, info := range infos {
-		name := info.Name()
-		n := len(name)
-		// This is pretty hacky.
-		if n > 4 && name[:5] == "tree_" && name[n-4:] == ".dat" {
-			names = append(names, path.Join(gConfig.TreeDir, name))
+		if info.IsDir() {
+			continue
 		}
+		// Compressed trees, e.g. tree_0_0_0.dat.gz, are also allowed.
+		name := compress.TrimExt(info.Name())
+
+		var ok bool
+		switch gConfig.TreeType {
+		case "consistent-trees":
+			ok = strings.HasPrefix(name, "tree_") &&
+				strings.HasSuffix(name, ".dat")
+		case "SubLink":
+			ok = subLinkName.MatchString(name)
+		case "LHaloTree":
+			ok = lHaloTreeName.MatchString(name)
+		case "Text":
+			ok = !strings.HasPrefix(name, ".")
+		}
+
+		if ok {
+			names = append(names, path.Join(gConfig.TreeDir, info.Name()))
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("There aren't any %s merger tree files in "+
+			"the 'TreeDir' directory, %s.", gConfig.TreeType, gConfig.TreeDir)
 	}
 	return names, nil
 }
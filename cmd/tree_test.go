@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTreeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_tree_files")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"tree_0_0_0.dat", "tree_0_0_1.dat.gz", "forests.list",
+		"tree.0.hdf5", "tree_extended.1.hdf5", "trees_063.0", "trees_063.1",
+	}
+	for _, file := range files {
+		fname := path.Join(dir, file)
+		if err := ioutil.WriteFile(fname, []byte{}, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tests := []struct {
+		treeType string
+		files    []string
+	}{
+		{"consistent-trees", []string{"tree_0_0_0.dat", "tree_0_0_1.dat.gz"}},
+		{"SubLink", []string{"tree.0.hdf5", "tree_extended.1.hdf5"}},
+		{"LHaloTree", []string{"trees_063.0", "trees_063.1"}},
+		{"Text", []string{
+			"forests.list", "tree.0.hdf5", "tree_0_0_0.dat",
+			"tree_0_0_1.dat.gz", "tree_extended.1.hdf5", "trees_063.0",
+			"trees_063.1",
+		}},
+	}
+
+	for i, test := range tests {
+		config := &GlobalConfig{TreeType: test.treeType}
+		config.TreeDir = dir
+		names, err := treeFiles(config)
+		if err != nil {
+			t.Errorf("%d) treeFiles returned error: %s", i, err.Error())
+			continue
+		}
+		for j := range test.files {
+			test.files[j] = path.Join(dir, test.files[j])
+		}
+		if fmt.Sprint(names) != fmt.Sprint(test.files) {
+			t.Errorf("%d) Expected %v, got %v.", i, test.files, names)
+		}
+	}
+
+	config := &GlobalConfig{TreeType: "LHaloTree"}
+	config.TreeDir = path.Join(dir, "tree.0.hdf5")
+	if _, err := treeFiles(config); err == nil {
+		t.Errorf("Expected error when TreeDir isn't a directory.")
+	}
+}
+
+func TestValidateTreeHaloTypes(t *testing.T) {
+	tests := []struct {
+		treeType, haloType string
+		valid              bool
+	}{
+		{"consistent-trees", "Rockstar-Binary", true},
+		{"Text", "Subfind", true},
+		{"SubLink", "Text", true},
+		{"LHaloTree", "nil", true},
+		{"SubLink", "Subfind", false},
+		{"LHaloTree", "Subfind", false},
+		{"LHaloTree", "AHF", false},
+		{"SubLink", "Rockstar-Binary", false},
+	}
+
+	for i, test := range tests {
+		config := &GlobalConfig{}
+		config.TreeType, config.HaloType = test.treeType, test.haloType
+		err := validateTreeHaloTypes(config)
+		if test.valid && err != nil {
+			t.Errorf("%d) validateTreeHaloTypes returned error: %s",
+				i, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("%d) Expected error for TreeType %s and HaloType %s.",
+				i, test.treeType, test.haloType)
+		}
+	}
+}
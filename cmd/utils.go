@@ -5,9 +5,8 @@ import (
 	"github.com/phil-mansfield/shellfish/io"
 )
 
-func getVectorBuffer(
-	fname string, config *GlobalConfig,
-) (io.VectorBuffer, error) {
+// ioContext returns the io.Context described by config.
+func ioContext(config *GlobalConfig) io.Context {
 	context := io.Context{
 		LGadgetNPartNum: config.LGadgetNpartNum,
 		GadgetDMTypeIndices: config.GadgetDMTypeIndices,
@@ -19,7 +18,59 @@ func getVectorBuffer(
 		NilH100: config.NilSnapH100,
 		NilScaleFactors: config.NilSnapScaleFactors,
 		NilTotalWidth: config.NilSnapTotalWidth,
+		RawHeaderSize: config.RawHeaderSize,
+		RawRecordMarkers: config.RawRecordMarkers,
+		RawHeaderNames: config.RawHeaderNames,
+		RawHeaderOffsets: config.RawHeaderOffsets,
+		RawHeaderTypes: config.RawHeaderTypes,
+		RawHeaderValues: config.RawHeaderValues,
+		RawArrayNames: config.RawArrayNames,
+		RawArrayOffsets: config.RawArrayOffsets,
+		RawArrayTypes: config.RawArrayTypes,
+		RawArrayStrides: config.RawArrayStrides,
+		RawPositionUnits: config.RawPositionUnits,
+		RawVelocityUnits: config.RawVelocityUnits,
+		RawMassUnits: config.RawMassUnits,
+		TipsyKpcUnit: config.TipsyKpcUnit,
+		TipsyMsolUnit: config.TipsyMsolUnit,
+		TipsyOmegaM: config.TipsyOmegaM,
+		TipsyOmegaL: config.TipsyOmegaL,
+		TipsyH100: config.TipsyH100,
+		TipsyFamilies: config.TipsyFamilies,
+		RamsesDMFamilies: config.RamsesDMFamilies,
+		SyntheticTotalWidth: config.SyntheticTotalWidth,
+		SyntheticOmegaM: config.SyntheticOmegaM,
+		SyntheticOmegaL: config.SyntheticOmegaL,
+		SyntheticH100: config.SyntheticH100,
+		SyntheticScaleFactors: config.SyntheticScaleFactors,
+		SyntheticParticles: config.SyntheticParticles,
+		SyntheticBlocks: config.SyntheticBlocks,
+		SyntheticSeed: config.SyntheticSeed,
+		SyntheticCausticContrast: config.SyntheticCausticContrast,
+		SyntheticROuterMult: config.SyntheticROuterMult,
+		SyntheticSubhaloMassRatio: config.SyntheticSubhaloMassRatio,
+		SyntheticHaloXs: config.SyntheticHaloX,
+		SyntheticHaloYs: config.SyntheticHaloY,
+		SyntheticHaloZs: config.SyntheticHaloZ,
+		SyntheticHaloM200ms: config.SyntheticHaloM200m,
+		SyntheticHaloC200ms: config.SyntheticHaloC200m,
+		SyntheticHaloRspMults: config.SyntheticHaloRspMult,
+		SyntheticHaloBAs: config.SyntheticHaloBA,
+		SyntheticHaloCAs: config.SyntheticHaloCA,
+		SyntheticSubhalos: config.SyntheticSubhalos,
+	}
+
+	// Every particle type used by a species needs to be read.
+	if len(config.species) > 0 {
+		context.GadgetDMTypeIndices = speciesTypeIndices(config.species)
 	}
+	return context
+}
+
+func getVectorBuffer(
+	fname string, config *GlobalConfig,
+) (io.VectorBuffer, error) {
+	context := ioContext(config)
 	
 	switch config.SnapshotType {
 	case "gotetra":
@@ -28,12 +79,24 @@ func getVectorBuffer(
 		return io.NewLGadget2Buffer(fname, config.Endianness, context)
 	case "Gadget-2":
 		return io.NewGadget2Buffer(fname, config.Endianness, context)
+	case "HDF5-Gadget":
+		return io.NewHDF5GadgetBuffer(fname, context)
 	case "ARTIO":
 		return io.NewARTIOBuffer(fname)
 	case "Bolshoi":
 		return io.NewBolshoiBuffer(fname, config.Endianness, context)
 	case "BolshoiP":
 		return io.NewBolshoiPBuffer(fname, config.Endianness, context)
+	case "raw":
+		return io.NewRawBuffer(fname, config.Endianness, context)
+	case "TIPSY":
+		return io.NewTipsyBuffer(fname, context)
+	case "RAMSES":
+		return io.NewRamsesBuffer(fname, config.Endianness, context)
+	case "cutout":
+		return io.NewCutoutBuffer(fname)
+	case "synthetic":
+		return io.NewSyntheticBuffer(context)
 	case "nil":
 		return io.NewNilBuffer(context)
 	}
@@ -94,3 +157,34 @@ func (lg *LockGroup) Lock(i int) *Lock {
 func (lg * LockGroup) Synchronize() {
 	for _ = range lg.locks { <- lg.C }
 }
+
+// newPrefetcher creates an io.Prefetcher which reads files with buf and with
+// PrefetchBlocks additional VectorBuffers. fname is the name of any particle
+// file in the simulation.
+func newPrefetcher(
+	buf io.VectorBuffer, fname string, config *GlobalConfig,
+) (*io.Prefetcher, error) {
+	bufs := []io.VectorBuffer{buf}
+	for i := int64(0); i < config.PrefetchBlocks; i++ {
+		b, err := getVectorBuffer(fname, config)
+		if err != nil {
+			return nil, err
+		}
+		bufs = append(bufs, b)
+	}
+	return io.NewPrefetcher(bufs), nil
+}
+
+// usedBlocks returns the indices of the blocks for which used returns true
+// and the names of their files.
+func usedBlocks(
+	files []string, used func(i int) bool,
+) (blocks []int, names []string) {
+	for i := range files {
+		if used(i) {
+			blocks = append(blocks, i)
+			names = append(names, files[i])
+		}
+	}
+	return blocks, names
+}
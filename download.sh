@@ -6,7 +6,6 @@ go get github.com/gonum/internal/asm/c64
 go get github.com/gonum/internal/asm/c128
 go get github.com/gonum/internal/asm/f32
 go get github.com/gonum/internal/asm/f64
-go get github.com/phil-mansfield/consistent_trees
 go get github.com/phil-mansfield/go-artio
 go get github.com/phil-mansfield/shellfish
 go install github.com/phil-mansfield/shellfish
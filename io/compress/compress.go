@@ -0,0 +1,303 @@
+/*
+package compress lets Shellfish read gzip- and zstd-compressed files in the
+same way as uncompressed ones. Compression is detected from the first bytes of
+a file rather than from its name, and compressed files are decompressed as a
+stream, so they don't need to fit in memory.
+*/
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Format is a compression format.
+type Format int
+
+const (
+	None Format = iota
+	Gzip
+	Zstd
+)
+
+func (f Format) String() string {
+	switch f {
+	case None:
+		return "None"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Extensions are the file extensions which are commonly used for compressed
+// files. They are only used to find the names of uncompressed files, not to
+// detect compression.
+var Extensions = []string{".gz", ".zst", ".zstd"}
+
+// Detect returns the format of data which starts with the given bytes. At
+// least four bytes are needed to detect zstd.
+func Detect(magic []byte) Format {
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return Gzip
+	}
+	if len(magic) >= 4 {
+		m := binary.LittleEndian.Uint32(magic)
+		if m == zstdMagic || m&zstdSkippableMask == zstdSkippableMagic {
+			return Zstd
+		}
+	}
+	return None
+}
+
+// FileFormat returns the compression format of the file fname.
+func FileFormat(fname string) (Format, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return None, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return None, err
+	}
+	return Detect(magic[:n]), nil
+}
+
+// NewReader returns a Reader which decompresses rd if it is compressed and
+// returns its contents unchanged otherwise.
+func NewReader(rd io.Reader) (io.Reader, Format, error) {
+	brd := bufio.NewReader(rd)
+	magic, err := brd.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, None, err
+	}
+
+	format := Detect(magic)
+	switch format {
+	case Gzip:
+		zrd, err := gzip.NewReader(brd)
+		if err != nil {
+			return nil, None, err
+		}
+		return &fullReader{zrd}, format, nil
+	case Zstd:
+		return &fullReader{newZstdReader(brd)}, format, nil
+	}
+	return brd, format, nil
+}
+
+// fullReader is a Reader whose Read only returns less data than was asked for
+// at the end of the stream. Some of Shellfish's readers read entire blocks with
+// a single call to Read, which works for files but not for decompressors.
+type fullReader struct {
+	rd io.Reader
+}
+
+func (rd *fullReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := rd.rd.Read(p[n:])
+		n += m
+		if err == io.EOF && n > 0 {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readCloser closes a file after reading from it.
+type readCloser struct {
+	io.Reader
+	f *os.File
+}
+
+func (rc *readCloser) Close() error { return rc.f.Close() }
+
+// Open opens the file fname for reading. If the file is compressed, reads
+// return the decompressed contents.
+func Open(fname string) (io.ReadCloser, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	rd, format, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Could not read the %s-compressed file %s: %s",
+			format, fname, err.Error())
+	} else if format == None {
+		// Seeking to the start is cheaper than going through the bufio.Reader.
+		if _, err = f.Seek(0, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	return &readCloser{rd, f}, nil
+}
+
+// ReadFile returns the contents of the file fname, decompressing it if
+// needed.
+func ReadFile(fname string) ([]byte, error) {
+	f, err := Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bs, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read %s: %s", fname, err.Error())
+	}
+	return bs, nil
+}
+
+// File is an open file which supports both sequential and random access.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// OpenFile opens the file fname for random access. Uncompressed files are
+// returned as *os.Files. Compressed streams can't be seeked, so ReadAt
+// decompresses until it reaches the requested offset. This is as fast as
+// reading an uncompressed file if offsets are read in increasing order, but
+// going backwards means decompressing the file again from the start.
+func OpenFile(fname string) (File, error) {
+	format, err := FileFormat(fname)
+	if err != nil {
+		return nil, err
+	} else if format == None {
+		return os.Open(fname)
+	}
+
+	sf := &streamFile{fname: fname}
+	if err := sf.reopen(); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// IsCompressed returns true if the file fname is compressed.
+func IsCompressed(fname string) (bool, error) {
+	format, err := FileFormat(fname)
+	return format != None, err
+}
+
+// streamFile is a File that reads a compressed stream.
+type streamFile struct {
+	fname string
+	rc    io.ReadCloser
+	// off is the offset of the next decompressed byte in rc.
+	off int64
+}
+
+func (sf *streamFile) reopen() error {
+	if sf.rc != nil {
+		sf.rc.Close()
+	}
+	rc, err := Open(sf.fname)
+	if err != nil {
+		return err
+	}
+	sf.rc, sf.off = rc, 0
+	return nil
+}
+
+func (sf *streamFile) Read(p []byte) (int, error) {
+	n, err := sf.rc.Read(p)
+	sf.off += int64(n)
+	return n, err
+}
+
+func (sf *streamFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < sf.off {
+		if err := sf.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	if off > sf.off {
+		n, err := io.CopyN(ioutil.Discard, sf.rc, off-sf.off)
+		sf.off += n
+		if err == io.EOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := io.ReadFull(sf, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (sf *streamFile) Close() error { return sf.rc.Close() }
+
+// TrimExt removes a compression extension from the end of fname, if it has
+// one.
+func TrimExt(fname string) string {
+	for _, ext := range Extensions {
+		if strings.HasSuffix(fname, ext) {
+			return fname[:len(fname)-len(ext)]
+		}
+	}
+	return fname
+}
+
+// Decompress is used by code which can only read from uncompressed files on
+// disk. If fname is compressed, Decompress writes its contents to a temporary
+// file in dir (or the default temporary directory if dir is "") and returns
+// the name of that file along with a function that removes it. Otherwise fname
+// is returned unchanged.
+func Decompress(fname, dir string) (string, func(), error) {
+	format, err := FileFormat(fname)
+	if err != nil {
+		return "", nil, err
+	} else if format == None {
+		return fname, func() {}, nil
+	}
+
+	rd, err := Open(fname)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rd.Close()
+
+	f, err := ioutil.TempFile(dir, path.Base(TrimExt(fname))+".")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+
+	wr := bufio.NewWriter(f)
+	if _, err = io.Copy(wr, rd); err == nil {
+		err = wr.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("Could not decompress %s: %s",
+			fname, err.Error())
+	}
+	return f.Name(), remove, nil
+}
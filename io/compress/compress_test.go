@@ -0,0 +1,213 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// smallZstd is smallText compressed with zstd -19.
+const smallZstd = "28b52ffd0468ed0000a85368656c6c666973682073706c6173686261636b0a" +
+	"02002e06aa58901ea79346"
+
+const smallText = "Shellfish Shellfish Shellfish Shellfish splashback splashback\n"
+
+func TestZstdFrame(t *testing.T) {
+	frame, _ := hex.DecodeString(smallZstd)
+	if f := Detect(frame); f != Zstd {
+		t.Fatalf("Detect returned %s for a zstd frame.", f)
+	}
+
+	rd, _, err := NewReader(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("Could not decompress frame: %s", err.Error())
+	} else if string(out) != smallText {
+		t.Errorf("Expected %q, got %q.", smallText, out)
+	}
+
+	// Concatenated frames and skippable frames.
+	skip := []byte{0x5e, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}
+	in := append(append(append([]byte{}, frame...), skip...), frame...)
+	rd, _, err = NewReader(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err = ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("Could not decompress frames: %s", err.Error())
+	} else if string(out) != smallText+smallText {
+		t.Errorf("Expected %q, got %q.", smallText+smallText, out)
+	}
+
+	// A corrupted checksum.
+	bad := append([]byte{}, frame...)
+	bad[len(bad)-1] ^= 1
+	rd, _, _ = NewReader(bytes.NewReader(bad))
+	if _, err = ioutil.ReadAll(rd); err == nil {
+		t.Errorf("Expected error for a bad checksum.")
+	}
+
+	// A truncated frame.
+	rd, _, _ = NewReader(bytes.NewReader(frame[:len(frame)-6]))
+	if _, err = ioutil.ReadAll(rd); err == nil {
+		t.Errorf("Expected error for a truncated frame.")
+	}
+}
+
+// testData returns several kinds of data which exercise different parts of
+// the compressors.
+func testData() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+
+	random := make([]byte, 300<<10)
+	r.Read(random)
+
+	text := &bytes.Buffer{}
+	for i := 0; i < 60000; i++ {
+		fmt.Fprintf(text, "%d %.4f %.4f\n", i, r.Float64(), r.NormFloat64())
+	}
+
+	runs := make([]byte, 500<<10)
+	for i := range runs {
+		runs[i] = byte(i / 1000)
+	}
+
+	return map[string][]byte{
+		"empty": {}, "random": random, "text": text.Bytes(), "runs": runs,
+		"short": []byte(smallText),
+	}
+}
+
+func TestZstdCommand(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("The zstd command isn't installed.")
+	}
+
+	dir, err := ioutil.TempDir("", "shellfish_compress")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range testData() {
+		in := path.Join(dir, name)
+		if err := ioutil.WriteFile(in, data, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, flags := range [][]string{
+			{"-1"}, {"-3"}, {"-9"}, {"-19"}, {"--ultra", "-22"},
+			{"--no-check"}, {"--long=24"}, {"-3", "--no-content-size"},
+		} {
+			out := in + ".zst"
+			args := append(append([]string{"-q", "-f"}, flags...),
+				in, "-o", out)
+			if msg, err := exec.Command("zstd", args...).CombinedOutput(); err != nil {
+				t.Fatalf("zstd %v failed: %s", args, msg)
+			}
+
+			if f, err := FileFormat(out); err != nil || f != Zstd {
+				t.Errorf("%s %v: FileFormat returned %s, %v.", name, flags, f, err)
+			}
+			got, err := ReadFile(out)
+			if err != nil {
+				t.Errorf("%s %v: ReadFile returned error: %s",
+					name, flags, err.Error())
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s %v: decompressed %d bytes, but they don't "+
+					"match the %d original bytes.", name, flags,
+					len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	for name, data := range testData() {
+		buf := &bytes.Buffer{}
+		wr := gzip.NewWriter(buf)
+		wr.Write(data)
+		wr.Close()
+
+		rd, format, err := NewReader(buf)
+		if err != nil || format != Gzip {
+			t.Fatalf("%s: NewReader returned %s, %v.", name, format, err)
+		}
+		got, err := ioutil.ReadAll(rd)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: gzip data didn't round trip, %v.", name, err)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_compress")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	data := testData()["text"]
+	plain, gz := path.Join(dir, "data.txt"), path.Join(dir, "data.txt.gz")
+	if err := ioutil.WriteFile(plain, data, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	buf := &bytes.Buffer{}
+	wr := gzip.NewWriter(buf)
+	wr.Write(data)
+	wr.Close()
+	if err := ioutil.WriteFile(gz, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, fname := range []string{plain, gz} {
+		f, err := OpenFile(fname)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// Forwards, backwards, and overlapping reads.
+		for _, off := range []int{10, 5000, 5000, 20, 100000, len(data) - 8} {
+			p := make([]byte, 8)
+			if _, err := f.ReadAt(p, int64(off)); err != nil {
+				t.Errorf("%s: ReadAt(%d) returned error: %s",
+					fname, off, err.Error())
+			} else if !bytes.Equal(p, data[off:off+8]) {
+				t.Errorf("%s: ReadAt(%d) returned %q, expected %q.",
+					fname, off, p, data[off:off+8])
+			}
+		}
+		if _, err := f.ReadAt(make([]byte, 8), int64(len(data)-4)); err == nil {
+			t.Errorf("%s: Expected error when reading past the end.", fname)
+		}
+		f.Close()
+	}
+
+	if TrimExt(gz) != plain || TrimExt(plain) != plain {
+		t.Errorf("TrimExt(%s) = %s.", gz, TrimExt(gz))
+	}
+
+	name, remove, err := Decompress(gz, dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	got, err := ioutil.ReadFile(name)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Decompress wrote the wrong data.")
+	}
+	remove()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Decompress's temporary file wasn't removed.")
+	}
+}
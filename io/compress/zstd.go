@@ -0,0 +1,927 @@
+package compress
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// This file contains a streaming zstd decoder. It follows RFC 8878 and the
+// reference implementation, and supports everything that the zstd command
+// line tool writes except dictionaries.
+
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+	zstdSkippableMask  = 0xfffffff0
+
+	zstdMaxBlockSize = 128 << 10
+	// zstdMaxWindow is the largest window that will be allocated. This is the
+	// same as the default limit of the reference decoder.
+	zstdMaxWindow = 1 << 27
+)
+
+var errZstdCorrupt = errors.New("zstd stream is corrupt")
+
+// zstdReader decompresses a sequence of zstd frames.
+type zstdReader struct {
+	rd  *bufio.Reader
+	err error
+
+	inFrame  bool
+	window   int
+	checksum bool
+	hash     xxh64
+
+	// out contains the decompressed data. Everything before start is
+	// history which can be referred to by later matches, and out[pos:] hasn't
+	// been returned by Read yet.
+	out        []byte
+	start, pos int
+
+	block []byte
+	lits  []byte
+
+	// Tables and offsets which can be reused by later blocks in a frame.
+	huff   *huffTable
+	tables [3]*fseTable
+	rep    [3]int
+}
+
+func newZstdReader(rd io.Reader) *zstdReader {
+	return &zstdReader{rd: bufio.NewReader(rd)}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.pos == len(z.out) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.out[z.pos:])
+	z.pos += n
+	return n, nil
+}
+
+// next decodes the next block, starting a new frame if needed. It returns
+// io.EOF at the end of the last frame.
+func (z *zstdReader) next() error {
+	if !z.inFrame {
+		if err := z.readFrameHeader(); err != nil {
+			return err
+		}
+	}
+
+	// Only the last window of data needs to be kept. It's only moved once
+	// the buffer has doubled so that each byte is copied at most once.
+	if len(z.out) > 2*z.window+zstdMaxBlockSize {
+		drop := len(z.out) - z.window
+		z.out = z.out[:copy(z.out, z.out[drop:])]
+		z.pos -= drop
+	}
+
+	var hd [3]byte
+	if _, err := io.ReadFull(z.rd, hd[:]); err != nil {
+		return unexpected(err)
+	}
+	v := uint32(hd[0]) | uint32(hd[1])<<8 | uint32(hd[2])<<16
+	last, typ, size := v&1 == 1, (v>>1)&3, int(v>>3)
+
+	start := len(z.out)
+	switch typ {
+	case 0:
+		if size > zstdMaxBlockSize {
+			return errZstdCorrupt
+		}
+		z.out = grow(z.out, size)
+		if _, err := io.ReadFull(z.rd, z.out[start:]); err != nil {
+			return unexpected(err)
+		}
+	case 1:
+		if size > zstdMaxBlockSize {
+			return errZstdCorrupt
+		}
+		b, err := z.rd.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		z.out = grow(z.out, size)
+		for i := start; i < len(z.out); i++ {
+			z.out[i] = b
+		}
+	case 2:
+		if size > zstdMaxBlockSize {
+			return errZstdCorrupt
+		}
+		z.block = grow(z.block[:0], size)
+		if _, err := io.ReadFull(z.rd, z.block); err != nil {
+			return unexpected(err)
+		}
+		if err := z.decodeBlock(z.block); err != nil {
+			return err
+		}
+	default:
+		return errZstdCorrupt
+	}
+
+	if z.checksum {
+		z.hash.Write(z.out[start:])
+	}
+	if last {
+		z.inFrame = false
+		if z.checksum {
+			var sum [4]byte
+			if _, err := io.ReadFull(z.rd, sum[:]); err != nil {
+				return unexpected(err)
+			}
+			if binary.LittleEndian.Uint32(sum[:]) != uint32(z.hash.Sum64()) {
+				return fmt.Errorf("zstd checksum doesn't match the data")
+			}
+		}
+	}
+	return nil
+}
+
+// readFrameHeader reads frame headers until it finds one which isn't a
+// skippable frame.
+func (z *zstdReader) readFrameHeader() error {
+	var buf [8]byte
+	for {
+		if _, err := io.ReadFull(z.rd, buf[:4]); err != nil {
+			if err == io.EOF {
+				return io.EOF
+			}
+			return unexpected(err)
+		}
+		magic := binary.LittleEndian.Uint32(buf[:4])
+		if magic == zstdMagic {
+			break
+		} else if magic&zstdSkippableMask != zstdSkippableMagic {
+			return fmt.Errorf("Data isn't a zstd frame.")
+		}
+
+		if _, err := io.ReadFull(z.rd, buf[:4]); err != nil {
+			return unexpected(err)
+		}
+		n := int64(binary.LittleEndian.Uint32(buf[:4]))
+		if _, err := io.CopyN(io.Discard, z.rd, n); err != nil {
+			return unexpected(err)
+		}
+	}
+
+	fhd, err := z.rd.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	fcsFlag, single := fhd>>6, fhd&(1<<5) != 0
+	if fhd&(1<<3) != 0 {
+		return errZstdCorrupt
+	}
+	z.checksum = fhd&(1<<2) != 0
+
+	if !single {
+		wd, err := z.rd.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		base := 1 << (10 + uint(wd>>3))
+		z.window = base + (base/8)*int(wd&7)
+	}
+
+	dictSize := []int{0, 1, 2, 4}[fhd&3]
+	fcsSize := []int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && single {
+		fcsSize = 1
+	}
+	if _, err := io.ReadFull(z.rd, buf[:dictSize]); err != nil {
+		return unexpected(err)
+	}
+	for _, b := range buf[:dictSize] {
+		if b != 0 {
+			return fmt.Errorf("zstd dictionaries aren't supported.")
+		}
+	}
+	for i := range buf {
+		buf[i] = 0
+	}
+	if _, err := io.ReadFull(z.rd, buf[:fcsSize]); err != nil {
+		return unexpected(err)
+	}
+	fcs := binary.LittleEndian.Uint64(buf[:])
+	if fcsSize == 2 {
+		fcs += 256
+	}
+	if single {
+		if fcs > zstdMaxWindow {
+			return fmt.Errorf("zstd frame is too large to decompress.")
+		}
+		z.window = int(fcs)
+	}
+	if z.window > zstdMaxWindow {
+		return fmt.Errorf("zstd window size is %d bytes, but the largest "+
+			"supported size is %d bytes.", z.window, zstdMaxWindow)
+	}
+
+	z.inFrame = true
+	z.hash.Reset()
+	z.huff = nil
+	z.tables = [3]*fseTable{}
+	z.rep = [3]int{1, 4, 8}
+	// Matches can't refer to earlier frames.
+	z.out = z.out[:copy(z.out, z.out[z.pos:])]
+	z.pos = 0
+	return nil
+}
+
+// unexpected converts the EOF errors returned when the stream ends early
+// into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// grow extends buf by n bytes.
+func grow(buf []byte, n int) []byte {
+	if len(buf)+n <= cap(buf) {
+		return buf[:len(buf)+n]
+	}
+	out := make([]byte, len(buf)+n, 2*cap(buf)+n)
+	copy(out, buf)
+	return out
+}
+
+func (z *zstdReader) decodeBlock(src []byte) error {
+	n, err := z.decodeLiterals(src)
+	if err != nil {
+		return err
+	}
+	return z.decodeSequences(src[n:])
+}
+
+//////////////
+// Literals //
+//////////////
+
+// decodeLiterals decodes the literals section of a compressed block into
+// z.lits and returns its size.
+func (z *zstdReader) decodeLiterals(src []byte) (int, error) {
+	if len(src) < 5 {
+		// Every block ends in a sequences section, so there's room to read
+		// the longest header.
+		src = append(src[:len(src):len(src)], 0, 0, 0, 0)
+	}
+	typ, sf := src[0]&3, (src[0]>>2)&3
+
+	if typ < 2 {
+		var size, hl int
+		switch sf {
+		case 0, 2:
+			size, hl = int(src[0]>>3), 1
+		case 1:
+			size, hl = int(src[0]>>4)|int(src[1])<<4, 2
+		case 3:
+			size, hl = int(src[0]>>4)|int(src[1])<<4|int(src[2])<<12, 3
+		}
+
+		if typ == 0 {
+			if len(src) < hl+size {
+				return 0, errZstdCorrupt
+			}
+			z.lits = append(z.lits[:0], src[hl:hl+size]...)
+			return hl + size, nil
+		}
+		z.lits = grow(z.lits[:0], size)
+		for i := range z.lits {
+			z.lits[i] = src[hl]
+		}
+		return hl + 1, nil
+	}
+
+	var regen, comp, hl int
+	streams := 4
+	switch sf {
+	case 0, 1:
+		if sf == 0 {
+			streams = 1
+		}
+		hl = 3
+		regen = int(src[0]>>4) | int(src[1]&0x3f)<<4
+		comp = int(src[1]>>6) | int(src[2])<<2
+	case 2:
+		hl = 4
+		regen = int(src[0]>>4) | int(src[1])<<4 | int(src[2]&3)<<12
+		comp = int(src[2]>>2) | int(src[3])<<6
+	case 3:
+		hl = 5
+		regen = int(src[0]>>4) | int(src[1])<<4 | int(src[2]&0x3f)<<12
+		comp = int(src[2]>>6) | int(src[3])<<2 | int(src[4])<<10
+	}
+	if len(src) < hl+comp || regen > zstdMaxBlockSize {
+		return 0, errZstdCorrupt
+	}
+	data := src[hl : hl+comp]
+
+	if typ == 2 {
+		h, n, err := readHuffTable(data)
+		if err != nil {
+			return 0, err
+		}
+		z.huff, data = h, data[n:]
+	} else if z.huff == nil {
+		return 0, errZstdCorrupt
+	}
+
+	z.lits = grow(z.lits[:0], regen)
+	if streams == 1 {
+		if err := z.huff.decode(z.lits, data); err != nil {
+			return 0, err
+		}
+		return hl + comp, nil
+	}
+
+	if len(data) < 6 {
+		return 0, errZstdCorrupt
+	}
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(data[0:])),
+		int(binary.LittleEndian.Uint16(data[2:])),
+		int(binary.LittleEndian.Uint16(data[4:])),
+	}
+	sizes[3] = len(data) - 6 - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return 0, errZstdCorrupt
+	}
+	data = data[6:]
+
+	seg := (regen + 3) / 4
+	for i := 0; i < 4; i++ {
+		lo, hi := i*seg, (i+1)*seg
+		if i == 3 {
+			hi = regen
+		}
+		if lo > hi {
+			return 0, errZstdCorrupt
+		}
+		if err := z.huff.decode(z.lits[lo:hi], data[:sizes[i]]); err != nil {
+			return 0, err
+		}
+		data = data[sizes[i]:]
+	}
+	return hl + comp, nil
+}
+
+// huffTable is a Huffman decoding table indexed by the next maxBits bits of
+// a stream.
+type huffTable struct {
+	maxBits uint
+	entries []huffEntry
+}
+
+type huffEntry struct {
+	sym, nbBits uint8
+}
+
+// readHuffTable reads a Huffman tree description and returns its size.
+func readHuffTable(src []byte) (*huffTable, int, error) {
+	if len(src) == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+
+	var weights []uint8
+	n := 0
+	if hb := int(src[0]); hb < 128 {
+		if len(src) < 1+hb {
+			return nil, 0, errZstdCorrupt
+		}
+		var err error
+		if weights, err = decodeHuffWeights(src[1 : 1+hb]); err != nil {
+			return nil, 0, err
+		}
+		n = 1 + hb
+	} else {
+		nw := hb - 127
+		n = 1 + (nw+1)/2
+		if len(src) < n {
+			return nil, 0, errZstdCorrupt
+		}
+		weights = make([]uint8, nw)
+		for i := range weights {
+			if b := src[1+i/2]; i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 15
+			}
+		}
+	}
+
+	// The last weight is implied by the others, since the total has to be a
+	// power of two.
+	total := 0
+	for _, w := range weights {
+		if w > 11 {
+			return nil, 0, errZstdCorrupt
+		} else if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	maxBits := uint(bits.Len(uint(total)))
+	left := 1<<maxBits - total
+	if maxBits > 11 || left&(left-1) != 0 || len(weights) > 255 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, uint8(bits.Len(uint(left))))
+
+	// Codes are assigned in order of increasing weight, and then in order of
+	// increasing symbol.
+	h := &huffTable{maxBits: maxBits, entries: make([]huffEntry, 1<<maxBits)}
+	pos := 0
+	for w := uint8(1); w <= uint8(maxBits); w++ {
+		for sym, sw := range weights {
+			if sw != w {
+				continue
+			}
+			e := huffEntry{uint8(sym), uint8(maxBits) + 1 - w}
+			for i := 0; i < 1<<(w-1); i++ {
+				h.entries[pos+i] = e
+			}
+			pos += 1 << (w - 1)
+		}
+	}
+
+	return h, n, nil
+}
+
+// decodeHuffWeights decodes FSE-compressed Huffman weights.
+func decodeHuffWeights(src []byte) ([]uint8, error) {
+	t, n, err := readFSETable(src, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+	br, err := newBackwardReader(src[n:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The weights are split between two interleaved states.
+	s1, s2 := br.read(t.log), br.read(t.log)
+	out := []uint8{}
+	for len(out) < 255 {
+		out = append(out, t.entries[s1].sym)
+		s1 = t.update(s1, br)
+		if br.pos < 0 {
+			out = append(out, t.entries[s2].sym)
+			return out, nil
+		}
+
+		out = append(out, t.entries[s2].sym)
+		s2 = t.update(s2, br)
+		if br.pos < 0 {
+			out = append(out, t.entries[s1].sym)
+			return out, nil
+		}
+	}
+	return nil, errZstdCorrupt
+}
+
+// decode decodes one Huffman stream, which must contain exactly len(dst)
+// symbols.
+func (h *huffTable) decode(dst, src []byte) error {
+	br, err := newBackwardReader(src)
+	if err != nil {
+		return err
+	}
+	for i := range dst {
+		e := h.entries[br.peek(h.maxBits)]
+		dst[i] = e.sym
+		br.pos -= int(e.nbBits)
+	}
+	if br.pos != 0 {
+		return errZstdCorrupt
+	}
+	return nil
+}
+
+///////////////
+// Sequences //
+///////////////
+
+const (
+	llKind = iota
+	ofKind
+	mlKind
+)
+
+var (
+	seqMaxSym = [3]int{35, 31, 52}
+	seqMaxLog = [3]uint{9, 8, 9}
+
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048,
+		4096, 8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	}
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	// predefinedTables are the default distributions used by the predefined
+	// sequence compression mode.
+	predefinedTables = [3]*fseTable{
+		buildFSETable([]int16{
+			4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+			2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+			-1, -1, -1, -1,
+		}, 6),
+		buildFSETable([]int16{
+			1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+		}, 5),
+		buildFSETable([]int16{
+			1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+			-1, -1, -1, -1, -1,
+		}, 6),
+	}
+)
+
+// decodeSequences decodes the sequences section of a compressed block and
+// executes the sequences, appending the block's contents to z.out.
+func (z *zstdReader) decodeSequences(src []byte) error {
+	if len(src) == 0 {
+		return errZstdCorrupt
+	}
+	nSeq, i := int(src[0]), 1
+	switch {
+	case nSeq == 0:
+		z.out = append(z.out, z.lits...)
+		return nil
+	case nSeq < 128:
+	case nSeq < 255:
+		if len(src) < 2 {
+			return errZstdCorrupt
+		}
+		nSeq, i = (nSeq-128)<<8|int(src[1]), 2
+	default:
+		if len(src) < 3 {
+			return errZstdCorrupt
+		}
+		nSeq, i = int(src[1])|int(src[2])<<8+0x7f00, 3
+	}
+
+	if len(src) <= i || src[i]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := src[i]
+	i++
+	for kind := llKind; kind <= mlKind; kind++ {
+		mode := (modes >> uint(6-2*kind)) & 3
+		n, err := z.readSeqTable(kind, mode, src[i:])
+		if err != nil {
+			return err
+		}
+		i += n
+	}
+	ll, of, ml := z.tables[llKind], z.tables[ofKind], z.tables[mlKind]
+
+	br, err := newBackwardReader(src[i:])
+	if err != nil {
+		return err
+	}
+	llS, ofS, mlS := br.read(ll.log), br.read(of.log), br.read(ml.log)
+
+	lits := z.lits
+	for s := 0; s < nSeq; s++ {
+		ofCode := uint(of.entries[ofS].sym)
+		mlCode := ml.entries[mlS].sym
+		llCode := ll.entries[llS].sym
+		if ofCode > 31 || int(mlCode) > seqMaxSym[mlKind] ||
+			int(llCode) > seqMaxSym[llKind] {
+			return errZstdCorrupt
+		}
+
+		ofVal := int(1<<ofCode + br.read(ofCode))
+		mLen := int(mlBase[mlCode]) + int(br.read(uint(mlBits[mlCode])))
+		lLen := int(llBase[llCode]) + int(br.read(uint(llBits[llCode])))
+
+		if s < nSeq-1 {
+			llS = ll.update(llS, br)
+			mlS = ml.update(mlS, br)
+			ofS = of.update(ofS, br)
+		}
+
+		offset, err := z.offset(ofVal, lLen)
+		if err != nil {
+			return err
+		}
+
+		if lLen > len(lits) {
+			return errZstdCorrupt
+		}
+		z.out = append(z.out, lits[:lLen]...)
+		lits = lits[lLen:]
+
+		if offset > len(z.out) {
+			return errZstdCorrupt
+		}
+		src := len(z.out) - offset
+		if offset >= mLen {
+			z.out = append(z.out, z.out[src:src+mLen]...)
+		} else {
+			// Overlapping matches repeat the last offset bytes.
+			for j := 0; j < mLen; j++ {
+				z.out = append(z.out, z.out[src+j])
+			}
+		}
+	}
+	if br.pos != 0 {
+		return errZstdCorrupt
+	}
+
+	z.out = append(z.out, lits...)
+	return nil
+}
+
+// offset converts an offset value into a distance and updates the repeat
+// offsets.
+func (z *zstdReader) offset(ofVal, lLen int) (int, error) {
+	rep := &z.rep
+	if ofVal > 3 {
+		offset := ofVal - 3
+		rep[0], rep[1], rep[2] = offset, rep[0], rep[1]
+		return offset, nil
+	}
+
+	idx := ofVal - 1
+	if lLen == 0 {
+		idx++
+	}
+	switch idx {
+	case 0:
+		return rep[0], nil
+	case 1:
+		rep[0], rep[1] = rep[1], rep[0]
+		return rep[0], nil
+	}
+
+	offset := rep[0] - 1
+	if idx == 2 {
+		offset = rep[2]
+	}
+	if offset == 0 {
+		return 0, errZstdCorrupt
+	}
+	rep[0], rep[1], rep[2] = offset, rep[0], rep[1]
+	return offset, nil
+}
+
+// readSeqTable reads the table used for one kind of sequence symbol and
+// returns the size of its description.
+func (z *zstdReader) readSeqTable(kind int, mode uint8, src []byte) (int, error) {
+	switch mode {
+	case 0:
+		z.tables[kind] = predefinedTables[kind]
+		return 0, nil
+	case 1:
+		if len(src) == 0 || int(src[0]) > seqMaxSym[kind] {
+			return 0, errZstdCorrupt
+		}
+		z.tables[kind] = &fseTable{entries: []fseEntry{{sym: src[0]}}}
+		return 1, nil
+	case 2:
+		t, n, err := readFSETable(src, seqMaxSym[kind], seqMaxLog[kind])
+		if err != nil {
+			return 0, err
+		}
+		z.tables[kind] = t
+		return n, nil
+	}
+
+	if z.tables[kind] == nil {
+		return 0, errZstdCorrupt
+	}
+	return 0, nil
+}
+
+/////////
+// FSE //
+/////////
+
+// fseTable is a finite state entropy decoding table.
+type fseTable struct {
+	log     uint
+	entries []fseEntry
+}
+
+type fseEntry struct {
+	sym      uint8
+	nbBits   uint8
+	newState uint16
+}
+
+// update returns the state which follows state.
+func (t *fseTable) update(state uint64, br *backwardReader) uint64 {
+	e := t.entries[state]
+	return uint64(e.newState) + br.read(uint(e.nbBits))
+}
+
+// readFSETable reads an FSE table description and returns its size.
+func readFSETable(src []byte, maxSym int, maxLog uint) (*fseTable, int, error) {
+	pos := 0
+	read := func(n uint) int {
+		v := bitsAt(src, pos, n)
+		pos += int(n)
+		return int(v)
+	}
+
+	log := uint(read(4)) + 5
+	if log > maxLog {
+		return nil, 0, errZstdCorrupt
+	}
+	remaining, threshold, nBits := 1<<log+1, 1<<log, log+1
+
+	counts := []int16{}
+	prev0 := false
+	for remaining > 1 && len(counts) <= maxSym {
+		if prev0 {
+			for {
+				r := read(2)
+				for i := 0; i < r; i++ {
+					counts = append(counts, 0)
+				}
+				if r != 3 {
+					break
+				}
+			}
+			if len(counts) > maxSym {
+				return nil, 0, errZstdCorrupt
+			}
+		}
+
+		// Small values take one fewer bit.
+		max := 2*threshold - 1 - remaining
+		count := int(bitsAt(src, pos, nBits-1))
+		if count < max {
+			pos += int(nBits) - 1
+		} else {
+			count = int(bitsAt(src, pos, nBits))
+			if count >= threshold {
+				count -= max
+			}
+			pos += int(nBits)
+		}
+		count--
+
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, int16(count))
+		prev0 = count == 0
+		for remaining < threshold && remaining > 1 {
+			nBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || pos > 8*len(src) {
+		return nil, 0, errZstdCorrupt
+	}
+
+	t := buildFSETable(counts, log)
+	if t == nil {
+		return nil, 0, errZstdCorrupt
+	}
+	return t, (pos + 7) / 8, nil
+}
+
+// buildFSETable builds a decoding table from the normalized counts of each
+// symbol. A count of -1 means that the symbol has a "less than one"
+// probability. nil is returned if the counts are invalid.
+func buildFSETable(counts []int16, log uint) *fseTable {
+	size := 1 << log
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+	next := make([]int, len(counts))
+
+	high := size - 1
+	for s, c := range counts {
+		if c == -1 {
+			t.entries[high].sym = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = int(c)
+		}
+	}
+
+	step, mask, pos := size>>1+size>>3+3, size-1, 0
+	for s, c := range counts {
+		for i := 0; i < int(c); i++ {
+			t.entries[pos].sym = uint8(s)
+			for pos = (pos + step) & mask; pos > high; {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 {
+		return nil
+	}
+
+	for u := range t.entries {
+		e := &t.entries[u]
+		ns := next[e.sym]
+		next[e.sym]++
+		if ns == 0 {
+			return nil
+		}
+		nb := log + 1 - uint(bits.Len(uint(ns)))
+		e.nbBits = uint8(nb)
+		e.newState = uint16(ns<<nb - size)
+	}
+	return t
+}
+
+//////////////
+// Bitreams //
+//////////////
+
+// backwardReader reads a bitstream from its end towards its start, which is
+// how zstd's entropy-coded streams are stored.
+type backwardReader struct {
+	src []byte
+	// pos is the number of bits which haven't been read yet. It becomes
+	// negative if the stream is overread, in which case zeros are returned.
+	pos int
+}
+
+func newBackwardReader(src []byte) (*backwardReader, error) {
+	if len(src) == 0 || src[len(src)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	// The highest set bit marks the end of the stream.
+	last := src[len(src)-1]
+	return &backwardReader{src, 8*(len(src)-1) + bits.Len8(last) - 1}, nil
+}
+
+// peek returns the next n bits without reading them.
+func (br *backwardReader) peek(n uint) uint64 {
+	return bitsAt(br.src, br.pos-int(n), n)
+}
+
+// read reads n bits. The first bit read is the most significant.
+func (br *backwardReader) read(n uint) uint64 {
+	br.pos -= int(n)
+	return bitsAt(br.src, br.pos, n)
+}
+
+// bitsAt returns the n <= 56 bits starting at bit pos, where bits are
+// numbered from the least significant bit of src[0]. Bits outside of src are
+// zero.
+func bitsAt(src []byte, pos int, n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	shift := uint(0)
+	if pos < 0 {
+		if pos+int(n) <= 0 {
+			return 0
+		}
+		shift = uint(-pos)
+		n -= shift
+		pos = 0
+	}
+
+	i := pos >> 3
+	var x uint64
+	if i+8 <= len(src) {
+		x = binary.LittleEndian.Uint64(src[i:])
+	} else {
+		for j := len(src) - 1; j >= i; j-- {
+			x = x<<8 | uint64(src[j])
+		}
+	}
+	x >>= uint(pos & 7)
+	return (x & (1<<n - 1)) << shift
+}
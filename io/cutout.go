@@ -0,0 +1,253 @@
+package io
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// cutoutMagic is the first eight bytes of every cutout file.
+var cutoutMagic = [8]byte{'S', 'F', 'C', 'U', 'T', 'O', 'U', 'T'}
+
+const cutoutVersion = 1
+
+// cutoutOrder is the byte order of cutout files. It's fixed so that cutouts
+// can be moved between machines.
+var cutoutOrder = binary.LittleEndian
+
+// cutoutHeader is the header at the start of a cutout file. It is followed by
+// NHalos CutoutHalos and then by the positions, velocities, masses, and IDs of
+// the N particles, each stored as a contiguous array.
+type cutoutHeader struct {
+	Magic                               [8]byte
+	Version                             int64
+	Z, OmegaM, OmegaL, H100, TotalWidth float64
+	MinMass                             float64
+	Origin, Width                       [3]float32
+	NHalos, N                           int64
+}
+
+// CutoutHalo describes one of the halos in a cutout file.
+type CutoutHalo struct {
+	ID, Snap   int64
+	X, Y, Z, R float64
+	// The halo's particles are the N particles starting at index Start.
+	Start, N int64
+}
+
+// Cutout is the contents of a cutout file: the particles around a set of
+// halos in a single snapshot. Particles within the radius of several halos
+// are only stored once, with the first of them, so a cutout file can be
+// analyzed in the same way as any other particle file.
+type Cutout struct {
+	Cosmo      CosmologyHeader
+	TotalWidth float64
+	// MinMass is the minimum particle mass of the original simulation.
+	MinMass float32
+	Halos   []CutoutHalo
+	Xs, Vs  [][3]float32
+	Ms      []float32
+	IDs     []int64
+}
+
+// WriteCutout writes a Cutout to the file fname.
+func WriteCutout(fname string, c *Cutout) error {
+	n := len(c.Xs)
+	if len(c.Vs) != n || len(c.Ms) != n || len(c.IDs) != n {
+		panic("Cutout arrays have different lengths.")
+	}
+
+	hd := cutoutHeader{
+		Magic:      cutoutMagic,
+		Version:    cutoutVersion,
+		Z:          c.Cosmo.Z,
+		OmegaM:     c.Cosmo.OmegaM,
+		OmegaL:     c.Cosmo.OmegaL,
+		H100:       c.Cosmo.H100,
+		TotalWidth: c.TotalWidth,
+		MinMass:    float64(c.MinMass),
+		NHalos:     int64(len(c.Halos)),
+		N:          int64(n),
+	}
+	if n > 0 {
+		hd.Origin, hd.Width = boundingBox(c.Xs, c.TotalWidth)
+	}
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	wr := bufio.NewWriter(f)
+
+	for _, x := range []interface{}{&hd, c.Halos, c.Xs, c.Vs, c.Ms, c.IDs} {
+		if err = binary.Write(wr, cutoutOrder, x); err != nil {
+			return err
+		}
+	}
+	if err = wr.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readCutoutHeader reads the header of a cutout file and leaves f at the
+// start of the halo table.
+func readCutoutHeader(f io.Reader, fname string) (*cutoutHeader, error) {
+	hd := &cutoutHeader{}
+	if err := binary.Read(f, cutoutOrder, hd); err != nil {
+		return nil, fmt.Errorf("Could not read the header of the cutout "+
+			"file %s: %s", fname, err.Error())
+	}
+	if hd.Magic != cutoutMagic {
+		return nil, fmt.Errorf("%s is not a cutout file.", fname)
+	} else if hd.Version != cutoutVersion {
+		return nil, fmt.Errorf("The cutout file %s has version %d, but "+
+			"this version of Shellfish can only read version %d.",
+			fname, hd.Version, cutoutVersion)
+	}
+	return hd, nil
+}
+
+// ReadCutoutHalos returns the halos stored in a cutout file.
+func ReadCutoutHalos(fname string) ([]CutoutHalo, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hd, err := readCutoutHeader(f, fname)
+	if err != nil {
+		return nil, err
+	}
+	halos := make([]CutoutHalo, hd.NHalos)
+	if err = binary.Read(f, cutoutOrder, halos); err != nil {
+		return nil, err
+	}
+	return halos, nil
+}
+
+// CutoutBuffer reads the cutout files written by shellfish cutout.
+type CutoutBuffer struct {
+	open   bool
+	mass   float32
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+}
+
+func NewCutoutBuffer(path string) (VectorBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hd, err := readCutoutHeader(f, path)
+	if err != nil {
+		return nil, err
+	}
+	return &CutoutBuffer{mass: float32(hd.MinMass)}, nil
+}
+
+func (buf *CutoutBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+	buf.open = true
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer f.Close()
+
+	hd, err := readCutoutHeader(f, fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	offset := int64(binary.Size(cutoutHeader{})) +
+		hd.NHalos*int64(binary.Size(CutoutHalo{}))
+	if _, err = f.Seek(offset, 0); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	n := int(hd.N)
+	buf.xs = expandVectors(buf.xs[:0], n)
+	buf.vs = expandVectors(buf.vs[:0], n)
+	buf.ms = expandScalars(buf.ms[:0], n)
+	buf.ids = expandInts(buf.ids[:0], n)
+	if n == 0 {
+		return buf.xs, buf.vs, buf.ms, buf.ids, nil
+	}
+
+	if err = readVecAsByte(f, cutoutOrder, buf.xs); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err = readVecAsByte(f, cutoutOrder, buf.vs); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err = readFloat32AsByte(f, cutoutOrder, buf.ms); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err = readInt64AsByte(f, cutoutOrder, buf.ids); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return buf.xs, buf.vs, buf.ms, buf.ids, nil
+}
+
+func (buf *CutoutBuffer) Close() {
+	if !buf.open {
+		panic("Buffer not open.")
+	}
+	buf.open = false
+}
+
+func (buf *CutoutBuffer) IsOpen() bool {
+	return buf.open
+}
+
+// ReadHeader doesn't need to read any particles, since the bounding box is
+// stored in the header.
+func (buf *CutoutBuffer) ReadHeader(fname string, out *Header) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hd, err := readCutoutHeader(f, fname)
+	if err != nil {
+		return err
+	}
+
+	out.TotalWidth = hd.TotalWidth
+	out.N = hd.N
+	out.Cosmo = CosmologyHeader{
+		Z: hd.Z, OmegaM: hd.OmegaM, OmegaL: hd.OmegaL, H100: hd.H100,
+	}
+	out.Origin, out.Width = hd.Origin, hd.Width
+	return nil
+}
+
+func (buf *CutoutBuffer) MinMass() float32 { return buf.mass }
+
+func (buf *CutoutBuffer) TotalParticles(fname string) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hd, err := readCutoutHeader(f, fname)
+	if err != nil {
+		return 0, err
+	}
+	return int(hd.N), nil
+}
@@ -0,0 +1,87 @@
+package io
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCutout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_cutout")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	c := &Cutout{
+		Cosmo:      CosmologyHeader{Z: 1, OmegaM: 0.3, OmegaL: 0.7, H100: 0.7},
+		TotalWidth: 100,
+		MinMass:    2.5,
+		Halos: []CutoutHalo{
+			{ID: 7, Snap: 3, X: 1, Y: 1, Z: 1, R: 2, Start: 0, N: 2},
+			{ID: 8, Snap: 3, X: 99, Y: 50, Z: 50, R: 2, Start: 2, N: 1},
+		},
+		Xs:  [][3]float32{{1, 1, 1}, {2, 1, 0.5}, {99.5, 50, 50}},
+		Vs:  [][3]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}},
+		Ms:  []float32{2.5, 2.5, 5},
+		IDs: []int64{10, 11, 12},
+	}
+	fname := path.Join(dir, "cutout_3.dat")
+	if err := WriteCutout(fname, c); err != nil {
+		t.Fatalf("WriteCutout returned error: %s", err.Error())
+	}
+
+	buf, err := NewCutoutBuffer(fname)
+	if err != nil {
+		t.Fatalf("NewCutoutBuffer returned error: %s", err.Error())
+	}
+	if m := buf.MinMass(); m != 2.5 {
+		t.Errorf("Expected MinMass() = 2.5, got %g.", m)
+	}
+	if n, err := buf.TotalParticles(fname); err != nil || n != 3 {
+		t.Errorf("Expected TotalParticles() = 3, got %d, %v.", n, err)
+	}
+
+	hd := &Header{}
+	if err := buf.ReadHeader(fname, hd); err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	if hd.N != 3 || hd.Cosmo != c.Cosmo || hd.TotalWidth != 100 {
+		t.Errorf("Got header %v %d %g.", hd.Cosmo, hd.N, hd.TotalWidth)
+	}
+	// The particles wrap around the x edge of the box.
+	if hd.Origin[0] != -0.5 || hd.Width[0] != 2.5 {
+		t.Errorf("Expected x origin -0.5 and width 2.5, got %g and %g.",
+			hd.Origin[0], hd.Width[0])
+	}
+
+	xs, vs, ms, ids, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	for i := range c.Xs {
+		if xs[i] != c.Xs[i] || vs[i] != c.Vs[i] || ms[i] != c.Ms[i] ||
+			ids[i] != c.IDs[i] {
+			t.Errorf("Particle %d is %v %v %g %d, expected %v %v %g %d.",
+				i, xs[i], vs[i], ms[i], ids[i],
+				c.Xs[i], c.Vs[i], c.Ms[i], c.IDs[i])
+		}
+	}
+	buf.Close()
+
+	halos, err := ReadCutoutHalos(fname)
+	if err != nil {
+		t.Fatalf("ReadCutoutHalos returned error: %s", err.Error())
+	}
+	if len(halos) != 2 || halos[0] != c.Halos[0] || halos[1] != c.Halos[1] {
+		t.Errorf("Expected halos %v, got %v.", c.Halos, halos)
+	}
+
+	if err := ioutil.WriteFile(fname, make([]byte, 200), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := NewCutoutBuffer(fname); err == nil {
+		t.Errorf("Expected error for a file which isn't a cutout.")
+	}
+}
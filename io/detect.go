@@ -0,0 +1,331 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+// detectHeaderSize is the number of bytes read from the start of a file when
+// detecting its format. It's larger than every header checked below.
+const detectHeaderSize = 512
+
+// gadgetRecordLimit is the largest number of Fortran records read when
+// telling LGadget-2 files apart from Gadget-2 files.
+const gadgetRecordLimit = 6
+
+// SnapshotGuess describes the format of a particle file, as found by
+// DetectSnapshot.
+type SnapshotGuess struct {
+	// SnapshotType is the value of the SnapshotType config variable which
+	// reads the file.
+	SnapshotType string
+	// Endianness is the value of the Endianness config variable needed to
+	// read the file. It's SystemOrder for formats which find their own byte
+	// order.
+	Endianness string
+	// LGadgetNPartNum is the value of LGadgetNpartNum needed to read LGadget-2
+	// files.
+	LGadgetNPartNum int64
+	// GadgetPositionUnits and GadgetMassUnits are the units of Gadget-2 and
+	// HDF5-Gadget files. They're 1 if the units couldn't be found.
+	GadgetPositionUnits, GadgetMassUnits float64
+	// ScaleFactor is the scale factor of the snapshot, or -1 if it isn't
+	// stored in the file.
+	ScaleFactor float64
+}
+
+// DetectSnapshot finds the format of the particle file fname by checking it
+// against the headers, magic numbers, and record markers of every format
+// which Shellfish can read. Bolshoi, BolshoiP, and raw files don't have
+// anything that identifies them, so they aren't detected.
+func DetectSnapshot(fname string) (*SnapshotGuess, error) {
+	guess := &SnapshotGuess{
+		Endianness: "SystemOrder", LGadgetNPartNum: 2,
+		GadgetPositionUnits: 1, GadgetMassUnits: 1, ScaleFactor: -1,
+	}
+
+	f, err := compress.OpenFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, detectHeaderSize)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, cutoutMagic[:]):
+		hd, err := readCutoutHeader(bytes.NewReader(head), fname)
+		if err != nil {
+			return nil, err
+		}
+		guess.SnapshotType = "cutout"
+		guess.ScaleFactor = 1 / (1 + hd.Z)
+		return guess, nil
+
+	case bytes.HasPrefix(head, hdf5Signature):
+		return detectHDF5Gadget(fname, guess)
+
+	case ramsesPartName.MatchString(path.Base(fname)):
+		return detectRamses(fname, head, guess)
+
+	case isARTIOBlock(fname):
+		guess.SnapshotType = "ARTIO"
+		return guess, nil
+	}
+
+	if len(head) >= 4 {
+		for _, order := range []binary.ByteOrder{
+			binary.LittleEndian, binary.BigEndian,
+		} {
+			if order.Uint32(head) == uint32(binary.Size(gadget2Header{})) {
+				return detectGadget(f, fname, order, guess)
+			}
+		}
+	}
+
+	if ok := detectGotetra(head, guess); ok {
+		return guess, nil
+	}
+
+	if hd, _, err := readTipsyHeader(
+		bytes.NewReader(head), fname,
+	); err == nil && hd.NBodies > 0 {
+		guess.SnapshotType = "TIPSY"
+		guess.ScaleFactor = hd.Time
+		return guess, nil
+	}
+
+	return nil, fmt.Errorf("I couldn't recognize the format of %s. "+
+		"Bolshoi, BolshoiP, and raw files can't be recognized "+
+		"automatically.", fname)
+}
+
+// endiannessName returns the value of the Endianness config variable which
+// corresponds to order.
+func endiannessName(order binary.ByteOrder) string {
+	if order == binary.BigEndian {
+		return "BigEndian"
+	}
+	return "LittleEndian"
+}
+
+// detectGadget tells LGadget-2 files apart from Gadget-2 files. Both start
+// with a 256-byte header record, but LGadget-2 files only have position,
+// velocity, and 64-bit ID records after it.
+func detectGadget(
+	f compress.File, fname string, order binary.ByteOrder,
+	guess *SnapshotGuess,
+) (*SnapshotGuess, error) {
+	gh := &gadget2Header{}
+	err := binary.Read(io.NewSectionReader(f, 4, int64(binary.Size(gh))),
+		order, gh)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the Gadget header of %s: %s",
+			fname, err.Error())
+	}
+
+	recs, err := fortranRecordSizes(f, order, gadgetRecordLimit)
+	if err != nil {
+		return nil, fmt.Errorf("%s starts like a Gadget file, but %s",
+			fname, err.Error())
+	} else if len(recs) < 4 {
+		return nil, fmt.Errorf("%s starts like a Gadget file, but only has "+
+			"%d Fortran records.", fname, len(recs))
+	}
+
+	guess.Endianness = endiannessName(order)
+	guess.ScaleFactor = gh.Time
+
+	n := recs[1] / 12
+	if len(recs) == 4 && recs[1] == recs[2] && recs[3] == 8*n {
+		switch n {
+		case int64(gh.NPart[1]) + int64(gh.NPart[0])<<32:
+			guess.SnapshotType, guess.LGadgetNPartNum = "LGadget-2", 2
+			return guess, nil
+		case int64(gh.NPart[0]):
+			guess.SnapshotType, guess.LGadgetNPartNum = "LGadget-2", 1
+			return guess, nil
+		}
+	}
+
+	if recs[1] != 12*int64(particleCount(gh)) {
+		return nil, fmt.Errorf("%s has a Gadget header for %d particles, "+
+			"but its position record has %d bytes.", fname,
+			particleCount(gh), recs[1])
+	}
+
+	guess.SnapshotType = "Gadget-2"
+	nTotal := int64(gh.NumPartTotal[1]) + int64(gh.NumPartTotalHW[1])<<32
+	guess.GadgetPositionUnits, guess.GadgetMassUnits = gadgetUnits(
+		gh.BoxSize, gh.Omega0, gh.Mass[1], nTotal,
+	)
+	return guess, nil
+}
+
+// fortranRecordSizes returns the sizes of the first max Fortran records in
+// f, stopping early if the file ends. An error is returned if the markers
+// around a record don't match.
+func fortranRecordSizes(
+	f compress.File, order binary.ByteOrder, max int,
+) ([]int64, error) {
+	sizes := []int64{}
+	marker := make([]byte, 4)
+	off := int64(0)
+	for len(sizes) < max {
+		if _, err := f.ReadAt(marker, off); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		size := int64(order.Uint32(marker))
+
+		if _, err := f.ReadAt(marker, off+4+size); err != nil {
+			return nil, fmt.Errorf("record %d is cut off.", len(sizes))
+		} else if int64(order.Uint32(marker)) != size {
+			return nil, fmt.Errorf("the markers around record %d don't "+
+				"match.", len(sizes))
+		}
+
+		sizes = append(sizes, size)
+		off += 8 + size
+	}
+	return sizes, nil
+}
+
+// gadgetUnits finds the units of a Gadget file's positions and masses by
+// comparing the mass of its dark matter particles to the mean density of the
+// universe. Gadget files almost always use either Mpc/h or kpc/h and either
+// Msun/h or 10^10 Msun/h. If the units can't be found, 1 and 1 are returned.
+func gadgetUnits(
+	boxSize, omegaM, mass float64, n int64,
+) (posUnits, massUnits float64) {
+	// The critical density in h^2 Msun / Mpc^3.
+	const rhoCrit = 2.775e11
+	if boxSize <= 0 || omegaM <= 0 || mass <= 0 || n <= 0 {
+		return 1, 1
+	}
+
+	posUnits, massUnits = 1, 1
+	best := math.Inf(+1)
+	for _, p := range []float64{1, 1e-3} {
+		for _, m := range []float64{1, 1e10} {
+			L := boxSize * p
+			ratio := mass * m * float64(n) / (omegaM * rhoCrit * L * L * L)
+			if d := math.Abs(math.Log(ratio)); d < best {
+				best, posUnits, massUnits = d, p, m
+			}
+		}
+	}
+
+	// Baryons can make the dark matter mass a bit smaller than the mean
+	// density, but anything further off than this is a different problem.
+	if best > math.Log(3) {
+		return 1, 1
+	}
+	return posUnits, massUnits
+}
+
+// detectHDF5Gadget checks that an HDF5 file has a Gadget header.
+func detectHDF5Gadget(
+	fname string, guess *SnapshotGuess,
+) (*SnapshotGuess, error) {
+	h, err := openHDF5(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	hd, err := readHDF5GadgetHeader(h)
+	if err != nil {
+		return nil, fmt.Errorf("%s is an HDF5 file, but I couldn't read a "+
+			"Gadget header from it: %s", fname, err.Error())
+	}
+
+	guess.SnapshotType = "HDF5-Gadget"
+	guess.ScaleFactor = hd.Time
+	if len(hd.Mass) > 1 && len(hd.NPartTotal) > 1 {
+		guess.GadgetPositionUnits, guess.GadgetMassUnits = gadgetUnits(
+			hd.BoxSize, hd.Omega0, hd.Mass[1], hd.NPartTotal[1],
+		)
+	}
+	return guess, nil
+}
+
+// detectRamses finds the byte order of a RAMSES particle file from the marker
+// of its first record, which contains a single int32.
+func detectRamses(
+	fname string, head []byte, guess *SnapshotGuess,
+) (*SnapshotGuess, error) {
+	guess.SnapshotType = "RAMSES"
+	if len(head) >= 4 && binary.BigEndian.Uint32(head) == 4 {
+		guess.Endianness = "BigEndian"
+	} else {
+		guess.Endianness = "LittleEndian"
+	}
+
+	infoName, _, _, err := ramsesFiles(fname)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readRamsesInfo(infoName)
+	if err != nil {
+		return nil, err
+	}
+	guess.ScaleFactor = info.AExp
+	return guess, nil
+}
+
+// isARTIOBlock returns true if fname is a particle file in an ARTIO fileset,
+// i.e. if it has a name like fileset.p000 and fileset.art exists.
+func isARTIOBlock(fname string) bool {
+	fileset, _, err := parseARTIOFilename(fname)
+	if err != nil || !strings.HasPrefix(fname[len(fileset):], ".p") {
+		return false
+	}
+	_, err = os.Stat(fileset + ".art")
+	return err == nil
+}
+
+// detectGotetra returns true if head is the start of a gotetra file, which
+// begins with an endianness flag and the size of its header.
+func detectGotetra(head []byte, guess *SnapshotGuess) bool {
+	hd := &rawGotetraHeader{}
+	size := binary.Size(hd)
+	if len(head) < 8+size {
+		return false
+	}
+
+	var order binary.ByteOrder
+	switch int32(binary.LittleEndian.Uint32(head)) {
+	case 0:
+		order = binary.LittleEndian
+	case -1:
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	if int(order.Uint32(head[4:])) != size {
+		return false
+	}
+
+	err := binary.Read(bytes.NewReader(head[8:8+size]), order, hd)
+	if err != nil {
+		return false
+	}
+	guess.SnapshotType = "gotetra"
+	guess.ScaleFactor = 1 / (1 + hd.Cosmo.Z)
+	return true
+}
@@ -0,0 +1,124 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDetectSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_detect")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	xs := [][3]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+	ids := []int64{1, 2, 3}
+
+	lgadget := path.Join(dir, "lgadget.0")
+	writeLGadget2(t, lgadget, xs, xs, ids)
+
+	// A big endian Gadget-2 file with gas, and therefore a mass record.
+	hd := gadget2Header{Time: 0.5, BoxSize: 10, Omega0: 0.3}
+	hd.NPart[0], hd.NPart[1] = 1, 2
+	hd.NumPartTotal = hd.NPart
+	hd.Mass[1] = 1
+	gadget := path.Join(dir, "gadget.0")
+	b := &bytes.Buffer{}
+	for _, x := range []interface{}{
+		hd, xs, xs, []int32{1, 2, 3}, []float32{0.5},
+	} {
+		fortranRecord(b, binary.BigEndian, x)
+	}
+	if err := ioutil.WriteFile(gadget, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tipsy := path.Join(dir, "snap.000128")
+	b = &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, tipsyHeader{
+		Time: 0.75, NBodies: 1, NDim: 3, NDark: 1,
+	})
+	binary.Write(b, binary.BigEndian, [9]float32{})
+	if err := ioutil.WriteFile(tipsy, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cutout := path.Join(dir, "cutout_3.dat")
+	if err := WriteCutout(cutout, &Cutout{
+		Cosmo: CosmologyHeader{Z: 1}, TotalWidth: 10,
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	unknown := path.Join(dir, "README")
+	if err := ioutil.WriteFile(
+		unknown, []byte("Not a snapshot."), 0644,
+	); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		fname        string
+		snapshotType string
+		endianness   string
+		scaleFactor  float64
+	}{
+		{lgadget, "LGadget-2", "LittleEndian", 0.25},
+		{gadget, "Gadget-2", "BigEndian", 0.5},
+		{tipsy, "TIPSY", "SystemOrder", 0.75},
+		{cutout, "cutout", "SystemOrder", 0.5},
+	}
+
+	for i, test := range tests {
+		guess, err := DetectSnapshot(test.fname)
+		if err != nil {
+			t.Errorf("%d) DetectSnapshot returned error: %s", i, err.Error())
+			continue
+		}
+		if guess.SnapshotType != test.snapshotType ||
+			guess.Endianness != test.endianness ||
+			guess.ScaleFactor != test.scaleFactor {
+			t.Errorf("%d) Expected %s, %s, and a = %g, got %s, %s, and "+
+				"a = %g.", i, test.snapshotType, test.endianness,
+				test.scaleFactor, guess.SnapshotType, guess.Endianness,
+				guess.ScaleFactor)
+		}
+	}
+
+	if _, err := DetectSnapshot(unknown); err == nil {
+		t.Errorf("Expected error for a file which isn't a snapshot.")
+	}
+}
+
+func TestGadgetUnits(t *testing.T) {
+	const rhoCrit = 2.775e11
+	// The dark matter in a 62.5 Mpc/h box with 128^3 particles.
+	L, omegaM, n := 62.5, 0.27, int64(128*128*128)
+	m := 0.85 * omegaM * rhoCrit * L * L * L / float64(n)
+
+	tests := []struct {
+		boxSize, mass       float64
+		posUnits, massUnits float64
+	}{
+		{L, m, 1, 1},
+		{L * 1e3, m, 1e-3, 1},
+		{L * 1e3, m / 1e10, 1e-3, 1e10},
+		{L, m / 1e10, 1, 1e10},
+		{L, 0, 1, 1},
+	}
+
+	for i, test := range tests {
+		p, u := gadgetUnits(test.boxSize, omegaM, test.mass, n)
+		if math.Abs(p/test.posUnits-1) > 1e-6 ||
+			math.Abs(u/test.massUnits-1) > 1e-6 {
+			t.Errorf("%d) Expected units %g and %g, got %g and %g.",
+				i, test.posUnits, test.massUnits, p, u)
+		}
+	}
+}
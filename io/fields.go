@@ -0,0 +1,205 @@
+package io
+
+// Fields is a set of flags which tells ReadFields and ReadChunks which
+// particle properties should be read.
+type Fields uint8
+
+const (
+	Positions Fields = 1 << iota
+	Velocities
+	Masses
+	IDs
+
+	// Types is the particle type of each particle. Only TypedBuffers know
+	// about particle types, so Types isn't part of AllFields.
+	Types
+
+	AllFields = Positions | Velocities | Masses | IDs
+)
+
+// Has returns true if every field in x is in f.
+func (f Fields) Has(x Fields) bool { return f&x == x }
+
+// Chunk is a contiguous range of particles from a single file. Fields which
+// weren't requested are nil.
+type Chunk struct {
+	// Start is the index of the chunk's first particle within the file.
+	Start  int
+	Xs, Vs [][3]float32
+	Ms     []float32
+	IDs    []int64
+	// Types is nil unless Types was requested from a TypedBuffer.
+	Types []uint8
+}
+
+// TypedBuffer is a VectorBuffer which reads several types of particles (e.g.
+// dark matter, gas, and stars) and can report the type of each one.
+type TypedBuffer interface {
+	VectorBuffer
+	// Types returns the type of every particle returned by the last call to
+	// Read. It's only valid until Close is called.
+	Types() []uint8
+}
+
+// FieldBuffer is a VectorBuffer which doesn't need to decode (or allocate)
+// the particle properties which its caller doesn't need. Code outside this
+// package should call the ReadFields and ReadChunks functions instead of these
+// methods so that VectorBuffers which aren't FieldBuffers still work.
+type FieldBuffer interface {
+	VectorBuffer
+	// ReadFields works the same way as Read, except that only the requested
+	// fields are read. The rest are returned as nil. Close must be called
+	// afterwards.
+	ReadFields(fname string, fields Fields) (
+		xs, vs [][3]float32, ms []float32, ids []int64, err error,
+	)
+	// ReadChunks calls f on consecutive chunks of the file, each of which
+	// contains at most chunkSize particles. The chunk's slices are reused and
+	// are only valid until f returns. The buffer must not be open, and Close
+	// must not be called afterwards. If f returns an error, ReadChunks stops
+	// and returns it.
+	ReadChunks(
+		fname string, fields Fields, chunkSize int, f func(*Chunk) error,
+	) error
+}
+
+// ReadFields reads the requested fields from a file. If buf isn't a
+// FieldBuffer, every field is read and the unneeded ones are dropped. Close
+// must be called afterwards.
+func ReadFields(buf VectorBuffer, fname string, fields Fields) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if fbuf, ok := buf.(FieldBuffer); ok {
+		return fbuf.ReadFields(fname, fields)
+	}
+
+	xs, vs, ms, ids, err = buf.Read(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	xs, vs, ms, ids = dropFields(fields, xs, vs, ms, ids)
+	return xs, vs, ms, ids, nil
+}
+
+// ReadChunks calls f on consecutive chunks of at most chunkSize particles
+// from a file. If chunkSize is non-positive, the whole file is a single chunk.
+// If buf isn't a FieldBuffer, the whole file is read at once and then split
+// into chunks. Close must not be called afterwards.
+func ReadChunks(
+	buf VectorBuffer, fname string, fields Fields, chunkSize int,
+	f func(*Chunk) error,
+) error {
+	if fbuf, ok := buf.(FieldBuffer); ok {
+		return fbuf.ReadChunks(fname, fields, chunkSize, f)
+	}
+
+	xs, vs, ms, ids, err := ReadFields(buf, fname, fields)
+	defer func() {
+		if buf.IsOpen() {
+			buf.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	types := readTypes(buf, fields)
+	return sliceChunks(xs, vs, ms, ids, types, chunkSize, f)
+}
+
+// readTypes returns the types of the particles which were just read by buf if
+// they were requested and buf is a TypedBuffer. Otherwise, it returns nil.
+func readTypes(buf VectorBuffer, fields Fields) []uint8 {
+	if tbuf, ok := buf.(TypedBuffer); ok && fields.Has(Types) {
+		return tbuf.Types()
+	}
+	return nil
+}
+
+// sliceChunks calls f on consecutive chunks of at most chunkSize particles
+// taken from the given slices, any of which may be nil.
+func sliceChunks(
+	xs, vs [][3]float32, ms []float32, ids []int64, types []uint8,
+	chunkSize int, f func(*Chunk) error,
+) error {
+	n := len(xs)
+	for _, length := range []int{len(vs), len(ms), len(ids), len(types)} {
+		if length > n {
+			n = length
+		}
+	}
+
+	c := &Chunk{}
+	return eachChunk(n, chunkSize, func(start, end int) error {
+		c.Start = start
+		c.Xs, c.Vs = sliceVectors(xs, start, end), sliceVectors(vs, start, end)
+		c.Ms, c.IDs = sliceScalars(ms, start, end), sliceInts(ids, start, end)
+		if types != nil {
+			c.Types = types[start:end]
+		}
+		return f(c)
+	})
+}
+
+// eachChunk calls f on the start and end index of consecutive chunks of at
+// most chunkSize elements which cover n elements. At least one chunk is
+// always visited so that empty files still produce a call to f.
+func eachChunk(n, chunkSize int, f func(start, end int) error) error {
+	if chunkSize <= 0 || chunkSize > n {
+		chunkSize = n
+	}
+	start := 0
+	for {
+		end := start + chunkSize
+		if end > n {
+			end = n
+		}
+		if err := f(start, end); err != nil {
+			return err
+		}
+		if end >= n {
+			return nil
+		}
+		start = end
+	}
+}
+
+// dropFields sets every slice which isn't in fields to nil.
+func dropFields(
+	fields Fields, xs, vs [][3]float32, ms []float32, ids []int64,
+) ([][3]float32, [][3]float32, []float32, []int64) {
+	if !fields.Has(Positions) {
+		xs = nil
+	}
+	if !fields.Has(Velocities) {
+		vs = nil
+	}
+	if !fields.Has(Masses) {
+		ms = nil
+	}
+	if !fields.Has(IDs) {
+		ids = nil
+	}
+	return xs, vs, ms, ids
+}
+
+func sliceVectors(x [][3]float32, start, end int) [][3]float32 {
+	if x == nil {
+		return nil
+	}
+	return x[start:end]
+}
+
+func sliceScalars(x []float32, start, end int) []float32 {
+	if x == nil {
+		return nil
+	}
+	return x[start:end]
+}
+
+func sliceInts(x []int64, start, end int) []int64 {
+	if x == nil {
+		return nil
+	}
+	return x[start:end]
+}
@@ -0,0 +1,299 @@
+package io
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// sliceBuffer is a VectorBuffer which isn't a FieldBuffer.
+type sliceBuffer struct {
+	open   bool
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+}
+
+func (buf *sliceBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	buf.open = true
+	return buf.xs, buf.vs, buf.ms, buf.ids, nil
+}
+
+func (buf *sliceBuffer) Close()                             { buf.open = false }
+func (buf *sliceBuffer) IsOpen() bool                       { return buf.open }
+func (buf *sliceBuffer) ReadHeader(string, *Header) error   { return nil }
+func (buf *sliceBuffer) MinMass() float32                   { return 1 }
+func (buf *sliceBuffer) TotalParticles(string) (int, error) { return 0, nil }
+
+// writeLGadget2 writes an LGadget-2 file containing the given particles.
+func writeLGadget2(
+	t *testing.T, fname string, xs, vs [][3]float32, ids []int64,
+) {
+	order := binary.LittleEndian
+	n := uint32(len(xs))
+	hd := lGadget2Header{
+		Time: 0.25, Redshift: 3, BoxSize: 10,
+		Omega0: 0.3, OmegaLambda: 0.7, HubbleParam: 0.7,
+	}
+	hd.NPart[1], hd.NPartTotal[1] = n, n
+
+	b := &bytes.Buffer{}
+	for _, x := range []interface{}{hd, xs, vs, ids} {
+		fortranRecord(b, order, x)
+	}
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestLGadget2Fields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_fields")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	xs := [][3]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {-1, 0, 0}, {0, 0, 11}}
+	vs := [][3]float32{{2, 2, 2}, {4, 4, 4}, {6, 6, 6}, {8, 8, 8}, {0, 0, 0}}
+	ids := []int64{10, 11, 12, 13, 14}
+	fname := path.Join(dir, "snap.0")
+	writeLGadget2(t, fname, xs, vs, ids)
+
+	buf, err := NewLGadget2Buffer(fname, "LittleEndian",
+		Context{LGadgetNPartNum: 2})
+	if err != nil {
+		t.Fatalf("NewLGadget2Buffer returned error: %s", err.Error())
+	}
+
+	allXs, allVs, allMs, allIDs, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	// Copy, since the buffers are reused.
+	allXs = append([][3]float32{}, allXs...)
+	allVs = append([][3]float32{}, allVs...)
+	allMs = append([]float32{}, allMs...)
+	allIDs = append([]int64{}, allIDs...)
+	buf.Close()
+
+	if allXs[3] != [3]float32{9, 0, 0} || allXs[4] != [3]float32{0, 0, 1} {
+		t.Errorf("Particles weren't wrapped: %v.", allXs)
+	}
+	if allVs[0] != [3]float32{1, 1, 1} {
+		t.Errorf("Expected v[0] = [1 1 1], got %v.", allVs[0])
+	}
+
+	rxs, rvs, rms, rids, err := ReadFields(buf, fname, Positions|IDs)
+	if err != nil {
+		t.Fatalf("ReadFields returned error: %s", err.Error())
+	}
+	if rvs != nil || rms != nil {
+		t.Errorf("Unrequested fields were read.")
+	}
+	for i := range allXs {
+		if rxs[i] != allXs[i] || rids[i] != allIDs[i] {
+			t.Errorf("ReadFields particle %d is %v %d, but Read gave %v %d.",
+				i, rxs[i], rids[i], allXs[i], allIDs[i])
+		}
+	}
+	buf.Close()
+
+	for _, b := range []VectorBuffer{buf, &sliceBuffer{
+		xs: allXs, vs: allVs, ms: allMs, ids: allIDs,
+	}} {
+		starts, n := []int{}, 0
+		err = ReadChunks(b, fname, Positions|Velocities|Masses, 2,
+			func(c *Chunk) error {
+				starts = append(starts, c.Start)
+				if c.IDs != nil || len(c.Xs) > 2 {
+					t.Errorf("Chunk starting at %d has %d particles and "+
+						"IDs %v.", c.Start, len(c.Xs), c.IDs)
+				}
+				for i := range c.Xs {
+					j := c.Start + i
+					if c.Xs[i] != allXs[j] || c.Vs[i] != allVs[j] ||
+						c.Ms[i] != allMs[j] {
+						t.Errorf("Chunk particle %d is %v %v %g, expected "+
+							"%v %v %g.", j, c.Xs[i], c.Vs[i], c.Ms[i],
+							allXs[j], allVs[j], allMs[j])
+					}
+				}
+				n += len(c.Xs)
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("ReadChunks returned error: %s", err.Error())
+		}
+		if n != len(allXs) || len(starts) != 3 || starts[2] != 4 {
+			t.Errorf("Expected chunks starting at [0 2 4] covering %d "+
+				"particles, got %v covering %d.", len(allXs), starts, n)
+		}
+		if b.IsOpen() {
+			t.Errorf("Buffer left open by ReadChunks.")
+		}
+	}
+}
+
+func TestLGadget2Compressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_fields")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	n := 1000
+	xs, vs, ids := make([][3]float32, n), make([][3]float32, n), make([]int64, n)
+	for i := range xs {
+		xs[i] = [3]float32{float32(i%10) + 0.5, float32(i%7) + 0.5, 1}
+		vs[i] = [3]float32{float32(i), float32(-i), 2}
+		ids[i] = int64(i)
+	}
+	fname := path.Join(dir, "snap.0")
+	writeLGadget2(t, fname, xs, vs, ids)
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b := &bytes.Buffer{}
+	wr := gzip.NewWriter(b)
+	wr.Write(data)
+	wr.Close()
+	gzName := fname + ".gz"
+	if err := ioutil.WriteFile(gzName, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx := Context{LGadgetNPartNum: 2}
+	buf, err := NewLGadget2Buffer(fname, "LittleEndian", ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	gzBuf, err := NewLGadget2Buffer(gzName, "LittleEndian", ctx)
+	if err != nil {
+		t.Fatalf("NewLGadget2Buffer returned error: %s", err.Error())
+	}
+	if buf.MinMass() != gzBuf.MinMass() {
+		t.Errorf("Expected MinMass() = %g, got %g.",
+			buf.MinMass(), gzBuf.MinMass())
+	}
+
+	hd, gzHd := &Header{}, &Header{}
+	if err := buf.ReadHeader(fname, hd); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := gzBuf.ReadHeader(gzName, gzHd); err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	if *hd != *gzHd {
+		t.Errorf("Expected header %v, got %v.", *hd, *gzHd)
+	}
+
+	allXs, allVs, allMs, allIDs, err := buf.Read(fname)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer buf.Close()
+
+	err = ReadChunks(gzBuf, gzName, AllFields, 300, func(c *Chunk) error {
+		for i := range c.Xs {
+			j := c.Start + i
+			if c.Xs[i] != allXs[j] || c.Vs[i] != allVs[j] ||
+				c.Ms[i] != allMs[j] || c.IDs[i] != allIDs[j] {
+				t.Errorf("Compressed particle %d is %v %v %g %d, expected "+
+					"%v %v %g %d.", j, c.Xs[i], c.Vs[i], c.Ms[i], c.IDs[i],
+					allXs[j], allVs[j], allMs[j], allIDs[j])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadChunks returned error: %s", err.Error())
+	}
+}
+
+func TestGadget2Types(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_fields")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Two gas particles, three dark matter particles with a single mass, and
+	// one star particle.
+	hd := gadget2Header{
+		Time: 1, BoxSize: 10, Omega0: 0.3, OmegaLambda: 0.7, HubbleParam: 0.7,
+	}
+	hd.NPart[0], hd.NPart[1], hd.NPart[4] = 2, 3, 1
+	hd.NumPartTotal = hd.NPart
+	hd.Mass[1] = 4
+
+	xs := [][3]float32{{0, 0, 0}, {1, 1, 1}, {2, 2, 2}, {3, 3, 3},
+		{4, 4, 4}, {5, 5, 5}}
+	vs := make([][3]float32, len(xs))
+	ids := []int32{10, 11, 20, 21, 22, 40}
+	multiMs := []float32{1, 2, 0.5}
+
+	fname := path.Join(dir, "snap.0")
+	b := &bytes.Buffer{}
+	for _, x := range []interface{}{hd, xs, vs, ids, multiMs} {
+		fortranRecord(b, binary.LittleEndian, x)
+	}
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx := Context{
+		GadgetDMTypeIndices:       []int64{0, 1, 4},
+		GadgetDMSingleMassIndices: []int64{1},
+		GadgetPositionUnits:       1, GadgetMassUnits: 1,
+	}
+	buf, err := NewGadget2Buffer(fname, "LittleEndian", ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expTypes := []uint8{0, 0, 1, 1, 1, 4}
+	expMs := []float32{1, 2, 4, 4, 4, 0.5}
+	n := 0
+	err = ReadChunks(buf, fname, Positions|Masses|Types, 4,
+		func(c *Chunk) error {
+			if c.Vs != nil || c.IDs != nil {
+				t.Errorf("Fields which weren't requested were read.")
+			}
+			for i := range c.Xs {
+				j := c.Start + i
+				if c.Xs[i] != xs[j] || c.Ms[i] != expMs[j] ||
+					c.Types[i] != expTypes[j] {
+					t.Errorf("Particle %d is %v %g %d, expected %v %g %d.",
+						j, c.Xs[i], c.Ms[i], c.Types[i],
+						xs[j], expMs[j], expTypes[j])
+				}
+				n++
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("ReadChunks returned error: %s", err.Error())
+	}
+	if n != len(xs) {
+		t.Errorf("Read %d particles, expected %d.", n, len(xs))
+	}
+
+	// Types which aren't requested aren't returned.
+	err = ReadChunks(buf, fname, Positions, 0, func(c *Chunk) error {
+		if c.Types != nil {
+			t.Errorf("Types were returned without being requested.")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadChunks returned error: %s", err.Error())
+	}
+}
@@ -4,7 +4,8 @@ import (
 	"fmt"
 	"encoding/binary"
 	"math"
-	"os"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
 )
 
 // gadgetHeader is the formatting for meta-information used by Gadget 2.
@@ -50,7 +51,7 @@ func (gh *gadget2Header) postprocess(
 func readGadget2Header(
 	path string, order binary.ByteOrder, out *gadget2Header,
 ) error {
-	f, err := os.Open(path)
+	f, err := compress.Open(path)
 	if err != nil {
 		return err
 	}
@@ -71,7 +72,7 @@ func (buf *Gadget2Buffer) readGadget2Particles(
 	
 	// Open the buffer and read the raw gadget header.
 
-	f, err := os.Open(path)
+	f, err := compress.Open(path)
 	if err != nil {
 		return nil, nil, nil, nil, nil, err
 	}
@@ -138,6 +139,7 @@ func (buf *Gadget2Buffer) readGadget2Particles(
 	vsBuf = vsBuf[0: dmN]
 	idsBuf = idsBuf[0: dmN]
 	msBuf = msBuf[0: dmN]
+	buf.types = packTypes(gh, &buf.context, buf.types)
 	
 	err = fix(gh, &buf.context, path, xsBuf, vsBuf, msBuf)
 	
@@ -284,6 +286,22 @@ func packFloat32(gh *gadget2Header, context *Context, buf []float32) {
 	}
 }
 
+// packTypes returns the type of each particle that's left after packing.
+func packTypes(gh *gadget2Header, context *Context, buf []uint8) []uint8 {
+	buf = expandTypes(buf[:0], dmCount(gh, context))
+	k := 0
+	for i := 0; i < 6; i++ {
+		if !isDM(context, i) {
+			continue
+		}
+		for j := 0; j < int(gh.NPart[i]); j++ {
+			buf[k] = uint8(i)
+			k++
+		}
+	}
+	return buf
+}
+
 // Fix periodicity and units.
 func fix(
 	gh *gadget2Header, context *Context, path string,
@@ -328,6 +346,7 @@ type Gadget2Buffer struct {
 	xs, vs      [][3]float32
 	ms, multiMs []float32
 	ids         []int64
+	types       []uint8
 	context     Context
 }
 
@@ -383,6 +402,8 @@ func (buf *Gadget2Buffer) IsOpen() bool {
 	return buf.open
 }
 
+func (buf *Gadget2Buffer) Types() []uint8 { return buf.types }
+
 func (buf *Gadget2Buffer) ReadHeader(fname string, out *Header) error {
 	err := readGadget2Header(fname, buf.order, &buf.hd)
 	if err != nil {
@@ -0,0 +1,426 @@
+package io
+
+import (
+	"fmt"
+	"math"
+)
+
+// hdf5GadgetHeader contains the header information of an HDF5 snapshot written
+// by Gadget-3, Gadget-4, AREPO, or SWIFT. Unlike Gadget-2 headers, the number
+// of particle types isn't fixed.
+type hdf5GadgetHeader struct {
+	NPart, NPartTotal                []int64
+	Mass                             []float64
+	Time, Redshift, BoxSize          float64
+	Omega0, OmegaLambda, HubbleParam float64
+	// PeculiarVelocities is true if velocities are stored as peculiar
+	// velocities instead of Gadget's sqrt(a)-scaled ones, as SWIFT does.
+	PeculiarVelocities bool
+}
+
+// hdf5CosmologyNames lists the groups which different codes store cosmological
+// parameters in and the names that they give to OmegaM, OmegaL, and h100.
+var hdf5CosmologyNames = []struct {
+	group                string
+	omegaM, omegaL, h100 string
+}{
+	{"Header", "Omega0", "OmegaLambda", "HubbleParam"},     // Gadget-3, AREPO
+	{"Parameters", "Omega0", "OmegaLambda", "HubbleParam"}, // Gadget-4
+	{"Cosmology", "Omega_m", "Omega_lambda", "h"},          // SWIFT
+}
+
+func readHDF5GadgetHeader(h *hdf5File) (*hdf5GadgetHeader, error) {
+	hd := &hdf5GadgetHeader{}
+	group, err := h.mustObject("Header")
+	if err != nil {
+		return nil, err
+	}
+
+	if hd.NPart, err = group.intAttr("NumPart_ThisFile"); err != nil {
+		return nil, err
+	}
+	if hd.NPartTotal, err = group.intAttr("NumPart_Total"); err != nil {
+		return nil, err
+	}
+	// Only some codes split up the total particle count.
+	if _, ok, _ := group.attr("NumPart_Total_HighWord"); ok {
+		hw, err := group.intAttr("NumPart_Total_HighWord")
+		if err != nil {
+			return nil, err
+		}
+		for i := range hw {
+			if i < len(hd.NPartTotal) {
+				hd.NPartTotal[i] += hw[i] << 32
+			}
+		}
+	}
+	if hd.Mass, err = group.floatAttr("MassTable"); err != nil {
+		return nil, err
+	}
+
+	z, err := group.floatAttr("Redshift")
+	if err != nil {
+		return nil, err
+	}
+	hd.Redshift = z[0]
+
+	// SWIFT's "Time" is cosmic time, not the scale factor.
+	if _, ok, _ := group.attr("Scale-factor"); ok {
+		a, err := group.floatAttr("Scale-factor")
+		if err != nil {
+			return nil, err
+		}
+		hd.Time = a[0]
+		hd.PeculiarVelocities = true
+	} else {
+		a, err := group.floatAttr("Time")
+		if err != nil {
+			return nil, err
+		}
+		hd.Time = a[0]
+	}
+
+	// SWIFT stores a separate width for every dimension.
+	L, err := group.floatAttr("BoxSize")
+	if err != nil {
+		return nil, err
+	} else if len(L) == 0 {
+		return nil, fmt.Errorf("The 'BoxSize' attribute of %s is empty.",
+			h.fname)
+	}
+	hd.BoxSize = L[0]
+
+	for _, names := range hdf5CosmologyNames {
+		cosmo, ok, err := h.object(names.group)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		} else if _, ok, _ := cosmo.attr(names.omegaM); !ok {
+			continue
+		}
+
+		vals := []*float64{&hd.Omega0, &hd.OmegaLambda, &hd.HubbleParam}
+		for i, name := range []string{
+			names.omegaM, names.omegaL, names.h100,
+		} {
+			x, err := cosmo.floatAttr(name)
+			if err != nil {
+				return nil, err
+			}
+			*vals[i] = x[0]
+		}
+		return hd, nil
+	}
+
+	return nil, fmt.Errorf("I couldn't find the cosmological parameters "+
+		"in %s. I looked in the Header, Parameters, and Cosmology groups.",
+		h.fname)
+}
+
+func (hd *hdf5GadgetHeader) postprocess(
+	xs [][3]float32, context *Context, out *Header,
+) {
+	// Assumes the catalog has already been checked for corruption.
+
+	out.TotalWidth = hd.BoxSize * context.GadgetPositionUnits
+
+	out.N = 0
+	for _, i := range context.GadgetDMTypeIndices {
+		if int(i) < len(hd.NPart) {
+			out.N += hd.NPart[i]
+		}
+	}
+
+	out.Cosmo.Z = hd.Redshift
+	out.Cosmo.OmegaM = hd.Omega0
+	out.Cosmo.OmegaL = hd.OmegaLambda
+	out.Cosmo.H100 = hd.HubbleParam
+
+	out.Origin, out.Width = boundingBox(xs, out.TotalWidth)
+}
+
+// checkTypes returns an error if the header doesn't have one of the dark matter
+// particle types.
+func (hd *hdf5GadgetHeader) checkTypes(context *Context, fname string) error {
+	for _, i := range context.GadgetDMTypeIndices {
+		if i < 0 || int(i) >= len(hd.NPart) ||
+			int(i) >= len(hd.NPartTotal) || int(i) >= len(hd.Mass) {
+			return fmt.Errorf("GadgetDMTypeIndices contains %d, but %s "+
+				"only has %d particle types.", i, fname, len(hd.NPart))
+		}
+	}
+	return nil
+}
+
+// HDF5GadgetBuffer reads the HDF5 snapshots written by Gadget-3, Gadget-4,
+// AREPO, and SWIFT. Each file of a multi-file snapshot is a separate block.
+type HDF5GadgetBuffer struct {
+	open    bool
+	mass    float32
+	xs, vs  [][3]float32
+	ms      []float32
+	ids     []int64
+	types   []uint8
+	context Context
+}
+
+func NewHDF5GadgetBuffer(path string, context Context) (VectorBuffer, error) {
+	buf := &HDF5GadgetBuffer{context: context}
+
+	h, err := openHDF5(path)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	hd, err := readHDF5GadgetHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	if err = hd.checkTypes(&context, path); err != nil {
+		return nil, err
+	}
+
+	// Types without a mass in MassTable have a Masses dataset instead.
+	buf.mass = float32(math.Inf(+1))
+	for _, i := range context.GadgetDMTypeIndices {
+		ms := []float32{float32(hd.Mass[i])}
+		if hd.Mass[i] == 0 {
+			if hd.NPart[i] == 0 {
+				continue
+			}
+			ms = make([]float32, hd.NPart[i])
+			name := fmt.Sprintf("PartType%d/Masses", i)
+			if err = readHDF5Scalars(h, name, ms); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, m := range ms {
+			if m < buf.mass {
+				buf.mass = m
+			}
+		}
+	}
+	buf.mass *= float32(context.GadgetMassUnits)
+
+	return buf, nil
+}
+
+func (buf *HDF5GadgetBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+	buf.open = true
+
+	h, err := openHDF5(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer h.Close()
+
+	hd, err := readHDF5GadgetHeader(h)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err = hd.checkTypes(&buf.context, fname); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	n := 0
+	for _, i := range buf.context.GadgetDMTypeIndices {
+		n += int(hd.NPart[i])
+	}
+
+	buf.xs = expandVectors(buf.xs[:0], n)
+	buf.vs = expandVectors(buf.vs[:0], n)
+	buf.ms = expandScalars(buf.ms[:0], n)
+	buf.ids = expandInts(buf.ids[:0], n)
+	buf.types = expandTypes(buf.types[:0], n)
+
+	start := 0
+	for _, i := range buf.context.GadgetDMTypeIndices {
+		end := start + int(hd.NPart[i])
+		if end == start {
+			continue
+		}
+		group := fmt.Sprintf("PartType%d", i)
+		for j := start; j < end; j++ {
+			buf.types[j] = uint8(i)
+		}
+
+		err = readHDF5Vectors(h, group+"/Coordinates", buf.xs[start:end])
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		err = readHDF5Vectors(h, group+"/Velocities", buf.vs[start:end])
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		err = readHDF5Ints(h, group+"/ParticleIDs", buf.ids[start:end])
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+
+		if hd.Mass[i] == 0 {
+			err = readHDF5Scalars(h, group+"/Masses", buf.ms[start:end])
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+		} else {
+			for j := start; j < end; j++ {
+				buf.ms[j] = float32(hd.Mass[i])
+			}
+		}
+
+		start = end
+	}
+
+	gh := &gadget2Header{Time: hd.Time, BoxSize: hd.BoxSize}
+	if hd.PeculiarVelocities {
+		// fix multiplies velocities by sqrt(Time), which would be wrong here.
+		gh.Time = 1
+	}
+	err = fix(gh, &buf.context, fname, buf.xs, buf.vs, buf.ms)
+
+	return buf.xs, buf.vs, buf.ms, buf.ids, err
+}
+
+// readHDF5Dataset reads the raw contents of the dataset at path and checks
+// that it has the expected number of elements.
+func readHDF5Dataset(
+	h *hdf5File, path string, n int,
+) (ds *hdf5Dataset, raw []byte, err error) {
+	obj, err := h.mustObject(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	ds, err = obj.dataset()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdf5Count(ds.dims) != n {
+		return nil, nil, fmt.Errorf("The dataset '%s' in %s has %d "+
+			"elements, but the header says it should have %d.",
+			path, h.fname, hdf5Count(ds.dims), n)
+	}
+	raw, err = ds.read()
+	return ds, raw, err
+}
+
+func readHDF5Vectors(h *hdf5File, path string, out [][3]float32) error {
+	ds, raw, err := readHDF5Dataset(h, path, 3*len(out))
+	if err != nil {
+		return err
+	}
+	floats, err := ds.dtype.floats()
+	if err != nil {
+		return fmt.Errorf("The dataset '%s' in %s can't be read: %s",
+			path, h.fname, err.Error())
+	}
+
+	size := ds.dtype.size
+	for i := range out {
+		for j := 0; j < 3; j++ {
+			out[i][j] = float32(floats(raw[(3*i+j)*size:]))
+		}
+	}
+	return nil
+}
+
+func readHDF5Scalars(h *hdf5File, path string, out []float32) error {
+	ds, raw, err := readHDF5Dataset(h, path, len(out))
+	if err != nil {
+		return err
+	}
+	floats, err := ds.dtype.floats()
+	if err != nil {
+		return fmt.Errorf("The dataset '%s' in %s can't be read: %s",
+			path, h.fname, err.Error())
+	}
+
+	for i := range out {
+		out[i] = float32(floats(raw[i*ds.dtype.size:]))
+	}
+	return nil
+}
+
+func readHDF5Ints(h *hdf5File, path string, out []int64) error {
+	ds, raw, err := readHDF5Dataset(h, path, len(out))
+	if err != nil {
+		return err
+	}
+	ints, err := ds.dtype.ints()
+	if err != nil {
+		return fmt.Errorf("The dataset '%s' in %s can't be read: %s",
+			path, h.fname, err.Error())
+	}
+
+	for i := range out {
+		out[i] = ints(raw[i*ds.dtype.size:])
+	}
+	return nil
+}
+
+func (buf *HDF5GadgetBuffer) Close() {
+	if !buf.open {
+		panic("Buffer not open.")
+	}
+	buf.open = false
+}
+
+func (buf *HDF5GadgetBuffer) IsOpen() bool {
+	return buf.open
+}
+
+func (buf *HDF5GadgetBuffer) Types() []uint8 { return buf.types }
+
+func (buf *HDF5GadgetBuffer) ReadHeader(fname string, out *Header) error {
+	h, err := openHDF5(fname)
+	if err != nil {
+		return err
+	}
+	hd, err := readHDF5GadgetHeader(h)
+	h.Close()
+	if err != nil {
+		return err
+	}
+
+	defer buf.Close()
+	xs, _, _, _, err := buf.Read(fname)
+	if err != nil {
+		return err
+	}
+
+	hd.postprocess(xs, &buf.context, out)
+
+	return nil
+}
+
+func (buf *HDF5GadgetBuffer) MinMass() float32 { return buf.mass }
+
+func (buf *HDF5GadgetBuffer) TotalParticles(fname string) (int, error) {
+	h, err := openHDF5(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+
+	hd, err := readHDF5GadgetHeader(h)
+	if err != nil {
+		return 0, err
+	}
+	if err = hd.checkTypes(&buf.context, fname); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, i := range buf.context.GadgetDMTypeIndices {
+		n += int(hd.NPartTotal[i])
+	}
+
+	return n, nil
+}
@@ -0,0 +1,1131 @@
+package io
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// This file contains a minimal, pure-Go reader for HDF5 files. It only
+// supports the subset of the format which simulation codes use when writing
+// snapshots:
+//
+// - Superblocks of every version (0-3).
+// - Version 1 and 2 object headers, including continuation blocks.
+// - Groups stored either as symbol tables (the default for most writers) or as
+//   compact link messages. Dense link storage is not supported.
+// - Attributes stored compactly in object headers.
+// - Compact, contiguous, and chunked datasets. Chunked datasets may be indexed
+//   by version 1 B-trees or by the single chunk and implicit indices.
+// - Fixed-point, floating point, and fixed-length string datatypes.
+// - The deflate, shuffle, and Fletcher32 filters.
+//
+// Anything else results in an error instead of incorrect data.
+
+var hdf5Signature = []byte("\x89HDF\r\n\x1a\n")
+
+// hdf5Undefined is the value of an undefined address.
+const hdf5Undefined = ^uint64(0)
+
+// Object header message types.
+const (
+	hdf5MsgDataspace    = 0x01
+	hdf5MsgLinkInfo     = 0x02
+	hdf5MsgDatatype     = 0x03
+	hdf5MsgLink         = 0x06
+	hdf5MsgLayout       = 0x08
+	hdf5MsgFilters      = 0x0b
+	hdf5MsgAttribute    = 0x0c
+	hdf5MsgContinuation = 0x10
+	hdf5MsgSymbolTable  = 0x11
+	hdf5MsgAttrInfo     = 0x15
+)
+
+// Datatype classes.
+const (
+	hdf5FixedPoint    = 0
+	hdf5FloatingPoint = 1
+	hdf5String        = 3
+)
+
+// Dataset layout classes.
+const (
+	hdf5Compact    = 0
+	hdf5Contiguous = 1
+	hdf5Chunked    = 2
+)
+
+// Chunk index types. hdf5BTreeIndex is used for every chunked dataset written
+// with a version 3 layout message.
+const (
+	hdf5BTreeIndex    = 0
+	hdf5SingleIndex   = 1
+	hdf5ImplicitIndex = 2
+)
+
+// hdf5File is an open HDF5 file.
+type hdf5File struct {
+	f                *os.File
+	fname            string
+	offSize, lenSize int
+	base             uint64
+	root             uint64
+}
+
+// hdf5Error is used to abort parsing from deep inside a structure. It is
+// converted into a normal error by recoverHDF5.
+type hdf5Error struct{ err error }
+
+// recoverHDF5 converts a hdf5Error panic into an error describing fname. It
+// must be deferred.
+func recoverHDF5(err *error, fname string) {
+	if x := recover(); x != nil {
+		hErr, ok := x.(hdf5Error)
+		if !ok {
+			panic(x)
+		}
+		*err = fmt.Errorf("The HDF5 file %s could not be read: %s",
+			fname, hErr.err.Error())
+	}
+}
+
+// hdf5Reader is a cursor which reads little endian values from a byte slice.
+type hdf5Reader struct {
+	buf []byte
+	i   int
+	h   *hdf5File
+}
+
+func (r *hdf5Reader) bytes(n int) []byte {
+	if n < 0 || r.i+n > len(r.buf) {
+		panic(hdf5Error{fmt.Errorf("a structure ended unexpectedly.")})
+	}
+	b := r.buf[r.i : r.i+n]
+	r.i += n
+	return b
+}
+
+func (r *hdf5Reader) skip(n int) { r.bytes(n) }
+
+func (r *hdf5Reader) uint(n int) uint64 {
+	b := r.bytes(n)
+	x := uint64(0)
+	for i := n - 1; i >= 0; i-- {
+		x = x<<8 | uint64(b[i])
+	}
+	return x
+}
+
+func (r *hdf5Reader) u8() int { return int(r.uint(1)) }
+
+// offset reads an address. Undefined addresses are returned as hdf5Undefined.
+func (r *hdf5Reader) offset() uint64 {
+	x := r.uint(r.h.offSize)
+	if r.h.offSize < 8 && x == 1<<uint(8*r.h.offSize)-1 {
+		return hdf5Undefined
+	}
+	return x
+}
+
+func (r *hdf5Reader) length() uint64 { return r.uint(r.h.lenSize) }
+
+func (r *hdf5Reader) signature(sig string) {
+	if s := string(r.bytes(len(sig))); s != sig {
+		panic(hdf5Error{fmt.Errorf("expected the signature '%s', but "+
+			"found '%s'.", sig, s)})
+	}
+}
+
+func (r *hdf5Reader) remaining() int { return len(r.buf) - r.i }
+
+// openHDF5 opens an HDF5 file and reads its superblock.
+func openHDF5(fname string) (h *hdf5File, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	defer recoverHDF5(&err, fname)
+
+	h = &hdf5File{f: f, fname: fname, offSize: 8, lenSize: 8}
+
+	// The superblock can be at 0, 512, 1024, 2048, etc.
+	sb := make([]byte, 128)
+	for off := int64(0); ; off *= 2 {
+		n, err := f.ReadAt(sb, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		} else if n < len(hdf5Signature) {
+			return nil, fmt.Errorf("%s is not an HDF5 file.", fname)
+		}
+
+		if bytes.Equal(sb[:len(hdf5Signature)], hdf5Signature) {
+			sb = sb[:n]
+			break
+		}
+		if off == 0 {
+			off = 256
+		}
+	}
+
+	r := &hdf5Reader{buf: sb, h: h}
+	r.skip(len(hdf5Signature))
+	switch version := r.u8(); version {
+	case 0, 1:
+		// Free-space, root group, and shared header message versions.
+		r.skip(4)
+		h.offSize, h.lenSize = r.u8(), r.u8()
+		// Group K values and file consistency flags.
+		r.skip(1 + 2 + 2 + 4)
+		if version == 1 {
+			r.skip(4)
+		}
+		h.base = r.offset()
+		// Free-space, end of file, and driver information addresses.
+		r.offset()
+		r.offset()
+		r.offset()
+		// The root group's symbol table entry starts with its link name.
+		r.offset()
+		h.root = r.offset()
+	case 2, 3:
+		h.offSize, h.lenSize = r.u8(), r.u8()
+		r.skip(1)
+		h.base = r.offset()
+		// Superblock extension and end of file addresses.
+		r.offset()
+		r.offset()
+		h.root = r.offset()
+	default:
+		return nil, fmt.Errorf("superblock version %d isn't supported.",
+			version)
+	}
+
+	if h.base == hdf5Undefined {
+		h.base = 0
+	}
+
+	return h, nil
+}
+
+// Close closes the file.
+func (h *hdf5File) Close() error { return h.f.Close() }
+
+// ReadHDF5Ints reads the integer dataset at path in the HDF5 file fname. It
+// lets other packages, like the SubLink merger tree reader, use the same HDF5
+// reader as the snapshot types.
+func ReadHDF5Ints(fname, path string) ([]int64, error) {
+	h, err := openHDF5(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+
+	obj, err := h.mustObject(path)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := obj.dataset()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]int64, hdf5Count(ds.dims))
+	if err := readHDF5Ints(h, path, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// read reads n bytes starting at the given address.
+func (h *hdf5File) read(addr uint64, n uint64) []byte {
+	if addr == hdf5Undefined {
+		panic(hdf5Error{fmt.Errorf("tried to read an undefined address.")})
+	}
+	buf := make([]byte, n)
+	_, err := h.f.ReadAt(buf, int64(h.base+addr))
+	if err != nil {
+		panic(hdf5Error{err})
+	}
+	return buf
+}
+
+// reader returns a reader over n bytes starting at the given address.
+func (h *hdf5File) reader(addr, n uint64) *hdf5Reader {
+	return &hdf5Reader{buf: h.read(addr, n), h: h}
+}
+
+// readPrefix is like read, but allows the read to run past the end of the
+// file. It's used for structures whose size isn't known ahead of time.
+func (h *hdf5File) readPrefix(addr uint64, n uint64) *hdf5Reader {
+	buf := make([]byte, n)
+	m, err := h.f.ReadAt(buf, int64(h.base+addr))
+	if err != nil && err != io.EOF {
+		panic(hdf5Error{err})
+	}
+	return &hdf5Reader{buf: buf[:m], h: h}
+}
+
+// hdf5Message is a single object header message.
+type hdf5Message struct {
+	typ   int
+	flags int
+	data  []byte
+}
+
+// hdf5Object is a group or dataset.
+type hdf5Object struct {
+	h    *hdf5File
+	name string
+	msgs []hdf5Message
+}
+
+// hdf5Block is a contiguous block of object header messages.
+type hdf5Block struct {
+	addr, size uint64
+}
+
+// object reads the object at the given path, e.g. "PartType1/Coordinates".
+// ok is false if the object doesn't exist.
+func (h *hdf5File) object(path string) (obj *hdf5Object, ok bool, err error) {
+	defer recoverHDF5(&err, h.fname)
+
+	obj = h.readObject(h.root, "/")
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		addr, ok := obj.child(name)
+		if !ok {
+			return nil, false, nil
+		}
+		obj = h.readObject(addr, strings.TrimRight(obj.name, "/")+"/"+name)
+	}
+
+	return obj, true, nil
+}
+
+// mustObject is like object, but returns an error if the object doesn't exist.
+func (h *hdf5File) mustObject(path string) (*hdf5Object, error) {
+	obj, ok, err := h.object(path)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("The HDF5 file %s doesn't contain '%s'.",
+			h.fname, path)
+	}
+	return obj, nil
+}
+
+// readObject reads all the messages in the object header at addr.
+func (h *hdf5File) readObject(addr uint64, name string) *hdf5Object {
+	obj := &hdf5Object{h: h, name: name}
+
+	r := h.readPrefix(addr, 64)
+	if r.remaining() > 0 && r.buf[0] == 1 {
+		r.skip(2)
+		nMsgs := int(r.uint(2))
+		r.skip(4)
+		size := r.uint(4)
+
+		// nMsgs includes continuation messages.
+		blocks := []hdf5Block{{addr + 16, size}}
+		for read := 0; len(blocks) > 0 && read < nMsgs; {
+			br := h.reader(blocks[0].addr, blocks[0].size)
+			blocks = blocks[1:]
+			for ; br.remaining() >= 8 && read < nMsgs; read++ {
+				typ, size := int(br.uint(2)), int(br.uint(2))
+				flags := br.u8()
+				br.skip(3)
+				msg := hdf5Message{typ, flags, br.bytes(size)}
+				blocks = obj.addMessage(msg, blocks)
+			}
+		}
+		return obj
+	}
+
+	r.signature("OHDR")
+	if version := r.u8(); version != 2 {
+		panic(hdf5Error{fmt.Errorf("object header version %d isn't "+
+			"supported.", version)})
+	}
+	flags := r.u8()
+	if flags&0x20 != 0 {
+		r.skip(16)
+	}
+	if flags&0x10 != 0 {
+		r.skip(4)
+	}
+	size := r.uint(1 << uint(flags&3))
+	hdrSize := 4
+	if flags&0x04 != 0 {
+		hdrSize += 2
+	}
+
+	blocks := []hdf5Block{{addr + uint64(r.i), size}}
+	for i := 0; len(blocks) > 0; i++ {
+		br := h.reader(blocks[0].addr, blocks[0].size)
+		blocks = blocks[1:]
+		if i > 0 {
+			br.signature("OCHK")
+			br.buf = br.buf[:len(br.buf)-4]
+		}
+
+		for br.remaining() >= hdrSize {
+			typ, size := br.u8(), int(br.uint(2))
+			flags := br.u8()
+			br.skip(hdrSize - 4)
+			msg := hdf5Message{typ, flags, br.bytes(size)}
+			blocks = obj.addMessage(msg, blocks)
+		}
+	}
+
+	return obj
+}
+
+// addMessage adds msg to the object, unless it's a continuation message, in
+// which case the block it points to is appended to blocks.
+func (obj *hdf5Object) addMessage(
+	msg hdf5Message, blocks []hdf5Block,
+) []hdf5Block {
+	if msg.typ == hdf5MsgContinuation {
+		r := &hdf5Reader{buf: msg.data, h: obj.h}
+		return append(blocks, hdf5Block{r.offset(), r.length()})
+	}
+	obj.msgs = append(obj.msgs, msg)
+	return blocks
+}
+
+// message returns the first message of the given type. ok is false if there
+// isn't one.
+func (obj *hdf5Object) message(typ int) (msg hdf5Message, ok bool) {
+	for _, msg := range obj.msgs {
+		if msg.typ == typ {
+			if msg.flags&0x02 != 0 {
+				panic(hdf5Error{fmt.Errorf("'%s' uses shared messages, "+
+					"which aren't supported.", obj.name)})
+			}
+			return msg, true
+		}
+	}
+	return hdf5Message{}, false
+}
+
+// child returns the address of the object header of a group's member.
+func (obj *hdf5Object) child(name string) (addr uint64, ok bool) {
+	h := obj.h
+
+	if msg, ok := obj.message(hdf5MsgSymbolTable); ok {
+		r := &hdf5Reader{buf: msg.data, h: h}
+		btree, heap := r.offset(), r.offset()
+		return h.symbolTableChild(btree, h.localHeap(heap), name)
+	}
+
+	dense := false
+	for _, msg := range obj.msgs {
+		switch msg.typ {
+		case hdf5MsgLink:
+			linkName, addr, hard := h.parseLink(msg.data)
+			if linkName != name {
+				continue
+			} else if !hard {
+				panic(hdf5Error{fmt.Errorf("'%s' is a soft or external "+
+					"link, which aren't supported.", name)})
+			}
+			return addr, true
+		case hdf5MsgLinkInfo:
+			r := &hdf5Reader{buf: msg.data, h: h}
+			r.skip(1)
+			if r.u8()&1 != 0 {
+				r.skip(8)
+			}
+			dense = r.offset() != hdf5Undefined
+		}
+	}
+
+	if dense {
+		panic(hdf5Error{fmt.Errorf("the group '%s' uses dense link "+
+			"storage, which isn't supported.", obj.name)})
+	}
+	return 0, false
+}
+
+// parseLink parses a link message.
+func (h *hdf5File) parseLink(data []byte) (name string, addr uint64, hard bool) {
+	r := &hdf5Reader{buf: data, h: h}
+	r.skip(1)
+	flags := r.u8()
+	linkType := 0
+	if flags&0x08 != 0 {
+		linkType = r.u8()
+	}
+	if flags&0x04 != 0 {
+		r.skip(8)
+	}
+	if flags&0x10 != 0 {
+		r.skip(1)
+	}
+	name = string(r.bytes(int(r.uint(1 << uint(flags&3)))))
+	if linkType != 0 {
+		return name, 0, false
+	}
+	return name, r.offset(), true
+}
+
+// localHeap returns the data segment of the local heap at addr.
+func (h *hdf5File) localHeap(addr uint64) []byte {
+	r := h.reader(addr, uint64(8+2*h.lenSize+h.offSize))
+	r.signature("HEAP")
+	r.skip(4)
+	size := r.length()
+	r.length()
+	return h.read(r.offset(), size)
+}
+
+// heapString returns the null-terminated string at offset in a local heap.
+func heapString(heap []byte, offset uint64) string {
+	if offset >= uint64(len(heap)) {
+		panic(hdf5Error{fmt.Errorf("a local heap offset is out of range.")})
+	}
+	s := heap[offset:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(s)
+}
+
+// hdf5TreeNode is a node of a version 1 B-tree.
+type hdf5TreeNode struct {
+	level    int
+	keys     [][]byte
+	children []uint64
+}
+
+// treeNode reads the version 1 B-tree node at addr. Each key is keySize bytes.
+func (h *hdf5File) treeNode(addr uint64, typ, keySize int) *hdf5TreeNode {
+	r := h.reader(addr, uint64(8+2*h.offSize))
+	r.signature("TREE")
+	if t := r.u8(); t != typ {
+		panic(hdf5Error{fmt.Errorf("expected a B-tree node of type %d, "+
+			"but found type %d.", typ, t)})
+	}
+	node := &hdf5TreeNode{level: r.u8()}
+	entries := int(r.uint(2))
+
+	r = h.reader(addr+uint64(8+2*h.offSize),
+		uint64(entries*(keySize+h.offSize)+keySize))
+	for i := 0; i < entries; i++ {
+		node.keys = append(node.keys, r.bytes(keySize))
+		node.children = append(node.children, r.offset())
+	}
+	node.keys = append(node.keys, r.bytes(keySize))
+
+	return node
+}
+
+// symbolTableChild searches the group B-tree at addr for a link with the given
+// name.
+func (h *hdf5File) symbolTableChild(
+	addr uint64, heap []byte, name string,
+) (uint64, bool) {
+	node := h.treeNode(addr, 0, h.lenSize)
+	for _, child := range node.children {
+		if node.level > 0 {
+			if addr, ok := h.symbolTableChild(child, heap, name); ok {
+				return addr, true
+			}
+			continue
+		}
+
+		r := h.reader(child, 8)
+		r.signature("SNOD")
+		r.skip(2)
+		n := int(r.uint(2))
+		entrySize := 2*h.offSize + 24
+		r = h.reader(child+8, uint64(n*entrySize))
+		for i := 0; i < n; i++ {
+			linkName, objAddr := r.offset(), r.offset()
+			r.skip(24)
+			if heapString(heap, linkName) == name {
+				return objAddr, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// hdf5Type is a fixed-point, floating point, or string datatype.
+type hdf5Type struct {
+	class  int
+	size   int
+	order  binary.ByteOrder
+	signed bool
+}
+
+// parseType parses a datatype message.
+func (h *hdf5File) parseType(data []byte) hdf5Type {
+	r := &hdf5Reader{buf: data, h: h}
+	t := hdf5Type{class: r.u8() & 0x0f, order: binary.LittleEndian}
+	bits := r.u8()
+	r.skip(2)
+	t.size = int(r.uint(4))
+
+	switch t.class {
+	case hdf5FixedPoint:
+		t.signed = bits&0x08 != 0
+		if bits&0x01 != 0 {
+			t.order = binary.BigEndian
+		}
+	case hdf5FloatingPoint:
+		if bits&0x41 == 0x01 {
+			t.order = binary.BigEndian
+		} else if bits&0x41 != 0 {
+			panic(hdf5Error{fmt.Errorf("VAX floating point numbers aren't " +
+				"supported.")})
+		}
+	}
+
+	return t
+}
+
+// floats returns a function which converts a single value of type t to a
+// float64.
+func (t hdf5Type) floats() (func(b []byte) float64, error) {
+	switch {
+	case t.class == hdf5FloatingPoint && t.size == 4:
+		return func(b []byte) float64 {
+			return float64(math.Float32frombits(t.order.Uint32(b)))
+		}, nil
+	case t.class == hdf5FloatingPoint && t.size == 8:
+		return func(b []byte) float64 {
+			return math.Float64frombits(t.order.Uint64(b))
+		}, nil
+	case t.class == hdf5FixedPoint:
+		ints, err := t.ints()
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) float64 { return float64(ints(b)) }, nil
+	}
+	return nil, fmt.Errorf("a datatype of class %d and size %d can't be "+
+		"read as a number.", t.class, t.size)
+}
+
+// ints returns a function which converts a single value of type t to an int64.
+func (t hdf5Type) ints() (func(b []byte) int64, error) {
+	switch t.class {
+	case hdf5FloatingPoint:
+		floats, err := t.floats()
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) int64 { return int64(floats(b)) }, nil
+	case hdf5FixedPoint:
+		if t.size != 1 && t.size != 2 && t.size != 4 && t.size != 8 {
+			break
+		}
+		shift := uint(64 - 8*t.size)
+		return func(b []byte) int64 {
+			x := uint64(0)
+			if t.order == binary.LittleEndian {
+				for i := t.size - 1; i >= 0; i-- {
+					x = x<<8 | uint64(b[i])
+				}
+			} else {
+				for i := 0; i < t.size; i++ {
+					x = x<<8 | uint64(b[i])
+				}
+			}
+			if t.signed {
+				return int64(x<<shift) >> shift
+			}
+			return int64(x)
+		}, nil
+	}
+	return nil, fmt.Errorf("a datatype of class %d and size %d can't be "+
+		"read as an integer.", t.class, t.size)
+}
+
+// parseSpace parses a dataspace message and returns its dimensions. Scalars
+// have no dimensions.
+func (h *hdf5File) parseSpace(data []byte) []uint64 {
+	r := &hdf5Reader{buf: data, h: h}
+	version, rank := r.u8(), r.u8()
+	r.skip(1)
+	switch version {
+	case 1:
+		r.skip(5)
+	case 2:
+		if r.u8() == 2 {
+			return []uint64{0}
+		}
+	default:
+		panic(hdf5Error{fmt.Errorf("dataspace version %d isn't supported.",
+			version)})
+	}
+
+	dims := make([]uint64, rank)
+	for i := range dims {
+		dims[i] = r.length()
+	}
+	return dims
+}
+
+// hdf5Count returns the number of elements in an array with dimensions dims.
+func hdf5Count(dims []uint64) int {
+	n := 1
+	for _, d := range dims {
+		n *= int(d)
+	}
+	return n
+}
+
+// hdf5Attr is an attribute of a group or dataset.
+type hdf5Attr struct {
+	dims  []uint64
+	dtype hdf5Type
+	data  []byte
+}
+
+// attr returns the attribute with the given name. ok is false if there isn't
+// one.
+func (obj *hdf5Object) attr(name string) (attr *hdf5Attr, ok bool, err error) {
+	defer recoverHDF5(&err, obj.h.fname)
+
+	dense := false
+	for _, msg := range obj.msgs {
+		if msg.typ == hdf5MsgAttrInfo {
+			r := &hdf5Reader{buf: msg.data, h: obj.h}
+			r.skip(1)
+			if r.u8()&1 != 0 {
+				r.skip(2)
+			}
+			dense = r.offset() != hdf5Undefined
+		}
+		if msg.typ != hdf5MsgAttribute {
+			continue
+		}
+
+		r := &hdf5Reader{buf: msg.data, h: obj.h}
+		version := r.u8()
+		r.skip(1)
+		nameSize, typeSize := int(r.uint(2)), int(r.uint(2))
+		spaceSize := int(r.uint(2))
+		pad := func(n int) int { return n }
+		switch version {
+		case 1:
+			pad = func(n int) int { return (n + 7) / 8 * 8 }
+		case 2:
+		case 3:
+			r.skip(1)
+		default:
+			return nil, false, fmt.Errorf("attribute message version %d "+
+				"isn't supported.", version)
+		}
+
+		attrName := string(bytes.TrimRight(r.bytes(pad(nameSize)), "\x00"))
+		if attrName != name {
+			continue
+		}
+		if msg.flags&0x02 != 0 || (version > 1 && msg.data[1] != 0) {
+			return nil, false, fmt.Errorf("the attribute '%s' of '%s' "+
+				"uses shared datatypes, which aren't supported.",
+				name, obj.name)
+		}
+
+		attr := &hdf5Attr{}
+		attr.dtype = obj.h.parseType(r.bytes(pad(typeSize)))
+		attr.dims = obj.h.parseSpace(r.bytes(pad(spaceSize)))
+		attr.data = r.bytes(hdf5Count(attr.dims) * attr.dtype.size)
+		return attr, true, nil
+	}
+
+	if dense {
+		return nil, false, fmt.Errorf("'%s' uses dense attribute storage, "+
+			"which isn't supported.", obj.name)
+	}
+	return nil, false, nil
+}
+
+// floatAttr returns the values of a numeric attribute as float64s.
+func (obj *hdf5Object) floatAttr(name string) ([]float64, error) {
+	attr, ok, err := obj.attr(name)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("'%s' in the HDF5 file %s doesn't have "+
+			"the attribute '%s'.", obj.name, obj.h.fname, name)
+	}
+
+	floats, err := attr.dtype.floats()
+	if err != nil {
+		return nil, fmt.Errorf("The attribute '%s' of '%s' in the HDF5 "+
+			"file %s is not a number: %s", name, obj.name, obj.h.fname, err)
+	}
+	out := make([]float64, hdf5Count(attr.dims))
+	for i := range out {
+		out[i] = floats(attr.data[i*attr.dtype.size:])
+	}
+	return out, nil
+}
+
+// intAttr returns the values of a numeric attribute as int64s.
+func (obj *hdf5Object) intAttr(name string) ([]int64, error) {
+	attr, ok, err := obj.attr(name)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("'%s' in the HDF5 file %s doesn't have "+
+			"the attribute '%s'.", obj.name, obj.h.fname, name)
+	}
+
+	ints, err := attr.dtype.ints()
+	if err != nil {
+		return nil, fmt.Errorf("The attribute '%s' of '%s' in the HDF5 "+
+			"file %s is not a number: %s", name, obj.name, obj.h.fname, err)
+	}
+	out := make([]int64, hdf5Count(attr.dims))
+	for i := range out {
+		out[i] = ints(attr.data[i*attr.dtype.size:])
+	}
+	return out, nil
+}
+
+// hdf5Filter is a single filter in a dataset's filter pipeline.
+type hdf5Filter struct {
+	id     int
+	values []uint32
+}
+
+// hdf5Dataset describes where the data of a dataset is stored.
+type hdf5Dataset struct {
+	h     *hdf5File
+	name  string
+	dims  []uint64
+	dtype hdf5Type
+
+	layout     int
+	addr, size uint64
+	compact    []byte
+
+	chunk        []uint64
+	index        int
+	filteredSize uint64
+	filterMask   uint32
+	filters      []hdf5Filter
+}
+
+// dataset reads the dataspace, datatype, layout, and filters of a dataset.
+func (obj *hdf5Object) dataset() (ds *hdf5Dataset, err error) {
+	defer recoverHDF5(&err, obj.h.fname)
+	h := obj.h
+	ds = &hdf5Dataset{h: h, name: obj.name}
+
+	space, ok1 := obj.message(hdf5MsgDataspace)
+	dtype, ok2 := obj.message(hdf5MsgDatatype)
+	layout, ok3 := obj.message(hdf5MsgLayout)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("'%s' in the HDF5 file %s isn't a dataset.",
+			obj.name, h.fname)
+	}
+	ds.dims = h.parseSpace(space.data)
+	ds.dtype = h.parseType(dtype.data)
+
+	r := &hdf5Reader{buf: layout.data, h: h}
+	switch version := r.u8(); version {
+	case 1, 2:
+		rank := r.u8()
+		ds.layout = r.u8()
+		r.skip(5)
+		if ds.layout != hdf5Compact {
+			ds.addr = r.offset()
+		}
+		dims := make([]uint64, rank)
+		for i := range dims {
+			dims[i] = r.uint(4)
+		}
+		switch ds.layout {
+		case hdf5Compact:
+			ds.compact = r.bytes(int(r.uint(4)))
+		case hdf5Contiguous:
+			ds.size = uint64(hdf5Count(ds.dims) * ds.dtype.size)
+		case hdf5Chunked:
+			ds.chunk = dims[:rank-1]
+		}
+	case 3, 4:
+		ds.layout = r.u8()
+		switch ds.layout {
+		case hdf5Compact:
+			ds.compact = r.bytes(int(r.uint(2)))
+		case hdf5Contiguous:
+			ds.addr, ds.size = r.offset(), r.length()
+		case hdf5Chunked:
+			ds.parseChunkedLayout(r, version)
+		default:
+			return nil, fmt.Errorf("'%s' in the HDF5 file %s uses layout "+
+				"class %d, which isn't supported.", obj.name, h.fname,
+				ds.layout)
+		}
+	default:
+		return nil, fmt.Errorf("data layout message version %d isn't "+
+			"supported.", version)
+	}
+
+	if msg, ok := obj.message(hdf5MsgFilters); ok {
+		ds.filters = h.parseFilters(msg.data)
+	}
+
+	return ds, nil
+}
+
+// parseChunkedLayout parses the part of a version 3 or 4 layout message which
+// describes a chunked dataset.
+func (ds *hdf5Dataset) parseChunkedLayout(r *hdf5Reader, version int) {
+	if version == 3 {
+		rank := r.u8() - 1
+		ds.index = hdf5BTreeIndex
+		ds.addr = r.offset()
+		ds.chunk = make([]uint64, rank)
+		for i := range ds.chunk {
+			ds.chunk[i] = r.uint(4)
+		}
+		return
+	}
+
+	flags, rank := r.u8(), r.u8()-1
+	encSize := r.u8()
+	ds.chunk = make([]uint64, rank)
+	for i := range ds.chunk {
+		ds.chunk[i] = r.uint(encSize)
+	}
+	r.skip(encSize)
+
+	switch ds.index = r.u8(); ds.index {
+	case hdf5SingleIndex:
+		if flags&0x02 != 0 {
+			ds.filteredSize = r.length()
+			ds.filterMask = uint32(r.uint(4))
+		}
+	case hdf5ImplicitIndex:
+	default:
+		panic(hdf5Error{fmt.Errorf("'%s' uses chunk index type %d, which "+
+			"isn't supported.", ds.name, ds.index)})
+	}
+	ds.addr = r.offset()
+}
+
+// parseFilters parses a filter pipeline message.
+func (h *hdf5File) parseFilters(data []byte) []hdf5Filter {
+	r := &hdf5Reader{buf: data, h: h}
+	version, n := r.u8(), r.u8()
+	if version == 1 {
+		r.skip(6)
+	}
+
+	filters := make([]hdf5Filter, n)
+	for i := range filters {
+		f := &filters[i]
+		f.id = int(r.uint(2))
+		nameSize := 0
+		if version == 1 || f.id >= 256 {
+			nameSize = int(r.uint(2))
+		}
+		r.skip(2)
+		nValues := int(r.uint(2))
+		if version == 1 {
+			nameSize = (nameSize + 7) / 8 * 8
+		}
+		r.skip(nameSize)
+
+		f.values = make([]uint32, nValues)
+		for j := range f.values {
+			f.values[j] = uint32(r.uint(4))
+		}
+		if version == 1 && nValues%2 == 1 {
+			r.skip(4)
+		}
+	}
+	return filters
+}
+
+// read returns the raw contents of the dataset in row-major order.
+func (ds *hdf5Dataset) read() (out []byte, err error) {
+	defer recoverHDF5(&err, ds.h.fname)
+
+	n := uint64(hdf5Count(ds.dims) * ds.dtype.size)
+	switch ds.layout {
+	case hdf5Compact:
+		if uint64(len(ds.compact)) < n {
+			return nil, fmt.Errorf("'%s' is smaller than its dataspace.",
+				ds.name)
+		}
+		return ds.compact[:n], nil
+	case hdf5Contiguous:
+		if n == 0 || ds.addr == hdf5Undefined {
+			return make([]byte, n), nil
+		}
+		return ds.h.read(ds.addr, n), nil
+	}
+
+	out = make([]byte, n)
+	if n == 0 || ds.addr == hdf5Undefined {
+		return out, nil
+	}
+	chunkSize := uint64(hdf5Count(ds.chunk) * ds.dtype.size)
+	offset := make([]uint64, len(ds.dims))
+
+	switch ds.index {
+	case hdf5BTreeIndex:
+		ds.readChunkTree(ds.addr, out)
+	case hdf5SingleIndex:
+		size := chunkSize
+		if ds.filteredSize > 0 {
+			size = ds.filteredSize
+		}
+		chunk := ds.unfilter(ds.h.read(ds.addr, size), ds.filterMask)
+		ds.copyChunk(out, chunk, offset)
+	case hdf5ImplicitIndex:
+		for addr := ds.addr; ; addr += chunkSize {
+			ds.copyChunk(out, ds.h.read(addr, chunkSize), offset)
+
+			i := len(offset) - 1
+			for ; i >= 0; i-- {
+				offset[i] += ds.chunk[i]
+				if offset[i] < ds.dims[i] {
+					break
+				}
+				offset[i] = 0
+			}
+			if i < 0 {
+				break
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// readChunkTree reads every chunk indexed by the B-tree node at addr into out.
+func (ds *hdf5Dataset) readChunkTree(addr uint64, out []byte) {
+	rank := len(ds.dims)
+	node := ds.h.treeNode(addr, 1, 8+8*(rank+1))
+	for i, child := range node.children {
+		if node.level > 0 {
+			ds.readChunkTree(child, out)
+			continue
+		}
+
+		r := &hdf5Reader{buf: node.keys[i], h: ds.h}
+		size, mask := r.uint(4), uint32(r.uint(4))
+		offset := make([]uint64, rank)
+		for j := range offset {
+			offset[j] = r.uint(8)
+		}
+
+		ds.copyChunk(out, ds.unfilter(ds.h.read(child, size), mask), offset)
+	}
+}
+
+// unfilter undoes the filter pipeline for a single chunk. Filters whose bit is
+// set in mask were skipped when the chunk was written.
+func (ds *hdf5Dataset) unfilter(data []byte, mask uint32) []byte {
+	for i := len(ds.filters) - 1; i >= 0; i-- {
+		if mask&(1<<uint(i)) != 0 {
+			continue
+		}
+
+		f := ds.filters[i]
+		switch f.id {
+		case 1:
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				panic(hdf5Error{err})
+			}
+			data, err = ioutil.ReadAll(zr)
+			if err != nil {
+				panic(hdf5Error{err})
+			}
+		case 2:
+			size := ds.dtype.size
+			if len(f.values) > 0 {
+				size = int(f.values[0])
+			}
+			data = unshuffle(data, size)
+		case 3:
+			data = data[:len(data)-4]
+		default:
+			panic(hdf5Error{fmt.Errorf("'%s' uses filter %d, which isn't "+
+				"supported.", ds.name, f.id)})
+		}
+	}
+	return data
+}
+
+// unshuffle undoes the HDF5 shuffle filter, which groups together the n-th
+// bytes of every element.
+func unshuffle(data []byte, size int) []byte {
+	n := len(data) / size
+	out := make([]byte, len(data))
+	for j := 0; j < size; j++ {
+		for i := 0; i < n; i++ {
+			out[i*size+j] = data[j*n+i]
+		}
+	}
+	copy(out[n*size:], data[n*size:])
+	return out
+}
+
+// copyChunk copies the part of a chunk which is inside the dataset into out.
+// offset is the index of the chunk's first element.
+func (ds *hdf5Dataset) copyChunk(out, chunk []byte, offset []uint64) {
+	rank, size := len(ds.dims), uint64(ds.dtype.size)
+	if uint64(len(chunk)) < uint64(hdf5Count(ds.chunk))*size {
+		panic(hdf5Error{fmt.Errorf("a chunk of '%s' is too small.", ds.name)})
+	}
+
+	// Chunks along the upper edge of the dataset may extend past it.
+	extent := make([]uint64, rank)
+	for i := range extent {
+		if offset[i] >= ds.dims[i] {
+			return
+		}
+		extent[i] = ds.chunk[i]
+		if offset[i]+extent[i] > ds.dims[i] {
+			extent[i] = ds.dims[i] - offset[i]
+		}
+	}
+
+	// Copy one row along the last dimension at a time.
+	idx := make([]uint64, rank)
+	for {
+		src, dst := uint64(0), uint64(0)
+		for i := 0; i < rank; i++ {
+			src = src*ds.chunk[i] + idx[i]
+			dst = dst*ds.dims[i] + offset[i] + idx[i]
+		}
+		n := extent[rank-1] * size
+		copy(out[dst*size:dst*size+n], chunk[src*size:src*size+n])
+
+		i := rank - 2
+		for ; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < extent[i] {
+				break
+			}
+			idx[i] = 0
+		}
+		if i < 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,680 @@
+package io
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+////////////////////////////////////////////////////////////////////////////
+// A minimal HDF5 writer. It produces files in one of two layouts: the one //
+// used by default by the HDF5 library (superblock version 0, version 1   //
+// object headers, and symbol table groups) and the one used when h5py is  //
+// told to use the latest format (superblock version 2, version 2 object  //
+// headers, and link messages).                                           //
+////////////////////////////////////////////////////////////////////////////
+
+type h5Attr struct {
+	name  string
+	dtype []byte
+	dims  []uint64
+	data  []byte
+}
+
+type h5Dataset struct {
+	name    string
+	dtype   []byte
+	dims    []uint64
+	data    []byte
+	chunk   []uint64
+	filters bool
+}
+
+type h5Group struct {
+	name     string
+	attrs    []h5Attr
+	groups   []*h5Group
+	datasets []*h5Dataset
+}
+
+type h5Writer struct {
+	buf    []byte
+	latest bool
+}
+
+// h5Msg is an object header message.
+type h5Msg struct {
+	typ  int
+	data []byte
+}
+
+func le(size int, x uint64) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(x >> uint(8*i))
+	}
+	return b
+}
+
+func cat(bs ...[]byte) []byte {
+	out := []byte{}
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func pad8(b []byte) []byte {
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func h5FloatType(size int) []byte {
+	props := cat(le(2, 0), le(2, 64), []byte{52, 11, 0, 52}, le(4, 1023))
+	sign := 63
+	if size == 4 {
+		props = cat(le(2, 0), le(2, 32), []byte{23, 8, 0, 23}, le(4, 127))
+		sign = 31
+	}
+	return cat([]byte{0x11, 0x20, byte(sign), 0}, le(4, uint64(size)), props)
+}
+
+func h5IntType(size int, signed bool) []byte {
+	bits := byte(0)
+	if signed {
+		bits = 0x08
+	}
+	return cat([]byte{0x10, bits, 0, 0}, le(4, uint64(size)),
+		le(2, 0), le(2, uint64(8*size)))
+}
+
+func f64Attr(name string, xs ...float64) h5Attr {
+	data := []byte{}
+	for _, x := range xs {
+		data = append(data, le(8, math.Float64bits(x))...)
+	}
+	return h5Attr{name, h5FloatType(8), []uint64{uint64(len(xs))}, data}
+}
+
+func scalarAttr(name string, x float64) h5Attr {
+	return h5Attr{name, h5FloatType(8), []uint64{}, le(8, math.Float64bits(x))}
+}
+
+func intAttr(name string, size int, xs ...int64) h5Attr {
+	data := []byte{}
+	for _, x := range xs {
+		data = append(data, le(size, uint64(x))...)
+	}
+	return h5Attr{name, h5IntType(size, false), []uint64{uint64(len(xs))}, data}
+}
+
+func f32Dataset(name string, width int, xs ...float32) *h5Dataset {
+	data := []byte{}
+	for _, x := range xs {
+		data = append(data, le(4, uint64(math.Float32bits(x)))...)
+	}
+	dims := []uint64{uint64(len(xs) / width), uint64(width)}
+	if width == 1 {
+		dims = dims[:1]
+	}
+	return &h5Dataset{name: name, dtype: h5FloatType(4), dims: dims, data: data}
+}
+
+func f64Dataset(name string, width int, xs ...float64) *h5Dataset {
+	data := []byte{}
+	for _, x := range xs {
+		data = append(data, le(8, math.Float64bits(x))...)
+	}
+	dims := []uint64{uint64(len(xs) / width), uint64(width)}
+	if width == 1 {
+		dims = dims[:1]
+	}
+	return &h5Dataset{name: name, dtype: h5FloatType(8), dims: dims, data: data}
+}
+
+func intDataset(name string, size int, signed bool, xs ...int64) *h5Dataset {
+	data := []byte{}
+	for _, x := range xs {
+		data = append(data, le(size, uint64(x))...)
+	}
+	return &h5Dataset{
+		name: name, dtype: h5IntType(size, signed),
+		dims: []uint64{uint64(len(xs))}, data: data,
+	}
+}
+
+// alloc appends b to the file and returns its address.
+func (w *h5Writer) alloc(b []byte) uint64 {
+	addr := uint64(len(w.buf))
+	w.buf = pad8(append(w.buf, b...))
+	return addr
+}
+
+func (w *h5Writer) space(dims []uint64) []byte {
+	var out []byte
+	if w.latest {
+		typ := byte(1)
+		if len(dims) == 0 {
+			typ = 0
+		}
+		out = []byte{2, byte(len(dims)), 0, typ}
+	} else {
+		out = []byte{1, byte(len(dims)), 0, 0, 0, 0, 0, 0}
+	}
+	for _, d := range dims {
+		out = append(out, le(8, d)...)
+	}
+	return out
+}
+
+func (w *h5Writer) attr(a h5Attr) h5Msg {
+	name := append([]byte(a.name), 0)
+	space := w.space(a.dims)
+	if w.latest {
+		return h5Msg{0x0c, cat(
+			[]byte{3, 0}, le(2, uint64(len(name))), le(2, uint64(len(a.dtype))),
+			le(2, uint64(len(space))), []byte{0}, name, a.dtype, space, a.data,
+		)}
+	}
+	return h5Msg{0x0c, cat(
+		[]byte{1, 0}, le(2, uint64(len(name))), le(2, uint64(len(a.dtype))),
+		le(2, uint64(len(space))), pad8(name), pad8(a.dtype), pad8(space),
+		a.data,
+	)}
+}
+
+// header writes an object header containing msgs. The messages are split
+// across two blocks so that continuation messages are tested.
+func (w *h5Writer) header(msgs []h5Msg) uint64 {
+	split := len(msgs) / 2
+	if w.latest {
+		block := func(msgs []h5Msg) []byte {
+			out := []byte{}
+			for _, m := range msgs {
+				out = append(out, cat([]byte{byte(m.typ)},
+					le(2, uint64(len(m.data))), []byte{0}, m.data)...)
+			}
+			return out
+		}
+		cont := w.alloc(cat([]byte("OCHK"), block(msgs[split:]), le(4, 0)))
+		contLen := uint64(len(block(msgs[split:])) + 8)
+		first := block(append(msgs[:split:split], h5Msg{0x10,
+			cat(le(8, cont), le(8, contLen))}))
+		return w.alloc(cat([]byte("OHDR"), []byte{2, 2},
+			le(4, uint64(len(first))), first, le(4, 0)))
+	}
+
+	block := func(msgs []h5Msg) []byte {
+		out := []byte{}
+		for _, m := range msgs {
+			data := pad8(append([]byte{}, m.data...))
+			out = append(out, cat(le(2, uint64(m.typ)),
+				le(2, uint64(len(data))), []byte{0, 0, 0, 0}, data)...)
+		}
+		return out
+	}
+	second := block(msgs[split:])
+	cont := w.alloc(second)
+	first := block(append(msgs[:split:split], h5Msg{0x10,
+		cat(le(8, cont), le(8, uint64(len(second))))}))
+	return w.alloc(cat([]byte{1, 0}, le(2, uint64(len(msgs)+1)), le(4, 1),
+		le(4, uint64(len(first))), le(4, 0), first))
+}
+
+// chunks splits a dataset into chunks in row-major order, padding chunks on
+// the upper edges with zeros. It returns the chunks and their offsets.
+func (ds *h5Dataset) chunks() (chunks [][]byte, offsets [][]uint64) {
+	size := uint64(len(ds.data) / hdf5Count(ds.dims))
+	offset := make([]uint64, len(ds.dims))
+	for {
+		chunk := make([]byte, uint64(hdf5Count(ds.chunk))*size)
+		idx := make([]uint64, len(ds.dims))
+		for i := 0; i < hdf5Count(ds.chunk); i++ {
+			src, dst, inside := uint64(0), uint64(0), true
+			for j := range idx {
+				inside = inside && offset[j]+idx[j] < ds.dims[j]
+				src = src*ds.dims[j] + offset[j] + idx[j]
+				dst = dst*ds.chunk[j] + idx[j]
+			}
+			if inside {
+				copy(chunk[dst*size:(dst+1)*size], ds.data[src*size:])
+			}
+			for j := len(idx) - 1; j >= 0; j-- {
+				if idx[j]++; idx[j] < ds.chunk[j] {
+					break
+				}
+				idx[j] = 0
+			}
+		}
+
+		chunks = append(chunks, chunk)
+		offsets = append(offsets, append([]uint64{}, offset...))
+
+		j := len(offset) - 1
+		for ; j >= 0; j-- {
+			if offset[j] += ds.chunk[j]; offset[j] < ds.dims[j] {
+				break
+			}
+			offset[j] = 0
+		}
+		if j < 0 {
+			return chunks, offsets
+		}
+	}
+}
+
+func (w *h5Writer) dataset(ds *h5Dataset, attrs []h5Attr) uint64 {
+	msgs := []h5Msg{{0x01, w.space(ds.dims)}, {0x03, ds.dtype}}
+	size := uint64(len(ds.data) / hdf5Count(ds.dims))
+	rank := len(ds.dims)
+
+	switch {
+	case ds.chunk == nil:
+		version := byte(3)
+		if w.latest {
+			version = 4
+		}
+		addr := w.alloc(ds.data)
+		msgs = append(msgs, h5Msg{0x08, cat([]byte{version, 1},
+			le(8, addr), le(8, uint64(len(ds.data))))})
+
+	case w.latest:
+		// Implicit index: unfiltered chunks stored back to back.
+		chunks, _ := ds.chunks()
+		addr := w.alloc(cat(chunks...))
+		layout := []byte{4, 2, 0, byte(rank + 1), 4}
+		for _, c := range ds.chunk {
+			layout = append(layout, le(4, c)...)
+		}
+		layout = cat(layout, le(4, size), []byte{2}, le(8, addr))
+		msgs = append(msgs, h5Msg{0x08, layout})
+
+	default:
+		// Version 1 B-tree index with shuffle and deflate filters.
+		chunks, offsets := ds.chunks()
+		node := cat([]byte("TREE"), []byte{1, 0}, le(2, uint64(len(chunks))),
+			le(8, hdf5Undefined), le(8, hdf5Undefined))
+		for i, chunk := range chunks {
+			if ds.filters {
+				chunk = unshuffleInverse(chunk, int(size))
+				zbuf := &bytes.Buffer{}
+				zw := zlib.NewWriter(zbuf)
+				zw.Write(chunk)
+				zw.Close()
+				chunk = zbuf.Bytes()
+			}
+			addr := w.alloc(chunk)
+			node = append(node, cat(le(4, uint64(len(chunk))), le(4, 0))...)
+			for _, x := range offsets[i] {
+				node = append(node, le(8, x)...)
+			}
+			node = cat(node, le(8, 0), le(8, addr))
+		}
+		node = cat(node, le(4, 0), le(4, 0))
+		for _, d := range ds.dims {
+			node = append(node, le(8, d)...)
+		}
+		node = append(node, le(8, 0)...)
+		btree := w.alloc(node)
+
+		layout := []byte{3, 2, byte(rank + 1)}
+		layout = append(layout, le(8, btree)...)
+		for _, c := range ds.chunk {
+			layout = append(layout, le(4, c)...)
+		}
+		msgs = append(msgs, h5Msg{0x08, cat(layout, le(4, size))})
+
+		if ds.filters {
+			msgs = append(msgs, h5Msg{0x0b, cat(
+				[]byte{1, 2, 0, 0, 0, 0, 0, 0},
+				le(2, 2), le(2, 0), le(2, 0), le(2, 1), le(4, size), le(4, 0),
+				le(2, 1), le(2, 0), le(2, 0), le(2, 1), le(4, 6), le(4, 0),
+			)})
+		}
+	}
+
+	for _, a := range attrs {
+		msgs = append(msgs, w.attr(a))
+	}
+	return w.header(msgs)
+}
+
+// unshuffleInverse applies the HDF5 shuffle filter.
+func unshuffleInverse(data []byte, size int) []byte {
+	n := len(data) / size
+	out := make([]byte, len(data))
+	for j := 0; j < size; j++ {
+		for i := 0; i < n; i++ {
+			out[j*n+i] = data[i*size+j]
+		}
+	}
+	return out
+}
+
+func (w *h5Writer) group(g *h5Group) uint64 {
+	names, addrs := []string{}, []uint64{}
+	for _, child := range g.groups {
+		names, addrs = append(names, child.name), append(addrs, w.group(child))
+	}
+	for _, ds := range g.datasets {
+		names, addrs = append(names, ds.name), append(addrs, w.dataset(ds, nil))
+	}
+
+	msgs := []h5Msg{}
+	if w.latest {
+		msgs = append(msgs, h5Msg{0x02,
+			cat([]byte{0, 0}, le(8, hdf5Undefined), le(8, hdf5Undefined))})
+		for i := range names {
+			msgs = append(msgs, h5Msg{0x06, cat([]byte{1, 0, byte(len(names[i]))},
+				[]byte(names[i]), le(8, addrs[i]))})
+		}
+	} else {
+		heap, offsets := []byte{0}, []uint64{}
+		for _, name := range names {
+			offsets = append(offsets, uint64(len(heap)))
+			heap = pad8(append(heap, append([]byte(name), 0)...))
+		}
+		heapData := w.alloc(heap)
+		heapAddr := w.alloc(cat([]byte("HEAP"), []byte{0, 0, 0, 0},
+			le(8, uint64(len(heap))), le(8, hdf5Undefined), le(8, heapData)))
+
+		snod := cat([]byte("SNOD"), []byte{1, 0}, le(2, uint64(len(names))))
+		for i := range names {
+			snod = cat(snod, le(8, offsets[i]), le(8, addrs[i]), make([]byte, 24))
+		}
+		snodAddr := w.alloc(snod)
+
+		last := uint64(0)
+		if len(offsets) > 0 {
+			last = offsets[len(offsets)-1]
+		}
+		btree := w.alloc(cat([]byte("TREE"), []byte{0, 0}, le(2, 1),
+			le(8, hdf5Undefined), le(8, hdf5Undefined),
+			le(8, 0), le(8, snodAddr), le(8, last)))
+		msgs = append(msgs, h5Msg{0x11, cat(le(8, btree), le(8, heapAddr))})
+	}
+
+	for _, a := range g.attrs {
+		msgs = append(msgs, w.attr(a))
+	}
+	return w.header(msgs)
+}
+
+// writeHDF5 writes root to fname.
+func writeHDF5(fname string, root *h5Group, latest bool) error {
+	w := &h5Writer{latest: latest}
+	sbSize := 96
+	if latest {
+		sbSize = 48
+	}
+	w.buf = make([]byte, sbSize)
+	rootAddr := w.group(root)
+
+	var sb []byte
+	if latest {
+		sb = cat(hdf5Signature, []byte{2, 8, 8, 0}, le(8, 0),
+			le(8, hdf5Undefined), le(8, uint64(len(w.buf))), le(8, rootAddr),
+			le(4, 0))
+	} else {
+		sb = cat(hdf5Signature, []byte{0, 0, 0, 0, 0, 8, 8, 0},
+			le(2, 4), le(2, 16), le(4, 0), le(8, 0), le(8, hdf5Undefined),
+			le(8, uint64(len(w.buf))), le(8, hdf5Undefined),
+			le(8, 0), le(8, rootAddr), le(4, 1), le(4, 0), make([]byte, 16))
+	}
+	copy(w.buf, sb)
+
+	return ioutil.WriteFile(fname, w.buf, 0644)
+}
+
+////////////////////////////////////////////////////////////////////////////
+
+func gadgetHDF5Root(latest bool) *h5Group {
+	hd := &h5Group{name: "Header", attrs: []h5Attr{
+		intAttr("NumPart_ThisFile", 4, 0, 5, 3, 0, 0, 0),
+		intAttr("NumPart_Total", 4, 0, 10, 6, 0, 0, 0),
+		intAttr("NumPart_Total_HighWord", 4, 0, 1, 0, 0, 0, 0),
+		f64Attr("MassTable", 0, 2.5, 0, 0, 0, 0),
+		scalarAttr("Time", 0.25),
+		scalarAttr("Redshift", 3),
+		scalarAttr("BoxSize", 100),
+		scalarAttr("Omega0", 0.3),
+		scalarAttr("OmegaLambda", 0.7),
+		scalarAttr("HubbleParam", 0.7),
+	}}
+
+	xs1 := f32Dataset("Coordinates", 3,
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15)
+	xs1.chunk, xs1.filters = []uint64{2, 3}, true
+	p1 := &h5Group{name: "PartType1", datasets: []*h5Dataset{
+		xs1,
+		f64Dataset("Velocities", 3,
+			2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30),
+		intDataset("ParticleIDs", 8, false, 100, 101, 102, 1<<40, 104),
+	}}
+
+	vs2 := f32Dataset("Velocities", 3, -2, -4, -6, 0, 0, 0, 8, 8, 8)
+	vs2.chunk = []uint64{2, 2}
+	p2 := &h5Group{name: "PartType2", datasets: []*h5Dataset{
+		f32Dataset("Coordinates", 3, 99.5, 0.5, 50, 20, 30, 40, 1, 1, 1),
+		vs2,
+		intDataset("ParticleIDs", 4, true, 7, 8, 9),
+		f32Dataset("Masses", 1, 5, 1.5, 5),
+	}}
+
+	return &h5Group{name: "/", groups: []*h5Group{hd, p1, p2}}
+}
+
+func TestHDF5Gadget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_hdf5")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	context := Context{
+		GadgetDMTypeIndices: []int64{1, 2},
+		GadgetMassUnits:     1, GadgetPositionUnits: 1,
+	}
+
+	xs := [][3]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {10, 11, 12},
+		{13, 14, 15}, {99.5, 0.5, 50}, {20, 30, 40}, {1, 1, 1}}
+	vs := [][3]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {10, 11, 12},
+		{13, 14, 15}, {-1, -2, -3}, {0, 0, 0}, {4, 4, 4}}
+	ms := []float32{2.5, 2.5, 2.5, 2.5, 2.5, 5, 1.5, 5}
+	ids := []int64{100, 101, 102, 1 << 40, 104, 7, 8, 9}
+
+	for _, latest := range []bool{false, true} {
+		fname := path.Join(dir, "snap.hdf5")
+		if err := writeHDF5(fname, gadgetHDF5Root(latest), latest); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		buf, err := NewHDF5GadgetBuffer(fname, context)
+		if err != nil {
+			t.Fatalf("latest = %v) NewHDF5GadgetBuffer returned error: %s",
+				latest, err.Error())
+		}
+		if buf.MinMass() != 1.5 {
+			t.Errorf("latest = %v) Expected MinMass() = 1.5, got %g.",
+				latest, buf.MinMass())
+		}
+		n, err := buf.TotalParticles(fname)
+		if err != nil {
+			t.Errorf("latest = %v) TotalParticles returned error: %s",
+				latest, err.Error())
+		} else if n != 16+1<<32 {
+			t.Errorf("latest = %v) Expected TotalParticles() = %d, got %d.",
+				latest, 16+1<<32, n)
+		}
+
+		rxs, rvs, rms, rids, err := buf.Read(fname)
+		if err != nil {
+			t.Fatalf("latest = %v) Read returned error: %s",
+				latest, err.Error())
+		}
+		if len(rxs) != len(xs) {
+			t.Fatalf("latest = %v) Expected %d particles, got %d.",
+				latest, len(xs), len(rxs))
+		}
+		for i := range xs {
+			if rxs[i] != xs[i] || rvs[i] != vs[i] || rms[i] != ms[i] ||
+				rids[i] != ids[i] {
+				t.Errorf("latest = %v) Expected particle %d to be %v %v "+
+					"%g %d, got %v %v %g %d.", latest, i, xs[i], vs[i],
+					ms[i], ids[i], rxs[i], rvs[i], rms[i], rids[i])
+			}
+		}
+		types := buf.(TypedBuffer).Types()
+		expTypes := []uint8{1, 1, 1, 1, 1, 2, 2, 2}
+		if !bytes.Equal(types, expTypes) {
+			t.Errorf("latest = %v) Expected types %v, got %v.",
+				latest, expTypes, types)
+		}
+		buf.Close()
+
+		hd := &Header{}
+		if err := buf.ReadHeader(fname, hd); err != nil {
+			t.Fatalf("latest = %v) ReadHeader returned error: %s",
+				latest, err.Error())
+		}
+		expected := CosmologyHeader{Z: 3, OmegaM: 0.3, OmegaL: 0.7, H100: 0.7}
+		if hd.Cosmo != expected || hd.N != 8 || hd.TotalWidth != 100 {
+			t.Errorf("latest = %v) Expected header %v %d %g, got %v %d %g.",
+				latest, expected, 8, 100.0, hd.Cosmo, hd.N, hd.TotalWidth)
+		}
+	}
+}
+
+func TestHDF5GadgetSWIFT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_hdf5")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	root := &h5Group{name: "/", groups: []*h5Group{
+		{name: "Header", attrs: []h5Attr{
+			intAttr("NumPart_ThisFile", 8, 0, 2, 0, 0, 0, 0, 0),
+			intAttr("NumPart_Total", 8, 0, 2, 0, 0, 0, 0, 0),
+			f64Attr("MassTable", 0, 0, 0, 0, 0, 0, 0),
+			scalarAttr("Time", 0.01),
+			scalarAttr("Scale-factor", 0.5),
+			scalarAttr("Redshift", 1),
+			f64Attr("BoxSize", 50, 50, 50),
+		}},
+		{name: "Cosmology", attrs: []h5Attr{
+			scalarAttr("Omega_m", 0.31),
+			scalarAttr("Omega_lambda", 0.69),
+			scalarAttr("h", 0.68),
+		}},
+		{name: "PartType1", datasets: []*h5Dataset{
+			f64Dataset("Coordinates", 3, 1, 2, 3, 4, 5, 6),
+			f32Dataset("Velocities", 3, 0, 0, 0, 2, 2, 2),
+			intDataset("ParticleIDs", 8, false, 1, 2),
+			f64Dataset("Masses", 1, 3, 4),
+		}},
+	}}
+
+	fname := path.Join(dir, "snap.hdf5")
+	if err := writeHDF5(fname, root, true); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	context := Context{
+		GadgetDMTypeIndices: []int64{1},
+		GadgetMassUnits:     1e10, GadgetPositionUnits: 1,
+	}
+	buf, err := NewHDF5GadgetBuffer(fname, context)
+	if err != nil {
+		t.Fatalf("NewHDF5GadgetBuffer returned error: %s", err.Error())
+	}
+	if buf.MinMass() != 3e10 {
+		t.Errorf("Expected MinMass() = 3e10, got %g.", buf.MinMass())
+	}
+
+	hd := &Header{}
+	if err := buf.ReadHeader(fname, hd); err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	expected := CosmologyHeader{Z: 1, OmegaM: 0.31, OmegaL: 0.69, H100: 0.68}
+	if hd.Cosmo != expected || hd.N != 2 || hd.TotalWidth != 50 {
+		t.Errorf("Expected header %v %d %g, got %v %d %g.",
+			expected, 2, 50.0, hd.Cosmo, hd.N, hd.TotalWidth)
+	}
+
+	_, vs, ms, _, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	defer buf.Close()
+	// SWIFT velocities are already peculiar, so they aren't rescaled.
+	if vs[1] != [3]float32{2, 2, 2} {
+		t.Errorf("Expected velocities to not be scaled by sqrt(a), got %v.",
+			vs)
+	}
+	if ms[0] != 3e10 || ms[1] != 4e10 {
+		t.Errorf("Expected masses [3e10 4e10], got %v.", ms)
+	}
+}
+
+func TestReadHDF5Ints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_hdf5")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for _, latest := range []bool{false, true} {
+		fname := path.Join(dir, "tree.0.hdf5")
+		root := &h5Group{name: "/", datasets: []*h5Dataset{
+			intDataset("SubhaloID", 8, true, 1<<40, -1, 3),
+			intDataset("SnapNum", 2, false, 99, 98, 97),
+		}}
+		if err := writeHDF5(fname, root, latest); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		ids, err := ReadHDF5Ints(fname, "SubhaloID")
+		if err != nil {
+			t.Fatalf("latest = %v) ReadHDF5Ints returned error: %s",
+				latest, err.Error())
+		}
+		snaps, err := ReadHDF5Ints(fname, "SnapNum")
+		if err != nil {
+			t.Fatalf("latest = %v) ReadHDF5Ints returned error: %s",
+				latest, err.Error())
+		}
+		if fmt.Sprint(ids, snaps) != fmt.Sprint([]int64{1 << 40, -1, 3},
+			[]int64{99, 98, 97}) {
+			t.Errorf("latest = %v) Got datasets %v and %v.",
+				latest, ids, snaps)
+		}
+
+		if _, err := ReadHDF5Ints(fname, "DescendantID"); err == nil {
+			t.Errorf("latest = %v) Expected error for a missing dataset.",
+				latest)
+		}
+	}
+}
+
+func TestHDF5NotHDF5(t *testing.T) {
+	f, err := ioutil.TempFile("", "shellfish_hdf5")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	binary.Write(f, binary.LittleEndian, make([]int64, 200))
+	f.Close()
+
+	if _, err := openHDF5(f.Name()); err == nil {
+		t.Errorf("Expected openHDF5 to fail on a file of zeros.")
+	}
+}
@@ -33,6 +33,11 @@ code as needed. If your file format is just  couple arrays of particles with
 some type of header (which it probably is), you can copy almost all of it and
 won't have to do much.
 
+(Optional) If your files store each particle property in its own block, you can
+also implement the FieldBuffer interface in fields.go. This lets the analysis
+modes skip the properties that they don't need and read big files in chunks.
+lgadget2.go has an example. Buffers that don't implement it still work.
+
 5. Update getVectorBuffer() in cmd/util.go. It'll just be adding a case to a
 switch statement.
 
@@ -95,6 +100,47 @@ type Context struct {
 	NilOmegaL float64
 	NilH100 float64
 	NilScaleFactors []float64
+
+	RawHeaderSize int64
+	RawRecordMarkers int64
+	RawHeaderNames []string
+	RawHeaderOffsets []int64
+	RawHeaderTypes []string
+	RawHeaderValues []float64
+	RawArrayNames []string
+	RawArrayOffsets []int64
+	RawArrayTypes []string
+	RawArrayStrides []int64
+	RawPositionUnits float64
+	RawVelocityUnits float64
+	RawMassUnits float64
+
+	TipsyKpcUnit float64
+	TipsyMsolUnit float64
+	TipsyOmegaM float64
+	TipsyOmegaL float64
+	TipsyH100 float64
+	TipsyFamilies []string
+
+	RamsesDMFamilies []int64
+
+	SyntheticTotalWidth float64
+	SyntheticOmegaM float64
+	SyntheticOmegaL float64
+	SyntheticH100 float64
+	SyntheticScaleFactors []float64
+	SyntheticParticles int64
+	SyntheticBlocks int64
+	SyntheticSeed int64
+	SyntheticCausticContrast float64
+	SyntheticROuterMult float64
+	SyntheticSubhaloMassRatio float64
+	SyntheticHaloXs, SyntheticHaloYs, SyntheticHaloZs []float64
+	SyntheticHaloM200ms []float64
+	SyntheticHaloC200ms []float64
+	SyntheticHaloRspMults []float64
+	SyntheticHaloBAs, SyntheticHaloCAs []float64
+	SyntheticSubhalos []int64
 }
 
 func reorder(buf []byte, size, words int) {
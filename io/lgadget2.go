@@ -6,6 +6,8 @@ import (
 	"io"
 	"math"
 	"os"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
 )
 
 // gadgetHeader is the formatting for meta-information used by Gadget 2.
@@ -70,7 +72,7 @@ func readInt32(r io.Reader, order binary.ByteOrder) int32 {
 func readLGadget2Header(
 	path string, order binary.ByteOrder, out *lGadget2Header,
 ) error {
-	f, err := os.Open(path)
+	f, err := compress.Open(path)
 	if err != nil {
 		return err
 	}
@@ -81,60 +83,72 @@ func readLGadget2Header(
 	return err
 }
 
-func (buf *LGadget2Buffer) readLGadget2Particles(
-	path string,
-	order binary.ByteOrder,
-	xsBuf, vsBuf [][3]float32,
-	msBuf []float32,
-	idsBuf []int64,
-) (xs, vs [][3]float32, ms []float32, ids []int64, err error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, nil, nil, nil, err
-	}
-	defer f.Close()
-
-	gh := &lGadget2Header{}
-
-	_ = readInt32(f, order)
-	binary.Read(f, binary.LittleEndian, gh)
-	_ = readInt32(f, order)
-
-	count := lgadgetParticleNum(gh.NPart, gh, buf.context)
+// lgadget2Offsets returns the offsets of the position, velocity, and ID blocks
+// in a file with n particles. Each block is surrounded by 4-byte Fortran
+// record markers.
+func lgadget2Offsets(n int64) (xs, vs, ids int64) {
+	hdSize := int64(binary.Size(lGadget2Header{}))
+	xs = 4 + hdSize + 4 + 4
+	vs = xs + 12*n + 4 + 4
+	ids = vs + 12*n + 4 + 4
+	return xs, vs, ids
+}
 
-	xsBuf = expandVectors(xsBuf[:0], int(count))
-	vsBuf = expandVectors(vsBuf[:0], int(count))
-	idsBuf = expandInts(idsBuf[:0], int(count))
+// readLGadget2Range reads the requested fields of the particles starting at
+// index start into the given buffers, all of which must either have the same
+// length or be nil. Positions, velocities, and IDs are read from fs[0], fs[1],
+// and fs[2], respectively.
+func (buf *LGadget2Buffer) readLGadget2Range(
+	fs [3]io.ReaderAt, path string, gh *lGadget2Header, count, start int64,
+	xs, vs [][3]float32, ms []float32, ids []int64,
+) error {
+	xsOffset, vsOffset, idsOffset := lgadget2Offsets(count)
 
-	_ = readInt32(f, order)
-	readVecAsByte(f, order, xsBuf)
-	_ = readInt32(f, order)
-	_ = readInt32(f, order)
-	readVecAsByte(f, order, vsBuf)
-	_ = readInt32(f, order)
-	_ = readInt32(f, order)
-	readInt64AsByte(f, order, idsBuf)
+	if len(xs) > 0 {
+		n := int64(len(xs))
+		rd := io.NewSectionReader(fs[0], xsOffset+12*start, 12*n)
+		if err := readVecAsByte(rd, buf.order, xs); err != nil {
+			return err
+		}
+	}
+	if len(vs) > 0 {
+		n := int64(len(vs))
+		rd := io.NewSectionReader(fs[1], vsOffset+12*start, 12*n)
+		if err := readVecAsByte(rd, buf.order, vs); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		n := int64(len(ids))
+		rd := io.NewSectionReader(fs[2], idsOffset+8*start, 8*n)
+		if err := readInt64AsByte(rd, buf.order, ids); err != nil {
+			return err
+		}
+	}
 
 	// Fix periodicity of particles and convert the units of our velocities.
 
 	rootA := float32(math.Sqrt(float64(gh.Time)))
+	for i := range vs {
+		for j := 0; j < 3; j++ {
+			vs[i][j] = vs[i][j] * rootA
+		}
+	}
 
 	tw := float32(gh.BoxSize)
-	for i := range xsBuf {
+	for i := range xs {
 		for j := 0; j < 3; j++ {
-			vsBuf[i][j] = vsBuf[i][j] * rootA
-			
-			if xsBuf[i][j] < 0 {
-				xsBuf[i][j] += tw
-			} else if xsBuf[i][j] >= tw {
-				xsBuf[i][j] -= tw
+			if xs[i][j] < 0 {
+				xs[i][j] += tw
+			} else if xs[i][j] >= tw {
+				xs[i][j] -= tw
 			}
 
-			if math.IsNaN(float64(xsBuf[i][j])) ||
-				math.IsInf(float64(xsBuf[i][j]), 0) ||
-				xsBuf[i][j] < -tw || xsBuf[i][j] > 2*tw {
+			if math.IsNaN(float64(xs[i][j])) ||
+				math.IsInf(float64(xs[i][j]), 0) ||
+				xs[i][j] < -tw || xs[i][j] > 2*tw {
 
-				return nil, nil, nil, nil, fmt.Errorf(
+				return fmt.Errorf(
 					"Corruption detected in the file %s. I can't analyze it.",
 					path,
 				)
@@ -142,12 +156,30 @@ func (buf *LGadget2Buffer) readLGadget2Particles(
 		}
 	}
 
-	msBuf = expandScalars(msBuf, int(count))
-	for i := range msBuf {
-		msBuf[i] = buf.mass
+	for i := range ms {
+		ms[i] = buf.mass
+	}
+
+	return nil
+}
+
+// openLGadget2 opens a file and reads its header and particle count.
+func (buf *LGadget2Buffer) openLGadget2(
+	path string,
+) (f compress.File, gh *lGadget2Header, count int64, err error) {
+	f, err = compress.OpenFile(path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	gh = &lGadget2Header{}
+	_ = readInt32(f, buf.order)
+	if err = binary.Read(f, binary.LittleEndian, gh); err != nil {
+		f.Close()
+		return nil, nil, 0, err
 	}
 
-	return xsBuf, vsBuf, msBuf, idsBuf, nil
+	return f, gh, lgadgetParticleNum(gh.NPart, gh, buf.context), nil
 }
 
 func expandVectors(vecs [][3]float32, n int) [][3]float32 {
@@ -185,6 +217,17 @@ func expandInts(ints []int64, n int) []int64 {
 	}
 }
 
+func expandTypes(types []uint8, n int) []uint8 {
+	switch {
+	case cap(types) >= n:
+		return types[:n]
+	case int(float64(cap(types))*1.5) > n:
+		return append(types[:cap(types)], make([]uint8, n-cap(types))...)
+	default:
+		return make([]uint8, n)
+	}
+}
+
 type LGadget2Buffer struct {
 	open     bool
 	order    binary.ByteOrder
@@ -232,17 +275,109 @@ func NewLGadget2Buffer(
 
 func (buf *LGadget2Buffer) Read(fname string) (
 	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	return buf.ReadFields(fname, AllFields)
+}
+
+func (buf *LGadget2Buffer) ReadFields(fname string, fields Fields) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
 ) {
 	if buf.open {
 		panic("Buffer already open.")
 	}
 	buf.open = true
 
-	buf.xs, buf.vs, buf.ms, buf.ids, err = buf.readLGadget2Particles(
-		fname, buf.order, buf.xs, buf.vs, buf.ms, buf.ids,
-	)
+	f, gh, count, err := buf.openLGadget2(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer f.Close()
+
+	if fields.Has(Positions) {
+		buf.xs = expandVectors(buf.xs[:0], int(count))
+		xs = buf.xs
+	}
+	if fields.Has(Velocities) {
+		buf.vs = expandVectors(buf.vs[:0], int(count))
+		vs = buf.vs
+	}
+	if fields.Has(Masses) {
+		buf.ms = expandScalars(buf.ms[:0], int(count))
+		ms = buf.ms
+	}
+	if fields.Has(IDs) {
+		buf.ids = expandInts(buf.ids[:0], int(count))
+		ids = buf.ids
+	}
+
+	fs := [3]io.ReaderAt{f, f, f}
+	err = buf.readLGadget2Range(fs, fname, gh, count, 0, xs, vs, ms, ids)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return xs, vs, ms, ids, nil
+}
+
+func (buf *LGadget2Buffer) ReadChunks(
+	fname string, fields Fields, chunkSize int, fn func(*Chunk) error,
+) error {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+
+	f, gh, count, err := buf.openLGadget2(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Compressed files can only be read forwards efficiently, so each field
+	// gets its own stream.
+	fs := [3]io.ReaderAt{f, f, f}
+	if _, ok := f.(*os.File); !ok {
+		for i, field := range []Fields{Velocities, IDs} {
+			if !fields.Has(field) {
+				continue
+			}
+			fi, err := compress.OpenFile(fname)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			fs[i+1] = fi
+		}
+	}
+
+	c := &Chunk{}
+	return eachChunk(int(count), chunkSize, func(start, end int) error {
+		n := end - start
+		c.Start = start
+		if fields.Has(Positions) {
+			buf.xs = expandVectors(buf.xs[:0], n)
+			c.Xs = buf.xs
+		}
+		if fields.Has(Velocities) {
+			buf.vs = expandVectors(buf.vs[:0], n)
+			c.Vs = buf.vs
+		}
+		if fields.Has(Masses) {
+			buf.ms = expandScalars(buf.ms[:0], n)
+			c.Ms = buf.ms
+		}
+		if fields.Has(IDs) {
+			buf.ids = expandInts(buf.ids[:0], n)
+			c.IDs = buf.ids
+		}
 
-	return buf.xs, buf.vs, buf.ms, buf.ids, err
+		err := buf.readLGadget2Range(
+			fs, fname, gh, count, int64(start), c.Xs, c.Vs, c.Ms, c.IDs,
+		)
+		if err != nil {
+			return err
+		}
+		return fn(c)
+	})
 }
 
 func (buf *LGadget2Buffer) Close() {
@@ -262,7 +397,7 @@ func (buf *LGadget2Buffer) ReadHeader(fname string, out *Header) error {
 		return err
 	}
 	defer buf.Close()
-	xs, _, _, _, err := buf.Read(fname)
+	xs, _, _, _, err := buf.ReadFields(fname, Positions)
 	if err != nil {
 		return err
 	}
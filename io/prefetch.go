@@ -0,0 +1,118 @@
+package io
+
+// Prefetcher reads a sequence of particle files, decoding the next files in
+// the background while the current one is being analyzed. Each file is read
+// by its own VectorBuffer, so a Prefetcher with n buffers holds at most n
+// files in memory and reads at most n-1 files ahead.
+type Prefetcher struct {
+	bufs []VectorBuffer
+}
+
+// prefetched is the contents of a file which was read in the background.
+type prefetched struct {
+	buf    VectorBuffer
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+	types  []uint8
+	err    error
+}
+
+// NewPrefetcher creates a Prefetcher which reads files with the given
+// buffers. If there is only one buffer, files are read sequentially in exactly
+// the same way as the ReadChunks function.
+func NewPrefetcher(bufs []VectorBuffer) *Prefetcher {
+	if len(bufs) == 0 {
+		panic("NewPrefetcher needs at least one VectorBuffer.")
+	}
+	return &Prefetcher{bufs: bufs}
+}
+
+// Buffer returns the first VectorBuffer that the Prefetcher was created with.
+// It can be used for other reads (e.g. headers) while ReadChunks isn't running.
+func (pf *Prefetcher) Buffer() VectorBuffer { return pf.bufs[0] }
+
+// ReadChunks calls f on consecutive chunks of at most chunkSize particles
+// from each file in files, in order. f is also given the index of the chunk's
+// file. The chunks are the same as the ones produced by the ReadChunks
+// function, so results don't depend on how many files are prefetched. If f
+// returns an error, ReadChunks stops and returns it.
+func (pf *Prefetcher) ReadChunks(
+	files []string, fields Fields, chunkSize int,
+	f func(i int, c *Chunk) error,
+) error {
+	if len(pf.bufs) == 1 {
+		for i := range files {
+			err := ReadChunks(pf.bufs[0], files[i], fields, chunkSize,
+				func(c *Chunk) error { return f(i, c) })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Both channels can hold every buffer, so sends never block.
+	free := make(chan VectorBuffer, len(pf.bufs))
+	out := make(chan *prefetched, len(pf.bufs))
+	done := make(chan struct{})
+	for _, buf := range pf.bufs {
+		free <- buf
+	}
+
+	go func() {
+		defer close(out)
+		for _, fname := range files {
+			var buf VectorBuffer
+			select {
+			case <-done:
+				return
+			case buf = <-free:
+			}
+
+			select {
+			case <-done:
+				free <- buf
+				return
+			default:
+			}
+
+			p := &prefetched{buf: buf}
+			p.xs, p.vs, p.ms, p.ids, p.err = ReadFields(buf, fname, fields)
+			if p.err == nil {
+				p.types = readTypes(buf, fields)
+			}
+			out <- p
+		}
+	}()
+
+	release := func(p *prefetched) {
+		if p.buf.IsOpen() {
+			p.buf.Close()
+		}
+		free <- p.buf
+	}
+	// Files which were read but never used need to be closed before the
+	// buffers can be used again.
+	defer func() {
+		close(done)
+		for p := range out {
+			release(p)
+		}
+	}()
+
+	for i := range files {
+		p := <-out
+		err := p.err
+		if err == nil {
+			err = sliceChunks(p.xs, p.vs, p.ms, p.ids, p.types, chunkSize,
+				func(c *Chunk) error { return f(i, c) })
+		}
+		release(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package io
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// chunkRecord is a copy of the contents of a Chunk, tagged with its file.
+type chunkRecord struct {
+	file, start int
+	xs          [][3]float32
+	ids         []int64
+}
+
+func TestPrefetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_prefetch")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{}
+	for i := 0; i < 4; i++ {
+		n := 3 + i
+		xs, vs, ids := make([][3]float32, n), make([][3]float32, n),
+			make([]int64, n)
+		for j := range xs {
+			xs[j] = [3]float32{float32(i), float32(j), 1}
+			ids[j] = int64(100*i + j)
+		}
+		fname := path.Join(dir, fmt.Sprintf("snap.%d", i))
+		writeLGadget2(t, fname, xs, vs, ids)
+		files = append(files, fname)
+	}
+
+	newBufs := func(n int) []VectorBuffer {
+		bufs := make([]VectorBuffer, n)
+		for i := range bufs {
+			buf, err := NewLGadget2Buffer(files[0], "LittleEndian",
+				Context{LGadgetNPartNum: 2})
+			if err != nil {
+				t.Fatalf("NewLGadget2Buffer returned error: %s", err.Error())
+			}
+			bufs[i] = buf
+		}
+		return bufs
+	}
+
+	read := func(pf *Prefetcher) []chunkRecord {
+		out := []chunkRecord{}
+		err := pf.ReadChunks(files, Positions|IDs, 2,
+			func(i int, c *Chunk) error {
+				out = append(out, chunkRecord{
+					i, c.Start, append([][3]float32{}, c.Xs...),
+					append([]int64{}, c.IDs...),
+				})
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("ReadChunks returned error: %s", err.Error())
+		}
+		return out
+	}
+
+	seq := read(NewPrefetcher(newBufs(1)))
+	if len(seq) != 2+2+3+3 {
+		t.Fatalf("Expected 10 chunks, got %d.", len(seq))
+	}
+
+	for _, n := range []int{2, 3, 5} {
+		bufs := newBufs(n)
+		pre := read(NewPrefetcher(bufs))
+		if len(pre) != len(seq) {
+			t.Fatalf("%d buffers: expected %d chunks, got %d.",
+				n, len(seq), len(pre))
+		}
+		for k := range seq {
+			a, b := seq[k], pre[k]
+			if a.file != b.file || a.start != b.start ||
+				fmt.Sprint(a.xs, a.ids) != fmt.Sprint(b.xs, b.ids) {
+				t.Errorf("%d buffers: chunk %d is %v, expected %v.",
+					n, k, b, a)
+			}
+		}
+		for i := range bufs {
+			if bufs[i].IsOpen() {
+				t.Errorf("%d buffers: buffer %d left open.", n, i)
+			}
+		}
+	}
+
+	// Errors stop the read and every buffer is still released.
+	bufs := newBufs(3)
+	calls := 0
+	err = NewPrefetcher(bufs).ReadChunks(files, Positions, 0,
+		func(i int, c *Chunk) error {
+			calls++
+			if i == 1 {
+				return fmt.Errorf("stop")
+			}
+			return nil
+		})
+	if err == nil || err.Error() != "stop" || calls != 2 {
+		t.Errorf("Expected error 'stop' after 2 calls, got %v after %d.",
+			err, calls)
+	}
+	for i := range bufs {
+		if bufs[i].IsOpen() {
+			t.Errorf("Buffer %d left open after error.", i)
+		}
+	}
+
+	bufs = newBufs(2)
+	err = NewPrefetcher(bufs).ReadChunks(
+		[]string{files[0], path.Join(dir, "missing")}, Positions, 0,
+		func(i int, c *Chunk) error { return nil })
+	if err == nil {
+		t.Errorf("Expected error for missing file.")
+	}
+}
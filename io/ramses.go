@@ -0,0 +1,530 @@
+package io
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/phil-mansfield/shellfish/cosmo"
+)
+
+// ramsesPartName matches the names of RAMSES particle files,
+// part_XXXXX.outYYYYY, where XXXXX is the output number and YYYYY is the
+// (1-indexed) CPU which wrote the file.
+var ramsesPartName = regexp.MustCompile(`^part_(\d+)\.out(\d+)$`)
+
+// ramsesLegacyFields are the names of the particle fields in RAMSES versions
+// that don't write a part_file_descriptor.txt file. The position and velocity
+// names are followed by mass, identity, levelp, and (if star formation is on)
+// birth_time and metallicity.
+var ramsesLegacyFields = []string{
+	"position_x", "position_y", "position_z",
+	"velocity_x", "velocity_y", "velocity_z",
+	"mass", "identity", "levelp", "birth_time", "metallicity",
+}
+
+// ramsesInfo contains the parts of an info_XXXXX.txt file needed to convert
+// from code units.
+type ramsesInfo struct {
+	NCPU, NDim          int64
+	BoxLen, AExp, H0    float64
+	OmegaM, OmegaL      float64
+	UnitL, UnitD, UnitT float64
+}
+
+// units returns the sizes of the RAMSES length, velocity, and mass units in
+// comoving Mpc/h, km/s, and Msun/h.
+func (info *ramsesInfo) units() (length, vel, mass float64) {
+	h := info.H0 / 100
+	cmPerMpc, gPerMsun := cosmo.MpcMks*1e2, cosmo.MSunMks*1e3
+	length = info.UnitL / info.AExp / cmPerMpc * h
+	vel = info.UnitL / info.UnitT / 1e5
+	mass = info.UnitD * info.UnitL * info.UnitL * info.UnitL / gPerMsun * h
+	return length, vel, mass
+}
+
+func readRamsesInfo(fname string) (*ramsesInfo, error) {
+	text, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := map[string]string{}
+	for _, line := range strings.Split(string(text), "\n") {
+		tok := strings.SplitN(line, "=", 2)
+		if len(tok) == 2 {
+			vals[strings.TrimSpace(tok[0])] = strings.TrimSpace(tok[1])
+		}
+	}
+
+	info := &ramsesInfo{}
+	ints := map[string]*int64{"ncpu": &info.NCPU, "ndim": &info.NDim}
+	floats := map[string]*float64{
+		"boxlen": &info.BoxLen, "aexp": &info.AExp, "H0": &info.H0,
+		"omega_m": &info.OmegaM, "omega_l": &info.OmegaL,
+		"unit_l": &info.UnitL, "unit_d": &info.UnitD, "unit_t": &info.UnitT,
+	}
+
+	for name, ptr := range ints {
+		x, err := strconv.ParseInt(vals[name], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read '%s' from the RAMSES "+
+				"info file %s.", name, fname)
+		}
+		*ptr = x
+	}
+	for name, ptr := range floats {
+		// Fortran sometimes writes exponents with a 'D'.
+		s := strings.Replace(strings.ToUpper(vals[name]), "D", "E", 1)
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read '%s' from the RAMSES "+
+				"info file %s.", name, fname)
+		}
+		*ptr = x
+	}
+
+	if info.NDim != 3 {
+		return nil, fmt.Errorf("The RAMSES info file %s has ndim = %d, but "+
+			"only three-dimensional simulations are supported.",
+			fname, info.NDim)
+	}
+
+	return info, nil
+}
+
+// readRamsesDescriptor returns the names of the particle fields listed in a
+// part_file_descriptor.txt file. Each non-comment line has the form
+// "ivar, variable_name, variable_type".
+func readRamsesDescriptor(fname string) ([]string, error) {
+	text, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		tok := strings.Split(line, ",")
+		if len(tok) != 3 {
+			return nil, fmt.Errorf("The line '%s' of the RAMSES descriptor "+
+				"file %s does not have three columns.", line, fname)
+		}
+		names = append(names, strings.TrimSpace(tok[1]))
+	}
+	return names, nil
+}
+
+// ramsesFiles returns the names of the info file and descriptor file which
+// describe the given particle file along with the snapshot's output number.
+func ramsesFiles(fname string) (info, desc, nout string, err error) {
+	dir, base := path.Split(fname)
+	match := ramsesPartName.FindStringSubmatch(base)
+	if match == nil {
+		return "", "", "", fmt.Errorf("The file %s doesn't have a name of "+
+			"the form part_XXXXX.outYYYYY, so I can't find its info file.",
+			fname)
+	}
+	nout = match[1]
+	info = path.Join(dir, fmt.Sprintf("info_%s.txt", nout))
+	desc = path.Join(dir, "part_file_descriptor.txt")
+	return info, desc, nout, nil
+}
+
+// readRamsesRecord reads a single Fortran record. io.EOF is returned if the
+// file ends before the record starts.
+func readRamsesRecord(rd io.Reader, order binary.ByteOrder) ([]byte, error) {
+	var size1, size2 int32
+	if err := binary.Read(rd, order, &size1); err != nil {
+		return nil, err
+	} else if size1 < 0 {
+		return nil, fmt.Errorf("Fortran record has a size of %d.", size1)
+	}
+	b := make([]byte, size1)
+	if _, err := io.ReadFull(rd, b); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(rd, order, &size2); err != nil {
+		return nil, err
+	} else if size1 != size2 {
+		return nil, fmt.Errorf("Fortran binary header is %d, but footer "+
+			"is %d.", size1, size2)
+	}
+	return b, nil
+}
+
+// ramsesPart contains the fields of a single particle file. Since different
+// RAMSES versions use different types, fields are kept as raw bytes until they
+// are needed and the size of each element is found from the record length.
+type ramsesPart struct {
+	n      int
+	order  binary.ByteOrder
+	fields map[string][]byte
+}
+
+func readRamsesPart(
+	fname string, order binary.ByteOrder,
+) (*ramsesPart, error) {
+	_, descName, _, err := ramsesFiles(fname)
+	if err != nil {
+		return nil, err
+	}
+	names := ramsesLegacyFields
+	if _, err := os.Stat(descName); err == nil {
+		if names, err = readRamsesDescriptor(descName); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+
+	// The header records are ncpu, ndim, npart, localseed, nstar_tot,
+	// mstar_tot, mstar_lost, and nsink.
+	part := &ramsesPart{order: order, fields: map[string][]byte{}}
+	for i := 0; i < 8; i++ {
+		b, err := readRamsesRecord(rd, order)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read the header of the RAMSES "+
+				"file %s: %s", fname, err.Error())
+		} else if i == 2 {
+			if len(b) != 4 {
+				return nil, fmt.Errorf("The npart record of the RAMSES "+
+					"file %s is %d bytes.", fname, len(b))
+			}
+			part.n = int(int32(order.Uint32(b)))
+		}
+	}
+
+	for _, name := range names {
+		b, err := readRamsesRecord(rd, order)
+		if err == io.EOF {
+			// Legacy files only have birth times if stars were formed.
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read the %s field of the "+
+				"RAMSES file %s: %s", name, fname, err.Error())
+		}
+		part.fields[name] = b
+	}
+
+	for _, name := range ramsesLegacyFields[:8] {
+		if _, ok := part.fields[name]; !ok {
+			return nil, fmt.Errorf("The RAMSES file %s does not have a "+
+				"%s field.", fname, name)
+		}
+	}
+
+	return part, nil
+}
+
+// elemSize returns the size of each element of a field, or an error if the
+// record's length isn't a multiple of the particle count.
+func (part *ramsesPart) elemSize(name string) (int, error) {
+	b := part.fields[name]
+	if part.n == 0 {
+		return 0, nil
+	} else if len(b)%part.n != 0 {
+		return 0, fmt.Errorf("The %s field has %d bytes, which can't hold "+
+			"%d particles.", name, len(b), part.n)
+	}
+	return len(b) / part.n, nil
+}
+
+// floatAt returns the ith element of a floating point field.
+func (part *ramsesPart) floatAt(name string, i int) (float64, error) {
+	size, err := part.elemSize(name)
+	if err != nil {
+		return 0, err
+	}
+	b := part.fields[name][i*size:]
+	switch size {
+	case 4:
+		return float64(math.Float32frombits(part.order.Uint32(b))), nil
+	case 8:
+		return math.Float64frombits(part.order.Uint64(b)), nil
+	}
+	return 0, fmt.Errorf("The %s field has %d byte elements.", name, size)
+}
+
+// intAt returns the ith element of an integer field.
+func (part *ramsesPart) intAt(name string, i int) (int64, error) {
+	size, err := part.elemSize(name)
+	if err != nil {
+		return 0, err
+	}
+	b := part.fields[name][i*size:]
+	switch size {
+	case 1:
+		return int64(int8(b[0])), nil
+	case 2:
+		return int64(int16(part.order.Uint16(b))), nil
+	case 4:
+		return int64(int32(part.order.Uint32(b))), nil
+	case 8:
+		return int64(part.order.Uint64(b)), nil
+	}
+	return 0, fmt.Errorf("The %s field has %d byte elements.", name, size)
+}
+
+// selectDM returns the indices of the dark matter particles in the file. If
+// the file has a family field, particles are selected by family. Otherwise,
+// dark matter particles are the ones with positive IDs and no birth time.
+func (part *ramsesPart) selectDM(families []int64) ([]int, error) {
+	_, hasFamily := part.fields["family"]
+	_, hasBirth := part.fields["birth_time"]
+
+	idx := []int{}
+	for i := 0; i < part.n; i++ {
+		if hasFamily {
+			family, err := part.intAt("family", i)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range families {
+				if f == family {
+					idx = append(idx, i)
+					break
+				}
+			}
+			continue
+		}
+
+		id, err := part.intAt("identity", i)
+		if err != nil {
+			return nil, err
+		}
+		birth := 0.0
+		if hasBirth {
+			if birth, err = part.floatAt("birth_time", i); err != nil {
+				return nil, err
+			}
+		}
+		if id > 0 && birth == 0 {
+			idx = append(idx, i)
+		}
+	}
+
+	return idx, nil
+}
+
+// RamsesBuffer reads the particle files written by RAMSES. Every CPU writes
+// its own part_XXXXX.outYYYYY file, and each of these files is a separate
+// block.
+type RamsesBuffer struct {
+	open    bool
+	order   binary.ByteOrder
+	mass    float32
+	xs, vs  [][3]float32
+	ms      []float32
+	ids     []int64
+	context Context
+}
+
+func NewRamsesBuffer(
+	path, orderFlag string, context Context,
+) (VectorBuffer, error) {
+
+	var order binary.ByteOrder = binary.LittleEndian
+	switch orderFlag {
+	case "LittleEndian":
+	case "BigEndian":
+		order = binary.BigEndian
+	case "SystemOrder":
+		if !IsSysOrder(order) {
+			order = binary.BigEndian
+		}
+	}
+
+	buf := &RamsesBuffer{order: order, context: context}
+
+	_, _, ms, _, err := buf.Read(path)
+	buf.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buf.mass = float32(math.Inf(+1))
+	for _, m := range ms {
+		if m < buf.mass {
+			buf.mass = m
+		}
+	}
+
+	return buf, nil
+}
+
+func (buf *RamsesBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+	buf.open = true
+
+	infoName, _, _, err := ramsesFiles(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	info, err := readRamsesInfo(infoName)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	part, err := readRamsesPart(fname, buf.order)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	idx, err := part.selectDM(buf.context.RamsesDMFamilies)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("Could not read %s: %s",
+			fname, err.Error())
+	}
+
+	n := len(idx)
+	buf.xs = expandVectors(buf.xs[:0], n)
+	buf.vs = expandVectors(buf.vs[:0], n)
+	buf.ms = expandScalars(buf.ms[:0], n)
+	buf.ids = expandInts(buf.ids[:0], n)
+
+	length, vel, mass := info.units()
+	xNames := ramsesLegacyFields[0:3]
+	vNames := ramsesLegacyFields[3:6]
+	for k, i := range idx {
+		for j := 0; j < 3; j++ {
+			x, err := part.floatAt(xNames[j], i)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			v, err := part.floatAt(vNames[j], i)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			buf.xs[k][j] = float32(x * length)
+			buf.vs[k][j] = float32(v * vel)
+		}
+
+		m, err := part.floatAt("mass", i)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		buf.ms[k] = float32(m * mass)
+
+		if buf.ids[k], err = part.intAt("identity", i); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	tw := float32(info.BoxLen * length)
+	for i := range buf.xs {
+		for j := 0; j < 3; j++ {
+			x := buf.xs[i][j]
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < -tw || x > 2*tw {
+				return nil, nil, nil, nil, fmt.Errorf(
+					"Corruption detected in the file %s. I can't analyze it.",
+					fname,
+				)
+			}
+
+			if x < 0 {
+				buf.xs[i][j] += tw
+			} else if x >= tw {
+				buf.xs[i][j] -= tw
+			}
+		}
+	}
+
+	return buf.xs, buf.vs, buf.ms, buf.ids, nil
+}
+
+func (buf *RamsesBuffer) Close() {
+	if !buf.open {
+		panic("Buffer not open.")
+	}
+	buf.open = false
+}
+
+func (buf *RamsesBuffer) IsOpen() bool {
+	return buf.open
+}
+
+func (buf *RamsesBuffer) ReadHeader(fname string, out *Header) error {
+	infoName, _, _, err := ramsesFiles(fname)
+	if err != nil {
+		return err
+	}
+	info, err := readRamsesInfo(infoName)
+	if err != nil {
+		return err
+	}
+
+	defer buf.Close()
+	xs, _, _, _, err := buf.Read(fname)
+	if err != nil {
+		return err
+	}
+
+	length, _, _ := info.units()
+	out.TotalWidth = info.BoxLen * length
+	out.N = int64(len(xs))
+
+	out.Cosmo.Z = 1/info.AExp - 1
+	out.Cosmo.OmegaM = info.OmegaM
+	out.Cosmo.OmegaL = info.OmegaL
+	out.Cosmo.H100 = info.H0 / 100
+
+	// Some CPUs may not own any particles.
+	if len(xs) > 0 {
+		out.Origin, out.Width = boundingBox(xs, out.TotalWidth)
+	}
+
+	return nil
+}
+
+func (buf *RamsesBuffer) MinMass() float32 { return buf.mass }
+
+// TotalParticles counts the dark matter particles in every CPU's file, since
+// RAMSES doesn't record this number anywhere that's consistent between
+// versions.
+func (buf *RamsesBuffer) TotalParticles(fname string) (int, error) {
+	infoName, _, nout, err := ramsesFiles(fname)
+	if err != nil {
+		return 0, err
+	}
+	info, err := readRamsesInfo(infoName)
+	if err != nil {
+		return 0, err
+	}
+
+	dir := path.Dir(fname)
+	n := 0
+	for cpu := int64(1); cpu <= info.NCPU; cpu++ {
+		name := path.Join(dir, fmt.Sprintf("part_%s.out%05d", nout, cpu))
+		part, err := readRamsesPart(name, buf.order)
+		if err != nil {
+			return 0, err
+		}
+		idx, err := part.selectDM(buf.context.RamsesDMFamilies)
+		if err != nil {
+			return 0, fmt.Errorf("Could not read %s: %s", name, err.Error())
+		}
+		n += len(idx)
+	}
+
+	return n, nil
+}
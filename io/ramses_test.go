@@ -0,0 +1,161 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/cosmo"
+)
+
+// writeRamsesSnapshot writes an info file and one particle file per element
+// of cpus. Each particle file contains the given records after the header.
+func writeRamsesSnapshot(
+	t *testing.T, dir string, cpus [][]interface{},
+) {
+	h, a := 0.7, 0.5
+	unitL := a * 100 * cosmo.MpcMks * 1e2 / h
+	unitD := 1e10 * cosmo.MSunMks * 1e3 / h / (unitL * unitL * unitL)
+	unitT := unitL / 1e5
+
+	info := &bytes.Buffer{}
+	fmt.Fprintf(info, "ncpu        = %10d\nndim        = %10d\n\n",
+		len(cpus), 3)
+	for _, kv := range []struct {
+		key string
+		val float64
+	}{
+		{"boxlen", 1}, {"time", -2}, {"aexp", a}, {"H0", 100 * h},
+		{"omega_m", 0.3}, {"omega_l", 0.7}, {"omega_k", 0},
+		{"unit_l", unitL}, {"unit_d", unitD}, {"unit_t", unitT},
+	} {
+		fmt.Fprintf(info, "%-11s = %22.15E\n", kv.key, kv.val)
+	}
+	fname := path.Join(dir, "info_00012.txt")
+	if err := ioutil.WriteFile(fname, info.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	order := binary.LittleEndian
+	for i, records := range cpus {
+		b := &bytes.Buffer{}
+		n := int32(0)
+		if len(records) > 0 {
+			n = int32(binary.Size(records[0]) / 8)
+		}
+		fortranRecord(b, order, int32(len(cpus)))
+		fortranRecord(b, order, int32(3))
+		fortranRecord(b, order, n)
+		fortranRecord(b, order, [4]int32{})
+		fortranRecord(b, order, int32(0))
+		fortranRecord(b, order, float64(0))
+		fortranRecord(b, order, float64(0))
+		fortranRecord(b, order, int32(0))
+		for _, r := range records {
+			fortranRecord(b, order, r)
+		}
+
+		fname := path.Join(dir, fmt.Sprintf("part_00012.out%05d", i+1))
+		if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestRamses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_ramses")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Legacy files: the second particle is a star and the third is a sink.
+	writeRamsesSnapshot(t, dir, [][]interface{}{
+		{
+			[]float64{0.1, 0.2, 0.3}, []float64{0.4, 0.5, 0.6},
+			[]float64{0.7, 0.8, 0.9}, []float64{1, 2, 3},
+			[]float64{0, 0, 0}, []float64{-1, 0, 0},
+			[]float64{1, 0.5, 2}, []int32{5, 6, -1}, []int32{7, 7, 7},
+			[]float64{0, 0.3, 0}, []float64{0, 0.02, 0},
+		},
+		{
+			[]float64{0.99}, []float64{0.5}, []float64{0.5},
+			[]float64{0}, []float64{0}, []float64{0},
+			[]float64{0.5}, []int32{8}, []int32{7},
+			[]float64{0}, []float64{0},
+		},
+	})
+
+	fname := path.Join(dir, "part_00012.out00001")
+	buf, err := NewRamsesBuffer(fname, "LittleEndian",
+		Context{RamsesDMFamilies: []int64{1}})
+	if err != nil {
+		t.Fatalf("NewRamsesBuffer returned error: %s", err.Error())
+	}
+	if m := buf.MinMass(); m < 0.9999e10 || m > 1.0001e10 {
+		t.Errorf("Expected MinMass() = 1e10, got %g.", m)
+	}
+	if n, err := buf.TotalParticles(fname); err != nil || n != 2 {
+		t.Errorf("Expected TotalParticles() = 2, got %d, %v.", n, err)
+	}
+
+	hd := &Header{}
+	if err := buf.ReadHeader(fname, hd); err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	if hd.N != 1 || hd.Cosmo.Z != 1 || hd.Cosmo.H100 != 0.7 ||
+		hd.TotalWidth < 99.999 || hd.TotalWidth > 100.001 {
+		t.Errorf("Got header %v %d %g.", hd.Cosmo, hd.N, hd.TotalWidth)
+	}
+
+	xs, vs, _, ids, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	eX, eV := [3]float32{10, 40, 70}, [3]float32{1, 0, -1}
+	for j := 0; j < 3; j++ {
+		dx, dv := xs[0][j]-eX[j], vs[0][j]-eV[j]
+		if dx > 1e-4 || dx < -1e-4 || dv > 1e-4 || dv < -1e-4 {
+			t.Errorf("Expected particle at %v, %v, got %v, %v.",
+				eX, eV, xs[0], vs[0])
+			break
+		}
+	}
+	if len(ids) != 1 || ids[0] != 5 {
+		t.Errorf("Expected IDs [5], got %v.", ids)
+	}
+	buf.Close()
+
+	// Newer files select particles by family instead.
+	desc := "# version:  1\n# ivar, variable_name, variable_type\n" +
+		"  1, position_x, d\n  2, position_y, d\n  3, position_z, d\n" +
+		"  4, velocity_x, d\n  5, velocity_y, d\n  6, velocity_z, d\n" +
+		"  7, mass, d\n  8, identity, q\n  9, levelp, i\n" +
+		" 10, family, b\n 11, tag, b\n"
+	err = ioutil.WriteFile(path.Join(dir, "part_file_descriptor.txt"),
+		[]byte(desc), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writeRamsesSnapshot(t, dir, [][]interface{}{
+		{
+			[]float64{0.1, 0.2}, []float64{0.4, 0.5}, []float64{0.7, 0.8},
+			[]float64{0, 0}, []float64{0, 0}, []float64{0, 0},
+			[]float64{1, 1}, []int64{1 << 40, 2}, []int32{7, 7},
+			[]int8{2, 1}, []int8{0, 0},
+		},
+	})
+
+	_, _, _, ids, err = buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("Expected IDs [2], got %v.", ids)
+	}
+	buf.Close()
+}
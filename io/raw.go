@@ -0,0 +1,433 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+)
+
+// RawHeaderNames lists the header fields which can be read from raw files.
+// Every field except Count and TotalCount is required. ScaleFactor may be
+// given instead of Redshift.
+var RawHeaderNames = []string{
+	"Count", "TotalCount", "BoxWidth", "Redshift", "ScaleFactor",
+	"OmegaM", "OmegaL", "H100",
+}
+
+// RawArrayNames lists the particle arrays which can be read from raw files.
+// X, V, and ID are required. Particles in files without an M array have the
+// uniform mass implied by TotalCount and the cosmology.
+var RawArrayNames = []string{"X", "V", "ID", "M"}
+
+// RawTypeSize returns the size in bytes of one of the types which can be used
+// for raw header fields and arrays. ok is false if the type isn't recognized.
+func RawTypeSize(typ string) (size int, ok bool) {
+	switch typ {
+	case "float32", "int32":
+		return 4, true
+	case "float64", "int64":
+		return 8, true
+	}
+	return 0, false
+}
+
+// rawFloat decodes a single value of the given type as a float64.
+func rawFloat(typ string, order binary.ByteOrder, b []byte) float64 {
+	switch typ {
+	case "float32":
+		return float64(math.Float32frombits(order.Uint32(b)))
+	case "float64":
+		return math.Float64frombits(order.Uint64(b))
+	case "int32":
+		return float64(int32(order.Uint32(b)))
+	case "int64":
+		return float64(int64(order.Uint64(b)))
+	}
+	panic(fmt.Sprintf("Unrecognized raw type '%s'.", typ))
+}
+
+// rawInt decodes a single value of the given type as an int64.
+func rawInt(typ string, order binary.ByteOrder, b []byte) int64 {
+	switch typ {
+	case "int32":
+		return int64(int32(order.Uint32(b)))
+	case "int64":
+		return int64(order.Uint64(b))
+	}
+	return int64(rawFloat(typ, order, b))
+}
+
+// rawHeader is the header of a raw file. Count and TotalCount are -1 if
+// they aren't known.
+type rawHeader struct {
+	Count, TotalCount    int64
+	BoxWidth, Redshift   float64
+	OmegaM, OmegaL, H100 float64
+}
+
+// rawArray is the location of a single particle array within a raw file.
+type rawArray struct {
+	name           string
+	typ            string
+	offset, stride int64
+	size           int64
+}
+
+// RawBuffer reads files whose layout is described by the Raw* variables of
+// the global config file.
+type RawBuffer struct {
+	open    bool
+	order   binary.ByteOrder
+	context Context
+	mass    float32
+
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+}
+
+func NewRawBuffer(
+	path, orderFlag string, context Context,
+) (VectorBuffer, error) {
+
+	var order binary.ByteOrder = binary.LittleEndian
+	switch orderFlag {
+	case "LittleEndian":
+	case "BigEndian":
+		order = binary.BigEndian
+	case "SystemOrder":
+		if !IsSysOrder(order) {
+			order = binary.BigEndian
+		}
+	}
+
+	buf := &RawBuffer{order: order, context: context}
+
+	hd, err := buf.readHeader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !buf.hasArray("M") {
+		if hd.TotalCount <= 0 {
+			return nil, fmt.Errorf("Files without an M array must have a " +
+				"TotalCount header field.")
+		}
+		c := CosmologyHeader{
+			Z: hd.Redshift, OmegaM: hd.OmegaM,
+			OmegaL: hd.OmegaL, H100: hd.H100,
+		}
+		buf.mass = calcUniformMass(hd.TotalCount,
+			hd.BoxWidth*context.RawPositionUnits, c)
+		return buf, nil
+	}
+
+	_, _, ms, _, err := buf.Read(path)
+	buf.Close()
+	if err != nil {
+		return nil, err
+	}
+	buf.mass = float32(math.Inf(+1))
+	for _, m := range ms {
+		if m < buf.mass {
+			buf.mass = m
+		}
+	}
+
+	return buf, nil
+}
+
+func (buf *RawBuffer) hasArray(name string) bool {
+	for _, arr := range buf.context.RawArrayNames {
+		if arr == name {
+			return true
+		}
+	}
+	return false
+}
+
+// headerEnd returns the offset of the first byte after the header.
+func (buf *RawBuffer) headerEnd() int64 {
+	c := &buf.context
+	if c.RawHeaderSize == 0 {
+		return 0
+	}
+	return c.RawHeaderSize + 2*c.RawRecordMarkers
+}
+
+func (buf *RawBuffer) readHeader(fname string) (*rawHeader, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &buf.context
+	data := make([]byte, c.RawHeaderSize)
+	if _, err := f.ReadAt(data, c.RawRecordMarkers); err != nil {
+		return nil, fmt.Errorf("Could not read the header of %s: %s",
+			fname, err.Error())
+	}
+
+	hd := &rawHeader{Count: -1, TotalCount: -1}
+	for i, name := range c.RawHeaderNames {
+		x := c.RawHeaderValues[i]
+		if off := c.RawHeaderOffsets[i]; off >= 0 {
+			size, _ := RawTypeSize(c.RawHeaderTypes[i])
+			if off+int64(size) > int64(len(data)) {
+				return nil, fmt.Errorf("The header field %s of %s is "+
+					"outside the header.", name, fname)
+			}
+			x = rawFloat(c.RawHeaderTypes[i], buf.order, data[off:])
+		}
+
+		switch name {
+		case "Count":
+			hd.Count = int64(x)
+		case "TotalCount":
+			hd.TotalCount = int64(x)
+		case "BoxWidth":
+			hd.BoxWidth = x
+		case "Redshift":
+			hd.Redshift = x
+		case "ScaleFactor":
+			hd.Redshift = 1/x - 1
+		case "OmegaM":
+			hd.OmegaM = x
+		case "OmegaL":
+			hd.OmegaL = x
+		case "H100":
+			hd.H100 = x
+		}
+	}
+
+	if hd.Count >= 0 {
+		return hd, nil
+	}
+
+	// Without a Count field, the number of particles is set by the file
+	// size.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hd.Count, err = buf.countFromSize(info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("The size of %s doesn't match its layout: %s",
+			fname, err.Error())
+	}
+
+	return hd, nil
+}
+
+// arrays returns the locations of the particle arrays in a file with n
+// particles. Arrays with an offset of -1 directly follow the previous array,
+// and are surrounded by record markers.
+func (buf *RawBuffer) arrays(n int64) []rawArray {
+	c := &buf.context
+	out := make([]rawArray, len(c.RawArrayNames))
+
+	end := buf.headerEnd()
+	for i := range out {
+		arr := &out[i]
+		arr.name, arr.typ = c.RawArrayNames[i], c.RawArrayTypes[i]
+		size, _ := RawTypeSize(arr.typ)
+		arr.size = int64(size)
+		if arr.name == "X" || arr.name == "V" {
+			arr.size *= 3
+		}
+
+		arr.stride = c.RawArrayStrides[i]
+		if arr.stride == 0 {
+			arr.stride = arr.size
+		}
+
+		arr.offset = c.RawArrayOffsets[i]
+		if arr.offset < 0 {
+			arr.offset = end + c.RawRecordMarkers
+			end = arr.offset + n*arr.stride + c.RawRecordMarkers
+		} else {
+			end = arr.offset + n*arr.stride
+		}
+	}
+
+	return out
+}
+
+// fileEnd returns the size of a file with n > 0 particles.
+func (buf *RawBuffer) fileEnd(n int64) int64 {
+	max := buf.headerEnd()
+	for i, arr := range buf.arrays(n) {
+		end := arr.offset + (n-1)*arr.stride + arr.size
+		if buf.context.RawArrayOffsets[i] < 0 {
+			end += buf.context.RawRecordMarkers
+		}
+		if end > max {
+			max = end
+		}
+	}
+	return max
+}
+
+// countFromSize returns the number of particles in a file of the given size.
+func (buf *RawBuffer) countFromSize(size int64) (int64, error) {
+	if size <= buf.headerEnd() {
+		return 0, nil
+	}
+
+	end1 := buf.fileEnd(1)
+	perParticle := buf.fileEnd(2) - end1
+	if perParticle <= 0 || size < end1 || (size-end1)%perParticle != 0 {
+		return 0, fmt.Errorf("%d bytes can't hold a whole number of "+
+			"particles.", size)
+	}
+
+	n := 1 + (size-end1)/perParticle
+	if buf.fileEnd(n) != size {
+		return 0, fmt.Errorf("%d bytes can't hold a whole number of "+
+			"particles.", size)
+	}
+	return n, nil
+}
+
+func (buf *RawBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+	buf.open = true
+
+	hd, err := buf.readHeader(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	n := int(hd.Count)
+
+	buf.xs = expandVectors(buf.xs[:0], n)
+	buf.vs = expandVectors(buf.vs[:0], n)
+	buf.ms = expandScalars(buf.ms[:0], n)
+	buf.ids = expandInts(buf.ids[:0], n)
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer f.Close()
+
+	c := &buf.context
+	for _, arr := range buf.arrays(hd.Count) {
+		if n == 0 {
+			break
+		}
+
+		data := make([]byte, int64(n-1)*arr.stride+arr.size)
+		if _, err := f.ReadAt(data, arr.offset); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("Could not read the %s "+
+				"array of %s: %s", arr.name, fname, err.Error())
+		}
+
+		elem := arr.size
+		if arr.name == "X" || arr.name == "V" {
+			elem /= 3
+		}
+		for i := 0; i < n; i++ {
+			b := data[int64(i)*arr.stride:]
+			switch arr.name {
+			case "X":
+				for j := 0; j < 3; j++ {
+					buf.xs[i][j] = float32(rawFloat(arr.typ, buf.order,
+						b[int64(j)*elem:]) * c.RawPositionUnits)
+				}
+			case "V":
+				for j := 0; j < 3; j++ {
+					buf.vs[i][j] = float32(rawFloat(arr.typ, buf.order,
+						b[int64(j)*elem:]) * c.RawVelocityUnits)
+				}
+			case "ID":
+				buf.ids[i] = rawInt(arr.typ, buf.order, b)
+			case "M":
+				buf.ms[i] = float32(rawFloat(arr.typ, buf.order, b) *
+					c.RawMassUnits)
+			}
+		}
+	}
+
+	if !buf.hasArray("M") {
+		for i := range buf.ms {
+			buf.ms[i] = buf.mass
+		}
+	}
+
+	tw := float32(hd.BoxWidth * c.RawPositionUnits)
+	for i := range buf.xs {
+		for j := 0; j < 3; j++ {
+			x := buf.xs[i][j]
+			if x < 0 {
+				buf.xs[i][j] += tw
+			} else if x >= tw {
+				buf.xs[i][j] -= tw
+			}
+
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < -tw || x > 2*tw {
+				return nil, nil, nil, nil, fmt.Errorf(
+					"Corruption detected in the file %s. I can't analyze it.",
+					fname,
+				)
+			}
+		}
+	}
+
+	return buf.xs, buf.vs, buf.ms, buf.ids, nil
+}
+
+func (buf *RawBuffer) Close() {
+	if !buf.open {
+		panic("Buffer not open.")
+	}
+	buf.open = false
+}
+
+func (buf *RawBuffer) IsOpen() bool {
+	return buf.open
+}
+
+func (buf *RawBuffer) ReadHeader(fname string, out *Header) error {
+	hd, err := buf.readHeader(fname)
+	if err != nil {
+		return err
+	}
+
+	defer buf.Close()
+	xs, _, _, _, err := buf.Read(fname)
+	if err != nil {
+		return err
+	}
+
+	out.TotalWidth = hd.BoxWidth * buf.context.RawPositionUnits
+	out.N = hd.Count
+
+	out.Cosmo.Z = hd.Redshift
+	out.Cosmo.OmegaM = hd.OmegaM
+	out.Cosmo.OmegaL = hd.OmegaL
+	out.Cosmo.H100 = hd.H100
+
+	out.Origin, out.Width = boundingBox(xs, out.TotalWidth)
+
+	return nil
+}
+
+func (buf *RawBuffer) MinMass() float32 { return buf.mass }
+
+func (buf *RawBuffer) TotalParticles(fname string) (int, error) {
+	hd, err := buf.readHeader(fname)
+	if err != nil {
+		return 0, err
+	} else if hd.TotalCount < 0 {
+		return 0, fmt.Errorf("The total number of particles can't be " +
+			"found because RawHeaderNames doesn't contain TotalCount.")
+	}
+	return int(hd.TotalCount), nil
+}
@@ -0,0 +1,185 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// fortranRecord writes x as a Fortran record with 4-byte markers.
+func fortranRecord(b *bytes.Buffer, order binary.ByteOrder, x interface{}) {
+	body := &bytes.Buffer{}
+	binary.Write(body, order, x)
+	binary.Write(b, order, int32(body.Len()))
+	b.Write(body.Bytes())
+	binary.Write(b, order, int32(body.Len()))
+}
+
+func TestRawBlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_raw")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	order := binary.BigEndian
+	b := &bytes.Buffer{}
+	fortranRecord(b, order, struct {
+		Count    int32
+		Pad      int32
+		BoxWidth float64
+		Redshift float64
+	}{3, 0, 100, 0.5})
+	fortranRecord(b, order, []float32{1, 2, 3, 4, 5, 6, 99, 101, -1})
+	fortranRecord(b, order, []float32{1, 1, 1, 2, 2, 2, 3, 3, 3})
+	fortranRecord(b, order, []int32{10, 11, -12})
+	fortranRecord(b, order, []float64{1, 2, 0.5})
+
+	fname := path.Join(dir, "blocked.dat")
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	context := Context{
+		RawHeaderSize: 24, RawRecordMarkers: 4,
+		RawHeaderNames: []string{
+			"Count", "BoxWidth", "Redshift", "OmegaM", "OmegaL", "H100",
+		},
+		RawHeaderOffsets: []int64{0, 8, 16, -1, -1, -1},
+		RawHeaderTypes: []string{
+			"int32", "float64", "float64", "float64", "float64", "float64",
+		},
+		RawHeaderValues:  []float64{0, 0, 0, 0.3, 0.7, 0.7},
+		RawArrayNames:    []string{"X", "V", "ID", "M"},
+		RawArrayOffsets:  []int64{-1, -1, -1, -1},
+		RawArrayTypes:    []string{"float32", "float32", "int32", "float64"},
+		RawArrayStrides:  []int64{0, 0, 0, 0},
+		RawPositionUnits: 1e-3, RawVelocityUnits: 2, RawMassUnits: 1e10,
+	}
+
+	buf, err := NewRawBuffer(fname, "BigEndian", context)
+	if err != nil {
+		t.Fatalf("NewRawBuffer returned error: %s", err.Error())
+	}
+	if buf.MinMass() != 0.5e10 {
+		t.Errorf("Expected MinMass() = 0.5e10, got %g.", buf.MinMass())
+	}
+
+	hd := &Header{}
+	if err := buf.ReadHeader(fname, hd); err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	expected := CosmologyHeader{Z: 0.5, OmegaM: 0.3, OmegaL: 0.7, H100: 0.7}
+	if hd.Cosmo != expected || hd.N != 3 || hd.TotalWidth != 0.1 {
+		t.Errorf("Expected header %v %d %g, got %v %d %g.",
+			expected, 3, 0.1, hd.Cosmo, hd.N, hd.TotalWidth)
+	}
+
+	xs, vs, ms, ids, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	defer buf.Close()
+
+	// Positions outside the box are wrapped back into it.
+	eXs := [][3]float32{{1e-3, 2e-3, 3e-3}, {4e-3, 5e-3, 6e-3},
+		{99e-3, 1e-3, 99e-3}}
+	eVs := [][3]float32{{2, 2, 2}, {4, 4, 4}, {6, 6, 6}}
+	eMs := []float32{1e10, 2e10, 0.5e10}
+	eIDs := []int64{10, 11, -12}
+	for i := range eXs {
+		for j := 0; j < 3; j++ {
+			if d := xs[i][j] - eXs[i][j]; d > 1e-6 || d < -1e-6 {
+				t.Errorf("Expected x[%d] = %v, got %v.", i, eXs[i], xs[i])
+				break
+			}
+		}
+		if vs[i] != eVs[i] || ms[i] != eMs[i] || ids[i] != eIDs[i] {
+			t.Errorf("Expected particle %d to be %v %g %d, got %v %g %d.",
+				i, eVs[i], eMs[i], eIDs[i], vs[i], ms[i], ids[i])
+		}
+	}
+}
+
+func TestRawInterleaved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_raw")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	order := binary.LittleEndian
+	b := &bytes.Buffer{}
+	binary.Write(b, order, struct {
+		ScaleFactor, BoxWidth float32
+		TotalCount            int64
+	}{0.5, 10, 1000})
+	for i := 0; i < 4; i++ {
+		x := float32(i)
+		binary.Write(b, order, bolshoiParticle{
+			X: [3]float32{x, x, x}, V: [3]float32{-x, -x, -x}, ID: int64(i),
+		})
+	}
+
+	fname := path.Join(dir, "interleaved.dat")
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	context := Context{
+		RawHeaderSize: 16,
+		RawHeaderNames: []string{
+			"ScaleFactor", "BoxWidth", "TotalCount", "OmegaM", "OmegaL", "H100",
+		},
+		RawHeaderOffsets: []int64{0, 4, 8, -1, -1, -1},
+		RawHeaderTypes: []string{
+			"float32", "float32", "int64", "float64", "float64", "float64",
+		},
+		RawHeaderValues:  []float64{0, 0, 0, 0.3, 0.7, 0.7},
+		RawArrayNames:    []string{"X", "V", "ID"},
+		RawArrayOffsets:  []int64{16, 28, 40},
+		RawArrayTypes:    []string{"float32", "float32", "int64"},
+		RawArrayStrides:  []int64{32, 32, 32},
+		RawPositionUnits: 1, RawVelocityUnits: 1, RawMassUnits: 1,
+	}
+
+	buf, err := NewRawBuffer(fname, "LittleEndian", context)
+	if err != nil {
+		t.Fatalf("NewRawBuffer returned error: %s", err.Error())
+	}
+	c := CosmologyHeader{Z: 1, OmegaM: 0.3, OmegaL: 0.7, H100: 0.7}
+	if m := calcUniformMass(1000, 10, c); buf.MinMass() != m {
+		t.Errorf("Expected MinMass() = %g, got %g.", m, buf.MinMass())
+	}
+	if n, err := buf.TotalParticles(fname); err != nil || n != 1000 {
+		t.Errorf("Expected TotalParticles() = 1000, got %d, %v.", n, err)
+	}
+
+	xs, vs, ms, ids, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	if len(xs) != 4 {
+		t.Fatalf("Expected 4 particles, got %d.", len(xs))
+	}
+	for i := range xs {
+		x := float32(i)
+		if xs[i] != [3]float32{x, x, x} || vs[i] != [3]float32{-x, -x, -x} ||
+			ids[i] != int64(i) || ms[i] != buf.MinMass() {
+			t.Errorf("Particle %d read as %v %v %g %d.",
+				i, xs[i], vs[i], ms[i], ids[i])
+		}
+	}
+	buf.Close()
+
+	// The particle count comes from the file size, so truncated files must
+	// be caught.
+	ioutil.WriteFile(fname, b.Bytes()[:b.Len()-3], 0644)
+	if _, _, _, _, err := buf.Read(fname); err == nil {
+		t.Errorf("Expected Read to fail on a truncated file.")
+	}
+	buf.Close()
+}
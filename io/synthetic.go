@@ -0,0 +1,425 @@
+package io
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/phil-mansfield/shellfish/cosmo"
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+// SyntheticFileFormat is the format of the names of synthetic "files". They
+// aren't files at all, but the snapshot index (starting from zero) and the
+// block of the particles which should be generated.
+const SyntheticFileFormat = "synthetic_%d_%d"
+
+// syntheticSubhaloC is the concentration of every subhalo.
+const syntheticSubhaloC = 10
+
+// syntheticSubhaloRMax is the maximum distance of subhalos from the center of
+// their host as a multiple of the host's splashback radius.
+const syntheticSubhaloRMax = 0.8
+
+// SyntheticHalo describes one of the halos in a synthetic snapshot. All
+// lengths are comoving and are in Mpc/h. Masses are in Msun/h.
+type SyntheticHalo struct {
+	ID         int64
+	X, Y, Z    float64
+	M200m      float64
+	C200m      float64
+	R200m, Rsp float64
+	// A, B, and C are the semi-axes of the splashback ellipsoid, which are
+	// aligned with the x, y, and z axes. A*B*C = Rsp^3.
+	A, B, C  float64
+	Subhalos int64
+}
+
+// syntheticModel contains everything needed to generate the particles of a
+// synthetic snapshot.
+type syntheticModel struct {
+	context  Context
+	halos    []SyntheticHalo
+	mass     float64
+	contrast float64
+	// counts[i] is the number of particles in halos[i], including its
+	// subhalos. The IDs of halo particles start after every background ID.
+	counts []int64
+	blocks int
+}
+
+// SyntheticHalos returns the halos which are placed in synthetic snapshots.
+// They can be used to write halo catalogs that match the snapshots or as the
+// ground truth for tests.
+func SyntheticHalos(context Context) ([]SyntheticHalo, error) {
+	c := &context
+	n := len(c.SyntheticHaloXs)
+	for _, length := range []int{
+		len(c.SyntheticHaloYs), len(c.SyntheticHaloZs),
+		len(c.SyntheticHaloM200ms), len(c.SyntheticHaloC200ms),
+		len(c.SyntheticHaloRspMults),
+	} {
+		if length != n {
+			return nil, fmt.Errorf("The SyntheticHalo* variables have " +
+				"different lengths.")
+		}
+	}
+	for _, length := range []int{
+		len(c.SyntheticHaloBAs), len(c.SyntheticHaloCAs),
+		len(c.SyntheticSubhalos),
+	} {
+		if length != 0 && length != n {
+			return nil, fmt.Errorf("The SyntheticHalo* variables have " +
+				"different lengths.")
+		}
+	}
+
+	rhoM := cosmo.RhoAverage(
+		c.SyntheticH100*100, c.SyntheticOmegaM, c.SyntheticOmegaL, 0,
+	)
+
+	halos := make([]SyntheticHalo, n)
+	for i := range halos {
+		h := &halos[i]
+		h.ID = int64(i)
+		h.X, h.Y, h.Z = c.SyntheticHaloXs[i], c.SyntheticHaloYs[i],
+			c.SyntheticHaloZs[i]
+		h.M200m, h.C200m = c.SyntheticHaloM200ms[i], c.SyntheticHaloC200ms[i]
+		h.R200m = r200m(h.M200m, rhoM)
+		h.Rsp = h.R200m * c.SyntheticHaloRspMults[i]
+
+		ba, ca := 1.0, 1.0
+		if len(c.SyntheticHaloBAs) > 0 {
+			ba, ca = c.SyntheticHaloBAs[i], c.SyntheticHaloCAs[i]
+		}
+		norm := math.Cbrt(ba * ca)
+		h.A, h.B, h.C = h.Rsp/norm, h.Rsp*ba/norm, h.Rsp*ca/norm
+
+		if len(c.SyntheticSubhalos) > 0 {
+			h.Subhalos = c.SyntheticSubhalos[i]
+		}
+	}
+
+	return halos, nil
+}
+
+// r200m returns the comoving R200m of a halo with mass m, given the comoving
+// mean matter density rhoM.
+func r200m(m, rhoM float64) float64 {
+	return math.Cbrt(m / (200 * rhoM * 4 * math.Pi / 3))
+}
+
+// nfwMass is proportional to the mass of an NFW halo inside x = r/r_s.
+func nfwMass(x float64) float64 {
+	return math.Log1p(x) - x/(1+x)
+}
+
+// nfwRadius draws a radius between r0 and r1 from an NFW profile with scale
+// radius rs.
+func nfwRadius(gen *rand.Generator, rs, r0, r1 float64) float64 {
+	m0, m1 := nfwMass(r0/rs), nfwMass(r1/rs)
+	target := gen.Uniform(m0, m1)
+
+	// nfwMass can't be inverted analytically, so bisect.
+	lo, hi := r0/rs, r1/rs
+	for i := 0; i < 50; i++ {
+		mid := (lo + hi) / 2
+		if nfwMass(mid) < target {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return rs * (lo + hi) / 2
+}
+
+// unitVector returns a random unit vector.
+func unitVector(gen *rand.Generator) [3]float64 {
+	z := gen.Uniform(-1, 1)
+	phi := gen.Uniform(0, 2*math.Pi)
+	r := math.Sqrt(1 - z*z)
+	return [3]float64{r * math.Cos(phi), r * math.Sin(phi), z}
+}
+
+func newSyntheticModel(context Context) (*syntheticModel, error) {
+	halos, err := SyntheticHalos(context)
+	if err != nil {
+		return nil, err
+	}
+
+	c := CosmologyHeader{
+		OmegaM: context.SyntheticOmegaM, OmegaL: context.SyntheticOmegaL,
+		H100: context.SyntheticH100,
+	}
+	mass := calcUniformMass(
+		context.SyntheticParticles, context.SyntheticTotalWidth, c,
+	)
+
+	model := &syntheticModel{
+		context: context, halos: halos, mass: float64(mass),
+		contrast: context.SyntheticCausticContrast,
+		blocks:   int(context.SyntheticBlocks),
+	}
+	if model.blocks < 1 {
+		model.blocks = 1
+	}
+
+	model.counts = make([]int64, len(halos))
+	for i := range halos {
+		inner, outer, sub := model.components(&halos[i])
+		model.counts[i] = inner + outer + sub
+	}
+
+	return model, nil
+}
+
+// components returns the number of particles inside the splashback radius
+// of a halo, outside it, and in each of its subhalos.
+func (model *syntheticModel) components(h *SyntheticHalo) (
+	inner, outer, sub int64,
+) {
+	rs := h.R200m / h.C200m
+	rOut := model.context.SyntheticROuterMult * h.R200m
+	norm := h.M200m / nfwMass(h.C200m) / model.mass
+
+	inner = int64(math.Floor(norm*nfwMass(h.Rsp/rs) + 0.5))
+	if rOut > h.Rsp {
+		outer = int64(math.Floor(model.contrast*norm*
+			(nfwMass(rOut/rs)-nfwMass(h.Rsp/rs)) + 0.5))
+	}
+	subMass := model.context.SyntheticSubhaloMassRatio * h.M200m
+	sub = h.Subhalos * int64(math.Floor(subMass/model.mass+0.5))
+
+	return inner, outer, sub
+}
+
+// eachHaloParticle calls f on the position of every particle in the halo at
+// index i. Positions are wrapped into the box.
+func (model *syntheticModel) eachHaloParticle(i int, f func(x [3]float32)) {
+	h := &model.halos[i]
+	gen := rand.New(rand.Xorshift,
+		rand.DeriveSeed(uint64(model.context.SyntheticSeed), 0, i))
+	tw := model.context.SyntheticTotalWidth
+	center := [3]float64{h.X, h.Y, h.Z}
+	// The profile is stretched along each axis so that surfaces of constant
+	// density are ellipsoids with the same volume as the spherical profile.
+	scale := [3]float64{h.A / h.Rsp, h.B / h.Rsp, h.C / h.Rsp}
+
+	emit := func(c [3]float64, r float64, u, s [3]float64) {
+		var x [3]float32
+		for k := 0; k < 3; k++ {
+			v := math.Mod(c[k]+r*u[k]*s[k], tw)
+			if v < 0 {
+				v += tw
+			}
+			x[k] = float32(v)
+			if x[k] >= float32(tw) {
+				x[k] = 0
+			}
+		}
+		f(x)
+	}
+
+	inner, outer, sub := model.components(h)
+	rs := h.R200m / h.C200m
+	rOut := model.context.SyntheticROuterMult * h.R200m
+	for j := int64(0); j < inner; j++ {
+		emit(center, nfwRadius(gen, rs, 0, h.Rsp), unitVector(gen), scale)
+	}
+	for j := int64(0); j < outer; j++ {
+		emit(center, nfwRadius(gen, rs, h.Rsp, rOut), unitVector(gen), scale)
+	}
+
+	if h.Subhalos == 0 {
+		return
+	}
+	subN := sub / h.Subhalos
+	subR200m := h.R200m * math.Cbrt(model.context.SyntheticSubhaloMassRatio)
+	subRs := subR200m / syntheticSubhaloC
+	sphere := [3]float64{1, 1, 1}
+	for j := int64(0); j < h.Subhalos; j++ {
+		var c [3]float64
+		r := nfwRadius(gen, rs, 0, syntheticSubhaloRMax*h.Rsp)
+		u := unitVector(gen)
+		for k := 0; k < 3; k++ {
+			c[k] = center[k] + r*u[k]*scale[k]
+		}
+		for n := int64(0); n < subN; n++ {
+			emit(c, nfwRadius(gen, subRs, 0, subR200m),
+				unitVector(gen), sphere)
+		}
+	}
+}
+
+// blockBounds returns the range of x values in a block.
+func (model *syntheticModel) blockBounds(block int) (lo, hi float32) {
+	tw := model.context.SyntheticTotalWidth
+	w := tw / float64(model.blocks)
+	lo, hi = float32(w*float64(block)), float32(w*float64(block+1))
+	if block == model.blocks-1 {
+		hi = float32(tw)
+	}
+	return lo, hi
+}
+
+// eachParticle calls f on every particle in a block. The background
+// particles come first, followed by each halo's particles. Every block
+// generates the full box and keeps the particles inside it, so the particles
+// don't depend on the number of blocks.
+func (model *syntheticModel) eachParticle(
+	block int, f func(x [3]float32, id int64),
+) {
+	ctx := &model.context
+	lo, hi := model.blockBounds(block)
+	tw := ctx.SyntheticTotalWidth
+
+	gen := rand.New(rand.Xorshift,
+		rand.DeriveSeed(uint64(ctx.SyntheticSeed), 1))
+	for j := int64(0); j < ctx.SyntheticParticles; j++ {
+		x := [3]float32{
+			float32(gen.Uniform(0, tw)), float32(gen.Uniform(0, tw)),
+			float32(gen.Uniform(0, tw)),
+		}
+		for k := range x {
+			if x[k] >= float32(tw) {
+				x[k] = 0
+			}
+		}
+		if x[0] >= lo && x[0] < hi {
+			f(x, j)
+		}
+	}
+
+	id := ctx.SyntheticParticles
+	for i := range model.halos {
+		j := id
+		model.eachHaloParticle(i, func(x [3]float32) {
+			if x[0] >= lo && x[0] < hi {
+				f(x, j)
+			}
+			j++
+		})
+		id += model.counts[i]
+	}
+}
+
+// SyntheticBuffer generates particles from an analytic model instead of
+// reading them from disk. Halos have NFW profiles with a sharp drop in
+// density at a known, possibly ellipsoidal, splashback radius, and sit on top
+// of a uniform background. This makes it possible to check Shellfish against
+// a known answer. The same particles are generated in every snapshot, and
+// all particles have zero velocity.
+type SyntheticBuffer struct {
+	open   bool
+	model  *syntheticModel
+	xs, vs [][3]float32
+	ms     []float32
+	ids    []int64
+}
+
+func NewSyntheticBuffer(context Context) (VectorBuffer, error) {
+	model, err := newSyntheticModel(context)
+	if err != nil {
+		return nil, err
+	}
+	return &SyntheticBuffer{model: model}, nil
+}
+
+// parseName returns the snapshot index and block of a synthetic file name.
+func (buf *SyntheticBuffer) parseName(fname string) (snap, block int, err error) {
+	_, err = fmt.Sscanf(fname, SyntheticFileFormat, &snap, &block)
+	if err != nil {
+		return 0, 0, fmt.Errorf("'%s' isn't the name of a synthetic "+
+			"snapshot.", fname)
+	}
+	if snap < 0 || snap >= len(buf.model.context.SyntheticScaleFactors) {
+		return 0, 0, fmt.Errorf("The synthetic snapshot '%s' has index %d, "+
+			"but there are only %d values in SyntheticScaleFactors.", fname,
+			snap, len(buf.model.context.SyntheticScaleFactors))
+	} else if block < 0 || block >= buf.model.blocks {
+		return 0, 0, fmt.Errorf("The synthetic snapshot '%s' has block %d, "+
+			"but there are only %d blocks.", fname, block, buf.model.blocks)
+	}
+	return snap, block, nil
+}
+
+func (buf *SyntheticBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+	buf.open = true
+
+	_, block, err := buf.parseName(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	buf.xs, buf.ids = buf.xs[:0], buf.ids[:0]
+	buf.model.eachParticle(block, func(x [3]float32, id int64) {
+		buf.xs = append(buf.xs, x)
+		buf.ids = append(buf.ids, id)
+	})
+
+	n := len(buf.xs)
+	buf.vs = expandVectors(buf.vs[:0], n)
+	buf.ms = expandScalars(buf.ms[:0], n)
+	for i := range buf.vs {
+		buf.vs[i] = [3]float32{}
+		buf.ms[i] = float32(buf.model.mass)
+	}
+
+	return buf.xs, buf.vs, buf.ms, buf.ids, nil
+}
+
+func (buf *SyntheticBuffer) Close() {
+	if !buf.open {
+		panic("Buffer not open.")
+	}
+	buf.open = false
+}
+
+func (buf *SyntheticBuffer) IsOpen() bool {
+	return buf.open
+}
+
+func (buf *SyntheticBuffer) ReadHeader(fname string, out *Header) error {
+	snap, block, err := buf.parseName(fname)
+	if err != nil {
+		return err
+	}
+	n, err := buf.TotalParticles(fname)
+	if err != nil {
+		return err
+	}
+
+	ctx := &buf.model.context
+	tw := ctx.SyntheticTotalWidth
+	lo, hi := buf.model.blockBounds(block)
+	*out = Header{
+		Cosmo: CosmologyHeader{
+			Z:      1/ctx.SyntheticScaleFactors[snap] - 1,
+			OmegaM: ctx.SyntheticOmegaM,
+			OmegaL: ctx.SyntheticOmegaL,
+			H100:   ctx.SyntheticH100,
+		},
+		N:          int64(n),
+		TotalWidth: tw,
+		Origin:     [3]float32{lo, 0, 0},
+		Width:      [3]float32{hi - lo, float32(tw), float32(tw)},
+	}
+
+	return nil
+}
+
+func (buf *SyntheticBuffer) MinMass() float32 { return float32(buf.model.mass) }
+
+func (buf *SyntheticBuffer) TotalParticles(fname string) (int, error) {
+	_, block, err := buf.parseName(fname)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	buf.model.eachParticle(block, func([3]float32, int64) { n++ })
+	return n, nil
+}
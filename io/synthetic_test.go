@@ -0,0 +1,182 @@
+package io
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func syntheticTestContext(blocks int64) Context {
+	return Context{
+		SyntheticTotalWidth:       20,
+		SyntheticOmegaM:           0.27,
+		SyntheticOmegaL:           0.73,
+		SyntheticH100:             0.7,
+		SyntheticScaleFactors:     []float64{0.5, 1},
+		SyntheticParticles:        20000,
+		SyntheticBlocks:           blocks,
+		SyntheticSeed:             3,
+		SyntheticCausticContrast:  0.1,
+		SyntheticROuterMult:       4,
+		SyntheticSubhaloMassRatio: 0.01,
+		SyntheticHaloXs:           []float64{5, 19.5},
+		SyntheticHaloYs:           []float64{5, 10},
+		SyntheticHaloZs:           []float64{5, 10},
+		SyntheticHaloM200ms:       []float64{1e14, 3e13},
+		SyntheticHaloC200ms:       []float64{5, 8},
+		SyntheticHaloRspMults:     []float64{1.2, 1.5},
+		SyntheticHaloBAs:          []float64{1, 0.8},
+		SyntheticHaloCAs:          []float64{1, 0.5},
+		SyntheticSubhalos:         []int64{0, 3},
+	}
+}
+
+func TestSyntheticHalos(t *testing.T) {
+	halos, err := SyntheticHalos(syntheticTestContext(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, h := range halos {
+		if v := h.A * h.B * h.C; math.Abs(v/(h.Rsp*h.Rsp*h.Rsp)-1) > 1e-6 {
+			t.Errorf("Halo %d has A*B*C = %g, but Rsp = %g.", h.ID, v, h.Rsp)
+		}
+	}
+	if h := halos[1]; math.Abs(h.B/h.A-0.8) > 1e-6 ||
+		math.Abs(h.C/h.A-0.5) > 1e-6 {
+		t.Errorf("Halo 1 has axes %g %g %g.", h.A, h.B, h.C)
+	}
+	// R200m of a 10^14 Msun/h halo is about 1.17 cMpc/h.
+	if r := halos[0].R200m; r < 1.15 || r > 1.2 {
+		t.Errorf("Halo 0 has R200m = %g.", r)
+	}
+
+	ctx := syntheticTestContext(1)
+	ctx.SyntheticHaloZs = ctx.SyntheticHaloZs[:1]
+	if _, err := SyntheticHalos(ctx); err == nil {
+		t.Errorf("Expected error for SyntheticHalo* lists of different " +
+			"lengths.")
+	}
+}
+
+func TestSyntheticBuffer(t *testing.T) {
+	single, err := NewSyntheticBuffer(syntheticTestContext(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fname := fmt.Sprintf(SyntheticFileFormat, 1, 0)
+	xs, vs, ms, ids, err := single.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+
+	pos := map[int64][3]float32{}
+	for i := range xs {
+		if _, ok := pos[ids[i]]; ok {
+			t.Fatalf("ID %d appears twice.", ids[i])
+		}
+		pos[ids[i]] = xs[i]
+		if vs[i] != [3]float32{} || ms[i] != single.MinMass() {
+			t.Fatalf("Particle %d has velocity %v and mass %g.",
+				i, vs[i], ms[i])
+		}
+	}
+	single.Close()
+
+	// The particles shouldn't depend on the number of blocks, and every
+	// block's header should bound its particles.
+	multi, err := NewSyntheticBuffer(syntheticTestContext(3))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	n := 0
+	for b := 0; b < 3; b++ {
+		fname := fmt.Sprintf(SyntheticFileFormat, 0, b)
+		hd := &Header{}
+		if err := multi.ReadHeader(fname, hd); err != nil {
+			t.Fatalf("ReadHeader returned error: %s", err.Error())
+		}
+		if hd.Cosmo.Z != 1 || hd.TotalWidth != 20 {
+			t.Errorf("Block %d has z = %g, TotalWidth = %g.",
+				b, hd.Cosmo.Z, hd.TotalWidth)
+		}
+
+		xs, _, _, ids, err := multi.Read(fname)
+		if err != nil {
+			t.Fatalf("Read returned error: %s", err.Error())
+		}
+		if int64(len(xs)) != hd.N {
+			t.Errorf("Block %d has %d particles, but the header says %d.",
+				b, len(xs), hd.N)
+		}
+		for i := range xs {
+			if x, ok := pos[ids[i]]; !ok || x != xs[i] {
+				t.Fatalf("Particle %d is at %v in block %d, but at %v "+
+					"with one block.", ids[i], xs[i], b, x)
+			}
+			for k := 0; k < 3; k++ {
+				if xs[i][k] < hd.Origin[k] ||
+					xs[i][k] >= hd.Origin[k]+hd.Width[k] {
+					t.Fatalf("Particle %v is outside block %d, which "+
+						"starts at %v and has width %v.",
+						xs[i], b, hd.Origin, hd.Width)
+				}
+			}
+		}
+		n += len(xs)
+		multi.Close()
+	}
+	if n != len(pos) {
+		t.Errorf("Split between blocks, there are %d particles instead of "+
+			"%d.", n, len(pos))
+	}
+
+	if _, err := multi.TotalParticles("snapshot.0"); err == nil {
+		t.Errorf("Expected error for a name which isn't synthetic.")
+	}
+	if _, err := multi.TotalParticles(
+		fmt.Sprintf(SyntheticFileFormat, 2, 0),
+	); err == nil {
+		t.Errorf("Expected error for a snapshot without a scale factor.")
+	}
+}
+
+func TestSyntheticProfile(t *testing.T) {
+	ctx := syntheticTestContext(1)
+	model, err := newSyntheticModel(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// Count the particles of the ellipsoidal halo in thin shells on either
+	// side of its splashback radius.
+	h := &model.halos[1]
+	tw := float32(ctx.SyntheticTotalWidth)
+	in, out := 0, 0
+	model.eachHaloParticle(1, func(x [3]float32) {
+		dx := [3]float32{x[0] - float32(h.X), x[1] - float32(h.Y),
+			x[2] - float32(h.Z)}
+		re := 0.0
+		for k, axis := range []float64{h.A, h.B, h.C} {
+			if dx[k] > tw/2 {
+				dx[k] -= tw
+			} else if dx[k] < -tw/2 {
+				dx[k] += tw
+			}
+			re += float64(dx[k]*dx[k]) / (axis * axis)
+		}
+		re = math.Sqrt(re)
+
+		if re > 0.9 && re < 1 {
+			in++
+		} else if re > 1 && re < 1.1 {
+			out++
+		}
+	})
+
+	if in == 0 || float64(out)/float64(in) > 2*ctx.SyntheticCausticContrast {
+		t.Errorf("Expected a sharp drop in density at the splashback "+
+			"radius, but found %d particles just inside and %d just "+
+			"outside.", in, out)
+	}
+}
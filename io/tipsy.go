@@ -0,0 +1,287 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/phil-mansfield/shellfish/cosmo"
+)
+
+// TipsyFamilies lists the particle families that can appear in a TIPSY file,
+// in the order that they are stored.
+var TipsyFamilies = []string{"gas", "dark", "star"}
+
+// tipsyHeader is the header of a TIPSY binary file, as written by ChaNGa and
+// Gasoline. The trailing padding is included in the on-disk header.
+type tipsyHeader struct {
+	Time                              float64
+	NBodies, NDim, NSph, NDark, NStar int32
+	Pad                               int32
+}
+
+// tipsyRecordSizes gives the size in bytes of a gas, dark matter, and star
+// particle. Every record starts with the mass, three positions, and three
+// velocities as float32s.
+var tipsyRecordSizes = [3]int64{48, 36, 44}
+
+// counts returns the number of gas, dark, and star particles in the file.
+func (hd *tipsyHeader) counts() [3]int64 {
+	return [3]int64{int64(hd.NSph), int64(hd.NDark), int64(hd.NStar)}
+}
+
+// readTipsyHeader reads the header of a TIPSY file. Standard TIPSY files are
+// big endian, but some codes write them in their native order, so the order is
+// found by checking which one gives a sensible number of dimensions.
+func readTipsyHeader(
+	f io.ReadSeeker, fname string,
+) (hd *tipsyHeader, order binary.ByteOrder, err error) {
+	hd = &tipsyHeader{}
+	for _, order = range []binary.ByteOrder{
+		binary.BigEndian, binary.LittleEndian,
+	} {
+		if _, err = f.Seek(0, 0); err != nil {
+			return nil, nil, err
+		}
+		if err = binary.Read(f, order, hd); err != nil {
+			return nil, nil, fmt.Errorf("Could not read the header of the "+
+				"TIPSY file %s: %s", fname, err.Error())
+		}
+		if hd.NDim == 3 && hd.NSph >= 0 && hd.NDark >= 0 && hd.NStar >= 0 &&
+			hd.NSph+hd.NDark+hd.NStar == hd.NBodies {
+			return hd, order, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("The file %s is not a three-dimensional "+
+		"TIPSY file.", fname)
+}
+
+// TipsyBuffer reads the TIPSY binary snapshots written by ChaNGa and Gasoline.
+// TIPSY files use G = 1 units whose length and mass units are set by the
+// simulation's dKpcUnit and dMsolUnit parameters.
+type TipsyBuffer struct {
+	open    bool
+	mass    float32
+	xs, vs  [][3]float32
+	ms      []float32
+	ids     []int64
+	context Context
+}
+
+func NewTipsyBuffer(path string, context Context) (VectorBuffer, error) {
+	buf := &TipsyBuffer{context: context}
+
+	_, _, ms, _, err := buf.Read(path)
+	buf.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	buf.mass = float32(math.Inf(+1))
+	for _, m := range ms {
+		if m < buf.mass {
+			buf.mass = m
+		}
+	}
+
+	return buf, nil
+}
+
+// units returns the sizes of the TIPSY length, velocity, and mass units in
+// comoving Mpc/h, km/s, and Msun/h.
+func (buf *TipsyBuffer) units() (length, vel, mass float64) {
+	c := &buf.context
+	kpcMks := cosmo.MpcMks / 1e3
+	vel = math.Sqrt(cosmo.GMks*c.TipsyMsolUnit*cosmo.MSunMks/
+		(c.TipsyKpcUnit*kpcMks)) / 1e3
+	length = c.TipsyKpcUnit / 1e3 * c.TipsyH100
+	return length, vel, c.TipsyMsolUnit * c.TipsyH100
+}
+
+// selected returns true if the particles in the given family should be read.
+func (buf *TipsyBuffer) selected(family int) bool {
+	for _, name := range buf.context.TipsyFamilies {
+		if name == TipsyFamilies[family] {
+			return true
+		}
+	}
+	return false
+}
+
+func (buf *TipsyBuffer) Read(fname string) (
+	xs, vs [][3]float32, ms []float32, ids []int64, err error,
+) {
+	if buf.open {
+		panic("Buffer already open.")
+	}
+	buf.open = true
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer f.Close()
+
+	hd, order, err := readTipsyHeader(f, fname)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	counts, n := hd.counts(), int64(0)
+	for family := range counts {
+		if buf.selected(family) {
+			n += counts[family]
+		}
+	}
+
+	buf.xs = expandVectors(buf.xs[:0], int(n))
+	buf.vs = expandVectors(buf.vs[:0], int(n))
+	buf.ms = expandScalars(buf.ms[:0], int(n))
+	buf.ids = expandInts(buf.ids[:0], int(n))
+
+	// IDs are the index of the particle in the file (i.e. its iOrder), which
+	// ChaNGa and Gasoline keep fixed between snapshots.
+	offset := int64(binary.Size(tipsyHeader{}))
+	id, start := int64(0), int64(0)
+	for family := range counts {
+		size := tipsyRecordSizes[family]
+		if !buf.selected(family) || counts[family] == 0 {
+			offset += size * counts[family]
+			id += counts[family]
+			continue
+		}
+
+		data := make([]byte, size*counts[family])
+		if _, err := f.ReadAt(data, offset); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("Could not read the %s "+
+				"particles in %s: %s", TipsyFamilies[family], fname,
+				err.Error())
+		}
+
+		for i := int64(0); i < counts[family]; i++ {
+			b := data[i*size:]
+			buf.ms[start+i] = tipsyFloat(order, b, 0)
+			for j := 0; j < 3; j++ {
+				buf.xs[start+i][j] = tipsyFloat(order, b, 1+j)
+				buf.vs[start+i][j] = tipsyFloat(order, b, 4+j)
+			}
+			buf.ids[start+i] = id + i
+		}
+
+		offset += size * counts[family]
+		id += counts[family]
+		start += counts[family]
+	}
+
+	err = buf.fix(hd, fname)
+	return buf.xs, buf.vs, buf.ms, buf.ids, err
+}
+
+// tipsyFloat returns the ith float32 in a particle record.
+func tipsyFloat(order binary.ByteOrder, b []byte, i int) float32 {
+	return math.Float32frombits(order.Uint32(b[4*i:]))
+}
+
+// fix converts the particles to Shellfish's units. TIPSY positions run from
+// -0.5 to 0.5 box widths, so they are shifted by half a box, which is what
+// Rockstar and AHF do when reading these files. Velocities are stored as
+// a^2 dx/dt, so they are divided by the scale factor to get peculiar
+// velocities.
+func (buf *TipsyBuffer) fix(hd *tipsyHeader, fname string) error {
+	length, vel, mass := buf.units()
+	tw := float32(length)
+	a := float32(hd.Time)
+
+	for i := range buf.xs {
+		for j := 0; j < 3; j++ {
+			x := (buf.xs[i][j] + 0.5) * tw
+			if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) ||
+				x < -tw || x > 2*tw {
+				return fmt.Errorf(
+					"Corruption detected in the file %s. I can't analyze it.",
+					fname,
+				)
+			}
+
+			if x < 0 {
+				x += tw
+			} else if x >= tw {
+				x -= tw
+			}
+			buf.xs[i][j] = x
+			buf.vs[i][j] *= float32(vel) / a
+		}
+		buf.ms[i] *= float32(mass)
+	}
+
+	return nil
+}
+
+func (buf *TipsyBuffer) Close() {
+	if !buf.open {
+		panic("Buffer not open.")
+	}
+	buf.open = false
+}
+
+func (buf *TipsyBuffer) IsOpen() bool {
+	return buf.open
+}
+
+func (buf *TipsyBuffer) ReadHeader(fname string, out *Header) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	hd, _, err := readTipsyHeader(f, fname)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	defer buf.Close()
+	xs, _, _, _, err := buf.Read(fname)
+	if err != nil {
+		return err
+	}
+
+	length, _, _ := buf.units()
+	out.TotalWidth = length
+	out.N = int64(len(xs))
+
+	out.Cosmo.Z = 1/hd.Time - 1
+	out.Cosmo.OmegaM = buf.context.TipsyOmegaM
+	out.Cosmo.OmegaL = buf.context.TipsyOmegaL
+	out.Cosmo.H100 = buf.context.TipsyH100
+
+	if len(xs) > 0 {
+		out.Origin, out.Width = boundingBox(xs, out.TotalWidth)
+	}
+
+	return nil
+}
+
+func (buf *TipsyBuffer) MinMass() float32 { return buf.mass }
+
+func (buf *TipsyBuffer) TotalParticles(fname string) (int, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hd, _, err := readTipsyHeader(f, fname)
+	if err != nil {
+		return 0, err
+	}
+
+	counts, n := hd.counts(), int64(0)
+	for family := range counts {
+		if buf.selected(family) {
+			n += counts[family]
+		}
+	}
+	return int(n), nil
+}
@@ -0,0 +1,102 @@
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTipsy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_tipsy")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	b := &bytes.Buffer{}
+	order := binary.BigEndian
+	binary.Write(b, order, tipsyHeader{
+		Time: 0.5, NBodies: 4, NDim: 3, NSph: 1, NDark: 2, NStar: 1,
+	})
+	// Records are mass, position, velocity, then family-specific fields.
+	binary.Write(b, order, [12]float32{7, 0, 0, 0, 1, 1, 1})
+	binary.Write(b, order, [9]float32{1, 0, 0.25, -0.25, 1, 2, 3})
+	binary.Write(b, order, [9]float32{2, 0.4999, -0.5, 0.1, -1, -2, -3})
+	binary.Write(b, order, [11]float32{3, 0.1, 0.1, 0.1, 0, 0, 0})
+
+	fname := path.Join(dir, "snap.000128")
+	if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	context := Context{
+		TipsyKpcUnit: 1000, TipsyMsolUnit: 2e10, TipsyOmegaM: 0.3,
+		TipsyOmegaL: 0.7, TipsyH100: 0.5, TipsyFamilies: []string{"dark"},
+	}
+	buf, err := NewTipsyBuffer(fname, context)
+	if err != nil {
+		t.Fatalf("NewTipsyBuffer returned error: %s", err.Error())
+	}
+	if buf.MinMass() != 1e10 {
+		t.Errorf("Expected MinMass() = 1e10, got %g.", buf.MinMass())
+	}
+
+	hd := &Header{}
+	if err := buf.ReadHeader(fname, hd); err != nil {
+		t.Fatalf("ReadHeader returned error: %s", err.Error())
+	}
+	expected := CosmologyHeader{Z: 1, OmegaM: 0.3, OmegaL: 0.7, H100: 0.5}
+	if hd.Cosmo != expected || hd.N != 2 || hd.TotalWidth != 0.5 {
+		t.Errorf("Expected header %v %d %g, got %v %d %g.",
+			expected, 2, 0.5, hd.Cosmo, hd.N, hd.TotalWidth)
+	}
+
+	xs, vs, ms, ids, err := buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	_, vel, _ := buf.(*TipsyBuffer).units()
+
+	eXs := [][3]float32{{0.25, 0.375, 0.125}, {0.49995, 0, 0.3}}
+	eVs := [][3]float32{{1, 2, 3}, {-1, -2, -3}}
+	eMs := []float32{1e10, 2e10}
+	eIDs := []int64{1, 2}
+	for i := range eXs {
+		for j := 0; j < 3; j++ {
+			v := eVs[i][j] * float32(vel) * 2
+			if math.Abs(float64(xs[i][j]-eXs[i][j])) > 1e-6 ||
+				math.Abs(float64(vs[i][j]-v)) > 1e-4*math.Abs(float64(v)) {
+				t.Errorf("Expected particle %d at %v, %v, got %v, %v.",
+					i, eXs[i], eVs[i], xs[i], vs[i])
+				break
+			}
+		}
+		if ms[i] != eMs[i] || ids[i] != eIDs[i] {
+			t.Errorf("Expected particle %d to have mass %g and ID %d, got "+
+				"%g and %d.", i, eMs[i], eIDs[i], ms[i], ids[i])
+		}
+	}
+	buf.Close()
+
+	// IDs stay the same when other families are read too.
+	context.TipsyFamilies = []string{"dark", "star"}
+	buf, err = NewTipsyBuffer(fname, context)
+	if err != nil {
+		t.Fatalf("NewTipsyBuffer returned error: %s", err.Error())
+	}
+	if n, err := buf.TotalParticles(fname); err != nil || n != 3 {
+		t.Errorf("Expected TotalParticles() = 3, got %d, %v.", n, err)
+	}
+	_, _, _, ids, err = buf.Read(fname)
+	if err != nil {
+		t.Fatalf("Read returned error: %s", err.Error())
+	}
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Errorf("Expected IDs [1 2 3], got %v.", ids)
+	}
+	buf.Close()
+}
@@ -0,0 +1,150 @@
+package analyze
+
+import (
+	"math"
+
+	"github.com/phil-mansfield/shellfish/los"
+	"github.com/phil-mansfield/shellfish/math/mat"
+)
+
+// HarmonicCoeffNum returns the number of coefficients in a real spherical
+// harmonic expansion that goes up to degree lMax.
+func HarmonicCoeffNum(lMax int) int { return (lMax + 1) * (lMax + 1) }
+
+// HarmonicLMax returns the maximum degree of a real spherical harmonic
+// expansion with n coefficients. ok is false if no expansion has n
+// coefficients.
+func HarmonicLMax(n int) (lMax int, ok bool) {
+	for l := 0; HarmonicCoeffNum(l) <= n; l++ {
+		if HarmonicCoeffNum(l) == n {
+			return l, true
+		}
+	}
+	return -1, false
+}
+
+// harmonicIdx returns the index of the coefficient of Y_lm in an expansion.
+// Coefficients are ordered by l and then by m, from -l to l.
+func harmonicIdx(l, m int) int { return l*l + l + m }
+
+// harmonicBasis writes the value of every real spherical harmonic up to degree
+// lMax at the given angle to out, in the same order as the coefficients of an
+// expansion.
+func harmonicBasis(lMax int, phi, theta float64, out []float64) {
+	eachHarmonic(lMax, phi, theta, func(idx int, y float64) { out[idx] = y })
+}
+
+// eachHarmonic calls f on the index and value of every real spherical harmonic
+// up to degree lMax at the given angle. The harmonics are orthonormal over the
+// unit sphere: Y_l0 is the normalized Legendre polynomial and Y_lm with m > 0
+// (m < 0) is proportional to cos(m phi) (sin(|m| phi)).
+func eachHarmonic(lMax int, phi, theta float64, f func(idx int, y float64)) {
+	sinTh, cosTh := math.Sincos(theta)
+
+	// pmm is the normalized associated Legendre function P_m^m. The
+	// recurrences below are stable up to very high degrees, unlike the
+	// monomials used by Penna-Dines functions.
+	pmm := math.Sqrt(1 / (4 * math.Pi))
+	for m := 0; m <= lMax; m++ {
+		if m > 0 {
+			pmm *= math.Sqrt(float64(2*m+1)/float64(2*m)) * sinTh
+		}
+
+		sinM, cosM := math.Sincos(float64(m) * phi)
+		set := func(l int, p float64) {
+			if m == 0 {
+				f(harmonicIdx(l, 0), p)
+			} else {
+				f(harmonicIdx(l, m), math.Sqrt2*p*cosM)
+				f(harmonicIdx(l, -m), math.Sqrt2*p*sinM)
+			}
+		}
+
+		set(m, pmm)
+		if m == lMax {
+			break
+		}
+
+		p2, p1 := pmm, math.Sqrt(float64(2*m+3))*cosTh*pmm
+		set(m+1, p1)
+		for l := m + 2; l <= lMax; l++ {
+			fl, fm := float64(l), float64(m)
+			a := math.Sqrt((4*fl*fl - 1) / (fl*fl - fm*fm))
+			b := math.Sqrt(((fl-1)*(fl-1) - fm*fm) / (4*(fl-1)*(fl-1) - 1))
+			p2, p1 = p1, a*(cosTh*p1-b*p2)
+			set(l, p1)
+		}
+	}
+}
+
+// HarmonicCoeffs calculates the coefficients of the real spherical harmonic
+// expansion up to degree lMax which best fits a set of input points in the
+// least squares sense. There must be at least HarmonicCoeffNum(lMax) points.
+func HarmonicCoeffs(xs, ys, zs []float64, lMax int) []float64 {
+	n := HarmonicCoeffNum(lMax)
+
+	// The harmonics are nearly orthogonal when the points cover the sphere,
+	// so the normal equations are well-conditioned.
+	ata := make([]float64, n*n)
+	atr := make([]float64, n)
+	basis := make([]float64, n)
+	for i := range xs {
+		r := math.Sqrt(xs[i]*xs[i] + ys[i]*ys[i] + zs[i]*zs[i])
+		phi := math.Atan2(ys[i], xs[i])
+		theta := math.Acos(zs[i] / r)
+
+		harmonicBasis(lMax, phi, theta, basis)
+		for j := 0; j < n; j++ {
+			atr[j] += basis[j] * r
+			for k := 0; k < n; k++ {
+				ata[j*n+k] += basis[j] * basis[k]
+			}
+		}
+	}
+
+	return mat.NewMatrix(ata, n, n).SolveVector(atr)
+}
+
+// HarmonicFunc returns a shell function corresponding to a set of real
+// spherical harmonic coefficients.
+func HarmonicFunc(cs []float64, lMax int) Shell {
+	return func(phi, th float64) float64 {
+		sum := 0.0
+		eachHarmonic(lMax, phi, th, func(idx int, y float64) {
+			sum += cs[idx] * y
+		})
+		return sum
+	}
+}
+
+// HarmonicPower returns the power in each degree, l, of a set of real
+// spherical harmonic coefficients: the sum of c_lm^2 over m. Since the
+// harmonics are orthonormal, the sum of the powers is the integral of r^2 over
+// solid angle. Everything above l = 0 comes from asphericity.
+func HarmonicPower(cs []float64) []float64 {
+	lMax, ok := HarmonicLMax(len(cs))
+	if !ok {
+		panic("Number of coefficients doesn't match any maximum degree.")
+	}
+
+	power := make([]float64, lMax+1)
+	for l := 0; l <= lMax; l++ {
+		for m := -l; m <= l; m++ {
+			c := cs[harmonicIdx(l, m)]
+			power[l] += c * c
+		}
+	}
+	return power
+}
+
+// HarmonicVolumeFit fits a real spherical harmonic shell to a set of points
+// constrained to a collection of planes belong to an los.Halo object.
+//
+// This function is essentially just a wrapper around HarmonicCoeffs.
+func HarmonicVolumeFit(
+	xs, ys [][]float64, h *los.Halo, lMax int,
+) (cs []float64, shell Shell) {
+	fXs, fYs, fZs := planeToVolume(xs, ys, h)
+	cs = HarmonicCoeffs(fXs, fYs, fZs, lMax)
+	return cs, HarmonicFunc(cs, lMax)
+}
@@ -0,0 +1,102 @@
+package analyze
+
+import (
+	"math"
+	"testing"
+
+	"github.com/phil-mansfield/shellfish/math/rand"
+)
+
+func TestHarmonicLMax(t *testing.T) {
+	for lMax := 0; lMax < 20; lMax++ {
+		l, ok := HarmonicLMax(HarmonicCoeffNum(lMax))
+		if !ok || l != lMax {
+			t.Errorf("Expected HarmonicLMax(%d) = %d, got %d.",
+				HarmonicCoeffNum(lMax), lMax, l)
+		}
+		// Penna-Dines shells must never be mistaken for harmonic shells.
+		if _, ok := HarmonicLMax(2 * (lMax + 1) * (lMax + 1)); ok {
+			t.Errorf("%d coefficients identified as a harmonic shell.",
+				2*(lMax+1)*(lMax+1))
+		}
+	}
+}
+
+func TestHarmonicOrthonormal(t *testing.T) {
+	lMax := 5
+	n := HarmonicCoeffNum(lMax)
+	prods := make([]float64, n*n)
+	basis := make([]float64, n)
+
+	// Midpoint integration over cos(theta) and phi.
+	nu, nphi := 200, 400
+	dOmega := (2.0 / float64(nu)) * (2 * math.Pi / float64(nphi))
+	for i := 0; i < nu; i++ {
+		theta := math.Acos(-1 + 2*(float64(i)+0.5)/float64(nu))
+		for j := 0; j < nphi; j++ {
+			phi := 2 * math.Pi * (float64(j) + 0.5) / float64(nphi)
+			harmonicBasis(lMax, phi, theta, basis)
+			for a := 0; a < n; a++ {
+				for b := 0; b < n; b++ {
+					prods[a*n+b] += basis[a] * basis[b] * dOmega
+				}
+			}
+		}
+	}
+
+	for a := 0; a < n; a++ {
+		for b := 0; b < n; b++ {
+			expected := 0.0
+			if a == b {
+				expected = 1
+			}
+			if math.Abs(prods[a*n+b]-expected) > 5e-3 {
+				t.Errorf("Expected <Y_%d, Y_%d> = %g, got %g.",
+					a, b, expected, prods[a*n+b])
+			}
+		}
+	}
+}
+
+func TestHarmonicFit(t *testing.T) {
+	gen := rand.New(rand.Xorshift, 1337)
+	s := ellipsoid(1, 0.8, 0.6)
+
+	npts := 2000
+	xs, ys, zs := make([]float64, npts), make([]float64, npts),
+		make([]float64, npts)
+	for i := range xs {
+		phi, theta := randomAngle(gen)
+		xs[i], ys[i], zs[i] = cartesian(phi, theta, s(phi, theta))
+	}
+
+	lMax := 8
+	cs := HarmonicCoeffs(xs, ys, zs, lMax)
+	fit := HarmonicFunc(cs, lMax)
+	for i := 0; i < 100; i++ {
+		phi, theta := randomAngle(gen)
+		r, rFit := s(phi, theta), fit(phi, theta)
+		if math.Abs(r-rFit) > 1e-2*r {
+			t.Errorf("%d) Expected r(%.3f, %.3f) = %.4f, got %.4f.",
+				i, phi, theta, r, rFit)
+		}
+	}
+
+	// A sphere of radius R has all its power in l = 0: the integral of R^2
+	// over solid angle.
+	for i := range xs {
+		phi, theta := randomAngle(gen)
+		xs[i], ys[i], zs[i] = cartesian(phi, theta, 2)
+	}
+	power := HarmonicPower(HarmonicCoeffs(xs, ys, zs, 4))
+	if math.Abs(power[0]-16*math.Pi) > 1e-6 {
+		t.Errorf("Expected l = 0 power of a sphere to be %g, got %g.",
+			16*math.Pi, power[0])
+	}
+	for l := 1; l < len(power); l++ {
+		if power[l] > 1e-12 {
+			t.Errorf("Expected l = %d power of a sphere to be 0, got %g.",
+				l, power[l])
+		}
+	}
+}
@@ -88,11 +88,21 @@ func PennaFunc(cs []float64, I, J, K int) Shell {
 func PennaVolumeFit(
 	xs, ys [][]float64, h *los.Halo, I, J int,
 ) (cs []float64, shell Shell) {
+	fXs, fYs, fZs := planeToVolume(xs, ys, h)
+	cs = PennaCoeffs(fXs, fYs, fZs, I, J, 2)
+	return cs, PennaFunc(cs, I, J, 2)
+}
+
+// planeToVolume converts points in the planes of each of a halo's rings into
+// a single set of 3D points.
+func planeToVolume(
+	xs, ys [][]float64, h *los.Halo,
+) (fXs, fYs, fZs []float64) {
 	n := 0
 	for i := range xs {
 		n += len(xs[i])
 	}
-	fXs, fYs, fZs := make([]float64, n), make([]float64, n), make([]float64, n)
+	fXs, fYs, fZs = make([]float64, n), make([]float64, n), make([]float64, n)
 
 	idx := 0
 	for i := range xs {
@@ -102,9 +112,7 @@ func PennaVolumeFit(
 			idx++
 		}
 	}
-
-	cs = PennaCoeffs(fXs, fYs, fZs, I, J, 2)
-	return cs, PennaFunc(cs, I, J, 2)
+	return fXs, fYs, fZs
 }
 
 // FilterPoints applies the filtering algorithm from section 2.2.3 of
@@ -2,11 +2,11 @@ package analyze
 
 import (
 	"math"
-	"math/rand"
 	
 	"github.com/gonum/matrix/mat64"
 	grid "github.com/phil-mansfield/shellfish/los/analyze/ellipse_grid"
 	intr "github.com/phil-mansfield/shellfish/math/interpolate"
+	"github.com/phil-mansfield/shellfish/math/rand"
 	"github.com/phil-mansfield/shellfish/math/sort"
 )
 
@@ -14,12 +14,13 @@ import (
 // angles.
 //
 // Unless otherwise specified, all quantities are calculated through Monte
-// Carlo solid angle sampling.
+// Carlo solid angle sampling using random numbers drawn from gen. Passing
+// generators with the same seed gives bit-identical results.
 type Shell func(phi, theta float64) float64
 
 // randomAngle returns and angle chosen uniformly at random.
-func randomAngle() (phi, theta float64) {
-	u, v := rand.Float64(), rand.Float64()
+func randomAngle(gen *rand.Generator) (phi, theta float64) {
+	u, v := gen.Uniform(0, 1), gen.Uniform(0, 1)
 	return 2 * math.Pi * u, math.Acos(2*v - 1)
 }
 
@@ -34,12 +35,14 @@ func cartesian(phi, theta, r float64) (x, y, z float64) {
 // calculated by Monte Carlo sampling of a sphere of radius rMax.
 //
 // This is slower than Volume for most shell shapes.
-func (s Shell) CartesianSampledVolume(samples int, rMax float64) float64 {
+func (s Shell) CartesianSampledVolume(
+	samples int, rMax float64, gen *rand.Generator,
+) float64 {
 	inside := 0
 	for i := 0; i < samples; i++ {
-		x := rand.Float64()*(2*rMax) - rMax
-		y := rand.Float64()*(2*rMax) - rMax
-		z := rand.Float64()*(2*rMax) - rMax
+		x := gen.Uniform(0, 1)*(2*rMax) - rMax
+		y := gen.Uniform(0, 1)*(2*rMax) - rMax
+		z := gen.Uniform(0, 1)*(2*rMax) - rMax
 
 		r := math.Sqrt(x*x + y*y + z*z)
 		phi := math.Atan2(y, x)
@@ -55,10 +58,10 @@ func (s Shell) CartesianSampledVolume(samples int, rMax float64) float64 {
 }
 
 // Volume returns the volume of Shell.
-func (s Shell) Volume(samples int) float64 {
+func (s Shell) Volume(samples int, gen *rand.Generator) float64 {
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r := s(phi, theta)
 		sum += r * r * r
 	}
@@ -67,10 +70,10 @@ func (s Shell) Volume(samples int) float64 {
 }
 
 // MeanRadius returns the angle-weighted mean radius of a Shell.
-func (s Shell) MeanRadius(samples int) float64 {
+func (s Shell) MeanRadius(samples int, gen *rand.Generator) float64 {
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, th := randomAngle()
+		phi, th := randomAngle(gen)
 		r := s(phi, th)
 		sum += r
 	}
@@ -78,10 +81,10 @@ func (s Shell) MeanRadius(samples int) float64 {
 }
 
 // MedianRadius returns the angle-weighted median radius of a Shell.
-func (s Shell) MedianRadius(samples int) float64 {
+func (s Shell) MedianRadius(samples int, gen *rand.Generator) float64 {
 	rs := make([]float64, samples)
 	for i := range rs {
-		phi, th := randomAngle()
+		phi, th := randomAngle(gen)
 		rs[i] = s(phi, th)
 	}
 	return sort.Median(rs, rs)
@@ -109,7 +112,9 @@ func trisort(x, y, z float64) (a, b, c float64, aIdx int) {
 
 // Axes calculates the moment of inertia-equivalent axes of a Shell as well
 // as the direction of the major axis.
-func (s Shell) Axes(samples int) (a, b, c float64, aVec [3]float64) {
+func (s Shell) Axes(
+	samples int, gen *rand.Generator,
+) (a, b, c float64, aVec [3]float64) {
 
 	// Temporarily approximate a constant-density ellipsoidal shell as
 	// a homoeoid.
@@ -120,7 +125,7 @@ func (s Shell) Axes(samples int) (a, b, c float64, aVec [3]float64) {
 	norm := 0.0
 
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r := s(phi, theta)
 		area := r * r / cosNorm(s, phi, theta)
 		x, y, z := cartesian(phi, theta, r)
@@ -215,10 +220,10 @@ func cosNorm(s Shell, phi, theta float64) float64 {
 }
 
 // SurfaceArea returns the surface area of a shell.
-func (s Shell) SurfaceArea(samples int) float64 {
+func (s Shell) SurfaceArea(samples int, gen *rand.Generator) float64 {
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r := s(phi, theta)
 		sum += r * r / cosNorm(s, phi, theta)
 	}
@@ -226,10 +231,12 @@ func (s Shell) SurfaceArea(samples int) float64 {
 }
 
 // DiffVolume returns the volume of the space between two Shells, s1 and s2.
-func (s1 Shell) DiffVolume(s2 Shell, samples int) float64 {
+func (s1 Shell) DiffVolume(
+	s2 Shell, samples int, gen *rand.Generator,
+) float64 {
 	sum := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r1, r2 := s1(phi, theta), s2(phi, theta)
 		r := (r1 + r2) / 2
 		dr := math.Abs(r1 - r2)
@@ -240,10 +247,12 @@ func (s1 Shell) DiffVolume(s2 Shell, samples int) float64 {
 
 // MaxDiff returns the maximum radial distance between two Shells along
 // any line of sight.
-func (s1 Shell) MaxDiff(s2 Shell, samples int) float64 {
+func (s1 Shell) MaxDiff(
+	s2 Shell, samples int, gen *rand.Generator,
+) float64 {
 	max := 0.0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r1, r2 := s1(phi, theta), s2(phi, theta)
 		dr := math.Abs(r1 - r2)
 		if dr > max {
@@ -254,12 +263,14 @@ func (s1 Shell) MaxDiff(s2 Shell, samples int) float64 {
 }
 
 // RadialRange returns the maximum and minimum radius of a Shell.
-func (s Shell) RadialRange(samples int) (low, high float64) {
-	phi, theta := randomAngle()
+func (s Shell) RadialRange(
+	samples int, gen *rand.Generator,
+) (low, high float64) {
+	phi, theta := randomAngle(gen)
 	low = s(phi, theta)
 	high = low
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r := s(phi, theta)
 		if r > high {
 			high = r
@@ -274,7 +285,7 @@ func (s Shell) RadialRange(samples int) (low, high float64) {
 // RadiusHistogram returns a normalized angle-weighted histogram of the radii
 // of a Shell.
 func (s Shell) RadiusHistogram(
-	samples, bins int, rMin, rMax float64,
+	samples, bins int, rMin, rMax float64, gen *rand.Generator,
 ) (rs, ns []float64) {
 	rs, ns = make([]float64, bins), make([]float64, bins)
 	dr := (rMax - rMin) / float64(bins)
@@ -284,7 +295,7 @@ func (s Shell) RadiusHistogram(
 
 	count := 0
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		r := s(phi, theta)
 		ri := (r - rMin) / dr
 		if ri < 0 {
@@ -310,7 +321,7 @@ func (s Shell) RadiusHistogram(
 // Monte Carlo calculation at every radius, so don't worry about the number of
 // bins having an effect on the performance.)
 func (s Shell) AngularFractionProfile(
-	samples, bins int, rMin, rMax float64,
+	samples, bins int, rMin, rMax float64, gen *rand.Generator,
 ) (rs, fs []float64) {
 	rs, fs = make([]float64, bins), make([]float64, bins)
 	ns := make([]int, bins)
@@ -323,7 +334,7 @@ func (s Shell) AngularFractionProfile(
 	}
 
 	for i := 0; i < samples; i++ {
-		phi, theta := randomAngle()
+		phi, theta := randomAngle(gen)
 		lr := math.Log(s(phi, theta))
 		lri := int((lr - lrMin) / dlr)
 		if lri < 0 || lri >= bins {
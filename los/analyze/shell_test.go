@@ -3,9 +3,9 @@ package analyze
 import (
 	"fmt"
 	"math"
-	"math/rand"
 	"testing"
-	"time"
+
+	"github.com/phil-mansfield/shellfish/math/rand"
 )
 
 func sphere(r float64) Shell {
@@ -39,13 +39,13 @@ func ellipsoid(a, b, c float64) Shell {
 }
 
 func TestEverything(t *testing.T) {
-	rand.Seed(time.Now().UnixNano())
+	gen := rand.New(rand.Xorshift, 1337)
 	s := ellipsoid(2, 4, 3)
 	//s := brokenSphere(2, 1)
 	samples := 1000 * 1000
-	fmt.Printf("Volume: %8.4g\n", s.Volume(samples))
-	a, b, c, aVec := s.Axes(samples)
+	fmt.Printf("Volume: %8.4g\n", s.Volume(samples, gen))
+	a, b, c, aVec := s.Axes(samples, gen)
 	fmt.Printf("Axes: %8.4g %8.4g %8.4g\n", a, b, c)
 	fmt.Printf("Printiple Axis: %8.4g\n", aVec)
-	fmt.Printf("Area: %8.4g\n", s.SurfaceArea(samples))
+	fmt.Printf("Area: %8.4g\n", s.SurfaceArea(samples, gen))
 }
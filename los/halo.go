@@ -199,12 +199,23 @@ func (h *Halo) Transform(vecs [][3]float32, totalWidth float64) {
 // Insert insreats a sphere with the given center and radius to all the rings
 // of the halo.
 func (h *Halo) Insert(vec [3]float32, radius, rho float64) {
+	h.InsertRings(vec, radius, rho, 0, 1)
+}
+
+// InsertRings inserts a sphere with the given center and radius to every
+// skip-th ring of the halo, starting with the ring at index offset. Threads
+// which insert the same spheres with different offsets never write to the same
+// memory, so they can share a Halo. Unlike Split and Join, this gives
+// bit-identical profiles regardless of the number of threads.
+func (h *Halo) InsertRings(
+	vec [3]float32, radius, rho float64, offset, skip int,
+) {
 	// transform into displacement from the center
 	vec[0] -= float32(h.origin[0])
 	vec[1] -= float32(h.origin[1])
 	vec[2] -= float32(h.origin[2])
 
-	for ring := 0; ring < h.rings; ring++ {
+	for ring := offset; ring < h.rings; ring += skip {
 		// If this intersection check is the chief cost, we can throw some
 		// more computational feometry at it until it's fixed. (3D spatial
 		// indexing trees.)
@@ -0,0 +1,434 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+const (
+	// indexFile is the name of the consistent-trees index inside MemoDir.
+	indexFile = "ct_index.dat"
+	// indexVersion is written at the start of index files so that indices
+	// written by older versions of Shellfish are rebuilt.
+	indexVersion = 2
+)
+
+// The columns of tree_*.dat files which are read. These positions are fixed
+// by the consistent-trees output format.
+const (
+	scaleCol  = 0
+	idCol     = 1
+	descIDCol = 3
+	mvirCol   = 10
+	mmpCol    = 14
+)
+
+// ctIndex is an index of a set of consistent-trees tree_*.dat files. It
+// records the byte range of every forest (i.e. every "#tree" block) and which
+// forest every halo is in, so that a history can be found by reading a single
+// forest.
+type ctIndex struct {
+	files []ctFile
+	// forests are the byte ranges of all the forests in all the files.
+	forests []ctForest
+	// ids and idForests give the index in forests of each halo ID. ids are
+	// sorted.
+	ids, idForests []int64
+}
+
+// ctFile is a single tree file in an index.
+type ctFile struct {
+	name string
+	// size and modTime are the size and modification time (in Unix
+	// nanoseconds) of the file when the index was built. They're used to
+	// notice when trees have been rewritten.
+	size, modTime int64
+	// scales are the distinct scale factors of the halos in the file, in
+	// increasing order. consistent-trees numbers snapshots by these, so the
+	// scale factor scales[i] is snapshot i + 1.
+	scales []float64
+}
+
+// ctForest is the byte range of a single forest. Offsets are into the
+// decompressed file.
+type ctForest struct {
+	File       int64
+	Start, End int64
+}
+
+// consistentTrees reads consistent-trees tree_*.dat files. memoDir is where
+// the index of the files is stored.
+type consistentTrees struct {
+	memoDir string
+}
+
+func (ct *consistentTrees) histories(
+	files []string, roots []int,
+) (ids, snaps [][]int, err error) {
+	idx, err := readIndex(files, ct.memoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Decompressing a file is only fast when it's read front to back, so
+	// the forests of each file are read in order through a single handle.
+	forestRoots := map[int][]int{}
+	fileForests := make([][]int, len(idx.files))
+	for i, root := range roots {
+		forest, ok := idx.findForest(root)
+		if !ok {
+			return nil, nil, fmt.Errorf(
+				"Halo %d not found in given files.", root,
+			)
+		}
+		if _, ok := forestRoots[forest]; !ok {
+			file := idx.forests[forest].File
+			fileForests[file] = append(fileForests[file], forest)
+		}
+		forestRoots[forest] = append(forestRoots[forest], i)
+	}
+
+	ids, snaps = make([][]int, len(roots)), make([][]int, len(roots))
+	for file, forests := range fileForests {
+		if len(forests) == 0 {
+			continue
+		}
+		sort.Slice(forests, func(i, j int) bool {
+			return idx.forests[forests[i]].Start <
+				idx.forests[forests[j]].Start
+		})
+
+		ctf := &idx.files[file]
+		f, err := compress.OpenFile(ctf.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, forest := range forests {
+			halos, err := readForest(f, ctf.name, idx.forests[forest])
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			b := newBranches(halos, ctf.scales)
+			for _, i := range forestRoots[forest] {
+				ids[i], snaps[i], _ = b.history(roots[i])
+			}
+		}
+		f.Close()
+	}
+
+	return ids, snaps, nil
+}
+
+// findForest returns the index of the forest containing the halo id. If
+// multiple files contain the ID, the forest in the first one is used.
+func (idx *ctIndex) findForest(id int) (int, bool) {
+	j := sort.Search(len(idx.ids), func(j int) bool {
+		return idx.ids[j] >= int64(id)
+	})
+	if j == len(idx.ids) || idx.ids[j] != int64(id) {
+		return 0, false
+	}
+	return int(idx.idForests[j]), true
+}
+
+// readIndex returns the index of the given tree files. The index is read from
+// memoDir if it's there and up to date, and is otherwise built and written to
+// memoDir.
+func readIndex(files []string, memoDir string) (*ctIndex, error) {
+	fname := path.Join(memoDir, indexFile)
+
+	infos := make([]ctFile, len(files))
+	for i := range files {
+		info, err := os.Stat(files[i])
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = ctFile{
+			name: files[i], size: info.Size(),
+			modTime: info.ModTime().UnixNano(),
+		}
+	}
+
+	if idx, err := readIndexFile(fname); err == nil && idx.matches(infos) {
+		return idx, nil
+	}
+
+	idx, err := buildIndex(infos)
+	if err != nil {
+		return nil, err
+	}
+
+	// Building the index requires reading every tree, so it's written to a
+	// temporary file first. Otherwise an interrupted run would leave behind
+	// a truncated index.
+	tmpFile := fname + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, fname)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// matches returns true if the index was built from the given files. Only
+// their names, sizes, and modification times are compared.
+func (idx *ctIndex) matches(files []ctFile) bool {
+	if len(files) != len(idx.files) {
+		return false
+	}
+	for i := range files {
+		if files[i].name != idx.files[i].name ||
+			files[i].size != idx.files[i].size ||
+			files[i].modTime != idx.files[i].modTime {
+			return false
+		}
+	}
+	return true
+}
+
+// buildIndex reads through every file and indexes its forests. files only
+// need their names, sizes, and modification times set.
+func buildIndex(files []ctFile) (*ctIndex, error) {
+	idx := &ctIndex{}
+	type idForest struct{ id, forest int64 }
+	halos := []idForest{}
+
+	for i, file := range files {
+		fname := file.name
+		f, err := compress.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		rd := bufio.NewReader(f)
+		scales := map[float64]bool{}
+		off, forest := int64(0), int64(-1)
+		for lineNum := 1; ; lineNum++ {
+			line, err := rd.ReadBytes('\n')
+			if len(line) == 0 && err == io.EOF {
+				break
+			} else if err != nil && err != io.EOF {
+				f.Close()
+				return nil, err
+			}
+
+			switch {
+			case bytes.HasPrefix(line, []byte("#tree")):
+				if forest != -1 {
+					idx.forests[forest].End = off
+				}
+				forest = int64(len(idx.forests))
+				idx.forests = append(idx.forests, ctForest{
+					File: int64(i), Start: off,
+				})
+			case forest == -1 || !isHaloLine(line):
+				// Header lines, the tree count, and blank lines.
+			default:
+				h, err := parseHalo(line)
+				if err != nil {
+					f.Close()
+					return nil, fmt.Errorf("Line %d of %s: %s",
+						lineNum, fname, err.Error())
+				}
+				scales[h.time] = true
+				halos = append(halos, idForest{int64(h.id), forest})
+			}
+
+			off += int64(len(line))
+		}
+		if forest != -1 {
+			idx.forests[forest].End = off
+		}
+		f.Close()
+
+		for scale := range scales {
+			file.scales = append(file.scales, scale)
+		}
+		sort.Float64s(file.scales)
+		idx.files = append(idx.files, file)
+	}
+
+	// A stable sort keeps halos found in multiple files in file order.
+	sort.SliceStable(halos, func(i, j int) bool {
+		return halos[i].id < halos[j].id
+	})
+	idx.ids = make([]int64, len(halos))
+	idx.idForests = make([]int64, len(halos))
+	for i := range halos {
+		idx.ids[i], idx.idForests[i] = halos[i].id, halos[i].forest
+	}
+
+	return idx, nil
+}
+
+// isHaloLine returns false for the blank lines and comments of a tree file.
+func isHaloLine(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) > 0 && line[0] != '#'
+}
+
+// parseHalo parses a single halo line of a tree file.
+func parseHalo(line []byte) (treeHalo, error) {
+	fields := bytes.Fields(line)
+	if len(fields) <= mmpCol {
+		return treeHalo{}, fmt.Errorf("Halo has %d columns, but "+
+			"consistent-trees halos have at least %d.", len(fields), mmpCol+1)
+	}
+
+	h := treeHalo{}
+	var err error
+	if h.time, err = strconv.ParseFloat(string(fields[scaleCol]), 64); err != nil {
+		return treeHalo{}, err
+	}
+	if h.id, err = strconv.Atoi(string(fields[idCol])); err != nil {
+		return treeHalo{}, err
+	}
+	if h.descID, err = strconv.Atoi(string(fields[descIDCol])); err != nil {
+		return treeHalo{}, err
+	}
+	if h.mass, err = strconv.ParseFloat(string(fields[mvirCol]), 64); err != nil {
+		return treeHalo{}, err
+	}
+	h.main = string(fields[mmpCol]) == "1"
+	return h, nil
+}
+
+// readForest reads the halos in a single forest of f, the tree file fname.
+func readForest(
+	f io.ReaderAt, fname string, forest ctForest,
+) ([]treeHalo, error) {
+	rd := bufio.NewReader(io.NewSectionReader(
+		f, forest.Start, forest.End-forest.Start,
+	))
+	halos := []treeHalo{}
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if !isHaloLine(line) {
+			continue
+		}
+
+		h, err := parseHalo(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err.Error())
+		}
+		halos = append(halos, h)
+	}
+
+	return halos, nil
+}
+
+// readIndexFile reads an index written by ctIndex.write.
+func readIndexFile(fname string) (*ctIndex, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	order := binary.LittleEndian
+
+	var version, nFiles int64
+	if err := binary.Read(rd, order, &version); err != nil {
+		return nil, err
+	} else if version != indexVersion {
+		return nil, fmt.Errorf("%s has index version %d, not %d.",
+			fname, version, indexVersion)
+	}
+	if err := binary.Read(rd, order, &nFiles); err != nil {
+		return nil, err
+	}
+
+	idx := &ctIndex{files: make([]ctFile, nFiles)}
+	for i := range idx.files {
+		var nameLen, nScales int64
+		if err := binary.Read(rd, order, &nameLen); err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(rd, name); err != nil {
+			return nil, err
+		}
+		idx.files[i].name = string(name)
+		if err := binary.Read(rd, order, &idx.files[i].size); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(rd, order, &idx.files[i].modTime); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(rd, order, &nScales); err != nil {
+			return nil, err
+		}
+		idx.files[i].scales = make([]float64, nScales)
+		if err := binary.Read(rd, order, idx.files[i].scales); err != nil {
+			return nil, err
+		}
+	}
+
+	var nForests, nIDs int64
+	if err := binary.Read(rd, order, &nForests); err != nil {
+		return nil, err
+	}
+	idx.forests = make([]ctForest, nForests)
+	if err := binary.Read(rd, order, idx.forests); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(rd, order, &nIDs); err != nil {
+		return nil, err
+	}
+	idx.ids, idx.idForests = make([]int64, nIDs), make([]int64, nIDs)
+	if err := binary.Read(rd, order, idx.ids); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(rd, order, idx.idForests); err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// write writes the index to wr in the format read by readIndexFile.
+func (idx *ctIndex) write(wr io.Writer) error {
+	bw := bufio.NewWriter(wr)
+	order := binary.LittleEndian
+
+	xs := []interface{}{int64(indexVersion), int64(len(idx.files))}
+	for _, file := range idx.files {
+		xs = append(xs, int64(len(file.name)), []byte(file.name),
+			file.size, file.modTime, int64(len(file.scales)), file.scales)
+	}
+	xs = append(xs, int64(len(idx.forests)), idx.forests,
+		int64(len(idx.ids)), idx.ids, idx.idForests)
+
+	for _, x := range xs {
+		if err := binary.Write(bw, order, x); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,125 @@
+package tree
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ctLine returns a tree_*.dat line with the given values and zeros in every
+// other column.
+func ctLine(scale float64, id, descID int, mvir float64, mmp int) string {
+	cols := make([]string, 20)
+	for i := range cols {
+		cols[i] = "0"
+	}
+	cols[scaleCol] = fmt.Sprintf("%.4f", scale)
+	cols[idCol] = fmt.Sprint(id)
+	cols[descIDCol] = fmt.Sprint(descID)
+	cols[mvirCol] = fmt.Sprintf("%g", mvir)
+	cols[mmpCol] = fmt.Sprint(mmp)
+	return strings.Join(cols, " ") + "\n"
+}
+
+func TestHaloHistories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_tree")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Forest 1: 3 <- {1, 2 (mmp)} and 4 <- 3. Forest 5: 7 <- 6.
+	tree0 := "#scale(0) id(1) desc_scale(2) desc_id(3)\n#Omega_M = 0.3\n2\n" +
+		"#tree 4\n" +
+		ctLine(1.0, 4, -1, 10, 1) +
+		ctLine(0.5, 3, 4, 8, 1) +
+		ctLine(0.25, 1, 3, 1, 0) +
+		"\n  \n" +
+		ctLine(0.25, 2, 3, 2, 1) +
+		"#tree 7\n" +
+		ctLine(1.0, 7, -1, 5, 1) +
+		ctLine(0.5, 6, 7, 4, 1)
+	// A second file with a forest without mmp flags.
+	tree1 := "#scale(0) id(1)\n1\n#tree 10\n" +
+		ctLine(0.5, 10, -1, 5, 0) +
+		ctLine(0.25, 8, 10, 1, 0) +
+		ctLine(0.25, 9, 10, 3, 0)
+
+	gzBuf := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzBuf)
+	gz.Write([]byte(tree1))
+	gz.Close()
+
+	files := []string{
+		path.Join(dir, "tree_0_0_0.dat"), path.Join(dir, "tree_0_0_1.dat.gz"),
+	}
+	if err := ioutil.WriteFile(files[0], []byte(tree0), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(files[1], gzBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	roots := []int{3, 6, 1, 9}
+	expIDs := "[[2 3 4] [6 7] [1 3 4] [9 10]]"
+	expSnaps := "[[11 12 13] [12 13] [11 12 13] [11 12]]"
+
+	// The second call reads the index written by the first.
+	for i := 0; i < 2; i++ {
+		ids, snaps, err := HaloHistories(
+			"consistent-trees", files, roots, 10, dir,
+		)
+		if err != nil {
+			t.Fatalf("%d) HaloHistories returned error: %s", i, err.Error())
+		}
+		if fmt.Sprint(ids) != expIDs || fmt.Sprint(snaps) != expSnaps {
+			t.Errorf("%d) Expected IDs %s and snapshots %s, got %v and %v.",
+				i, expIDs, expSnaps, ids, snaps)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, indexFile)); err != nil {
+		t.Errorf("Index file wasn't written.")
+	}
+
+	_, _, err = HaloHistories("consistent-trees", files, []int{100}, 0, dir)
+	if err == nil {
+		t.Errorf("Expected error for a halo that isn't in the trees.")
+	}
+
+	// Rewriting a tree file should make the index be rebuilt.
+	tree0 += "#tree 12\n" + ctLine(1.0, 12, -1, 1, 1)
+	if err := ioutil.WriteFile(files[0], []byte(tree0), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, _, err := HaloHistories("consistent-trees", files, []int{12}, 0, dir)
+	if err != nil {
+		t.Fatalf("HaloHistories returned error: %s", err.Error())
+	}
+	if fmt.Sprint(ids) != "[[12]]" {
+		t.Errorf("Expected IDs [[12]] after rewriting trees, got %v.", ids)
+	}
+
+	// So should rewriting it without changing its size.
+	tree0 = strings.Replace(tree0, " 12 ", " 13 ", -1)
+	if err := ioutil.WriteFile(files[0], []byte(tree0), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(files[0], later, later); err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, _, err = HaloHistories("consistent-trees", files, []int{13}, 0, dir)
+	if err != nil {
+		t.Fatalf("HaloHistories returned error: %s", err.Error())
+	}
+	if fmt.Sprint(ids) != "[[13]]" {
+		t.Errorf("Expected IDs [[13]] after rewriting trees, got %v.", ids)
+	}
+}
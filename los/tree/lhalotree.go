@@ -0,0 +1,102 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+// lHaloTreeSnapFactor and lHaloTreeFileFactor are used to give LHaloTree
+// halos IDs. LHaloTree halos only store their index within the Subfind file
+// FileNr of their snapshot, so the ID of a halo is
+// SnapNum * lHaloTreeSnapFactor + FileNr * lHaloTreeFileFactor + SubhaloIndex.
+const (
+	lHaloTreeSnapFactor = 1000 * 1000 * 1000 * 1000 * 1000
+	lHaloTreeFileFactor = 10 * 1000 * 1000 * 1000
+)
+
+// lHaloTreeHalo is a single halo in an LHaloTree file, laid out as in the
+// halo_data struct of L-HaloTree and the Millennium trees. Descendant and
+// FirstProgenitor are indices into the halo's tree, or -1.
+type lHaloTreeHalo struct {
+	Descendant, FirstProgenitor, NextProgenitor int32
+	FirstHaloInFOFGroup, NextHaloInFOFGroup     int32
+	Len                                         int32
+	MMean200, MCrit200, MTopHat                 float32
+	Pos, Vel                                    [3]float32
+	VelDisp, Vmax                               float32
+	Spin                                        [3]float32
+	MostBoundID                                 int64
+	SnapNum, FileNr, SubhaloIndex               int32
+	SubHalfMass                                 float32
+}
+
+// readLHaloTree reads a binary LHaloTree file, e.g. trees_063.0. These
+// start with the number of trees, the total number of halos, and the number
+// of halos in each tree, followed by the halos of each tree. The byte order is
+// found from the size of the file.
+func readLHaloTree(fname string) ([]treeHalo, error) {
+	data, err := compress.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	haloSize := int64(binary.Size(&lHaloTreeHalo{}))
+	var order binary.ByteOrder
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if len(data) < 8 {
+			break
+		}
+		nTrees := int64(int32(o.Uint32(data)))
+		nHalos := int64(int32(o.Uint32(data[4:])))
+		if nTrees >= 0 && nHalos >= 0 &&
+			8+4*nTrees+haloSize*nHalos == int64(len(data)) {
+			order = o
+			break
+		}
+	}
+	if order == nil {
+		return nil, fmt.Errorf("The size of %s, %d bytes, doesn't match "+
+			"the number of trees and halos in its header, so it isn't an "+
+			"LHaloTree file.", fname, len(data))
+	}
+
+	rd := bytes.NewReader(data)
+	var nTrees, nHalos int32
+	binary.Read(rd, order, &nTrees)
+	binary.Read(rd, order, &nHalos)
+	treeHalos := make([]int32, nTrees)
+	binary.Read(rd, order, treeHalos)
+	raw := make([]lHaloTreeHalo, nHalos)
+	if err := binary.Read(rd, order, raw); err != nil {
+		return nil, err
+	}
+
+	halos := make([]treeHalo, 0, nHalos)
+	start := 0
+	for i, n := range treeHalos {
+		if n < 0 || start+int(n) > len(raw) {
+			return nil, fmt.Errorf("Tree %d of %s has %d halos, which is "+
+				"more than the number of halos left in the file.", i, fname, n)
+		}
+		tree := raw[start : start+int(n)]
+		for i, h := range tree {
+			th := treeHalo{id: lHaloTreeID(h), descID: -1, time: float64(h.SnapNum)}
+			if d := h.Descendant; d >= 0 && int(d) < len(tree) {
+				th.descID = lHaloTreeID(tree[d])
+				th.main = int(tree[d].FirstProgenitor) == i
+			}
+			halos = append(halos, th)
+		}
+		start += int(n)
+	}
+
+	return halos, nil
+}
+
+func lHaloTreeID(h lHaloTreeHalo) int {
+	return int(h.SnapNum)*lHaloTreeSnapFactor +
+		int(h.FileNr)*lHaloTreeFileFactor + int(h.SubhaloIndex)
+}
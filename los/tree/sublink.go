@@ -0,0 +1,49 @@
+package tree
+
+import (
+	"fmt"
+
+	"github.com/phil-mansfield/shellfish/io"
+)
+
+// readSubLink reads an IllustrisTNG-style SubLink tree file, e.g.
+// tree_extended.0.hdf5. Halos are identified by their SubhaloID and the main
+// branch follows FirstProgenitorID.
+func readSubLink(fname string) ([]treeHalo, error) {
+	names := []string{
+		"SubhaloID", "DescendantID", "FirstProgenitorID", "SnapNum",
+	}
+	cols := make([][]int64, len(names))
+	for i := range names {
+		var err error
+		if cols[i], err = io.ReadHDF5Ints(fname, names[i]); err != nil {
+			return nil, err
+		}
+		if len(cols[i]) != len(cols[0]) {
+			return nil, fmt.Errorf("The SubLink tree %s has %d %s values, "+
+				"but %d %s values.", fname, len(cols[i]), names[i],
+				len(cols[0]), names[0])
+		}
+	}
+
+	return subLinkHalos(cols[0], cols[1], cols[2], cols[3]), nil
+}
+
+// subLinkHalos converts the columns of a SubLink tree into treeHalos.
+func subLinkHalos(ids, descIDs, firstProgIDs, snaps []int64) []treeHalo {
+	firstProg := map[int64]int64{}
+	for i := range ids {
+		firstProg[ids[i]] = firstProgIDs[i]
+	}
+
+	halos := make([]treeHalo, len(ids))
+	for i := range halos {
+		halos[i] = treeHalo{
+			id: int(ids[i]), descID: int(descIDs[i]), time: float64(snaps[i]),
+		}
+		if descIDs[i] != -1 {
+			halos[i].main = firstProg[descIDs[i]] == ids[i]
+		}
+	}
+	return halos
+}
@@ -0,0 +1,67 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/phil-mansfield/shellfish/io/compress"
+)
+
+// readTextTree reads a text edge list. Each line is a single halo with the
+// columns
+//
+//	ID DescID Snap [Mass]
+//
+// where DescID is -1 for halos without descendants. Lines starting with '#'
+// are comments. If Mass is given, the most massive progenitor of each halo is
+// on its main branch. Otherwise the first progenitor in the file is.
+func readTextTree(fname string) ([]treeHalo, error) {
+	f, err := compress.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	halos := []treeHalo{}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := bytes.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("Line %d of %s has %d columns, but text "+
+				"merger trees have the columns ID, DescID, Snap, and "+
+				"optionally Mass.", lineNum, fname, len(fields))
+		}
+
+		h := treeHalo{}
+		var snap int
+		h.id, err = strconv.Atoi(string(fields[0]))
+		if err == nil {
+			h.descID, err = strconv.Atoi(string(fields[1]))
+		}
+		if err == nil {
+			snap, err = strconv.Atoi(string(fields[2]))
+		}
+		if err == nil && len(fields) == 4 {
+			h.mass, err = strconv.ParseFloat(string(fields[3]), 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d of %s: %s",
+				lineNum, fname, err.Error())
+		}
+		h.time = float64(snap)
+
+		halos = append(halos, h)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return halos, nil
+}
@@ -2,38 +2,112 @@ package tree
 
 import (
 	"fmt"
-
-	ct "github.com/phil-mansfield/consistent_trees"
+	"sort"
 )
 
-// HaloHistories takes a slice of Rockstar halo tree file names, a slice of
-// the root halo IDs, and the "snapshot offset." The snapshot offset is the
-// difference between the number of snpashots which contain a nonzero number
-// of halos and the total number of snapshots. This can be calculated by
-// env.Halos.SnapOffset(). HaloHistories will return slices of IDs and
-// snapshots which correspond to the history of each of the given root IDs.
+// treeFormat is a merger tree file format.
+type treeFormat interface {
+	// histories returns the main branches of the halos with the IDs roots.
+	// consistent-trees files don't store snapshot numbers, so their
+	// snapshots are numbered starting from 1 at the earliest scale factor in
+	// the file which contains the root. Every other format returns the
+	// snapshot numbers stored in its files.
+	histories(files []string, roots []int) (ids, snaps [][]int, err error)
+}
+
+// treeHalo is a single halo in a merger tree. Every format is converted to
+// a list of these so that main branches are found in the same way for all of
+// them.
+type treeHalo struct {
+	id, descID int
+	// time orders the snapshots of a file. It's the scale factor or the
+	// snapshot number, depending on the format.
+	time float64
+	// main is true if the tree format flags the halo as the main progenitor
+	// of its descendant. Otherwise the most massive progenitor is used, with
+	// ties going to the first one in the file.
+	main bool
+	mass float64
+}
+
+// HaloHistories takes the TreeType of a set of merger trees, a slice of
+// their file names, a slice of the root halo IDs, and the "snapshot offset."
+// The snapshot offset is the difference between the number of snpashots which
+// contain a nonzero number of halos and the total number of snapshots. This
+// can be calculated by env.Halos.SnapOffset(). HaloHistories will return
+// slices of IDs and snapshots which correspond to the history of each of the
+// given root IDs.
+//
+// The snapshot offset is only added to consistent-trees snapshots. SubLink,
+// LHaloTree, and Text trees store the number of each halo's snapshot, and
+// these numbers are returned unchanged.
+//
+// consistent-trees files are indexed the first time they're read and the
+// index is written to memoDir, so later calls only need to read the forests
+// that contain the roots.
 func HaloHistories(
-	files []string, roots []int, snapOffset int,
+	treeType string, files []string, roots []int, snapOffset int,
+	memoDir string,
 ) (ids [][]int, snaps [][]int, err error) {
 	if len(roots) == 0 {
 		return [][]int{}, [][]int{}, nil
 	}
 
+	var format treeFormat
+	switch treeType {
+	case "consistent-trees":
+		format = &consistentTrees{memoDir}
+	case "SubLink":
+		format = fileFormat(readSubLink)
+	case "LHaloTree":
+		format = fileFormat(readLHaloTree)
+	case "Text":
+		format = fileFormat(readTextTree)
+	default:
+		panic(fmt.Sprintf("Unknown TreeType '%s'", treeType))
+	}
+
+	ids, snaps, err = format.histories(files, roots)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if treeType == "consistent-trees" {
+		for i := range snaps {
+			for j := range snaps[i] {
+				snaps[i][j] += snapOffset
+			}
+		}
+	}
+	return ids, snaps, nil
+}
+
+// fileFormat is a treeFormat whose files are read in full, one at a time.
+// Files are read until all the roots have been found.
+type fileFormat func(fname string) ([]treeHalo, error)
+
+func (read fileFormat) histories(
+	files []string, roots []int,
+) (ids, snaps [][]int, err error) {
 	ids, snaps = make([][]int, len(roots)), make([][]int, len(roots))
 
 	foundCount := 0
 	for _, file := range files {
-		ct.ReadTree(file)
+		halos, err := read(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		b := newBranches(halos, nil)
+
 		var ok bool
 		for i, id := range roots {
 			if ids[i] != nil {
 				continue
 			}
-			if ids[i], snaps[i], ok = findHistory(id); ok {
+			if ids[i], snaps[i], ok = b.history(id); ok {
 				foundCount++
 			}
 		}
-		ct.DeleteTree()
 		if foundCount == len(roots) {
 			break
 		}
@@ -46,68 +120,84 @@ func HaloHistories(
 			)
 		}
 	}
+	return ids, snaps, nil
+}
+
+// branches finds the main branches in a set of halos.
+type branches struct {
+	halos []treeHalo
+	// times are the distinct times of the halos' file. The halos at times[i]
+	// are in snapshot i + 1. If times is nil, each halo's time is its
+	// snapshot number.
+	times []float64
+	// byID maps IDs to indices in halos and prog maps IDs to the index of
+	// their main progenitor.
+	byID, prog map[int]int
+}
 
-	for i := range snaps {
-		for j := range snaps[i] {
-			snaps[i][j] += snapOffset
+func newBranches(halos []treeHalo, times []float64) *branches {
+	b := &branches{
+		halos: halos, times: times,
+		byID: map[int]int{}, prog: map[int]int{},
+	}
+	for i, h := range halos {
+		b.byID[h.id] = i
+	}
+	for i, h := range halos {
+		if h.descID == -1 {
+			continue
+		}
+		j, ok := b.prog[h.descID]
+		if !ok || isMainProg(h, halos[j]) {
+			b.prog[h.descID] = i
 		}
 	}
-	return ids, snaps, nil
+	return b
 }
 
-func findHalo(id int) (ct.Halo, int, bool) {
-	tree := ct.GetHaloTree()
-	for i := 0; i < tree.NumLists(); i++ {
-		list := tree.HaloLists(i)
-		h, ok := ct.LookupHaloInList(list, id)
-		if ok {
-			return h, tree.NumLists() - i, true
-		}
+// isMainProg returns true if h should replace the current main progenitor,
+// curr.
+func isMainProg(h, curr treeHalo) bool {
+	if h.main != curr.main {
+		return h.main
 	}
-	return ct.Halo{}, 0, false
+	return h.mass > curr.mass
 }
 
-func findHistory(id int) (ids, snaps []int, ok bool) {
-	h, snap, ok := findHalo(id)
+func (b *branches) snap(i int) int {
+	if b.times == nil {
+		return int(b.halos[i].time)
+	}
+	return sort.SearchFloat64s(b.times, b.halos[i].time) + 1
+}
+
+// history returns the IDs and snapshots of the main branch which runs through
+// the halo id. The branch is followed forwards along descendants and
+// backwards along main progenitors.
+func (b *branches) history(id int) (ids, snaps []int, ok bool) {
+	root, ok := b.byID[id]
 	if !ok {
 		return nil, nil, false
 	}
-	desc, descSnaps := descTree(h)
-	prog, progSnaps := progTree(h)
 
-	ids = combine(reverse(prog), []int{id}, desc)
-	snaps = combine(reverse(progSnaps), []int{snap}, descSnaps)
-	return ids, snaps, true
-}
-
-func descTree(h ct.Halo) (ids, snaps []int) {
-	ids, snaps = []int{}, []int{}
-	var ok bool
-	numLists := ct.GetHaloTree().NumLists()
-	for {
-		h, ok = h.Desc()
-		if !ok {
-			break
-		}
-		ids = append(ids, h.ID())
-		snaps = append(snaps, numLists-ct.LookupIndex(h.Scale()))
+	progIDs, progSnaps := []int{}, []int{}
+	for i, ok := b.prog[id]; ok; i, ok = b.prog[b.halos[i].id] {
+		progIDs = append(progIDs, b.halos[i].id)
+		progSnaps = append(progSnaps, b.snap(i))
 	}
-	return ids, snaps
-}
 
-func progTree(h ct.Halo) (ids, snaps []int) {
-	ids, snaps = []int{}, []int{}
-	var ok bool
-	numLists := ct.GetHaloTree().NumLists()
-	for {
-		h, ok = h.Prog()
-		if !ok {
+	descIDs, descSnaps := []int{}, []int{}
+	for i := root; b.halos[i].descID != -1; {
+		if i, ok = b.byID[b.halos[i].descID]; !ok {
 			break
 		}
-		ids = append(ids, h.ID())
-		snaps = append(snaps, numLists-ct.LookupIndex(h.Scale()))
+		descIDs = append(descIDs, b.halos[i].id)
+		descSnaps = append(descSnaps, b.snap(i))
 	}
-	return ids, snaps
+
+	ids = combine(reverse(progIDs), []int{id}, descIDs)
+	snaps = combine(reverse(progSnaps), []int{b.snap(root)}, descSnaps)
+	return ids, snaps, true
 }
 
 func reverse(xs []int) []int {
@@ -0,0 +1,156 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTextTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_text_tree")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{path.Join(dir, "a.txt"), path.Join(dir, "b.txt")}
+	// Without masses, the first progenitor is on the main branch.
+	tree0 := "# ID DescID Snap\n" +
+		"1 3 5\n2 3 5\n3 4 6\n\n4 -1 7\n"
+	// With masses, the most massive one is.
+	tree1 := "10 30 5 1e10\n20 30 5 2e10\n30 -1 6 3e10\n"
+	if err := ioutil.WriteFile(files[0], []byte(tree0), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(files[1], []byte(tree1), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids, snaps, err := HaloHistories("Text", files, []int{4, 2, 30}, 4, "")
+	if err != nil {
+		t.Fatalf("HaloHistories returned error: %s", err.Error())
+	}
+	// Snapshots are the ones in the files, without the offset.
+	expIDs, expSnaps := "[[1 3 4] [2 3 4] [20 30]]", "[[5 6 7] [5 6 7] [5 6]]"
+	if fmt.Sprint(ids) != expIDs || fmt.Sprint(snaps) != expSnaps {
+		t.Errorf("Expected IDs %s and snapshots %s, got %v and %v.",
+			expIDs, expSnaps, ids, snaps)
+	}
+
+	// Files which skip snapshots or start at different snapshots keep
+	// their snapshot numbers.
+	gap0, gap1 := "1 2 10\n2 -1 12\n", "5 6 11\n6 7 12\n7 -1 13\n"
+	if err := ioutil.WriteFile(files[0], []byte(gap0), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(files[1], []byte(gap1), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	ids, snaps, err = HaloHistories("Text", files, []int{1, 5}, 4, "")
+	if err != nil {
+		t.Fatalf("HaloHistories returned error: %s", err.Error())
+	}
+	expIDs, expSnaps = "[[1 2] [5 6 7]]", "[[10 12] [11 12 13]]"
+	if fmt.Sprint(ids) != expIDs || fmt.Sprint(snaps) != expSnaps {
+		t.Errorf("Expected IDs %s and snapshots %s, got %v and %v.",
+			expIDs, expSnaps, ids, snaps)
+	}
+
+	if _, _, err := HaloHistories("Text", files, []int{100}, 0, ""); err == nil {
+		t.Errorf("Expected error for a halo that isn't in the trees.")
+	}
+
+	if err := ioutil.WriteFile(files[0], []byte("1 2\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, err := HaloHistories("Text", files, []int{1}, 0, ""); err == nil {
+		t.Errorf("Expected error for a line with too few columns.")
+	}
+}
+
+func TestSubLinkHalos(t *testing.T) {
+	// 4 <- {2, 3 (first)} and 3 <- 1.
+	halos := subLinkHalos(
+		[]int64{4, 2, 3, 1}, []int64{-1, 4, 4, 3},
+		[]int64{3, -1, 1, -1}, []int64{99, 98, 98, 97},
+	)
+	b := newBranches(halos, nil)
+	ids, snaps, ok := b.history(2)
+	if !ok || fmt.Sprint(ids, snaps) != "[2 4] [98 99]" {
+		t.Errorf("Expected [2 4] [98 99] for halo 2, got %v %v.", ids, snaps)
+	}
+	ids, snaps, ok = b.history(4)
+	if !ok || fmt.Sprint(ids, snaps) != "[1 3 4] [97 98 99]" {
+		t.Errorf("Expected [1 3 4] [97 98 99] for halo 4, got %v %v.",
+			ids, snaps)
+	}
+}
+
+func TestLHaloTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shellfish_lhalotree")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Tree 0: halo 0 <- {1, 2 (first)}. Tree 1: halo 0 <- 1. The halos in
+	// tree 1 are from a different Subfind file but have the same
+	// SubhaloIndex values as halos in tree 0.
+	trees := [][]lHaloTreeHalo{
+		{
+			{Descendant: -1, FirstProgenitor: 2, SnapNum: 63, SubhaloIndex: 0},
+			{Descendant: 0, FirstProgenitor: -1, SnapNum: 62, SubhaloIndex: 5},
+			{Descendant: 0, FirstProgenitor: -1, SnapNum: 62, SubhaloIndex: 6},
+		},
+		{
+			{Descendant: -1, FirstProgenitor: 1, SnapNum: 63, FileNr: 1,
+				SubhaloIndex: 0},
+			{Descendant: 0, FirstProgenitor: -1, SnapNum: 62, FileNr: 1,
+				SubhaloIndex: 6},
+		},
+	}
+
+	for _, order := range []binary.ByteOrder{
+		binary.LittleEndian, binary.BigEndian,
+	} {
+		b := &bytes.Buffer{}
+		binary.Write(b, order, []int32{2, 5, 3, 2})
+		binary.Write(b, order, trees[0])
+		binary.Write(b, order, trees[1])
+		fname := path.Join(dir, "trees_063.0")
+		if err := ioutil.WriteFile(fname, b.Bytes(), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		id := func(snap, file, idx int) int {
+			return snap*lHaloTreeSnapFactor + file*lHaloTreeFileFactor + idx
+		}
+		ids, snaps, err := HaloHistories(
+			"LHaloTree", []string{fname}, []int{id(63, 0, 0), id(62, 1, 6)},
+			0, "",
+		)
+		if err != nil {
+			t.Fatalf("%v) HaloHistories returned error: %s",
+				order, err.Error())
+		}
+		expIDs := fmt.Sprint([][]int{
+			{id(62, 0, 6), id(63, 0, 0)}, {id(62, 1, 6), id(63, 1, 0)},
+		})
+		if fmt.Sprint(ids) != expIDs ||
+			fmt.Sprint(snaps) != "[[62 63] [62 63]]" {
+			t.Errorf("%v) Expected IDs %s and snapshots [[62 63] [62 63]], "+
+				"got %v and %v.", order, expIDs, ids, snaps)
+		}
+
+		if err := ioutil.WriteFile(fname, b.Bytes()[:100], 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := readLHaloTree(fname); err == nil {
+			t.Errorf("%v) Expected error for a truncated file.", order)
+		}
+	}
+}
@@ -107,3 +107,25 @@ func (gen *Generator) UniformAt(low, high float64, target []float64) {
 		target[i] = target[i]*(high-low) + low
 	}
 }
+
+// DeriveSeed returns a seed which depends on seed and on every one of keys.
+// Generators started from seeds derived with different keys produce unrelated
+// sequences, so work can be split between threads, or done in any order,
+// without changing the random numbers that each piece of work sees.
+func DeriveSeed(seed uint64, keys ...int) uint64 {
+	x := splitMix64(seed)
+	for _, key := range keys {
+		x = splitMix64(x ^ uint64(key))
+	}
+	return x
+}
+
+// splitMix64 is the output function of the SplitMix64 generator. It maps
+// nearby inputs to unrelated outputs, which matters because some generators
+// only use the low bits of their seeds.
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -8,6 +8,36 @@ const (
 	DefaultBufSize = 1 << 10
 )
 
+func TestDeriveSeed(t *testing.T) {
+	if DeriveSeed(1337, 4, 100) != DeriveSeed(1337, 4, 100) {
+		t.Errorf("DeriveSeed isn't deterministic.")
+	}
+
+	seeds := []uint64{
+		DeriveSeed(1337), DeriveSeed(1337, 4), DeriveSeed(1337, 4, 100),
+		DeriveSeed(1337, 100, 4), DeriveSeed(1337, 5, 100),
+		DeriveSeed(1338, 4, 100),
+	}
+	for i := range seeds {
+		for j := i + 1; j < len(seeds); j++ {
+			if uint32(seeds[i]) == uint32(seeds[j]) {
+				t.Errorf("Seeds %d and %d have the same low bits: %x.",
+					i, j, seeds[i])
+			}
+		}
+	}
+
+	for _, gt := range []GeneratorType{Xorshift, Golang, Tausworthe} {
+		g1, g2 := New(gt, DeriveSeed(7, 1)), New(gt, DeriveSeed(7, 1))
+		for i := 0; i < 100; i++ {
+			if x1, x2 := g1.Uniform(0, 1), g2.Uniform(0, 1); x1 != x2 {
+				t.Fatalf("%d) Generator %d gave %g and %g for the same "+
+					"seed.", i, gt, x1, x2)
+			}
+		}
+	}
+}
+
 func benchmarkUniform(gt GeneratorType, b *testing.B) {
 	gen := NewTimeSeed(gt)
 	b.ResetTimer()
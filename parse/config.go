@@ -108,6 +108,7 @@ type ConfigVars struct {
 	varNames        []string
 	varTypes        []varType
 	conversionFuncs []conversionFunc
+	ptrs            []interface{}
 }
 
 func intConv(ptr *int64) conversionFunc {
@@ -218,11 +219,45 @@ func NewConfigVars(name string) *ConfigVars {
 	return &ConfigVars{name: name}
 }
 
+// Name returns the title of the config file that vars describes.
+func (vars *ConfigVars) Name() string {
+	return vars.name
+}
+
+// Values returns the current value of every registered variable, keyed by
+// variable name. Once a config file and flags have been read, this includes
+// both explicitly set variables and defaults.
+func (vars *ConfigVars) Values() map[string]interface{} {
+	values := make(map[string]interface{})
+	for i, name := range vars.varNames {
+		switch ptr := vars.ptrs[i].(type) {
+		case *int64:
+			values[name] = *ptr
+		case *float64:
+			values[name] = *ptr
+		case *string:
+			values[name] = *ptr
+		case *bool:
+			values[name] = *ptr
+		case *[]int64:
+			values[name] = *ptr
+		case *[]float64:
+			values[name] = *ptr
+		case *[]string:
+			values[name] = *ptr
+		case *[]bool:
+			values[name] = *ptr
+		}
+	}
+	return values
+}
+
 func (vars *ConfigVars) Int(ptr *int64, name string, value int64) {
 	*ptr = value
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, intConv(ptr))
 	vars.varTypes = append(vars.varTypes, intVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) Float(ptr *float64, name string, value float64) {
@@ -230,6 +265,7 @@ func (vars *ConfigVars) Float(ptr *float64, name string, value float64) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, floatConv(ptr))
 	vars.varTypes = append(vars.varTypes, floatVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) String(ptr *string, name string, value string) {
@@ -237,6 +273,7 @@ func (vars *ConfigVars) String(ptr *string, name string, value string) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, stringConv(ptr))
 	vars.varTypes = append(vars.varTypes, stringVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) Bool(ptr *bool, name string, value bool) {
@@ -244,6 +281,7 @@ func (vars *ConfigVars) Bool(ptr *bool, name string, value bool) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, boolConv(ptr))
 	vars.varTypes = append(vars.varTypes, boolVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) Ints(ptr *[]int64, name string, value []int64) {
@@ -251,6 +289,7 @@ func (vars *ConfigVars) Ints(ptr *[]int64, name string, value []int64) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, intsConv(ptr))
 	vars.varTypes = append(vars.varTypes, intsVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) Floats(ptr *[]float64, name string, value []float64) {
@@ -258,6 +297,7 @@ func (vars *ConfigVars) Floats(ptr *[]float64, name string, value []float64) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, floatsConv(ptr))
 	vars.varTypes = append(vars.varTypes, floatsVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) Strings(ptr *[]string, name string, value []string) {
@@ -265,6 +305,7 @@ func (vars *ConfigVars) Strings(ptr *[]string, name string, value []string) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, stringsConv(ptr))
 	vars.varTypes = append(vars.varTypes, stringsVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 func (vars *ConfigVars) Bools(ptr *[]bool, name string, value []bool) {
@@ -272,6 +313,7 @@ func (vars *ConfigVars) Bools(ptr *[]bool, name string, value []bool) {
 	vars.varNames = append(vars.varNames, name)
 	vars.conversionFuncs = append(vars.conversionFuncs, boolsConv(ptr))
 	vars.varTypes = append(vars.varTypes, boolsVar)
+	vars.ptrs = append(vars.ptrs, ptr)
 }
 
 //////////////////
@@ -434,3 +434,33 @@ func TestValidFlags(t *testing.T) {
 		t.Errorf("Flag Okay not set.")
 	}
 }
+
+func TestValues(t *testing.T) {
+	var (
+		n    int64
+		xs   []float64
+		name string
+	)
+	vars := NewConfigVars("values_test.config")
+	vars.Int(&n, "N", 3)
+	vars.Floats(&xs, "Xs", []float64{1, 2})
+	vars.String(&name, "Name", "")
+
+	if err := ReadFlags([]string{"--N", "7"}, vars); err != nil {
+		t.Fatalf("ReadFlags returned error: %s", err.Error())
+	}
+
+	if vars.Name() != "values_test.config" {
+		t.Errorf("Expected name 'values_test.config', got '%s'.", vars.Name())
+	}
+	values := vars.Values()
+	if v, ok := values["N"].(int64); !ok || v != 7 {
+		t.Errorf("Expected N = 7, got %v.", values["N"])
+	}
+	if v, ok := values["Xs"].([]float64); !ok || len(v) != 2 || v[1] != 2 {
+		t.Errorf("Expected Xs = [1 2], got %v.", values["Xs"])
+	}
+	if v, ok := values["Name"].(string); !ok || v != "" {
+		t.Errorf("Expected Name = \"\", got %v.", values["Name"])
+	}
+}
@@ -5,13 +5,14 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"bytes"
+	"time"
 
 	"github.com/phil-mansfield/shellfish/cmd"
+	"github.com/phil-mansfield/shellfish/cmd/catalog"
 	"github.com/phil-mansfield/shellfish/cmd/env"
 	"github.com/phil-mansfield/shellfish/version"
 	"github.com/phil-mansfield/shellfish/logging"
@@ -19,12 +20,62 @@ import (
 
 var helpStrings = map[string]string{
 	// check mode
+	"init": `Type "shellfish help" for basic information on invoking the init tool.
+
+The init tool writes a global config file for your simulation to stdout. It
+is invoked as
+
+    shellfish init <snapshot-dir> [halo-dir] > my_simulation.config
+
+init looks through snapshot-dir and the directories inside it for particle
+files. It checks each type of file against the formats Shellfish can read,
+using their headers, magic numbers, and record markers, and finds their byte
+order. It then works out SnapshotFormat, SnapshotFormatMeanings, and the ranges
+of the snapshots and blocks from the names of the files. Numbers in the file
+names which change along with the scale factor are snapshots, and the others
+are blocks. For Gadget files, the units are found by comparing the particle
+mass to the mean density of the universe.
+
+If halo-dir is given, HaloType is set to Text and the ID, X, Y, Z, and M200m
+columns are found from the header line of the catalogs. Otherwise, HaloType is
+set to nil. TreeType is always set to nil. MemoDir is set to shellfish_memo in
+the current directory, which is created if it doesn't exist.
+
+The config file is checked before it's written, so it can be used right away:
+
+    export SHELLFISH_GLOBAL_CONFIG=my_simulation.config
+
+Bolshoi, BolshoiP, and raw files can't be recognized automatically, and TIPSY
+and ARTIO files need information which isn't in the files, so config files for
+those formats need to be written by hand. Type "shellfish help config" for an
+example.`,
+	"synthetic": `Type "shellfish help" for basic information on invoking the synthetic tool.
+
+The synthetic tool writes the halo catalogs of synthetic snapshots. It is
+invoked as
+
+    shellfish synthetic
+
+and takes no config file, flags, or input. It requires SnapshotType to be
+synthetic and SyntheticCatalogDir to be set in the global config file, and
+writes a Text halo catalog for each snapshot to SyntheticCatalogDir. The
+catalogs list every synthetic halo along with its true splashback radius and
+shape. Catalogs which are already up to date aren't rewritten.
+
+Run the synthetic tool once before running the other tools, since they don't
+write the catalogs themselves. For documentation on the synthetic variables,
+type "shellfish help config".`,
 	"check": `Type "shellfish help" for basic information on invoking the id tool.
 
 The check tool does some basic sanity checks on the snapshot values read from
 disk. The goal of this mode is to rule out the possibility of non-compliant
 snapshot formats or I/O bugs in Shellfish.
 
+If HaloType isn't nil, check also makes sure that every halo catalog has the
+same scale factor as its snapshot. This catches halo catalogs which have been
+matched up with the wrong snapshots. Catalogs that don't store scale factors
+(Subfind catalogs and text catalogs without an "#a = " line) aren't checked.
+
 For a documented example of an check config file, type:
 
      shellfish help check.config
@@ -217,12 +268,12 @@ Column 6 to 6 + 2P^2 - P_ijk: The Penna-Dines coefficients of the splashback
 
 (This input can be generated by shellfish shell.)
 
-The stats tool prints the following catalog to stdout:
+The stats tool prints the following catalog to stdout by default:
 
 Column 0  - ID:      The halo's catalog ID.
 Column 1  - Snap:    Index of the halo's snapshot.
-Column 2  - R_sp:    The volume-equivalent splashback radius in comoving Mpc/h.
-Column 3  - M_sp:    The mass contained within the splashback shell in Msun/h.
+Column 2  - M_sp:    The mass contained within the splashback shell in Msun/h.
+Column 3  - R_sp:    The volume-equivalent splashback radius in comoving Mpc/h.
 Column 4  - V_sp:    The volume of the splashback shell in comoving (Mpc/h)^3.
 Column 5  - SA_sp:   The surface area of the splashback shell in comoving
                      (Mpc/h)^2.
@@ -234,7 +285,68 @@ Column 8  - c_sp:    The length of the minor axis of the splashback shell in
                      comoving Mpc/h.
 Column 9 to 11 - A: The x, y, and z components of the major axis of the
                     splashback in arbitrary units.
+Column 12 - r_min:   The minimum radius of the splashback shell in comoving
+                     Mpc/h.
+Column 13 - r_max:   The maximum radius of the splashback shell in comoving
+                     Mpc/h.
+
+A different set of columns, in a different order, can be selected with the
+Values variable. See "shellfish help stats.config" for details.
 `,
+	"pipeline": `Type "shellfish help" for basic information on invoking the pipeline tool.
+
+The pipeline tool runs several of the other tools in a single process. Halos
+are passed between the tools in memory, and if both the shell and stats tools
+are run, each particle file is only read once per snapshot. The stages which
+are run, along with the config files used by each stage, are specified in the
+pipeline config file. For a documented example, type:
+
+     shellfish help pipeline.config
+
+By default, the pipeline tool runs
+
+    shellfish id | shellfish tree | shellfish coord | shellfish shell |
+    shellfish stats
+
+The pipeline tool takes no input from stdin.
+
+The pipeline tool prints the catalog that would be printed by the final stage.`,
+
+	"cutout": `Type "shellfish help" for basic information on invoking the cutout tool.
+
+The cutout tool writes the particles around a set of halos to small cutout
+files, one per snapshot. If you're going to analyze the same halos several
+times, you can run the cutout tool once and then point the other tools at the
+cutouts by setting SnapshotType = cutout in a copy of your global config file.
+They will then only need to read the cutouts instead of the full snapshots.
+Particles which are near several halos are only written once.
+
+For a documented example of a cutout config file, type:
+
+     shellfish help cutout.config
+
+The cutout tool takes the following input from stdin:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h
+Column 5 - R200m: The radius of the halo in comoving Mpc/h
+
+(This input can be generated by shellfish coord.)
+
+The cutout tool prints the following catalog to stdout:
+
+Column 0 - ID:    The halo's catalog ID.
+Column 1 - Snap:  Index of the halo's snapshot.
+Column 2 - X:     X coordinate of the halo in comoving Mpc/h
+Column 3 - Y:     Y coordinate of the halo in comoving Mpc/h
+Column 4 - Z:     Z coordinate of the halo in comoving Mpc/h
+Column 5 - R200m: The radius of the halo in comoving Mpc/h
+Column 6 - N:     The number of particles written with the halo.
+
+(This output can be fed directly to shellfish shell and shellfish prof.)`,
 
 	"config":       new(cmd.GlobalConfig).ExampleConfig(),
 	"id.config":    cmd.ModeNames["id"].ExampleConfig(),
@@ -246,6 +358,8 @@ Column 9 to 11 - A: The x, y, and z components of the major axis of the
 	"phase.config": cmd.ModeNames["phase"].ExampleConfig(),
 	"potential.config": cmd.ModeNames["potential"].ExampleConfig(),
 	"check.config": cmd.ModeNames["check"].ExampleConfig(),
+	"pipeline.config": cmd.ModeNames["pipeline"].ExampleConfig(),
+	"cutout.config": cmd.ModeNames["cutout"].ExampleConfig(),
 }
 
 var modeDescriptions = `The best way to learn how to use shellfish is the tutorial on its github page:
@@ -255,6 +369,8 @@ although the formatting will be less pretty.)
 
 The different tools in the Shellfish toolchain are:
 
+    shellfish init      <snapshot-dir>          [halo-dir]
+    shellfish synthetic
     shellfish check     [____.check.config]     [flags]
     shellfish id        [____.id.config]        [flags]
     shellfish tree      [____.tree.config]      [flags]
@@ -264,6 +380,8 @@ The different tools in the Shellfish toolchain are:
     shellfish stats     [____.stats.config]     [flags]
     shellfish phase     [____.stats.config]     [flags]
     shellfish potential [____.potential.config] [flags]
+    shellfish pipeline  [____.pipeline.config]  [flags]
+    shellfish cutout    [____.cutout.config]    [flags]
 
 (Arguments in brackets are optional.)
 
@@ -280,7 +398,7 @@ For documented example config files, type any of:
 
     shellfish help [ check.config | id.config | prof.config |shell.config |
                      stats.config | tree.config | phase.config |
-                     potenial.config ]
+                     potenial.config | pipeline.config | cutout.config ]
 
 In addition to any arguments passed at the command line, before calling
 Shellfish rountines you will need to specify a "global" config file (it
@@ -289,6 +407,10 @@ environment variable. For a documented global config file, type
 
     shellfish help config
 
+or, to have one written for your simulation, type
+
+    shellfish init <snapshot-dir> [halo-dir] > my_simulation.config
+
 The Shellfish tools expect an input catalog through stdin and will return an
 output catalog through standard out. (The only exception is the id tool, which
 doesn't take any input thorugh stdin) This means that you will generally invoke
@@ -299,8 +421,8 @@ shellfish as a series of piped commands. E.g:
 For more information on the input and output that a given tool expects, type
 any of:
 
-    shellfish help [ check | id | tree | coord | prof | shell | stats | phase |
-                     potential ]`
+    shellfish help [ init | synthetic | check | id | tree | coord | prof |
+                     shell | stats | phase | potential | pipeline | cutout ]`
 
 func main() {
 	args := os.Args
@@ -328,7 +450,37 @@ func main() {
 			fmt.Println("The help mode can only take a single argument.")
 		}
 		os.Exit(0)
-		// TODO: Implement the help command.
+	case "init":
+		if len(args) < 3 || len(args) > 4 {
+			fmt.Fprintf(os.Stderr, "The init mode takes a snapshot "+
+				"directory and, optionally, a halo directory.\nFor help, "+
+				"type './shellfish help init'.\n")
+			os.Exit(1)
+		}
+		haloDir := ""
+		if len(args) == 4 {
+			haloDir = args[3]
+		}
+		text, err := cmd.InitConfig(args[2], haloDir, cmd.InitMemoDir)
+		if err != nil {
+			log.Printf("Error running mode init:\n%s\n", err.Error())
+			fmt.Println("Shellfish terminating.")
+			os.Exit(1)
+		}
+		fmt.Print(text)
+		os.Exit(0)
+	case "synthetic":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "The synthetic mode doesn't take any "+
+				"arguments.\nFor help, type './shellfish help synthetic'.\n")
+			os.Exit(1)
+		}
+		if err := writeSyntheticCatalogs(args[:2]); err != nil {
+			log.Printf("Error running mode synthetic:\n%s\n", err.Error())
+			fmt.Println("Shellfish terminating.")
+			os.Exit(1)
+		}
+		os.Exit(0)
 	case "version":
 		fmt.Printf("Shellfish version %s\n", version.SourceVersion)
 		os.Exit(0)
@@ -348,28 +500,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	var stdinData []byte
+	// Input is read lazily, one batch at a time, so that a mode can start
+	// working before the previous mode in a pipeline has finished.
+	var in *catalog.BatchReader
 	switch args[1] {
-	case "tree", "coord", "prof", "shell", "stats", "phase", "potential":
-		var err error
-		stdinData, err = ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, err.Error())
-			fmt.Println("Shellfish terminating.")
-			os.Exit(1)
-		}
-
-		if len(stdinData) == 0 {
-			return
-		}
-
-		lineEnd := bytes.IndexByte(stdinData, '\n')
-		if lineEnd == -1 { lineEnd = len(stdinData) }
-
-		 if lineEnd >= 9 && string(stdinData[:9]) == "Shellfish" {
-			fmt.Println(string(stdinData)[:lineEnd])
-			os.Exit(1)
-		}
+	case "tree", "coord", "prof", "shell", "stats", "phase", "potential",
+		"cutout":
+		in = catalog.NewBatchReader(os.Stdin)
+	default:
+		in = catalog.NewBatchReader(bytes.NewReader(nil))
 	}
 	
 	flags := getFlags(args[2:])
@@ -395,6 +534,14 @@ func main() {
 		}
 	}
 
+	cmd.SetSeed(gConfig)
+
+	if err = cmd.CheckGlobalConfig(mode, gConfig); err != nil {
+		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+		fmt.Println("Shellfish terminating.")
+		os.Exit(1)
+	}
+
 	if err = checkMemoDir(gConfig.MemoDir, gConfigName); err != nil {
 		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
 		fmt.Println("Shellfish terminating.")
@@ -402,7 +549,7 @@ func main() {
 	}
 
 	switch args[1] {
-	case "shell", "stats", "prof", "check", "phase", "potential":
+	case "shell", "stats", "prof", "check", "phase", "potential", "cutout":
 		if gConfig.SnapshotType == "nil" {
 			log.Printf("Cannot run mode %s with SnapshotType = nil", args[1])
 			fmt.Println("Shellfish terminating")
@@ -437,15 +584,41 @@ func main() {
 		os.Exit(1)
 	}
 	
-	out, err := mode.Run(gConfig, e, stdinData)
+	catalog.OutputFormat, err = catalog.ParseFormat(gConfig.OutputFormat)
+	if err != nil {
+		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+		fmt.Println("Shellfish terminating.")
+		os.Exit(1)
+	}
+	out := catalog.NewRowWriter(os.Stdout)
+
+	start := time.Now()
+	err = mode.Run(gConfig, e, in, out)
+	if upErr, ok := err.(*catalog.UpstreamError); ok {
+		// An earlier mode in the pipeline failed and has already explained
+		// why, so just pass its message along.
+		fmt.Println(upErr.Line)
+		os.Exit(1)
+	} else if err != nil {
+		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+		fmt.Println("Shellfish terminating.")
+		os.Exit(1)
+	}
+
+	// Record how this catalog was made, along with how its input was made.
+	out.AddProvenance(in.Provenance()...)
+	block, err := cmd.Provenance(args[1], mode, gConfig, in.Hash(), start)
 	if err != nil {
 		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
 		fmt.Println("Shellfish terminating.")
 		os.Exit(1)
 	}
+	out.AddProvenance(block)
 
-	for i := range out {
-		fmt.Println(out[i])
+	if err = out.Close(); err != nil {
+		log.Printf("Error running mode %s:\n%s\n", args[1], err.Error())
+		fmt.Println("Shellfish terminating.")
+		os.Exit(1)
 	}
 }
 
@@ -475,6 +648,22 @@ func getGlobalConfig(args []string) (string, *cmd.GlobalConfig, error) {
 	return name, config, nil
 }
 
+// writeSyntheticCatalogs writes the halo catalogs of the synthetic snapshots
+// described by the global config file.
+func writeSyntheticCatalogs(args []string) error {
+	_, gConfig, err := getGlobalConfig(args)
+	if err != nil {
+		return err
+	}
+	if gConfig.SnapshotType != "synthetic" {
+		return fmt.Errorf("The synthetic mode can only be run if " +
+			"'SnapshotType' is set to synthetic.")
+	} else if gConfig.SyntheticCatalogDir == "" {
+		return fmt.Errorf("The 'SyntheticCatalogDir' variable isn't set.")
+	}
+	return cmd.WriteSyntheticCatalogs(gConfig)
+}
+
 // getConfig return the name of the mode-specific config file from the command
 // line arguments.
 func getConfig(args []string) (string, bool) {
@@ -548,6 +737,10 @@ func configEqual(m, c *cmd.GlobalConfig) bool {
 		c.SnapshotFormat == m.SnapshotFormat &&
 		c.SnapshotType == m.SnapshotType &&
 		c.HaloDir == m.HaloDir &&
+		c.HaloFormat == m.HaloFormat &&
+		stringsEqual(c.HaloFormatMeanings, m.HaloFormatMeanings) &&
+		int64sEqual(c.HaloBlockMins, m.HaloBlockMins) &&
+		int64sEqual(c.HaloBlockMaxes, m.HaloBlockMaxes) &&
 		c.HaloType == m.HaloType &&
 		c.TreeDir == m.TreeDir &&
 		int64sEqual(c.BlockMins, m.BlockMins) &&
@@ -592,8 +785,13 @@ func initHalos(
 	mode string, gConfig *cmd.GlobalConfig, e *env.Environment,
 ) error {
 	switch mode {
-	case "shell", "stats", "prof", "check", "phase", "potential":
+	case "shell", "stats", "prof", "phase", "potential", "cutout":
 		return nil
+	case "check":
+		// check compares the halo catalogs to the particles if there are any.
+		if gConfig.HaloType == "nil" {
+			return nil
+		}
 	}
 
 	switch gConfig.HaloType {
@@ -606,6 +804,12 @@ func initHalos(
 			return fmt.Errorf("You're trying to use the '%s' TreeType with " +
 				"the 'Text' HaloType.")
 		}
+	case "Rockstar-Binary":
+		return e.InitRockstarBinaryHalo(&gConfig.HaloInfo)
+	case "AHF":
+		return e.InitAHFHalo(&gConfig.HaloInfo)
+	case "Subfind":
+		return e.InitSubfindHalo(&gConfig.HaloInfo)
 	}
 	if gConfig.TreeType == "nil" {
 		return fmt.Errorf("You may not use nil as a TreeType for the "+
@@ -623,12 +827,29 @@ func initCatalogs(gConfig *cmd.GlobalConfig, e *env.Environment) error {
 		return e.InitLGadget2(&gConfig.ParticleInfo, gConfig.ValidateFormats)
 	case "Gadget-2":
 		return e.InitGadget2(&gConfig.ParticleInfo, gConfig.ValidateFormats)
+	case "HDF5-Gadget":
+		return e.InitHDF5Gadget(
+			&gConfig.ParticleInfo, gConfig.ValidateFormats,
+		)
 	case "ARTIO":
 		return e.InitARTIO(&gConfig.ParticleInfo, gConfig.ValidateFormats)
 	case "Bolshoi":
 		return e.InitBolshoi(&gConfig.ParticleInfo, gConfig.ValidateFormats)
 	case "BolshoiP":
 		return e.InitBolshoiP(&gConfig.ParticleInfo, gConfig.ValidateFormats)
+	case "raw":
+		return e.InitRaw(&gConfig.ParticleInfo, gConfig.ValidateFormats)
+	case "TIPSY":
+		return e.InitTipsy(&gConfig.ParticleInfo, gConfig.ValidateFormats)
+	case "RAMSES":
+		return e.InitRamses(&gConfig.ParticleInfo, gConfig.ValidateFormats)
+	case "cutout":
+		return e.InitCutout(&gConfig.ParticleInfo, gConfig.ValidateFormats)
+	case "synthetic":
+		return e.InitSynthetic(
+			&gConfig.ParticleInfo, gConfig.SyntheticBlocks,
+			gConfig.ValidateFormats,
+		)
 	case "nil":
 		return e.InitNil(&gConfig.ParticleInfo, gConfig.ValidateFormats)
 	}